@@ -68,6 +68,11 @@ if [ -f "/etc/asterisk/extensions.conf" ]; then
     print_status "Backed up extensions.conf"
 fi
 
+if [ -f "/etc/asterisk/queues.conf" ]; then
+    cp /etc/asterisk/queues.conf "$BACKUP_DIR/"
+    print_status "Backed up queues.conf"
+fi
+
 print_success "Configuration files backed up to $BACKUP_DIR"
 
 # Install Asterisk if not already installed
@@ -91,6 +96,7 @@ cp "$SCRIPT_DIR/http.conf" /etc/asterisk/
 cp "$SCRIPT_DIR/pjsip.conf" /etc/asterisk/
 cp "$SCRIPT_DIR/manager.conf" /etc/asterisk/
 cp "$SCRIPT_DIR/extensions.conf" /etc/asterisk/
+cp "$SCRIPT_DIR/queues.conf" /etc/asterisk/
 
 # Set proper permissions
 chown asterisk:asterisk /etc/asterisk/*.conf
@@ -7,22 +7,38 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"voip-backend/config"
 )
 
+// Timings of the client. They are variables so tests can shorten them.
+var (
+	// commandTimeout is how long SendCommand waits for the response carrying its ActionID
+	commandTimeout = 30 * time.Second
+
+	// reconnectDelay is how long a lost connection waits before the
+	// reconnection loop starts, and reconnectInterval the wait between attempts
+	reconnectDelay    = 5 * time.Second
+	reconnectInterval = 10 * time.Second
+)
+
 type AMIClient struct {
 	conn           net.Conn
 	reader         *bufio.Reader
 	mutex          sync.Mutex
-	events         chan AMIEvent
-	commands       chan AMICommand
 	quit           chan bool
+	quitOnce       sync.Once
 	connected      bool
 	reconnecting   bool
 	lastPing       time.Time
 	reconnectMutex sync.Mutex
 	healthMutex    sync.RWMutex
+
+	// Actions waiting for their response, keyed by ActionID
+	pending      map[string]*pendingAction
+	pendingMutex sync.Mutex
+	actionSeq    uint64
 }
 
 type AMIEvent struct {
@@ -30,18 +46,28 @@ type AMIEvent struct {
 	Fields map[string]string
 }
 
-type AMICommand struct {
-	Action   string
-	Fields   map[string]string
-	Response chan AMIResponse
-}
-
 type AMIResponse struct {
 	Success bool
 	Fields  map[string]string
 	Error   string
 }
 
+// pendingAction tracks an action that has been written but not yet answered.
+// List actions stay pending after their opening response until the event
+// carrying "EventList: Complete" for the same ActionID arrives.
+type pendingAction struct {
+	list     bool
+	response *AMIResponse
+	events   []AMIEvent
+	done     chan actionResult
+}
+
+type actionResult struct {
+	response AMIResponse
+	events   []AMIEvent
+	err      error // set when the action got no response
+}
+
 var amiClient *AMIClient
 var amiMutex sync.Mutex
 
@@ -68,6 +94,7 @@ func InitAMI() error {
 	amiClient = client
 	go amiClient.handleEvents()
 	go amiClient.startHealthMonitoring()
+	publishConnectionEvent(EventAMIConnected)
 
 	log.Println("AMI client initialized successfully")
 	return nil
@@ -76,7 +103,7 @@ func InitAMI() error {
 // startReconnectionLoop continuously tries to reconnect
 func startReconnectionLoop() {
 	for {
-		time.Sleep(10 * time.Second) // Wait 10 seconds between attempts
+		time.Sleep(reconnectInterval)
 
 		if amiClient != nil && amiClient.IsConnected() {
 			return // Connection restored, exit loop
@@ -110,13 +137,14 @@ func reconnectAMI() error {
 	amiClient = client
 	go amiClient.handleEvents()
 	go amiClient.startHealthMonitoring()
+	publishConnectionEvent(EventAMIConnected)
 
 	return nil
 }
 
 // NewAMIClient creates a new AMI client
 func NewAMIClient() (*AMIClient, error) {
-	address := fmt.Sprintf("%s:%s", config.AppConfig.AsteriskHost, config.AppConfig.AsteriskAMIPort)
+	address := net.JoinHostPort(config.AppConfig.AsteriskHost, config.AppConfig.AsteriskAMIPort)
 
 	log.Printf("Attempting to connect to Asterisk AMI at %s...", address)
 	conn, err := net.DialTimeout("tcp", address, 5*time.Second) // Reduced timeout to 5 seconds
@@ -127,11 +155,10 @@ func NewAMIClient() (*AMIClient, error) {
 	client := &AMIClient{
 		conn:      conn,
 		reader:    bufio.NewReader(conn),
-		events:    make(chan AMIEvent, 100),
-		commands:  make(chan AMICommand, 10),
 		quit:      make(chan bool),
 		connected: false,
 		lastPing:  time.Now(),
+		pending:   make(map[string]*pendingAction),
 	}
 
 	// Read the initial greeting
@@ -148,8 +175,6 @@ func NewAMIClient() (*AMIClient, error) {
 		return nil, fmt.Errorf("AMI login failed: %v", err)
 	}
 
-	go client.handleConnection()
-
 	// Mark as connected after successful login
 	client.healthMutex.Lock()
 	client.connected = true
@@ -160,24 +185,28 @@ func NewAMIClient() (*AMIClient, error) {
 	return client, nil
 }
 
-// login authenticates with the AMI
+// login authenticates with the AMI. It runs before handleEvents is started,
+// so it is the only reader on the connection and can read the reply directly.
 func (c *AMIClient) login() error {
-	loginCmd := fmt.Sprintf("Action: Login\r\nUsername: %s\r\nSecret: %s\r\n\r\n",
-		config.AppConfig.AsteriskAMIUsername,
-		config.AppConfig.AsteriskAMISecret)
-
-	c.mutex.Lock()
-	_, err := c.conn.Write([]byte(loginCmd))
-	c.mutex.Unlock()
-
+	actionID := c.nextActionID()
+	err := c.writeAction("Login", actionID, map[string]string{
+		"Username": config.AppConfig.AsteriskAMIUsername,
+		"Secret":   config.AppConfig.AsteriskAMISecret,
+	})
 	if err != nil {
 		return err
 	}
 
-	// Read login response
-	response, err := c.readResponse()
-	if err != nil {
-		return err
+	// Read login response, skipping anything that is not the reply to our Login
+	var response AMIResponse
+	for {
+		response, err = c.readResponse()
+		if err != nil {
+			return err
+		}
+		if response.Fields["ActionID"] == actionID || response.Fields["Event"] == "" {
+			break
+		}
 	}
 
 	if response.Fields["Response"] != "Success" {
@@ -187,19 +216,10 @@ func (c *AMIClient) login() error {
 	return nil
 }
 
-// handleConnection handles the AMI connection
-func (c *AMIClient) handleConnection() {
-	for {
-		select {
-		case cmd := <-c.commands:
-			c.executeCommand(cmd)
-		case <-c.quit:
-			return
-		}
-	}
-}
-
-// handleEvents processes AMI events
+// handleEvents is the only reader of the AMI connection once login has
+// completed. Every frame is demultiplexed here: responses are routed to the
+// SendCommand caller waiting on the matching ActionID and everything else is
+// delivered to the event stream.
 func (c *AMIClient) handleEvents() {
 	for {
 		response, err := c.readResponse()
@@ -210,27 +230,80 @@ func (c *AMIClient) handleEvents() {
 			c.connected = false
 			c.healthMutex.Unlock()
 
-			// Trigger reconnection
-			go func() {
-				time.Sleep(5 * time.Second)
-				startReconnectionLoop()
-			}()
+			// Fail any callers still waiting for a response
+			c.failPending(fmt.Errorf("AMI connection lost: %v", err))
+
+			// Trigger reconnection unless the client was closed on purpose
+			if !c.isClosed() {
+				publishConnectionEvent(EventAMIDisconnected)
+				go func() {
+					time.Sleep(reconnectDelay)
+					startReconnectionLoop()
+				}()
+			}
 			return
 		}
 
-		if response.Fields["Event"] != "" {
-			event := AMIEvent{
-				Type:   response.Fields["Event"],
-				Fields: response.Fields,
+		c.dispatchFrame(response)
+	}
+}
+
+// dispatchFrame routes a single frame read from the connection. Events that
+// do not belong to a pending list action are published on the event bus.
+func (c *AMIClient) dispatchFrame(response AMIResponse) {
+	actionID := response.Fields["ActionID"]
+
+	// Some events (OriginateResponse) carry a Response field too, so a frame
+	// is only a response when it is not an event
+	if response.Fields["Event"] == "" && response.Fields["Response"] != "" {
+		c.pendingMutex.Lock()
+		action, ok := c.pending[actionID]
+		if ok {
+			// A list action that was accepted keeps collecting events
+			if action.list && response.Success && strings.EqualFold(response.Fields["EventList"], "start") {
+				action.response = &response
+				c.pendingMutex.Unlock()
+				return
 			}
+			delete(c.pending, actionID)
+		}
+		c.pendingMutex.Unlock()
+
+		if ok {
+			action.done <- actionResult{response: response}
+		} else {
+			log.Printf("[AMI] Dropping response with unknown ActionID %q", actionID)
+		}
+		return
+	}
+
+	if response.Fields["Event"] == "" {
+		return
+	}
+
+	event := AMIEvent{
+		Type:   response.Fields["Event"],
+		Fields: response.Fields,
+	}
 
-			select {
-			case c.events <- event:
-			default:
-				log.Println("Event channel full, dropping event")
+	if actionID != "" {
+		c.pendingMutex.Lock()
+		action, ok := c.pending[actionID]
+		if ok && action.list && action.response != nil {
+			if strings.EqualFold(response.Fields["EventList"], "Complete") {
+				delete(c.pending, actionID)
+				c.pendingMutex.Unlock()
+				action.done <- actionResult{response: *action.response, events: action.events}
+				return
 			}
+			action.events = append(action.events, event)
+			c.pendingMutex.Unlock()
+			return
 		}
+		c.pendingMutex.Unlock()
 	}
+
+	eventBus.Publish(event)
 }
 
 // readResponse reads a complete AMI response
@@ -257,7 +330,9 @@ func (c *AMIClient) readResponse() (AMIResponse, error) {
 
 	success := fields["Response"] == "Success"
 
-	log.Printf("[AMI] Response received: Success=%t, Fields=%+v", success, fields)
+	if fields["Event"] == "" {
+		log.Printf("[AMI] Response received: Success=%t, Fields=%+v", success, fields)
+	}
 
 	return AMIResponse{
 		Success: success,
@@ -266,39 +341,61 @@ func (c *AMIClient) readResponse() (AMIResponse, error) {
 	}, nil
 }
 
-// executeCommand executes an AMI command
-func (c *AMIClient) executeCommand(cmd AMICommand) {
+// writeAction serializes an action with the given ActionID onto the connection
+func (c *AMIClient) writeAction(action, actionID string, fields map[string]string) error {
 	var cmdStr strings.Builder
-	cmdStr.WriteString(fmt.Sprintf("Action: %s\r\n", cmd.Action))
+	cmdStr.WriteString(fmt.Sprintf("Action: %s\r\n", action))
+	cmdStr.WriteString(fmt.Sprintf("ActionID: %s\r\n", actionID))
 
-	for key, value := range cmd.Fields {
+	for key, value := range fields {
+		if strings.EqualFold(key, "ActionID") {
+			continue
+		}
 		cmdStr.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
 	}
 	cmdStr.WriteString("\r\n")
 
 	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	_, err := c.conn.Write([]byte(cmdStr.String()))
-	c.mutex.Unlock()
+	return err
+}
 
-	if err != nil {
-		cmd.Response <- AMIResponse{
-			Success: false,
-			Error:   err.Error(),
-		}
-		return
-	}
+// nextActionID generates a unique ActionID for this connection
+func (c *AMIClient) nextActionID() string {
+	seq := atomic.AddUint64(&c.actionSeq, 1)
+	return fmt.Sprintf("voip-%d-%d", time.Now().UnixNano(), seq)
+}
 
-	// Read response
-	response, err := c.readResponse()
-	if err != nil {
-		cmd.Response <- AMIResponse{
-			Success: false,
-			Error:   err.Error(),
-		}
-		return
+// removePending stops waiting for the response to an action
+func (c *AMIClient) removePending(actionID string) {
+	c.pendingMutex.Lock()
+	delete(c.pending, actionID)
+	c.pendingMutex.Unlock()
+}
+
+// failPending answers every outstanding action with the given error
+func (c *AMIClient) failPending(err error) {
+	c.pendingMutex.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*pendingAction)
+	c.pendingMutex.Unlock()
+
+	for _, action := range pending {
+		action.done <- actionResult{err: err}
 	}
+}
 
-	cmd.Response <- response
+// isClosed reports whether Close has been called on the client
+func (c *AMIClient) isClosed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 // GetAMIClient returns the global AMI client
@@ -308,33 +405,68 @@ func GetAMIClient() *AMIClient {
 
 // SendCommand sends a command to AMI and returns the response
 func (c *AMIClient) SendCommand(action string, fields map[string]string) (AMIResponse, error) {
+	result, err := c.sendAction(action, fields, false)
+	if err != nil {
+		return AMIResponse{}, err
+	}
+	return result.response, nil
+}
+
+// SendListCommand sends a list action (CoreShowChannels, PJSIPShowContacts, ...)
+// and returns its response together with every event Asterisk emitted for it
+// up to, but not including, the terminating *Complete event.
+func (c *AMIClient) SendListCommand(action string, fields map[string]string) (AMIResponse, []AMIEvent, error) {
+	result, err := c.sendAction(action, fields, true)
+	if err != nil {
+		return AMIResponse{}, nil, err
+	}
+	return result.response, result.events, nil
+}
+
+// sendAction writes an action and waits for the frames answering its ActionID
+func (c *AMIClient) sendAction(action string, fields map[string]string, list bool) (actionResult, error) {
 	if c == nil {
-		return AMIResponse{}, fmt.Errorf("AMI client not initialized")
+		return actionResult{}, fmt.Errorf("AMI client not initialized")
 	}
 
-	cmd := AMICommand{
-		Action:   action,
-		Fields:   fields,
-		Response: make(chan AMIResponse, 1),
+	if c.isClosed() {
+		return actionResult{}, fmt.Errorf("AMI client closed")
 	}
 
-	select {
-	case c.commands <- cmd:
-	case <-time.After(10 * time.Second):
-		return AMIResponse{}, fmt.Errorf("command queue timeout")
+	// Fail fast instead of waiting for a timeout on a connection known to be dead
+	if !c.IsConnected() {
+		return actionResult{}, fmt.Errorf("AMI client not connected")
 	}
 
-	select {
-	case response := <-cmd.Response:
-		return response, nil
-	case <-time.After(30 * time.Second):
-		return AMIResponse{}, fmt.Errorf("response timeout after 30 seconds")
+	// Register the waiter before writing so a fast response cannot be missed
+	actionID := c.nextActionID()
+	pending := &pendingAction{
+		list: list,
+		done: make(chan actionResult, 1),
+	}
+
+	c.pendingMutex.Lock()
+	c.pending[actionID] = pending
+	c.pendingMutex.Unlock()
+
+	if err := c.writeAction(action, actionID, fields); err != nil {
+		c.removePending(actionID)
+		return actionResult{}, fmt.Errorf("failed to send %s: %v", action, err)
 	}
-}
 
-// GetEvents returns the events channel
-func (c *AMIClient) GetEvents() <-chan AMIEvent {
-	return c.events
+	select {
+	case result := <-pending.done:
+		if result.err != nil {
+			return actionResult{}, fmt.Errorf("%s failed: %v", action, result.err)
+		}
+		return result, nil
+	case <-time.After(commandTimeout):
+		c.removePending(actionID)
+		return actionResult{}, fmt.Errorf("response timeout after %v waiting for %s (ActionID %s)", commandTimeout, action, actionID)
+	case <-c.quit:
+		c.removePending(actionID)
+		return actionResult{}, fmt.Errorf("AMI client closed")
+	}
 }
 
 // IsConnected returns the connection status
@@ -375,7 +507,7 @@ func (c *AMIClient) performHealthCheck() {
 
 		// Trigger reconnection
 		go func() {
-			time.Sleep(5 * time.Second)
+			time.Sleep(reconnectDelay)
 			startReconnectionLoop()
 		}()
 	} else {
@@ -399,13 +531,16 @@ func (c *AMIClient) Close() {
 	}
 
 	c.healthMutex.Lock()
+	wasConnected := c.connected
 	c.connected = false
 	c.healthMutex.Unlock()
 
-	select {
-	case c.quit <- true:
-	default:
-	}
+	c.quitOnce.Do(func() {
+		close(c.quit)
+		if wasConnected {
+			publishConnectionEvent(EventAMIDisconnected)
+		}
+	})
 
 	if c.conn != nil {
 		c.conn.Close()
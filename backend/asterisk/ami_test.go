@@ -0,0 +1,257 @@
+package asterisk
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"voip-backend/asterisk/amitest"
+	"voip-backend/config"
+)
+
+// fakeAMI is shared by every test of the package: the client reads its
+// address from the global configuration, which background reconnection
+// loops may read at any time
+var fakeAMI *amitest.Server
+
+func TestMain(m *testing.M) {
+	commandTimeout = 500 * time.Millisecond
+	reconnectDelay = 50 * time.Millisecond
+	reconnectInterval = 50 * time.Millisecond
+
+	fakeAMI = amitest.NewServer(amitest.Config{AnswerAfter: 100 * time.Millisecond})
+	if err := fakeAMI.Start(""); err != nil {
+		log.Fatalf("Failed to start fake AMI: %v", err)
+	}
+
+	host, port := fakeAMI.HostPort()
+	config.AppConfig = &config.Config{
+		AsteriskHost:        host,
+		AsteriskAMIPort:     port,
+		AsteriskAMIUsername: "admin",
+		AsteriskAMISecret:   "amp111",
+	}
+
+	code := m.Run()
+	fakeAMI.Close()
+	os.Exit(code)
+}
+
+// newTestClient connects a client of its own to the fake server and starts
+// its reader
+func newTestClient(t *testing.T) *AMIClient {
+	t.Helper()
+
+	client, err := NewAMIClient()
+	if err != nil {
+		t.Fatalf("NewAMIClient: %v", err)
+	}
+	go client.handleEvents()
+	t.Cleanup(client.Close)
+	return client
+}
+
+// connectGlobalClient sets up the global client the package functions use
+func connectGlobalClient(t *testing.T) {
+	t.Helper()
+
+	if err := InitAMI(); err != nil {
+		t.Fatalf("InitAMI: %v", err)
+	}
+	if client := currentClient(); client == nil || !client.IsConnected() {
+		t.Fatal("InitAMI did not connect")
+	}
+	t.Cleanup(func() {
+		amiMutex.Lock()
+		defer amiMutex.Unlock()
+		amiClient.Close()
+		amiClient = nil
+	})
+}
+
+// currentClient reads the global client under the lock reconnectAMI holds
+func currentClient() *AMIClient {
+	amiMutex.Lock()
+	defer amiMutex.Unlock()
+	return amiClient
+}
+
+// waitFor polls a condition until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	fakeAMI.RefuseLogins(true)
+	defer fakeAMI.RefuseLogins(false)
+
+	logins := fakeAMI.Logins()
+	client, err := NewAMIClient()
+	if err == nil {
+		client.Close()
+		t.Fatal("NewAMIClient succeeded with logins refused")
+	}
+	if !strings.Contains(err.Error(), "Authentication failed") {
+		t.Errorf("error = %q, want the server's authentication failure", err)
+	}
+	if fakeAMI.Logins() != logins {
+		t.Errorf("logins = %d, want %d", fakeAMI.Logins(), logins)
+	}
+}
+
+func TestSendCommandMatchesActionID(t *testing.T) {
+	client := newTestClient(t)
+
+	// Concurrent actions each get the response carrying their ActionID
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := client.SendCommand("Ping", nil)
+			if err == nil && !response.Success {
+				err = fmt.Errorf("ping failed: %s", response.Error)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Ping: %v", err)
+		}
+	}
+}
+
+func TestEventWithResponseFieldIsNotAResponse(t *testing.T) {
+	client := newTestClient(t)
+
+	// OriginateResponse events carry the ActionID of the Originate and a
+	// Response field; they must not be taken for the action's reply
+	fakeAMI.Handle("Originate", func(session *amitest.Session, action amitest.Action) {
+		session.Send(amitest.Frame{
+			"Event":    "OriginateResponse",
+			"ActionID": action.ActionID,
+			"Response": "Failure",
+		})
+		session.Reply(action, amitest.Frame{"Response": "Success", "Message": "Originate successfully queued"})
+	})
+	defer fakeAMI.Handle("Originate", nil)
+
+	response, err := client.SendCommand("Originate", map[string]string{"Channel": "PJSIP/1001"})
+	if err != nil {
+		t.Fatalf("Originate: %v", err)
+	}
+	if !response.Success {
+		t.Errorf("Originate response = %+v, want the Success reply", response.Fields)
+	}
+}
+
+func TestActionTimeout(t *testing.T) {
+	client := newTestClient(t)
+
+	// A handler that never replies leaves the action waiting
+	fakeAMI.Handle("Ping", func(session *amitest.Session, action amitest.Action) {})
+	_, err := client.SendCommand("Ping", nil)
+	fakeAMI.Handle("Ping", nil)
+
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Ping error = %v, want a timeout", err)
+	}
+
+	client.pendingMutex.Lock()
+	pending := len(client.pending)
+	client.pendingMutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d actions still pending after the timeout", pending)
+	}
+
+	// The connection stays usable
+	if _, err := client.SendCommand("Ping", nil); err != nil {
+		t.Errorf("Ping after timeout: %v", err)
+	}
+}
+
+func TestListCommandCollectsEvents(t *testing.T) {
+	client := newTestClient(t)
+	fakeAMI.AddEndpoint("1001", true)
+	fakeAMI.AddEndpoint("1002", false)
+
+	response, events, err := client.SendListCommand("PJSIPShowEndpoints", nil)
+	if err != nil {
+		t.Fatalf("PJSIPShowEndpoints: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("PJSIPShowEndpoints response = %+v", response.Fields)
+	}
+
+	names := make(map[string]bool)
+	for _, event := range events {
+		if event.Type != "EndpointList" {
+			t.Errorf("unexpected %s event in the list", event.Type)
+		}
+		names[event.Fields["ObjectName"]] = true
+	}
+	if !names["1001"] || !names["1002"] {
+		t.Errorf("endpoints listed = %v, want 1001 and 1002", names)
+	}
+}
+
+func TestReconnection(t *testing.T) {
+	connectGlobalClient(t)
+	before := currentClient()
+	logins := fakeAMI.Logins()
+
+	sub := Subscribe(EventFilter{Types: []string{EventAMIConnected, EventAMIDisconnected}}, 0)
+	defer sub.Unsubscribe()
+
+	// The connection drops as when Asterisk restarts
+	fakeAMI.DropConnections()
+
+	expectEvent(t, sub, EventAMIDisconnected)
+	expectEvent(t, sub, EventAMIConnected)
+
+	client := currentClient()
+	if client == before {
+		t.Fatal("the global client was not replaced")
+	}
+	if !client.IsConnected() {
+		t.Fatal("the new client is not connected")
+	}
+	if fakeAMI.Logins() != logins+1 {
+		t.Errorf("logins = %d, want %d", fakeAMI.Logins(), logins+1)
+	}
+	if _, err := client.SendCommand("Ping", nil); err != nil {
+		t.Errorf("Ping after reconnection: %v", err)
+	}
+	if _, err := before.SendCommand("Ping", nil); err == nil {
+		t.Error("Ping on the dropped client succeeded")
+	}
+}
+
+// expectEvent waits for the next event of a subscription
+func expectEvent(t *testing.T, sub *Subscription, eventType string) {
+	t.Helper()
+
+	select {
+	case event := <-sub.Events():
+		if event.Type != eventType {
+			t.Fatalf("event = %s, want %s", event.Type, eventType)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", eventType)
+	}
+}
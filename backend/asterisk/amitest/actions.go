@@ -0,0 +1,778 @@
+package amitest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// handleBuiltin implements the actions the backend uses
+func (s *Server) handleBuiltin(session *Session, action Action) {
+	switch strings.ToLower(action.Name) {
+	case "login":
+		s.handleLogin(session, action)
+	case "logoff":
+		session.Reply(action, Frame{"Response": "Goodbye", "Message": "Thanks for all the fish."})
+		session.Close()
+	case "ping":
+		session.Reply(action, Frame{
+			"Response":  "Success",
+			"Ping":      "Pong",
+			"Timestamp": fmt.Sprintf("%d.000000", time.Now().Unix()),
+		})
+	case "originate":
+		s.handleOriginate(session, action)
+	case "hangup":
+		channel := action.Fields["Channel"]
+		if err := s.HangupChannel(channel, 16); err != nil {
+			session.Reply(action, Frame{"Response": "Error", "Message": "No such channel"})
+			return
+		}
+		session.Reply(action, Frame{"Response": "Success", "Message": "Channel Hungup"})
+	case "redirect":
+		s.handleRedirect(session, action)
+	case "blindtransfer":
+		s.handleBlindTransfer(session, action)
+	case "atxfer":
+		s.handleAtxfer(session, action)
+	case "musiconhold":
+		s.handleMusicOnHold(session, action, true)
+	case "stopmusiconhold":
+		s.handleMusicOnHold(session, action, false)
+	case "confbridgelist":
+		s.handleConfbridgeList(session, action)
+	case "confbridgelistrooms":
+		s.handleConfbridgeListRooms(session, action)
+	case "confbridgemute", "confbridgeunmute":
+		s.handleConfbridgeMute(session, action)
+	case "confbridgekick":
+		s.handleConfbridgeKick(session, action)
+	case "confbridgelock", "confbridgeunlock":
+		s.handleConfbridgeLock(session, action)
+	case "queuestatus":
+		s.handleQueueStatus(session, action)
+	case "queueadd":
+		s.handleQueueAdd(session, action)
+	case "queueremove":
+		s.handleQueueRemove(session, action)
+	case "queuepause":
+		s.handleQueuePause(session, action)
+	case "status":
+		s.handleStatus(session, action)
+	case "coreshowchannels":
+		s.handleCoreShowChannels(session, action)
+	case "pjsipshowendpoints":
+		s.handleShowEndpoints(session, action)
+	case "pjsipshowendpoint":
+		s.handleShowEndpoint(session, action)
+	case "pjsipshowcontacts":
+		s.handleShowContacts(session, action)
+	default:
+		session.Reply(action, Frame{"Response": "Error", "Message": "Invalid/unknown command"})
+	}
+}
+
+func (s *Server) handleLogin(session *Session, action Action) {
+	s.mutex.Lock()
+	ok := !s.refuse &&
+		action.Fields["Username"] == s.config.Username &&
+		action.Fields["Secret"] == s.config.Secret
+	if ok {
+		s.logins++
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Authentication failed"})
+		// Asterisk closes the connection after a failed login
+		session.Close()
+		return
+	}
+
+	s.mutex.Lock()
+	session.authenticated = true
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Authentication accepted"})
+	session.Send(Frame{"Event": "FullyBooted", "Privilege": "system,all", "Status": "Fully Booted"})
+}
+
+// handleOriginate simulates Originate to a PJSIP endpoint followed by a
+// Dial of Exten: the first leg is answered straight away, the second rings
+// until Config.AnswerAfter elapses or Answer is called
+func (s *Server) handleOriginate(session *Session, action Action) {
+	channelName := action.Fields["Channel"]
+	exten := action.Fields["Exten"]
+	if channelName == "" {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Channel not specified"})
+		return
+	}
+	switch strings.ToLower(action.Fields["Application"]) {
+	case "confbridge":
+		s.handleApplicationOriginate(session, action, s.joinConference)
+		return
+	case "queue":
+		s.handleApplicationOriginate(session, action, s.joinQueue)
+		return
+	}
+
+	callerExt := strings.TrimPrefix(channelName, "PJSIP/")
+
+	s.mutex.Lock()
+	callerReachable := s.isReachableLocked(callerExt)
+	caller := s.newChannelLocked(callerExt, exten, action.Fields["Context"], callerExt)
+	if id := action.Fields["ChannelId"]; id != "" {
+		caller.Uniqueid = id
+		caller.Linkedid = id
+	}
+	caller.Variables = parseVariables(action.Fields["Variable"])
+	s.mutex.Unlock()
+
+	async := strings.EqualFold(action.Fields["Async"], "true")
+	if !async && !callerReachable {
+		s.removeChannel(caller.Name)
+		session.Reply(action, Frame{"Response": "Error", "Message": "Originate failed"})
+		return
+	}
+	session.Reply(action, Frame{"Response": "Success", "Message": "Originate successfully queued"})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if !callerReachable {
+			s.removeChannel(caller.Name)
+			s.Emit("OriginateResponse", Frame{
+				"ActionID": action.ActionID,
+				"Response": "Failure",
+				"Channel":  channelName,
+				"Context":  action.Fields["Context"],
+				"Exten":    exten,
+				"Reason":   "0",
+				"Uniqueid": "<null>",
+			})
+			return
+		}
+
+		callerCopy := *caller
+		s.Emit("Newchannel", channelFields(&callerCopy))
+		callerCopy.State = "Up"
+		s.setState(caller.Name, "Up")
+		s.Emit("Newstate", channelFields(&callerCopy))
+		s.Emit("OriginateResponse", Frame{
+			"ActionID": action.ActionID,
+			"Response": "Success",
+			"Channel":  caller.Name,
+			"Context":  action.Fields["Context"],
+			"Exten":    exten,
+			"Reason":   "4",
+			"Uniqueid": caller.Uniqueid,
+		})
+
+		s.dial(callerCopy, exten, action.Fields["OtherChannelId"], false)
+	}()
+}
+
+// handleApplicationOriginate simulates Originate of a PJSIP endpoint into
+// a dialplan application: the endpoint rings, answers after
+// Config.AnswerAfter and is handed to join with the first argument of Data.
+// The channel is hung up if join fails.
+func (s *Server) handleApplicationOriginate(session *Session, action Action, join func(channel, data string) error) {
+	endpoint := strings.TrimPrefix(action.Fields["Channel"], "PJSIP/")
+	data := strings.SplitN(action.Fields["Data"], ",", 2)[0]
+	if data == "" {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Data not specified"})
+		return
+	}
+
+	s.mutex.Lock()
+	reachable := s.isReachableLocked(endpoint)
+	ch := s.newChannelLocked(endpoint, data, action.Fields["Context"], callerIDNumber(action.Fields["CallerID"]))
+	if id := action.Fields["ChannelId"]; id != "" {
+		ch.Uniqueid = id
+		ch.Linkedid = id
+	}
+	ch.Variables = parseVariables(action.Fields["Variable"])
+	chCopy := *ch
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Originate successfully queued"})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		s.Emit("Newchannel", channelFields(&chCopy))
+		if !reachable {
+			s.HangupChannel(chCopy.Name, 20)
+			return
+		}
+
+		chCopy.State = "Ringing"
+		s.setState(chCopy.Name, "Ringing")
+		s.Emit("Newstate", channelFields(&chCopy))
+
+		select {
+		case <-time.After(s.config.AnswerAfter):
+		case <-s.closed:
+			return
+		}
+
+		chCopy.State = "Up"
+		s.setState(chCopy.Name, "Up")
+		s.Emit("Newstate", channelFields(&chCopy))
+		s.Emit("OriginateResponse", Frame{
+			"ActionID": action.ActionID,
+			"Response": "Success",
+			"Channel":  chCopy.Name,
+			"Reason":   "4",
+			"Uniqueid": chCopy.Uniqueid,
+		})
+
+		if err := join(chCopy.Name, data); err != nil {
+			s.logf("amitest: %s cannot join %s %s: %v", chCopy.Name, action.Fields["Application"], data, err)
+			s.HangupChannel(chCopy.Name, 21)
+		}
+	}()
+}
+
+// dial creates the channel of the dialled extension, rings it and answers
+// it after AnswerAfter. A consultation call (attended transfer) is tracked
+// on the transferer's Consult instead of replacing its Peer.
+func (s *Server) dial(caller Channel, exten, uniqueid string, consult bool) {
+	callerExt := strings.TrimPrefix(caller.Name, "PJSIP/")
+	if i := strings.LastIndex(callerExt, "-"); i > 0 {
+		callerExt = callerExt[:i]
+	}
+
+	s.mutex.Lock()
+	reachable := s.isReachableLocked(exten)
+	callee := s.newChannelLocked(exten, exten, caller.Context, callerExt)
+	if uniqueid != "" {
+		callee.Uniqueid = uniqueid
+	}
+	callee.Linkedid = caller.Linkedid
+	callee.Peer = caller.Name
+	if caller.Queue != "" {
+		callee.Queue = caller.Queue
+		callee.QueueMember = "PJSIP/" + exten
+	}
+	if live, ok := s.channels[caller.Name]; ok {
+		if consult {
+			callee.Transferee = live.Peer
+			live.Consult = callee.Name
+		} else {
+			live.Peer = callee.Name
+		}
+	}
+	calleeCopy := *callee
+	s.mutex.Unlock()
+
+	s.Emit("Newchannel", channelFields(&calleeCopy))
+	dialBegin := channelFields(&caller)
+	for key, value := range destFields(&calleeCopy) {
+		dialBegin[key] = value
+	}
+	dialBegin["DialString"] = exten
+	s.Emit("DialBegin", dialBegin)
+
+	if calleeCopy.QueueMember != "" {
+		s.mutex.Lock()
+		var called Frame
+		if q := s.queues[calleeCopy.Queue]; q != nil && q.members[calleeCopy.QueueMember] != nil {
+			called = agentFields(q, q.members[calleeCopy.QueueMember], &caller, &calleeCopy)
+		}
+		s.mutex.Unlock()
+		if called != nil {
+			s.Emit("AgentCalled", called)
+		}
+	}
+
+	if !reachable {
+		dialEnd := dialBegin
+		delete(dialEnd, "DialString")
+		dialEnd["DialStatus"] = "CHANUNAVAIL"
+		s.Emit("DialEnd", dialEnd)
+		s.HangupChannel(callee.Name, 20)
+		return
+	}
+
+	calleeCopy.State = "Ringing"
+	s.setState(callee.Name, "Ringing")
+	s.Emit("Newstate", channelFields(&calleeCopy))
+
+	if s.config.AnswerAfter > 0 {
+		select {
+		case <-time.After(s.config.AnswerAfter):
+			s.Answer(callee.Name)
+		case <-s.closed:
+		}
+	}
+}
+
+// handleBlindTransfer hangs up the transferer and has the party it was
+// talking to dial the target
+func (s *Server) handleBlindTransfer(session *Session, action Action) {
+	s.mutex.Lock()
+	transferer, ok := s.channels[action.Fields["Channel"]]
+	var transferee *Channel
+	if ok {
+		transferee = s.channels[transferer.Peer]
+	}
+	if transferee == nil {
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "No such channel"})
+		return
+	}
+	transferer.Peer = ""
+	transferee.Peer = ""
+	transferee.BridgeID = ""
+	transfereeCopy := *transferee
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Transfer succeeded"})
+
+	exten := action.Fields["Exten"]
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fields := channelFields(&transfereeCopy)
+		fields["Result"] = "Success"
+		fields["Extension"] = exten
+		fields["Context"] = action.Fields["Context"]
+		s.Emit("BlindTransfer", fields)
+		s.HangupChannel(action.Fields["Channel"], 16)
+		s.dial(transfereeCopy, exten, "", false)
+	}()
+}
+
+// handleAtxfer starts a consultation call from the transferer to the target
+// while the transferee waits. Hanging up the transferer completes the
+// transfer; hanging up the consultation call abandons it.
+func (s *Server) handleAtxfer(session *Session, action Action) {
+	s.mutex.Lock()
+	transferer, ok := s.channels[action.Fields["Channel"]]
+	if !ok || transferer.Peer == "" || transferer.Consult != "" {
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "No such channel"})
+		return
+	}
+	transfererCopy := *transferer
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Atxfer successfully queued"})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.dial(transfererCopy, action.Fields["Exten"], "", true)
+	}()
+}
+
+func (s *Server) handleRedirect(session *Session, action Action) {
+	s.mutex.Lock()
+	ch, ok := s.channels[action.Fields["Channel"]]
+	if ok {
+		ch.Exten = action.Fields["Exten"]
+		ch.Context = action.Fields["Context"]
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Channel specified does not exist"})
+		return
+	}
+	session.Reply(action, Frame{"Response": "Success", "Message": "Redirect successful"})
+}
+
+// handleMusicOnHold starts (start true) or stops music on hold on a channel
+func (s *Server) handleMusicOnHold(session *Session, action Action, start bool) {
+	s.mutex.Lock()
+	ch, ok := s.channels[action.Fields["Channel"]]
+	if ok {
+		ch.MusicClass = ""
+		if start {
+			ch.MusicClass = action.Fields["Class"]
+			if ch.MusicClass == "" {
+				ch.MusicClass = "default"
+			}
+		}
+	}
+	var chCopy Channel
+	if ok {
+		chCopy = *ch
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No such channel"})
+		return
+	}
+
+	if start {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Started music on hold"})
+		fields := channelFields(&chCopy)
+		fields["Class"] = chCopy.MusicClass
+		s.Emit("MusicOnHoldStart", fields)
+	} else {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Stopped music on hold"})
+		s.Emit("MusicOnHoldStop", channelFields(&chCopy))
+	}
+}
+
+func (s *Server) handleStatus(session *Session, action Action) {
+	filter := action.Fields["Channel"]
+	var entries []Frame
+	for _, ch := range s.Channels() {
+		if filter != "" && ch.Name != filter {
+			continue
+		}
+		fields := channelFields(&ch)
+		fields["Event"] = "Status"
+		fields["Seconds"] = fmt.Sprintf("%d", int(time.Since(ch.Created).Seconds()))
+		fields["BridgeID"] = ch.BridgeID
+		entries = append(entries, fields)
+	}
+
+	if filter != "" && len(entries) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No such channel"})
+		return
+	}
+	session.ReplyList(action, "Channel status will follow", entries, "StatusComplete")
+}
+
+func (s *Server) handleCoreShowChannels(session *Session, action Action) {
+	var entries []Frame
+	for _, ch := range s.Channels() {
+		fields := channelFields(&ch)
+		fields["Event"] = "CoreShowChannel"
+		fields["Duration"] = formatDuration(time.Since(ch.Created))
+		fields["BridgeId"] = ch.BridgeID
+		fields["Application"] = "Dial"
+		entries = append(entries, fields)
+	}
+	session.ReplyList(action, "Channels will follow", entries, "CoreShowChannelsComplete")
+}
+
+func (s *Server) handleShowEndpoints(session *Session, action Action) {
+	endpoints := s.sortedEndpoints()
+	if len(endpoints) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No endpoints found"})
+		return
+	}
+
+	entries := make([]Frame, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		contacts := ""
+		state := "Unavailable"
+		if endpoint.Registered {
+			contacts = contactURI(endpoint.Name) + ",Avail"
+			state = "Not in use"
+		}
+		entries = append(entries, Frame{
+			"Event":          "EndpointList",
+			"ObjectType":     "endpoint",
+			"ObjectName":     endpoint.Name,
+			"Transport":      "transport-ws",
+			"Aor":            endpoint.Name,
+			"Auths":          endpoint.Name,
+			"Contacts":       contacts,
+			"DeviceState":    state,
+			"ActiveChannels": "",
+		})
+	}
+	session.ReplyList(action, "A listing of Endpoints follows, presented as EndpointList events", entries, "EndpointListComplete")
+}
+
+func (s *Server) handleShowEndpoint(session *Session, action Action) {
+	name := action.Fields["Endpoint"]
+
+	s.mutex.Lock()
+	endpoint, ok := s.endpoints[name]
+	var ep Endpoint
+	if ok {
+		ep = *endpoint
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Unable to retrieve endpoint " + name})
+		return
+	}
+
+	entries := []Frame{{
+		"Event":       "EndpointDetail",
+		"ObjectType":  "endpoint",
+		"ObjectName":  ep.Name,
+		"Context":     "default",
+		"Aors":        ep.Name,
+		"Auth":        ep.Name,
+		"DeviceState": map[bool]string{true: "Not in use", false: "Unavailable"}[ep.Registered],
+	}}
+	if ep.Registered {
+		entries = append(entries, Frame{
+			"Event":         "ContactStatusDetail",
+			"AOR":           ep.Name,
+			"URI":           contactURI(ep.Name),
+			"Status":        "Reachable",
+			"RoundtripUsec": "1500",
+			"EndpointName":  ep.Name,
+			"UserAgent":     "amitest",
+		})
+	}
+	session.ReplyList(action, "Following are Events for each object associated with the Endpoint", entries, "EndpointDetailComplete")
+}
+
+func (s *Server) handleShowContacts(session *Session, action Action) {
+	var entries []Frame
+	for _, endpoint := range s.sortedEndpoints() {
+		if !endpoint.Registered {
+			continue
+		}
+		entries = append(entries, Frame{
+			"Event":         "ContactList",
+			"ObjectType":    "contact",
+			"ObjectName":    endpoint.Name + ";@amitest",
+			"Uri":           contactURI(endpoint.Name),
+			"Endpoint":      endpoint.Name,
+			"Aor":           endpoint.Name,
+			"Status":        "Reachable",
+			"RoundtripUsec": "1500",
+			"UserAgent":     "amitest",
+		})
+	}
+
+	if len(entries) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No Contacts found"})
+		return
+	}
+	session.ReplyList(action, "A listing of Contacts follows, presented as ContactList events", entries, "ContactListComplete")
+}
+
+// isReachableLocked reports whether an endpoint may be dialled. With no
+// endpoints configured every extension is considered reachable.
+func (s *Server) isReachableLocked(name string) bool {
+	if len(s.endpoints) == 0 {
+		return true
+	}
+	endpoint, ok := s.endpoints[name]
+	return ok && endpoint.Registered
+}
+
+func (s *Server) newChannelLocked(endpoint, exten, context, callerID string) *Channel {
+	s.sequence++
+	now := time.Now()
+	ch := &Channel{
+		Name:        fmt.Sprintf("PJSIP/%s-%08x", endpoint, s.sequence),
+		Uniqueid:    fmt.Sprintf("%d.%d", now.Unix(), s.sequence),
+		Exten:       exten,
+		Context:     context,
+		CallerIDNum: callerID,
+		State:       "Down",
+		Created:     now,
+	}
+	ch.Linkedid = ch.Uniqueid
+	s.channels[ch.Name] = ch
+	return ch
+}
+
+func (s *Server) setState(name, state string) {
+	s.mutex.Lock()
+	if ch, ok := s.channels[name]; ok {
+		ch.State = state
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Server) removeChannel(name string) {
+	s.mutex.Lock()
+	delete(s.channels, name)
+	s.mutex.Unlock()
+}
+
+func (s *Server) sortedEndpoints() []Endpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	endpoints := make([]Endpoint, 0, len(s.endpoints))
+	for _, endpoint := range s.endpoints {
+		endpoints = append(endpoints, *endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Name < endpoints[j].Name
+	})
+	return endpoints
+}
+
+// channelFields returns the standard channel header of an event
+func channelFields(ch *Channel) Frame {
+	return Frame{
+		"Channel":          ch.Name,
+		"ChannelState":     stateNumber(ch.State),
+		"ChannelStateDesc": ch.State,
+		"CallerIDNum":      ch.CallerIDNum,
+		"ConnectedLineNum": "<unknown>",
+		"Context":          ch.Context,
+		"Exten":            ch.Exten,
+		"Priority":         "1",
+		"Uniqueid":         ch.Uniqueid,
+		"Linkedid":         ch.Linkedid,
+	}
+}
+
+// destFields returns the Dest* header describing the dialled channel
+func destFields(ch *Channel) Frame {
+	fields := Frame{}
+	for key, value := range channelFields(ch) {
+		fields["Dest"+key] = value
+	}
+	return fields
+}
+
+// cdrFields returns the Cdr event cdr_manager posts for a finished call
+func cdrFields(caller, callee *Channel, cause int) Frame {
+	end := time.Now()
+	fields := Frame{
+		"AccountCode":        "",
+		"Source":             caller.CallerIDNum,
+		"Destination":        caller.Exten,
+		"LinkedID":           caller.Linkedid, // Logged when cdr_manager maps the linkedid field
+		"DestinationContext": caller.Context,
+		"CallerID":           fmt.Sprintf("\"\" <%s>", caller.CallerIDNum),
+		"Channel":            caller.Name,
+		"DestinationChannel": "",
+		"LastApplication":    "Dial",
+		"LastData":           "PJSIP/" + caller.Exten,
+		"StartTime":          caller.Created.Format(cdrTimeLayout),
+		"AnswerTime":         "",
+		"EndTime":            end.Format(cdrTimeLayout),
+		"Duration":           fmt.Sprintf("%d", int(end.Sub(caller.Created).Seconds())),
+		"BillableSeconds":    "0",
+		"AMAFlags":           "DOCUMENTATION",
+		"UniqueID":           caller.Uniqueid,
+		"UserField":          "",
+	}
+	if callee != nil {
+		fields["DestinationChannel"] = callee.Name
+		fields["Destination"] = callee.Exten
+	}
+
+	switch {
+	case !caller.Answered.IsZero():
+		fields["AnswerTime"] = caller.Answered.Format(cdrTimeLayout)
+		fields["BillableSeconds"] = fmt.Sprintf("%d", int(end.Sub(caller.Answered).Seconds()))
+		fields["Disposition"] = "ANSWERED"
+	case cause == 17:
+		fields["Disposition"] = "BUSY"
+	case cause == 18 || cause == 19 || cause == 16:
+		fields["Disposition"] = "NO ANSWER"
+	default:
+		fields["Disposition"] = "FAILED"
+	}
+	return fields
+}
+
+// celFields returns a CEL event as posted by cel_manager
+func celFields(ch *Channel, eventName, extra string) Frame {
+	return Frame{
+		"EventName":   eventName,
+		"AccountCode": "",
+		"CallerIDnum": ch.CallerIDNum,
+		"Exten":       ch.Exten,
+		"Context":     ch.Context,
+		"Channel":     ch.Name,
+		"Application": "",
+		"EventTime":   time.Now().Format(cdrTimeLayout),
+		"UniqueID":    ch.Uniqueid,
+		"LinkedID":    ch.Linkedid,
+		"Peer":        ch.Peer,
+		"Extra":       extra,
+	}
+}
+
+// cdrTimeLayout is the timestamp format of cdr_manager and cel_manager
+const cdrTimeLayout = "2006-01-02 15:04:05"
+
+// parseVariables splits an Originate Variable header into assignments. Like
+// Asterisk, it does not split on commas inside parentheses, so
+// CONFBRIDGE(bridge,max_members)=10 stays whole.
+func parseVariables(value string) map[string]string {
+	variables := make(map[string]string)
+	depth, start := 0, 0
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) {
+			switch value[i] {
+			case '(':
+				depth++
+				continue
+			case ')':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		parts := strings.SplitN(value[start:i], "=", 2)
+		if len(parts) == 2 {
+			variables[parts[0]] = parts[1]
+		}
+		start = i + 1
+	}
+	return variables
+}
+
+// callerIDNumber returns the number of a "Name <number>" caller ID
+func callerIDNumber(callerID string) string {
+	if start := strings.Index(callerID, "<"); start >= 0 {
+		if end := strings.Index(callerID[start:], ">"); end > 0 {
+			return callerID[start+1 : start+end]
+		}
+	}
+	return callerID
+}
+
+func contactURI(name string) string {
+	return fmt.Sprintf("sip:%s@127.0.0.1:5060", name)
+}
+
+func stateNumber(state string) string {
+	switch state {
+	case "Ring":
+		return "4"
+	case "Ringing":
+		return "5"
+	case "Up":
+		return "6"
+	case "Busy":
+		return "7"
+	default:
+		return "0"
+	}
+}
+
+func causeText(cause int) string {
+	switch cause {
+	case 16:
+		return "Normal Clearing"
+	case 17:
+		return "User busy"
+	case 19:
+		return "No answer"
+	case 20:
+		return "Subscriber absent"
+	case 21:
+		return "Call Rejected"
+	default:
+		return "Unknown"
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	seconds := int(d.Seconds())
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, (seconds/60)%60, seconds%60)
+}
@@ -0,0 +1,220 @@
+package amitest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// joinConference puts an answered channel into a conference, honouring the
+// CONFBRIDGE(user,admin) and CONFBRIDGE(bridge,max_members) variables
+func (s *Server) joinConference(channel, conference string) error {
+	s.mutex.Lock()
+	ch, ok := s.channels[channel]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("no such channel")
+	}
+	admin := strings.EqualFold(ch.Variables["CONFBRIDGE(user,admin)"], "yes")
+	members := s.conferenceMembersLocked(conference)
+	if s.lockedConferences[conference] && !admin {
+		s.mutex.Unlock()
+		return fmt.Errorf("conference is locked")
+	}
+	if max, _ := strconv.Atoi(ch.Variables["CONFBRIDGE(bridge,max_members)"]); max > 0 && len(members) >= max && !admin {
+		s.mutex.Unlock()
+		return fmt.Errorf("conference is full")
+	}
+	ch.Conference = conference
+	ch.ConfAdmin = admin
+	chCopy := *ch
+	s.mutex.Unlock()
+
+	if len(members) == 0 {
+		s.Emit("ConfbridgeStart", Frame{"Conference": conference})
+	}
+	s.Emit("ConfbridgeJoin", conferenceFields(&chCopy))
+	return nil
+}
+
+// leaveConference reports a hung up channel leaving its conference, which
+// ends once it is empty
+func (s *Server) leaveConference(ch Channel) {
+	s.Emit("ConfbridgeLeave", conferenceFields(&ch))
+
+	s.mutex.Lock()
+	empty := len(s.conferenceMembersLocked(ch.Conference)) == 0
+	if empty {
+		delete(s.lockedConferences, ch.Conference)
+	}
+	s.mutex.Unlock()
+
+	if empty {
+		s.Emit("ConfbridgeEnd", Frame{"Conference": ch.Conference})
+	}
+}
+
+func (s *Server) handleConfbridgeList(session *Session, action Action) {
+	conference := action.Fields["Conference"]
+
+	s.mutex.Lock()
+	members := s.conferenceMembersLocked(conference)
+	s.mutex.Unlock()
+
+	if len(members) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No active conferences."})
+		return
+	}
+
+	entries := make([]Frame, 0, len(members))
+	for i := range members {
+		fields := conferenceFields(&members[i])
+		fields["Event"] = "ConfbridgeList"
+		entries = append(entries, fields)
+	}
+	session.ReplyList(action, "Confbridge user list will follow", entries, "ConfbridgeListComplete")
+}
+
+func (s *Server) handleConfbridgeListRooms(session *Session, action Action) {
+	s.mutex.Lock()
+	rooms := make(map[string][]Channel)
+	for _, ch := range s.channels {
+		if ch.Conference != "" {
+			rooms[ch.Conference] = append(rooms[ch.Conference], *ch)
+		}
+	}
+	locked := make(map[string]bool, len(s.lockedConferences))
+	for conference, isLocked := range s.lockedConferences {
+		locked[conference] = isLocked
+	}
+	s.mutex.Unlock()
+
+	if len(rooms) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No active conferences."})
+		return
+	}
+
+	names := make([]string, 0, len(rooms))
+	for conference := range rooms {
+		names = append(names, conference)
+	}
+	sort.Strings(names)
+
+	entries := make([]Frame, 0, len(names))
+	for _, conference := range names {
+		marked := 0
+		for _, ch := range rooms[conference] {
+			if ch.ConfAdmin {
+				marked++
+			}
+		}
+		entries = append(entries, Frame{
+			"Event":      "ConfbridgeListRooms",
+			"Conference": conference,
+			"Parties":    strconv.Itoa(len(rooms[conference])),
+			"Marked":     strconv.Itoa(marked),
+			"Locked":     yesNo(locked[conference]),
+			"Muted":      "No",
+		})
+	}
+	session.ReplyList(action, "Confbridge conferences will follow", entries, "ConfbridgeListRoomsComplete")
+}
+
+func (s *Server) handleConfbridgeMute(session *Session, action Action) {
+	mute := strings.EqualFold(action.Name, "ConfbridgeMute")
+
+	s.mutex.Lock()
+	ch, ok := s.channels[action.Fields["Channel"]]
+	if !ok || ch.Conference != action.Fields["Conference"] {
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "No Channel by that name found in Conference."})
+		return
+	}
+	ch.ConfMuted = mute
+	chCopy := *ch
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "User muted"})
+	if mute {
+		s.Emit("ConfbridgeMute", conferenceFields(&chCopy))
+	} else {
+		s.Emit("ConfbridgeUnmute", conferenceFields(&chCopy))
+	}
+}
+
+func (s *Server) handleConfbridgeKick(session *Session, action Action) {
+	s.mutex.Lock()
+	ch, ok := s.channels[action.Fields["Channel"]]
+	ok = ok && ch.Conference == action.Fields["Conference"]
+	s.mutex.Unlock()
+
+	if !ok {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No Conference by that name found."})
+		return
+	}
+	session.Reply(action, Frame{"Response": "Success", "Message": "User kicked"})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.HangupChannel(action.Fields["Channel"], 16)
+	}()
+}
+
+func (s *Server) handleConfbridgeLock(session *Session, action Action) {
+	lock := strings.EqualFold(action.Name, "ConfbridgeLock")
+	conference := action.Fields["Conference"]
+
+	s.mutex.Lock()
+	exists := len(s.conferenceMembersLocked(conference)) > 0
+	if exists {
+		s.lockedConferences[conference] = lock
+	}
+	s.mutex.Unlock()
+
+	if !exists {
+		session.Reply(action, Frame{"Response": "Error", "Message": "No Conference by that name found."})
+		return
+	}
+
+	if lock {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Conference locked"})
+		s.Emit("ConfbridgeLock", Frame{"Conference": conference})
+	} else {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Conference unlocked"})
+		s.Emit("ConfbridgeUnlock", Frame{"Conference": conference})
+	}
+}
+
+// conferenceMembersLocked returns the channels in a conference in the
+// order they were created
+func (s *Server) conferenceMembersLocked(conference string) []Channel {
+	var members []Channel
+	for _, ch := range s.channels {
+		if ch.Conference == conference {
+			members = append(members, *ch)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Created.Before(members[j].Created)
+	})
+	return members
+}
+
+// conferenceFields returns the header of a Confbridge* event about a channel
+func conferenceFields(ch *Channel) Frame {
+	fields := channelFields(ch)
+	fields["Conference"] = ch.Conference
+	fields["CallerIDName"] = ch.CallerIDNum
+	fields["Admin"] = yesNo(ch.ConfAdmin)
+	fields["Muted"] = yesNo(ch.ConfMuted)
+	return fields
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "Yes"
+	}
+	return "No"
+}
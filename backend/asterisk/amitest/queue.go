@@ -0,0 +1,493 @@
+package amitest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queue is an app_queue queue in the fake server. Callers are offered to
+// the free member that has gone longest without a call.
+type queue struct {
+	name      string
+	members   map[string]*queueMember // by interface
+	callers   []string                // channels waiting, in the order they joined
+	completed int
+	abandoned int
+}
+
+// queueMember is a dynamic member (agent) of a queue
+type queueMember struct {
+	Interface      string
+	MemberName     string
+	StateInterface string
+	Paused         bool
+	PausedReason   string
+	CallsTaken     int
+	LastCall       time.Time
+	LoginTime      time.Time
+	Caller         string        // Queue caller being rung or talked to
+	CallerWait     time.Duration // How long Caller waited before the member answered
+	InCall         bool
+}
+
+// AddQueue defines a queue, as a [name] section of queues.conf would.
+// Originate into Queue, QueueAdd and QueueRemove fail for other queues.
+func (s *Server) AddQueue(name string) {
+	s.mutex.Lock()
+	if _, ok := s.queues[name]; !ok {
+		s.queues[name] = &queue{name: name, members: make(map[string]*queueMember)}
+	}
+	s.mutex.Unlock()
+}
+
+// joinQueue puts an answered channel at the back of a queue and offers
+// it to a free member
+func (s *Server) joinQueue(channel, name string) error {
+	s.mutex.Lock()
+	ch, ok := s.channels[channel]
+	q := s.queues[name]
+	if !ok || q == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("no such queue")
+	}
+	ch.Queue = name
+	ch.Answered = time.Now()
+	q.callers = append(q.callers, channel)
+	fields := channelFields(ch)
+	fields["Queue"] = name
+	fields["Position"] = strconv.Itoa(len(q.callers))
+	fields["Count"] = strconv.Itoa(len(q.callers))
+	s.mutex.Unlock()
+
+	s.Emit("QueueCallerJoin", fields)
+	s.distributeQueue(name)
+	return nil
+}
+
+// distributeQueue rings a free member for every waiting caller that is not
+// already being offered to one
+func (s *Server) distributeQueue(name string) {
+	for {
+		s.mutex.Lock()
+		q := s.queues[name]
+		if q == nil {
+			s.mutex.Unlock()
+			return
+		}
+
+		var caller *Channel
+		for _, channel := range q.callers {
+			if ch, ok := s.channels[channel]; ok && !offeredLocked(q, channel) {
+				caller = ch
+				break
+			}
+		}
+		member := s.freeMemberLocked(q)
+		if caller == nil || member == nil {
+			s.mutex.Unlock()
+			return
+		}
+		member.Caller = caller.Name
+		callerCopy := *caller
+		s.mutex.Unlock()
+
+		exten := strings.TrimPrefix(member.Interface, "PJSIP/")
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.dial(callerCopy, exten, "", false)
+		}()
+	}
+}
+
+// offeredLocked reports whether a member is already ringing for a caller
+func offeredLocked(q *queue, channel string) bool {
+	for _, member := range q.members {
+		if member.Caller == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// freeMemberLocked returns the member that has gone longest without a call
+// among those logged in, not paused, not busy and registered
+func (s *Server) freeMemberLocked(q *queue) *queueMember {
+	var best *queueMember
+	for _, member := range q.members {
+		if member.Paused || member.Caller != "" ||
+			!s.isReachableLocked(strings.TrimPrefix(member.Interface, "PJSIP/")) {
+			continue
+		}
+		if best == nil || member.LastCall.Before(best.LastCall) ||
+			(member.LastCall.Equal(best.LastCall) && member.Interface < best.Interface) {
+			best = member
+		}
+	}
+	return best
+}
+
+// queueAnswerLocked records a member answering a queue caller as in a call
+// and returns the events to raise
+func (s *Server) queueAnswerLocked(caller, agent *Channel) []Frame {
+	q := s.queues[caller.Queue]
+	if q == nil {
+		return nil
+	}
+	member := q.members[agent.QueueMember]
+
+	position := 0
+	for i, channel := range q.callers {
+		if channel == caller.Name {
+			position = i + 1
+			q.callers = append(q.callers[:i], q.callers[i+1:]...)
+			break
+		}
+	}
+
+	leave := channelFields(caller)
+	leave["Event"] = "QueueCallerLeave"
+	leave["Queue"] = q.name
+	leave["Position"] = strconv.Itoa(position)
+	leave["Count"] = strconv.Itoa(len(q.callers))
+	frames := []Frame{leave}
+
+	if member != nil {
+		member.InCall = true
+		member.CallerWait = time.Since(caller.Answered)
+		connect := agentFields(q, member, caller, agent)
+		connect["Event"] = "AgentConnect"
+		connect["HoldTime"] = strconv.Itoa(int(member.CallerWait.Seconds()))
+		connect["RingTime"] = strconv.Itoa(int(time.Since(agent.Created).Seconds()))
+		status := s.memberFieldsLocked(q, member)
+		status["Event"] = "QueueMemberStatus"
+		frames = append(frames, connect, status)
+	}
+	return frames
+}
+
+// queueHangupLocked updates the queues for a channel about to be hung up
+// and returns the events to raise. A member's leg that stops ringing does
+// not take the waiting caller with it, so its Peer is cleared.
+func (s *Server) queueHangupLocked(ch *Channel) []Frame {
+	if ch.Queue == "" {
+		return nil
+	}
+	q := s.queues[ch.Queue]
+	if q == nil {
+		return nil
+	}
+
+	// A caller still waiting abandons the queue
+	for i, channel := range q.callers {
+		if channel != ch.Name {
+			continue
+		}
+		q.callers = append(q.callers[:i], q.callers[i+1:]...)
+		q.abandoned++
+		if agent, ok := s.channels[ch.Peer]; ok {
+			if member := q.members[agent.QueueMember]; member != nil {
+				member.Caller = ""
+			}
+		}
+
+		abandon := channelFields(ch)
+		abandon["Event"] = "QueueCallerAbandon"
+		abandon["Queue"] = q.name
+		abandon["Position"] = strconv.Itoa(i + 1)
+		abandon["OriginalPosition"] = strconv.Itoa(i + 1)
+		abandon["HoldTime"] = strconv.Itoa(int(time.Since(ch.Answered).Seconds()))
+		leave := channelFields(ch)
+		leave["Event"] = "QueueCallerLeave"
+		leave["Queue"] = q.name
+		leave["Position"] = strconv.Itoa(i + 1)
+		leave["Count"] = strconv.Itoa(len(q.callers))
+		return []Frame{abandon, leave}
+	}
+
+	caller, agent := ch, s.channels[ch.Peer]
+	if ch.QueueMember != "" {
+		caller, agent = s.channels[ch.Peer], ch
+	}
+	if caller == nil || agent == nil {
+		return nil
+	}
+	member := q.members[agent.QueueMember]
+	if member == nil || member.Caller != caller.Name {
+		return nil
+	}
+	member.Caller = ""
+
+	if !member.InCall {
+		// The member's phone stopped ringing: offer the caller again
+		agent.Peer = ""
+		caller.Peer = ""
+		noAnswer := agentFields(q, member, caller, agent)
+		noAnswer["Event"] = "AgentRingNoAnswer"
+		noAnswer["RingTime"] = strconv.Itoa(int(time.Since(agent.Created).Seconds()))
+		return []Frame{noAnswer}
+	}
+
+	member.InCall = false
+	member.CallsTaken++
+	member.LastCall = time.Now()
+	q.completed++
+
+	reason := "caller"
+	if ch == agent {
+		reason = "agent"
+	}
+	complete := agentFields(q, member, caller, agent)
+	complete["Event"] = "AgentComplete"
+	complete["HoldTime"] = strconv.Itoa(int(member.CallerWait.Seconds()))
+	complete["TalkTime"] = strconv.Itoa(int(time.Since(agent.Answered).Seconds()))
+	complete["Reason"] = reason
+	status := s.memberFieldsLocked(q, member)
+	status["Event"] = "QueueMemberStatus"
+	return []Frame{complete, status}
+}
+
+func (s *Server) handleQueueStatus(session *Session, action Action) {
+	filter := action.Fields["Queue"]
+
+	s.mutex.Lock()
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		if filter == "" || filter == name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var entries []Frame
+	for _, name := range names {
+		q := s.queues[name]
+		entries = append(entries, Frame{
+			"Event":     "QueueParams",
+			"Queue":     name,
+			"Max":       "0",
+			"Strategy":  "leastrecent",
+			"Calls":     strconv.Itoa(len(q.callers)),
+			"Holdtime":  "0",
+			"TalkTime":  "0",
+			"Completed": strconv.Itoa(q.completed),
+			"Abandoned": strconv.Itoa(q.abandoned),
+			"Weight":    "0",
+		})
+		for _, member := range sortedMembers(q) {
+			fields := s.memberFieldsLocked(q, member)
+			fields["Event"] = "QueueMember"
+			fields["Name"] = fields["MemberName"]
+			fields["Location"] = fields["Interface"]
+			delete(fields, "MemberName")
+			delete(fields, "Interface")
+			entries = append(entries, fields)
+		}
+		for i, channel := range q.callers {
+			ch, ok := s.channels[channel]
+			if !ok {
+				continue
+			}
+			fields := channelFields(ch)
+			fields["Event"] = "QueueEntry"
+			fields["Queue"] = name
+			fields["Position"] = strconv.Itoa(i + 1)
+			fields["CallerIDName"] = ch.CallerIDNum
+			fields["Wait"] = strconv.Itoa(int(time.Since(ch.Answered).Seconds()))
+			fields["Priority"] = "0"
+			entries = append(entries, fields)
+		}
+	}
+	s.mutex.Unlock()
+
+	session.ReplyList(action, "Queue status will follow", entries, "QueueStatusComplete")
+}
+
+func (s *Server) handleQueueAdd(session *Session, action Action) {
+	name := action.Fields["Queue"]
+	iface := action.Fields["Interface"]
+
+	s.mutex.Lock()
+	q := s.queues[name]
+	switch {
+	case q == nil:
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "Unable to add interface to queue: No such queue"})
+		return
+	case q.members[iface] != nil:
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "Unable to add interface: Already there"})
+		return
+	}
+	member := &queueMember{
+		Interface:      iface,
+		MemberName:     action.Fields["MemberName"],
+		StateInterface: action.Fields["StateInterface"],
+		Paused:         isTrue(action.Fields["Paused"]),
+		LoginTime:      time.Now(),
+	}
+	if member.MemberName == "" {
+		member.MemberName = iface
+	}
+	if member.StateInterface == "" {
+		member.StateInterface = iface
+	}
+	q.members[iface] = member
+	fields := s.memberFieldsLocked(q, member)
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Added interface to queue"})
+	s.Emit("QueueMemberAdded", fields)
+	s.distributeQueue(name)
+}
+
+func (s *Server) handleQueueRemove(session *Session, action Action) {
+	name := action.Fields["Queue"]
+	iface := action.Fields["Interface"]
+
+	s.mutex.Lock()
+	q := s.queues[name]
+	var member *queueMember
+	if q != nil {
+		member = q.members[iface]
+	}
+	switch {
+	case q == nil:
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "Unable to remove interface from queue: No such queue"})
+		return
+	case member == nil:
+		s.mutex.Unlock()
+		session.Reply(action, Frame{"Response": "Error", "Message": "Unable to remove interface: Not there"})
+		return
+	}
+	delete(q.members, iface)
+	fields := s.memberFieldsLocked(q, member)
+	s.mutex.Unlock()
+
+	session.Reply(action, Frame{"Response": "Success", "Message": "Removed interface from queue"})
+	s.Emit("QueueMemberRemoved", fields)
+}
+
+func (s *Server) handleQueuePause(session *Session, action Action) {
+	name := action.Fields["Queue"]
+	iface := action.Fields["Interface"]
+	paused := isTrue(action.Fields["Paused"])
+
+	// Without Queue the member is paused in every queue it belongs to
+	s.mutex.Lock()
+	var changed []Frame
+	var queues []string
+	for _, q := range s.queues {
+		if name != "" && q.name != name {
+			continue
+		}
+		member := q.members[iface]
+		if member == nil {
+			continue
+		}
+		member.Paused = paused
+		member.PausedReason = ""
+		if paused {
+			member.PausedReason = action.Fields["Reason"]
+		}
+		changed = append(changed, s.memberFieldsLocked(q, member))
+		queues = append(queues, q.name)
+	}
+	s.mutex.Unlock()
+
+	if len(changed) == 0 {
+		session.Reply(action, Frame{"Response": "Error", "Message": "Interface not found"})
+		return
+	}
+
+	if paused {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Interface paused successfully"})
+	} else {
+		session.Reply(action, Frame{"Response": "Success", "Message": "Interface unpaused successfully"})
+	}
+	for _, fields := range changed {
+		s.Emit("QueueMemberPause", fields)
+	}
+	if !paused {
+		for _, q := range queues {
+			s.distributeQueue(q)
+		}
+	}
+}
+
+// memberFieldsLocked returns the header of a QueueMember* event
+func (s *Server) memberFieldsLocked(q *queue, member *queueMember) Frame {
+	status := "1" // AST_DEVICE_NOT_INUSE
+	switch {
+	case !s.isReachableLocked(strings.TrimPrefix(member.Interface, "PJSIP/")):
+		status = "5" // AST_DEVICE_UNAVAILABLE
+	case member.InCall:
+		status = "2" // AST_DEVICE_INUSE
+	case member.Caller != "":
+		status = "6" // AST_DEVICE_RINGING
+	}
+
+	lastCall := "0"
+	if !member.LastCall.IsZero() {
+		lastCall = strconv.FormatInt(member.LastCall.Unix(), 10)
+	}
+
+	return Frame{
+		"Queue":          q.name,
+		"MemberName":     member.MemberName,
+		"Interface":      member.Interface,
+		"StateInterface": member.StateInterface,
+		"Membership":     "dynamic",
+		"Penalty":        "0",
+		"CallsTaken":     strconv.Itoa(member.CallsTaken),
+		"LastCall":       lastCall,
+		"LastPause":      "0",
+		"LoginTime":      strconv.FormatInt(member.LoginTime.Unix(), 10),
+		"InCall":         boolDigit(member.InCall),
+		"Status":         status,
+		"Paused":         boolDigit(member.Paused),
+		"PausedReason":   member.PausedReason,
+		"Ringinuse":      "0",
+		"Wrapuptime":     "0",
+	}
+}
+
+// agentFields returns the header of an Agent* event: the caller's channel,
+// the member's channel as Dest* and the member
+func agentFields(q *queue, member *queueMember, caller, agent *Channel) Frame {
+	fields := channelFields(caller)
+	for key, value := range destFields(agent) {
+		fields[key] = value
+	}
+	fields["Queue"] = q.name
+	fields["Interface"] = member.Interface
+	fields["MemberName"] = member.MemberName
+	return fields
+}
+
+// sortedMembers returns the members of a queue in interface order
+func sortedMembers(q *queue) []*queueMember {
+	members := make([]*queueMember, 0, len(q.members))
+	for _, member := range q.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Interface < members[j].Interface
+	})
+	return members
+}
+
+func boolDigit(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+func isTrue(value string) bool {
+	return strings.EqualFold(value, "true") || strings.EqualFold(value, "yes") || value == "1"
+}
@@ -0,0 +1,700 @@
+// Package amitest provides an in-process fake of the Asterisk Manager
+// Interface. It speaks enough of the AMI protocol (greeting, Login, Ping,
+// Originate, Hangup, Redirect, Status and the PJSIP/channel list actions)
+// for the asterisk package and the call handlers to run without a real
+// Asterisk, and lets callers script events, delays and disconnects.
+package amitest
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Greeting is the banner sent to every new connection
+const Greeting = "Asterisk Call Manager/5.0.1"
+
+// Frame is a single AMI message as a set of key/value pairs
+type Frame map[string]string
+
+// Action is an action received from a client
+type Action struct {
+	Name     string
+	ActionID string
+	Fields   map[string]string
+}
+
+// HandlerFunc handles an action. It overrides the built-in behaviour for
+// that action name; a handler that does not reply leaves the client waiting,
+// which is how response timeouts are simulated.
+type HandlerFunc func(session *Session, action Action)
+
+// Config controls the behaviour of the fake server
+type Config struct {
+	// Credentials accepted by Login
+	Username string
+	Secret   string
+
+	// AnswerAfter makes a dialled extension answer automatically after the
+	// given delay. Zero leaves it ringing until Answer is called.
+	AnswerAfter time.Duration
+
+	// Logf receives debug output; nil disables logging
+	Logf func(format string, args ...interface{})
+}
+
+// Server is a fake AMI server listening on a local TCP port
+type Server struct {
+	config   Config
+	listener net.Listener
+	address  string
+
+	mutex     sync.Mutex
+	sessions  map[*Session]bool
+	handlers  map[string]HandlerFunc
+	delays    map[string]time.Duration
+	endpoints map[string]*Endpoint
+	channels  map[string]*Channel
+	actions   []Action
+	logins    int
+	refuse    bool
+	sequence  int
+
+	lockedConferences map[string]bool
+	queues            map[string]*queue
+
+	wg     sync.WaitGroup
+	closed chan struct{}
+}
+
+// Endpoint is a PJSIP endpoint known to the fake server
+type Endpoint struct {
+	Name       string
+	Registered bool
+}
+
+// Channel is a live channel in the fake server
+type Channel struct {
+	Name        string
+	Uniqueid    string
+	Linkedid    string
+	Exten       string
+	Context     string
+	CallerIDNum string
+	State       string
+	Peer        string
+	BridgeID    string
+	Consult     string // Consultation call of an attended transfer started from this channel
+	Transferee  string // On a consultation call, the channel waiting to be transferred
+	MusicClass  string // Music on hold class while MusicOnHold is playing to the channel
+	OnHold      bool   // The phone has put the call on hold
+	Conference  string // ConfBridge conference the channel is in
+	ConfAdmin   bool
+	ConfMuted   bool
+	Queue       string // app_queue queue the channel waits in, or was answered from
+	QueueMember string // On an agent's leg, the member interface rung for the queue caller
+	Variables   map[string]string
+	Created     time.Time
+	Answered    time.Time
+}
+
+// Session is a single client connection
+type Session struct {
+	server        *Server
+	conn          net.Conn
+	writeMutex    sync.Mutex
+	authenticated bool
+}
+
+// NewServer creates a server with the given configuration. Use Start to
+// begin listening.
+func NewServer(config Config) *Server {
+	if config.Username == "" {
+		config.Username = "admin"
+	}
+	if config.Secret == "" {
+		config.Secret = "amp111"
+	}
+
+	return &Server{
+		config:    config,
+		sessions:  make(map[*Session]bool),
+		handlers:  make(map[string]HandlerFunc),
+		delays:    make(map[string]time.Duration),
+		endpoints: make(map[string]*Endpoint),
+		channels:  make(map[string]*Channel),
+		closed:    make(chan struct{}),
+
+		lockedConferences: make(map[string]bool),
+		queues:            make(map[string]*queue),
+	}
+}
+
+// Start listens on the given address ("127.0.0.1:0" picks a free port)
+func (s *Server) Start(address string) error {
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	s.mutex.Lock()
+	s.listener = listener
+	s.address = listener.Addr().String()
+	s.closed = make(chan struct{})
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go s.acceptLoop(listener)
+
+	s.logf("Fake AMI listening on %s", s.address)
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.address
+}
+
+// HostPort returns the listening host and port separately, matching the
+// ASTERISK_HOST / ASTERISK_AMI_PORT configuration values
+func (s *Server) HostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	return host, port
+}
+
+// Close stops listening and drops every connection
+func (s *Server) Close() {
+	s.mutex.Lock()
+	listener := s.listener
+	s.listener = nil
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// Restart closes the server and listens again on the same address, which
+// is what a client sees when Asterisk is restarted
+func (s *Server) Restart() error {
+	address := s.Addr()
+	s.Close()
+	return s.Start(address)
+}
+
+// DropConnections forcibly closes every client connection while the
+// server keeps accepting new ones
+func (s *Server) DropConnections() {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.conn.Close()
+	}
+}
+
+// RefuseLogins makes Login fail even with valid credentials
+func (s *Server) RefuseLogins(refuse bool) {
+	s.mutex.Lock()
+	s.refuse = refuse
+	s.mutex.Unlock()
+}
+
+// Handle overrides the behaviour of an action
+func (s *Server) Handle(action string, handler HandlerFunc) {
+	s.mutex.Lock()
+	s.handlers[strings.ToLower(action)] = handler
+	s.mutex.Unlock()
+}
+
+// SetDelay delays every reply to the given action
+func (s *Server) SetDelay(action string, delay time.Duration) {
+	s.mutex.Lock()
+	s.delays[strings.ToLower(action)] = delay
+	s.mutex.Unlock()
+}
+
+// AddEndpoint configures a PJSIP endpoint, optionally with a reachable contact
+func (s *Server) AddEndpoint(name string, registered bool) {
+	s.mutex.Lock()
+	s.endpoints[name] = &Endpoint{Name: name, Registered: registered}
+	s.mutex.Unlock()
+}
+
+// SetRegistered changes the registration of an endpoint and emits the
+// matching ContactStatus event
+func (s *Server) SetRegistered(name string, registered bool) {
+	s.mutex.Lock()
+	endpoint, ok := s.endpoints[name]
+	if !ok {
+		endpoint = &Endpoint{Name: name}
+		s.endpoints[name] = endpoint
+	}
+	endpoint.Registered = registered
+	s.mutex.Unlock()
+
+	status := "Reachable"
+	if !registered {
+		status = "Removed"
+	}
+	s.Emit("ContactStatus", Frame{
+		"URI":           contactURI(name),
+		"ContactStatus": status,
+		"AOR":           name,
+		"EndpointName":  name,
+		"RoundtripUsec": "1500",
+	})
+}
+
+// Emit sends an event to every authenticated connection
+func (s *Server) Emit(event string, fields Frame) {
+	frame := Frame{"Event": event}
+	for key, value := range fields {
+		frame[key] = value
+	}
+
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		if session.authenticated {
+			sessions = append(sessions, session)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.Send(frame)
+	}
+}
+
+// Actions returns every action received so far
+func (s *Server) Actions() []Action {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	actions := make([]Action, len(s.actions))
+	copy(actions, s.actions)
+	return actions
+}
+
+// Logins returns the number of successful logins
+func (s *Server) Logins() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.logins
+}
+
+// Channels returns a snapshot of the live channels
+func (s *Server) Channels() []Channel {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	channels := make([]Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, *channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Uniqueid < channels[j].Uniqueid
+	})
+	return channels
+}
+
+// Answer answers the ringing leg dialled from the given channel (either
+// leg may be passed) and bridges the call
+func (s *Server) Answer(channel string) error {
+	s.mutex.Lock()
+	ch, ok := s.channels[channel]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("no such channel: %s", channel)
+	}
+	callee := ch
+	if ch.Peer != "" && ch.State != "Ringing" {
+		callee = s.channels[ch.Peer]
+	}
+	if callee == nil || callee.Peer == "" {
+		s.mutex.Unlock()
+		return fmt.Errorf("channel %s is not part of a call", channel)
+	}
+	caller := s.channels[callee.Peer]
+	if caller == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("channel %s has no peer", channel)
+	}
+	callee.State = "Up"
+	var queueFrames []Frame
+	if callee.QueueMember != "" {
+		queueFrames = s.queueAnswerLocked(caller, callee)
+	}
+	caller.Answered = time.Now()
+	callee.Answered = caller.Answered
+	bridgeID := fmt.Sprintf("bridge-%s", caller.Uniqueid)
+	caller.BridgeID = bridgeID
+	callee.BridgeID = bridgeID
+	callerCopy, calleeCopy := *caller, *callee
+	s.mutex.Unlock()
+
+	s.Emit("Newstate", channelFields(&calleeCopy))
+	dialEnd := channelFields(&callerCopy)
+	for key, value := range destFields(&calleeCopy) {
+		dialEnd[key] = value
+	}
+	dialEnd["DialStatus"] = "ANSWER"
+	s.Emit("DialEnd", dialEnd)
+
+	for _, ch := range []*Channel{&callerCopy, &calleeCopy} {
+		fields := channelFields(ch)
+		fields["BridgeUniqueid"] = bridgeID
+		fields["BridgeType"] = "basic"
+		fields["BridgeNumChannels"] = "2"
+		s.Emit("BridgeEnter", fields)
+	}
+	for _, frame := range queueFrames {
+		s.Emit(frame["Event"], frame)
+	}
+	return nil
+}
+
+// Hold puts a bridged channel's call on hold (held true) or takes it off
+// hold as if the phone had pressed its hold button
+func (s *Server) Hold(channel string, held bool) error {
+	s.mutex.Lock()
+	ch, ok := s.channels[channel]
+	if !ok || ch.BridgeID == "" {
+		s.mutex.Unlock()
+		return fmt.Errorf("channel %s is not in a call", channel)
+	}
+	if ch.OnHold == held {
+		s.mutex.Unlock()
+		return nil
+	}
+	ch.OnHold = held
+	chCopy := *ch
+	s.mutex.Unlock()
+
+	if held {
+		fields := channelFields(&chCopy)
+		fields["MusicClass"] = "default"
+		s.Emit("Hold", fields)
+	} else {
+		s.Emit("Unhold", channelFields(&chCopy))
+	}
+	return nil
+}
+
+// HangupChannel hangs up a channel and its peer as if a phone had hung up
+func (s *Server) HangupChannel(channel string, cause int) error {
+	s.mutex.Lock()
+	ch, ok := s.channels[channel]
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("no such channel: %s", channel)
+	}
+	queueFrames := s.queueHangupLocked(ch)
+	legs := []Channel{*ch}
+	delete(s.channels, channel)
+
+	var transferred []Channel
+	switch {
+	case ch.Transferee != "":
+		// Consultation call hung up: the transferer is back with the transferee
+		if transferer, ok := s.channels[ch.Peer]; ok {
+			transferer.Consult = ""
+		}
+	case ch.Consult != "" && s.channels[ch.Consult] != nil && s.channels[ch.Consult].State == "Up":
+		// Transferer hung up after the target answered: complete the transfer
+		target := s.channels[ch.Consult]
+		target.Transferee = ""
+		target.Peer = ""
+		if transferee, ok := s.channels[ch.Peer]; ok {
+			transferee.Peer = target.Name
+			target.Peer = transferee.Name
+			transferee.BridgeID = target.BridgeID
+			transferred = append(transferred, *transferee, *target)
+		}
+	default:
+		if consult, ok := s.channels[ch.Consult]; ok {
+			legs = append(legs, *consult)
+			delete(s.channels, ch.Consult)
+		}
+		if peer, ok := s.channels[ch.Peer]; ok {
+			legs = append(legs, *peer)
+			delete(s.channels, ch.Peer)
+		}
+	}
+	s.mutex.Unlock()
+
+	if len(transferred) == 2 {
+		fields := channelFields(&transferred[0])
+		fields["Result"] = "Success"
+		fields["DestType"] = "Bridge"
+		fields["TransfereeChannel"] = transferred[0].Name
+		fields["TransferTargetChannel"] = transferred[1].Name
+		s.Emit("AttendedTransfer", fields)
+		enter := channelFields(&transferred[0])
+		enter["BridgeUniqueid"] = transferred[0].BridgeID
+		s.Emit("BridgeEnter", enter)
+	}
+
+	for _, leg := range legs {
+		if leg.BridgeID != "" {
+			fields := channelFields(&leg)
+			fields["BridgeUniqueid"] = leg.BridgeID
+			s.Emit("BridgeLeave", fields)
+		}
+	}
+	for _, leg := range legs {
+		if leg.Conference != "" {
+			s.leaveConference(leg)
+		}
+	}
+	for _, frame := range queueFrames {
+		s.Emit(frame["Event"], frame)
+	}
+	for _, leg := range legs {
+		fields := channelFields(&leg)
+		fields["Cause"] = fmt.Sprintf("%d", cause)
+		fields["Cause-txt"] = causeText(cause)
+		s.Emit("Hangup", fields)
+		s.Emit("CEL", celFields(&leg, "HANGUP", fmt.Sprintf(`{"hangupcause":%d,"hangupsource":"%s","dialstatus":""}`, cause, ch.Name)))
+	}
+
+	// cdr_manager posts a record for each pairing of parties once it ends,
+	// from the point of view of the party that placed the call
+	var caller *Channel
+	for i := range legs {
+		if legs[i].Uniqueid == legs[i].Linkedid || len(legs) > 1 {
+			if caller == nil || legs[i].Created.Before(caller.Created) {
+				caller = &legs[i]
+			}
+		}
+	}
+	if caller != nil {
+		var callee *Channel
+		for i := range legs {
+			if legs[i].Name == caller.Peer {
+				callee = &legs[i]
+			}
+		}
+		s.Emit("Cdr", cdrFields(caller, callee, cause))
+	}
+
+	// cel_manager's LINKEDID_END follows once no channel of the call is left
+	s.mutex.Lock()
+	remaining := false
+	for _, live := range s.channels {
+		if live.Linkedid == ch.Linkedid {
+			remaining = true
+		}
+	}
+	s.mutex.Unlock()
+	if !remaining {
+		s.Emit("CEL", celFields(ch, "LINKEDID_END", ""))
+	}
+
+	// A member freed by the hangup can take the next caller
+	if ch.Queue != "" {
+		s.distributeQueue(ch.Queue)
+	}
+	return nil
+}
+
+// acceptLoop accepts connections until the listener is closed
+func (s *Server) acceptLoop(listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		session := &Session{server: s, conn: conn}
+		s.mutex.Lock()
+		s.sessions[session] = true
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go session.serve()
+	}
+}
+
+// serve reads actions from one connection
+func (session *Session) serve() {
+	s := session.server
+	defer func() {
+		session.conn.Close()
+		s.mutex.Lock()
+		delete(s.sessions, session)
+		s.mutex.Unlock()
+		s.wg.Done()
+	}()
+
+	session.writeRaw(Greeting + "\r\n")
+
+	reader := bufio.NewReader(session.conn)
+	for {
+		fields, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+
+		action := Action{
+			Name:     fields["Action"],
+			ActionID: fields["ActionID"],
+			Fields:   fields,
+		}
+		if action.Name == "" {
+			continue
+		}
+
+		s.mutex.Lock()
+		s.actions = append(s.actions, action)
+		handler := s.handlers[strings.ToLower(action.Name)]
+		delay := s.delays[strings.ToLower(action.Name)]
+		s.mutex.Unlock()
+
+		s.logf("Fake AMI received %s (ActionID %s)", action.Name, action.ActionID)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-s.closed:
+				return
+			}
+		}
+
+		if !session.authenticated && !strings.EqualFold(action.Name, "Login") {
+			session.Reply(action, Frame{"Response": "Error", "Message": "Permission denied"})
+			continue
+		}
+
+		if handler != nil {
+			handler(session, action)
+			continue
+		}
+
+		s.handleBuiltin(session, action)
+	}
+}
+
+// Reply sends a response frame carrying the action's ActionID
+func (session *Session) Reply(action Action, fields Frame) {
+	frame := Frame{}
+	for key, value := range fields {
+		frame[key] = value
+	}
+	if action.ActionID != "" {
+		frame["ActionID"] = action.ActionID
+	}
+	session.Send(frame)
+}
+
+// ReplyList sends the response, entry events and completion event of a list action
+func (session *Session) ReplyList(action Action, message string, entries []Frame, completeEvent string) {
+	session.Reply(action, Frame{"Response": "Success", "EventList": "start", "Message": message})
+	for _, entry := range entries {
+		session.Reply(action, entry)
+	}
+	session.Reply(action, Frame{
+		"Event":     completeEvent,
+		"EventList": "Complete",
+		"ListItems": fmt.Sprintf("%d", len(entries)),
+	})
+}
+
+// Send writes a frame to the connection
+func (session *Session) Send(frame Frame) {
+	var b strings.Builder
+
+	// Response/Event first and ActionID second, as Asterisk does
+	for _, key := range []string{"Response", "Event", "ActionID"} {
+		if value, ok := frame[key]; ok {
+			b.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+
+	keys := make([]string, 0, len(frame))
+	for key := range frame {
+		if key != "Response" && key != "Event" && key != "ActionID" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString(key + ": " + frame[key] + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	session.writeRaw(b.String())
+}
+
+// Close drops this connection
+func (session *Session) Close() {
+	session.conn.Close()
+}
+
+func (session *Session) writeRaw(data string) {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	session.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	session.conn.Write([]byte(data))
+}
+
+// readFrame reads one blank-line terminated frame
+func readFrame(reader *bufio.Reader) (map[string]string, error) {
+	fields := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if len(fields) == 0 {
+				continue
+			}
+			return fields, nil
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.config.Logf != nil {
+		s.config.Logf(format, args...)
+	}
+}
+
+// StdLogf can be used as Config.Logf to log through the standard logger
+func StdLogf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
@@ -1,13 +1,22 @@
 package asterisk
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
 )
 
-// InitiateCall initiates a call between two extensions
-func InitiateCall(fromExtension, toExtension string) (string, error) {
+// NewCallID generates the ID of a call placed through the API. It is passed
+// to Asterisk as the Uniqueid of the originated channel, so it becomes the
+// Linkedid of every leg and AMI events can be matched back to the call.
+func NewCallID() string {
+	return fmt.Sprintf("call-%d", time.Now().UnixNano())
+}
+
+// InitiateCall initiates a call between two extensions and returns the
+// channel that was originated
+func InitiateCall(fromExtension, toExtension, callID string) (string, error) {
 	log.Printf("[AMI] Initiating call from %s to %s", fromExtension, toExtension)
 
 	client := GetAMIClient()
@@ -16,9 +25,6 @@ func InitiateCall(fromExtension, toExtension string) (string, error) {
 		return "", fmt.Errorf("AMI client not available")
 	}
 
-	// Generate unique call ID
-	callID := fmt.Sprintf("call-%d", time.Now().Unix())
-
 	// Create the channel name for the caller
 	callerChannel := fmt.Sprintf("PJSIP/%s", fromExtension)
 
@@ -26,14 +32,15 @@ func InitiateCall(fromExtension, toExtension string) (string, error) {
 
 	// Originate the call
 	fields := map[string]string{
-		"Channel":  callerChannel,
-		"Context":  "default",
-		"Exten":    toExtension,
-		"Priority": "1",
-		"CallerID": fromExtension,
-		"Timeout":  "30000", // 30 seconds
-		"Variable": fmt.Sprintf("CALL_ID=%s", callID),
-		"Async":    "true", // Make it asynchronous to avoid blocking
+		"Channel":   callerChannel,
+		"Context":   "default",
+		"Exten":     toExtension,
+		"Priority":  "1",
+		"CallerID":  fromExtension,
+		"Timeout":   "30000", // 30 seconds
+		"Variable":  fmt.Sprintf("CALL_ID=%s", callID),
+		"ChannelId": callID,
+		"Async":     "true", // Make it asynchronous to avoid blocking
 	}
 
 	log.Printf("[AMI] Sending Originate command with fields: %+v", fields)
@@ -116,91 +123,86 @@ func GetChannelStatus(channel string) (map[string]string, error) {
 		"Channel": channel,
 	}
 
-	response, err := client.SendCommand("Status", fields)
+	response, events, err := client.SendListCommand("Status", fields)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get channel status: %v", err)
 	}
 
-	return response.Fields, nil
-}
+	if !response.Success {
+		return nil, fmt.Errorf("channel status failed: %s", response.Error)
+	}
 
-// ListChannels lists all active channels
-func ListChannels() ([]map[string]string, error) {
-	client := GetAMIClient()
-	if client == nil {
-		return nil, fmt.Errorf("AMI client not available")
+	for _, event := range events {
+		if event.Type == "Status" {
+			return event.Fields, nil
+		}
 	}
 
-	response, err := client.SendCommand("CoreShowChannels", map[string]string{})
+	return nil, fmt.Errorf("channel %s not found", channel)
+}
+
+// ListChannels lists all active channels
+func ListChannels() ([]Channel, error) {
+	events, err := listAction("CoreShowChannels", nil, "CoreShowChannel")
 	if err != nil {
 		return nil, fmt.Errorf("failed to list channels: %v", err)
 	}
 
-	// This is a simplified version - in reality, you'd need to parse multiple responses
-	var channels []map[string]string
-	if response.Success {
-		channels = append(channels, response.Fields)
+	channels := make([]Channel, 0, len(events))
+	for _, event := range events {
+		f := event.Fields
+		channels = append(channels, Channel{
+			Channel:          f["Channel"],
+			Uniqueid:         f["Uniqueid"],
+			Linkedid:         f["Linkedid"],
+			ChannelState:     f["ChannelState"],
+			ChannelStateDesc: f["ChannelStateDesc"],
+			CallerIDNum:      f["CallerIDNum"],
+			CallerIDName:     f["CallerIDName"],
+			ConnectedLineNum: f["ConnectedLineNum"],
+			Context:          f["Context"],
+			Exten:            f["Exten"],
+			Application:      f["Application"],
+			ApplicationData:  f["ApplicationData"],
+			Duration:         f["Duration"],
+			BridgeID:         f["BridgeId"],
+		})
 	}
 
 	return channels, nil
 }
 
-// GetSIPPeers gets the list of SIP peers (extensions)
-func GetSIPPeers() ([]map[string]string, error) {
-	client := GetAMIClient()
-	if client == nil {
-		return nil, fmt.Errorf("AMI client not available")
-	}
-
-	response, err := client.SendCommand("SIPpeers", map[string]string{})
+// GetSIPPeers gets the list of SIP peers (extensions). The system runs on
+// PJSIP, so peers are the configured PJSIP endpoints.
+func GetSIPPeers() ([]Endpoint, error) {
+	peers, err := ListEndpoints()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get SIP peers: %v", err)
 	}
 
-	// This is a simplified version - in reality, you'd need to parse multiple responses
-	var peers []map[string]string
-	if response.Success {
-		peers = append(peers, response.Fields)
-	}
-
 	return peers, nil
 }
 
 // GetExtensionStatus checks if an extension is registered and available
 func GetExtensionStatus(extension string) (string, error) {
-	client := GetAMIClient()
-	if client == nil {
+	if GetAMIClient() == nil {
 		return "unknown", fmt.Errorf("AMI client not available")
 	}
 
-	// For PJSIP, we need to use different commands
-	// First check if endpoint exists
-	endpointFields := map[string]string{
-		"Endpoint": extension,
+	// PJSIPShowEndpoint returns the endpoint together with the status of
+	// every contact registered against its AORs
+	detail, err := GetEndpointDetail(extension)
+	if errors.Is(err, ErrEndpointNotFound) {
+		return "not_configured", err
 	}
-
-	endpointResponse, err := client.SendCommand("PJSIPShowEndpoint", endpointFields)
 	if err != nil {
-		return "unknown", fmt.Errorf("failed to check endpoint: %v", err)
+		return "unknown", err
 	}
 
-	if !endpointResponse.Success {
-		return "not_configured", fmt.Errorf("endpoint %s not configured in Asterisk", extension)
-	}
-
-	// Check if endpoint has any contacts (is registered)
-	contactFields := map[string]string{
-		"Contact": fmt.Sprintf("%s/sip:%s@", extension, extension),
-	}
-
-	contactResponse, err := client.SendCommand("PJSIPShowContacts", contactFields)
-	if err != nil {
-		// If we can't get contacts, endpoint exists but may not be registered
-		return "configured_not_registered", nil
-	}
-
-	if contactResponse.Success {
-		return "registered", nil
+	for _, contact := range detail.Contacts {
+		if contact.IsReachable() {
+			return "registered", nil
+		}
 	}
 
 	return "configured_not_registered", nil
@@ -208,47 +210,38 @@ func GetExtensionStatus(extension string) (string, error) {
 
 // GetDetailedEndpointStatus provides comprehensive endpoint diagnostics
 func GetDetailedEndpointStatus(extension string) (map[string]interface{}, error) {
-	client := GetAMIClient()
-	if client == nil {
+	if GetAMIClient() == nil {
 		return nil, fmt.Errorf("AMI client not available")
 	}
 
 	result := map[string]interface{}{
 		"extension":           extension,
 		"endpoint_configured": false,
-		"contacts":            []map[string]string{},
+		"registered":          false,
+		"contacts":            []Contact{},
 		"endpoint_details":    map[string]string{},
 		"errors":              []string{},
 	}
 
-	// Check if endpoint is configured
-	endpointFields := map[string]string{
-		"Endpoint": extension,
-	}
-
-	endpointResponse, err := client.SendCommand("PJSIPShowEndpoint", endpointFields)
+	detail, err := GetEndpointDetail(extension)
 	if err != nil {
 		result["errors"] = append(result["errors"].([]string), fmt.Sprintf("Failed to check endpoint: %v", err))
 		return result, nil
 	}
 
-	if endpointResponse.Success {
-		result["endpoint_configured"] = true
-		result["endpoint_details"] = endpointResponse.Fields
-	} else {
-		result["errors"] = append(result["errors"].([]string), "Endpoint not configured in Asterisk")
-		return result, nil
+	result["endpoint_configured"] = true
+	result["endpoint_details"] = detail.Fields
+	result["contacts"] = detail.Contacts
+
+	for _, contact := range detail.Contacts {
+		if contact.IsReachable() {
+			result["registered"] = true
+			break
+		}
 	}
 
-	// Get contacts for this endpoint
-	contactResponse, err := client.SendCommand("PJSIPShowContacts", map[string]string{})
-	if err != nil {
-		result["errors"] = append(result["errors"].([]string), fmt.Sprintf("Failed to get contacts: %v", err))
-	} else if contactResponse.Success {
-		// Note: In a real implementation, you'd parse multiple contact responses
-		// For now, we'll just include the response fields
-		contacts := []map[string]string{contactResponse.Fields}
-		result["contacts"] = contacts
+	if len(detail.Contacts) == 0 {
+		result["errors"] = append(result["errors"].([]string), "Endpoint has no registered contacts")
 	}
 
 	return result, nil
@@ -281,6 +274,62 @@ func TransferCall(channel, extension string) error {
 	return nil
 }
 
+// BlindTransfer transfers the party bridged with the transferer's channel to
+// another extension. The transferer's channel is hung up.
+func BlindTransfer(channel, extension string) error {
+	client := GetAMIClient()
+	if client == nil {
+		return fmt.Errorf("AMI client not available")
+	}
+
+	fields := map[string]string{
+		"Channel": channel,
+		"Exten":   extension,
+		"Context": "default",
+	}
+
+	response, err := client.SendCommand("BlindTransfer", fields)
+	if err != nil {
+		return fmt.Errorf("failed to transfer call: %v", err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("transfer failed: %s", response.Error)
+	}
+
+	log.Printf("Call on channel %s blind transferred to extension %s", channel, extension)
+	return nil
+}
+
+// AttendedTransfer starts an attended transfer: the transferer's channel is
+// connected to the target extension for a consultation while the party it was
+// talking to waits. Hanging up the transferer completes the transfer; hanging
+// up the consultation channel abandons it.
+func AttendedTransfer(channel, extension string) error {
+	client := GetAMIClient()
+	if client == nil {
+		return fmt.Errorf("AMI client not available")
+	}
+
+	fields := map[string]string{
+		"Channel": channel,
+		"Exten":   extension,
+		"Context": "default",
+	}
+
+	response, err := client.SendCommand("Atxfer", fields)
+	if err != nil {
+		return fmt.Errorf("failed to start attended transfer: %v", err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("attended transfer failed: %s", response.Error)
+	}
+
+	log.Printf("Attended transfer started on channel %s to extension %s", channel, extension)
+	return nil
+}
+
 // HoldCall puts a call on hold
 func HoldCall(channel string) error {
 	client := GetAMIClient()
@@ -329,3 +378,51 @@ func UnholdCall(channel string) error {
 	log.Printf("Call removed from hold: %s", channel)
 	return nil
 }
+
+// Ways a supervisor can monitor a call
+const (
+	MonitorListen  = "listen"  // Hear both parties, unheard
+	MonitorWhisper = "whisper" // Also speak to the spied party only
+	MonitorBarge   = "barge"   // Speak to both parties
+)
+
+// SpyOnCall calls a supervisor's extension and, once answered, connects it
+// to a channel with ChanSpy in the given monitor mode
+func SpyOnCall(extension, channel, mode string) (string, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return "", fmt.Errorf("AMI client not available")
+	}
+
+	// q: no beep or channel name announcement; E: stop when the spied
+	// channel hangs up
+	options := "qE"
+	switch mode {
+	case MonitorWhisper:
+		options += "w"
+	case MonitorBarge:
+		options += "B"
+	}
+
+	supervisorChannel := fmt.Sprintf("PJSIP/%s", extension)
+	fields := map[string]string{
+		"Channel":     supervisorChannel,
+		"Application": "ChanSpy",
+		"Data":        fmt.Sprintf("%s,%s", channel, options),
+		"CallerID":    fmt.Sprintf("Monitor <%s>", ExtensionFromChannel(channel)),
+		"Timeout":     "30000",
+		"Async":       "true",
+	}
+
+	response, err := client.SendCommand("Originate", fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to monitor call: %v", err)
+	}
+
+	if !response.Success {
+		return "", fmt.Errorf("monitor failed: %s", response.Error)
+	}
+
+	log.Printf("Extension %s monitoring channel %s (%s)", extension, channel, mode)
+	return supervisorChannel, nil
+}
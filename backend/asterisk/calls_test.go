@@ -0,0 +1,139 @@
+package asterisk
+
+import (
+	"testing"
+	"time"
+	"voip-backend/asterisk/amitest"
+)
+
+func TestCallLifecycle(t *testing.T) {
+	connectGlobalClient(t)
+	fakeAMI.AddEndpoint("2001", true)
+	fakeAMI.AddEndpoint("2002", true)
+
+	callID := NewCallID()
+	channel, err := InitiateCall("2001", "2002", callID)
+	if err != nil {
+		t.Fatalf("InitiateCall: %v", err)
+	}
+	if channel != "PJSIP/2001" {
+		t.Errorf("channel = %s, want PJSIP/2001", channel)
+	}
+
+	// The callee answers after the fake server's AnswerAfter
+	var channels []Channel
+	waitFor(t, 2*time.Second, "both legs up", func() bool {
+		channels, err = ListChannels()
+		if err != nil || len(channels) != 2 {
+			return false
+		}
+		for _, ch := range channels {
+			if ch.ChannelStateDesc != "Up" {
+				return false
+			}
+		}
+		return true
+	})
+	for _, ch := range channels {
+		if ch.Linkedid != callID {
+			t.Errorf("%s linkedid = %s, want the call ID %s", ch.Channel, ch.Linkedid, callID)
+		}
+	}
+
+	if err := HangupCall(channels[0].Channel); err != nil {
+		t.Fatalf("HangupCall: %v", err)
+	}
+	waitFor(t, 2*time.Second, "every leg hung up", func() bool {
+		channels, err = ListChannels()
+		return err == nil && len(channels) == 0
+	})
+}
+
+func TestHangupUnknownChannel(t *testing.T) {
+	connectGlobalClient(t)
+
+	if err := HangupCall("PJSIP/9999-00000001"); err == nil {
+		t.Error("HangupCall of an unknown channel succeeded")
+	}
+}
+
+func TestGetExtensionStatus(t *testing.T) {
+	connectGlobalClient(t)
+	fakeAMI.AddEndpoint("3001", true)
+	fakeAMI.AddEndpoint("3002", false)
+
+	tests := []struct {
+		extension string
+		want      string
+	}{
+		{"3001", "registered"},
+		{"3002", "configured_not_registered"},
+		{"3999", "not_configured"},
+	}
+	for _, tt := range tests {
+		status, _ := GetExtensionStatus(tt.extension)
+		if status != tt.want {
+			t.Errorf("GetExtensionStatus(%s) = %s, want %s", tt.extension, status, tt.want)
+		}
+	}
+}
+
+func TestGetExtensionStatusUnknownOnTransportError(t *testing.T) {
+	connectGlobalClient(t)
+	fakeAMI.AddEndpoint("3001", true)
+
+	// A lookup that times out says nothing about the endpoint
+	fakeAMI.Handle("PJSIPShowEndpoint", func(session *amitest.Session, action amitest.Action) {})
+	defer fakeAMI.Handle("PJSIPShowEndpoint", nil)
+
+	status, err := GetExtensionStatus("3001")
+	if err == nil {
+		t.Fatal("GetExtensionStatus succeeded without an answer")
+	}
+	if status != "unknown" {
+		t.Errorf("GetExtensionStatus = %s, want unknown", status)
+	}
+}
+
+func TestGetExtensionStatusUnknownOnDroppedConnection(t *testing.T) {
+	connectGlobalClient(t)
+	fakeAMI.AddEndpoint("3001", true)
+
+	// The connection drops while the lookup waits for its answer
+	fakeAMI.Handle("PJSIPShowEndpoint", func(session *amitest.Session, action amitest.Action) {
+		go fakeAMI.DropConnections()
+	})
+	defer fakeAMI.Handle("PJSIPShowEndpoint", nil)
+
+	status, err := GetExtensionStatus("3001")
+	if err == nil {
+		t.Fatal("GetExtensionStatus succeeded on a dropped connection")
+	}
+	if status != "unknown" {
+		t.Errorf("GetExtensionStatus = %s, want unknown", status)
+	}
+
+	// Let the client reconnect before the next test
+	waitFor(t, 2*time.Second, "reconnection", func() bool {
+		client := currentClient()
+		return client != nil && client.IsConnected()
+	})
+}
+
+func TestGetExtensionStatusUnknownOnOtherErrors(t *testing.T) {
+	connectGlobalClient(t)
+
+	// Only a missing endpoint means the extension is not configured
+	fakeAMI.Handle("PJSIPShowEndpoint", func(session *amitest.Session, action amitest.Action) {
+		session.Reply(action, amitest.Frame{"Response": "Error", "Message": "Permission denied"})
+	})
+	defer fakeAMI.Handle("PJSIPShowEndpoint", nil)
+
+	status, err := GetExtensionStatus("3001")
+	if err == nil {
+		t.Fatal("GetExtensionStatus succeeded with permission denied")
+	}
+	if status != "unknown" {
+		t.Errorf("GetExtensionStatus = %s, want unknown", status)
+	}
+}
@@ -0,0 +1,359 @@
+package asterisk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AMI events carrying call detail records (cdr_manager) and channel event
+// logging (cel_manager)
+const (
+	EventCdr = "Cdr"
+	EventCEL = "CEL"
+)
+
+// CDR dispositions as reported by Asterisk
+const (
+	DispositionAnswered = "ANSWERED"
+	DispositionNoAnswer = "NO ANSWER"
+	DispositionBusy     = "BUSY"
+	DispositionFailed   = "FAILED"
+)
+
+// cdrTimeLayout is the timestamp format used by cdr_manager, cdr_csv and cel_manager
+const cdrTimeLayout = "2006-01-02 15:04:05"
+
+// CDR is a call detail record. Duration runs from StartTime to EndTime and
+// includes ring time; Billsec only counts the time after the call was answered.
+type CDR struct {
+	AccountCode        string     `json:"account_code"`
+	Source             string     `json:"source"`
+	Destination        string     `json:"destination"`
+	DestinationContext string     `json:"destination_context"`
+	CallerID           string     `json:"caller_id"`
+	Channel            string     `json:"channel"`
+	DestinationChannel string     `json:"destination_channel"`
+	LastApplication    string     `json:"last_application"`
+	LastData           string     `json:"last_data"`
+	StartTime          time.Time  `json:"start_time"`
+	AnswerTime         *time.Time `json:"answer_time"`
+	EndTime            time.Time  `json:"end_time"`
+	Duration           int        `json:"duration"`
+	Billsec            int        `json:"billsec"`
+	Disposition        string     `json:"disposition"`
+	Uniqueid           string     `json:"uniqueid"`
+	Linkedid           string     `json:"linkedid"` // Only present when cdr_manager/cdr_custom is configured to log it
+	UserField          string     `json:"user_field"`
+}
+
+// CallID returns the ID used to match the record to a call: the Linkedid
+// when logged, otherwise the Uniqueid of the originating channel, which
+// Asterisk also uses as the Linkedid of the call
+func (c CDR) CallID() string {
+	if c.Linkedid != "" {
+		return c.Linkedid
+	}
+	return c.Uniqueid
+}
+
+// CEL is a channel event logging record
+type CEL struct {
+	EventName    string    `json:"event_name"` // CHAN_START, ANSWER, HANGUP, LINKEDID_END, ...
+	EventTime    time.Time `json:"event_time"`
+	CallerIDNum  string    `json:"caller_id_num"`
+	Exten        string    `json:"exten"`
+	Context      string    `json:"context"`
+	Channel      string    `json:"channel"`
+	Application  string    `json:"application"`
+	Uniqueid     string    `json:"uniqueid"`
+	Linkedid     string    `json:"linkedid"`
+	Peer         string    `json:"peer"`
+	HangupCause  int       `json:"hangup_cause"`
+	HangupSource string    `json:"hangup_source"`
+	DialStatus   string    `json:"dial_status"`
+}
+
+// ParseCDREvent converts a Cdr AMI event into a CDR
+func ParseCDREvent(event AMIEvent) (CDR, error) {
+	f := event.Fields
+	return buildCDR(map[string]string{
+		"accountcode": f["AccountCode"],
+		"src":         f["Source"],
+		"dst":         f["Destination"],
+		"dcontext":    f["DestinationContext"],
+		"clid":        f["CallerID"],
+		"channel":     f["Channel"],
+		"dstchannel":  f["DestinationChannel"],
+		"lastapp":     f["LastApplication"],
+		"lastdata":    f["LastData"],
+		"start":       f["StartTime"],
+		"answer":      f["AnswerTime"],
+		"end":         f["EndTime"],
+		"duration":    f["Duration"],
+		"billsec":     f["BillableSeconds"],
+		"disposition": f["Disposition"],
+		"uniqueid":    f["UniqueID"],
+		"linkedid":    firstNonEmpty(f["LinkedID"], f["Linkedid"]),
+		"userfield":   f["UserField"],
+	})
+}
+
+// ParseCELEvent converts a CEL AMI event into a CEL record
+func ParseCELEvent(event AMIEvent) (CEL, error) {
+	f := event.Fields
+
+	record := CEL{
+		EventName:   f["EventName"],
+		CallerIDNum: f["CallerIDnum"],
+		Exten:       f["Exten"],
+		Context:     f["Context"],
+		Channel:     f["Channel"],
+		Application: f["Application"],
+		Uniqueid:    f["UniqueID"],
+		Linkedid:    f["LinkedID"],
+		Peer:        f["Peer"],
+	}
+	if record.EventName == "" {
+		return record, fmt.Errorf("CEL event without EventName")
+	}
+
+	eventTime, err := parseCDRTime(f["EventTime"])
+	if err != nil {
+		return record, fmt.Errorf("invalid CEL EventTime: %v", err)
+	}
+	if eventTime != nil {
+		record.EventTime = *eventTime
+	}
+
+	// HANGUP carries the cause as JSON in Extra, e.g.
+	// {"hangupcause":16,"hangupsource":"PJSIP/1001-00000001","dialstatus":"ANSWER"}
+	if extra := f["Extra"]; extra != "" && strings.HasPrefix(strings.TrimSpace(extra), "{") {
+		var details struct {
+			HangupCause  int    `json:"hangupcause"`
+			HangupSource string `json:"hangupsource"`
+			DialStatus   string `json:"dialstatus"`
+		}
+		if err := json.Unmarshal([]byte(extra), &details); err == nil {
+			record.HangupCause = details.HangupCause
+			record.HangupSource = details.HangupSource
+			record.DialStatus = details.DialStatus
+		}
+	}
+
+	return record, nil
+}
+
+// cdrCSVColumns is the column order written by cdr_csv (Master.csv) with
+// loguniqueid and loguserfield enabled
+var cdrCSVColumns = []string{
+	"accountcode", "src", "dst", "dcontext", "clid", "channel", "dstchannel",
+	"lastapp", "lastdata", "start", "answer", "end", "duration", "billsec",
+	"disposition", "amaflags", "uniqueid", "userfield",
+}
+
+// ReadCDRCSV reads CDRs from a cdr_csv Master.csv file. Files written by
+// cdr_custom may start with a header row naming the columns (using the
+// cdr_csv names above plus "linkedid"), in which case it is used instead of
+// the default column order.
+func ReadCDRCSV(reader io.Reader) ([]CDR, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+
+	columns := cdrCSVColumns
+	var records []CDR
+
+	for line := 1; ; line++ {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if line == 1 && isCDRHeader(row) {
+			columns = make([]string, len(row))
+			for i, name := range row {
+				columns[i] = strings.ToLower(strings.TrimSpace(name))
+			}
+			continue
+		}
+
+		values := make(map[string]string, len(columns))
+		for i, name := range columns {
+			if i < len(row) {
+				values[name] = row[i]
+			}
+		}
+
+		record, err := buildCDR(values)
+		if err != nil {
+			return records, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// NormalizeDisposition maps the dispositions of older Asterisk versions onto
+// the four reported today
+func NormalizeDisposition(disposition string) string {
+	switch strings.ToUpper(strings.TrimSpace(disposition)) {
+	case DispositionAnswered:
+		return DispositionAnswered
+	case DispositionNoAnswer, "NOANSWER", "CANCEL":
+		return DispositionNoAnswer
+	case DispositionBusy:
+		return DispositionBusy
+	case "":
+		return ""
+	default:
+		// FAILED, CONGESTION, CHANUNAVAIL
+		return DispositionFailed
+	}
+}
+
+// DispositionFromDialStatus maps a Dial() DialStatus onto a CDR disposition
+func DispositionFromDialStatus(dialStatus string) string {
+	if strings.EqualFold(dialStatus, "ANSWER") {
+		return DispositionAnswered
+	}
+	return NormalizeDisposition(dialStatus)
+}
+
+// hangupCauses describes the Q.850 causes commonly seen on PJSIP calls
+var hangupCauses = map[int]string{
+	1:   "Unallocated number",
+	3:   "No route to destination",
+	16:  "Normal Clearing",
+	17:  "User busy",
+	18:  "No user responding",
+	19:  "No answer",
+	20:  "Subscriber absent",
+	21:  "Call Rejected",
+	26:  "Answered elsewhere",
+	27:  "Destination out of order",
+	31:  "Normal, unspecified",
+	34:  "Circuit/channel congestion",
+	38:  "Network out of order",
+	41:  "Temporary failure",
+	42:  "Switching equipment congestion",
+	58:  "Bearer capability not available",
+	127: "Interworking, unspecified",
+}
+
+// HangupCauseText returns the description of a Q.850 hangup cause
+func HangupCauseText(cause int) string {
+	if text, ok := hangupCauses[cause]; ok {
+		return text
+	}
+	return "Unknown"
+}
+
+// buildCDR converts named cdr_csv columns into a CDR
+func buildCDR(values map[string]string) (CDR, error) {
+	record := CDR{
+		AccountCode:        values["accountcode"],
+		Source:             values["src"],
+		Destination:        values["dst"],
+		DestinationContext: values["dcontext"],
+		CallerID:           values["clid"],
+		Channel:            values["channel"],
+		DestinationChannel: values["dstchannel"],
+		LastApplication:    values["lastapp"],
+		LastData:           values["lastdata"],
+		Disposition:        NormalizeDisposition(values["disposition"]),
+		Uniqueid:           values["uniqueid"],
+		Linkedid:           values["linkedid"],
+		UserField:          values["userfield"],
+	}
+
+	start, err := parseCDRTime(values["start"])
+	if err != nil {
+		return record, fmt.Errorf("invalid start time: %v", err)
+	}
+	if start == nil {
+		return record, fmt.Errorf("missing start time")
+	}
+	record.StartTime = *start
+
+	if record.AnswerTime, err = parseCDRTime(values["answer"]); err != nil {
+		return record, fmt.Errorf("invalid answer time: %v", err)
+	}
+
+	end, err := parseCDRTime(values["end"])
+	if err != nil {
+		return record, fmt.Errorf("invalid end time: %v", err)
+	}
+	if end != nil {
+		record.EndTime = *end
+	}
+
+	if record.Duration, err = parseSeconds(values["duration"]); err != nil {
+		return record, fmt.Errorf("invalid duration: %v", err)
+	}
+	if record.Billsec, err = parseSeconds(values["billsec"]); err != nil {
+		return record, fmt.Errorf("invalid billsec: %v", err)
+	}
+
+	return record, nil
+}
+
+// parseCDRTime parses an Asterisk CDR/CEL timestamp in local time. Empty
+// values (e.g. the answer time of an unanswered call) return nil.
+func parseCDRTime(value string) (*time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	// cel_manager can be configured to log microseconds
+	for _, layout := range []string{cdrTimeLayout, cdrTimeLayout + ".000000", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return &t, nil
+		}
+	}
+
+	// Some configurations log seconds since the epoch
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		t := time.Unix(0, int64(seconds*float64(time.Second)))
+		return &t, nil
+	}
+
+	return nil, fmt.Errorf("unrecognised timestamp %q", value)
+}
+
+// parseSeconds parses a whole number of seconds, treating empty as zero
+func parseSeconds(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// isCDRHeader reports whether a CSV row names columns rather than holding data
+func isCDRHeader(row []string) bool {
+	for _, value := range row {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "uniqueid", "src", "billsec", "disposition":
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package asterisk
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AMI events raised by app_confbridge
+const (
+	EventConfbridgeStart  = "ConfbridgeStart"
+	EventConfbridgeEnd    = "ConfbridgeEnd"
+	EventConfbridgeJoin   = "ConfbridgeJoin"
+	EventConfbridgeLeave  = "ConfbridgeLeave"
+	EventConfbridgeMute   = "ConfbridgeMute"
+	EventConfbridgeUnmute = "ConfbridgeUnmute"
+	EventConfbridgeLock   = "ConfbridgeLock"
+	EventConfbridgeUnlock = "ConfbridgeUnlock"
+)
+
+// ConferenceParticipant is a channel in a ConfBridge conference, from a
+// ConfbridgeJoin event or a ConfbridgeList listing
+type ConferenceParticipant struct {
+	Conference   string    `json:"conference"`
+	Channel      string    `json:"channel"`
+	Uniqueid     string    `json:"uniqueid"`
+	CallerIDNum  string    `json:"caller_id_num"`
+	CallerIDName string    `json:"caller_id_name"`
+	Extension    string    `json:"extension"`
+	Admin        bool      `json:"admin"`
+	Muted        bool      `json:"muted"`
+	JoinedAt     time.Time `json:"joined_at"`
+}
+
+// ConferenceRoomStatus is one entry of a ConfbridgeListRooms listing
+type ConferenceRoomStatus struct {
+	Conference string `json:"conference"`
+	Parties    int    `json:"parties"`
+	Marked     int    `json:"marked"`
+	Locked     bool   `json:"locked"`
+	Muted      bool   `json:"muted"`
+}
+
+// ConferenceDialOptions configure the channel dialled into a conference
+type ConferenceDialOptions struct {
+	Admin           bool // Join as a moderator (CONFBRIDGE(user,admin))
+	MaxParticipants int  // Limit the conference size (CONFBRIDGE(bridge,max_members)), 0 for no limit
+}
+
+// ParseConferenceParticipant converts a ConfbridgeJoin or ConfbridgeList
+// event into a participant
+func ParseConferenceParticipant(event AMIEvent) ConferenceParticipant {
+	f := event.Fields
+	participant := ConferenceParticipant{
+		Conference:   f["Conference"],
+		Channel:      f["Channel"],
+		Uniqueid:     f["Uniqueid"],
+		CallerIDNum:  f["CallerIDNum"],
+		CallerIDName: f["CallerIDName"],
+		Extension:    ExtensionFromChannel(f["Channel"]),
+		Admin:        isYes(f["Admin"]),
+		Muted:        isYes(f["Muted"]),
+		JoinedAt:     time.Now(),
+	}
+	if participant.Extension == "" {
+		participant.Extension = participant.CallerIDNum
+	}
+	return participant
+}
+
+// DialIntoConference calls an extension and places it in a ConfBridge
+// conference once answered
+func DialIntoConference(extension, conference string, options ConferenceDialOptions) (string, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return "", fmt.Errorf("AMI client not available")
+	}
+
+	// Variable holds several assignments separated by commas; Asterisk
+	// does not split inside the parentheses of CONFBRIDGE(...)
+	variables := []string{fmt.Sprintf("CONFERENCE=%s", conference)}
+	if options.Admin {
+		variables = append(variables, "CONFBRIDGE(user,admin)=yes", "CONFBRIDGE(user,marked)=yes")
+	}
+	if options.MaxParticipants > 0 {
+		variables = append(variables, fmt.Sprintf("CONFBRIDGE(bridge,max_members)=%d", options.MaxParticipants))
+	}
+
+	channel := fmt.Sprintf("PJSIP/%s", extension)
+	fields := map[string]string{
+		"Channel":     channel,
+		"Application": "ConfBridge",
+		"Data":        conference,
+		"CallerID":    fmt.Sprintf("Conference <%s>", conference),
+		"Timeout":     "30000",
+		"Variable":    strings.Join(variables, ","),
+		"Async":       "true",
+	}
+
+	response, err := client.SendCommand("Originate", fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to dial into conference: %v", err)
+	}
+
+	if !response.Success {
+		return "", fmt.Errorf("conference dial failed: %s", response.Error)
+	}
+
+	log.Printf("Dialling %s into conference %s", extension, conference)
+	return channel, nil
+}
+
+// ListConferenceParticipants lists the channels in a conference
+func ListConferenceParticipants(conference string) ([]ConferenceParticipant, error) {
+	events, err := listAction("ConfbridgeList", map[string]string{"Conference": conference}, "ConfbridgeList")
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]ConferenceParticipant, 0, len(events))
+	for _, event := range events {
+		participants = append(participants, ParseConferenceParticipant(event))
+	}
+	return participants, nil
+}
+
+// ListConferenceRooms lists the conferences currently in progress
+func ListConferenceRooms() ([]ConferenceRoomStatus, error) {
+	events, err := listAction("ConfbridgeListRooms", nil, "ConfbridgeListRooms")
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]ConferenceRoomStatus, 0, len(events))
+	for _, event := range events {
+		f := event.Fields
+		room := ConferenceRoomStatus{
+			Conference: f["Conference"],
+			Locked:     isYes(f["Locked"]),
+			Muted:      isYes(f["Muted"]),
+		}
+		room.Parties, _ = strconv.Atoi(f["Parties"])
+		room.Marked, _ = strconv.Atoi(f["Marked"])
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// MuteConferenceParticipant mutes (mute true) or unmutes a channel in a conference
+func MuteConferenceParticipant(conference, channel string, mute bool) error {
+	action := "ConfbridgeUnmute"
+	if mute {
+		action = "ConfbridgeMute"
+	}
+	return conferenceAction(action, map[string]string{
+		"Conference": conference,
+		"Channel":    channel,
+	})
+}
+
+// KickConferenceParticipant removes a channel from a conference
+func KickConferenceParticipant(conference, channel string) error {
+	return conferenceAction("ConfbridgeKick", map[string]string{
+		"Conference": conference,
+		"Channel":    channel,
+	})
+}
+
+// LockConference locks (lock true) or unlocks a conference. Only
+// moderators can join a locked conference.
+func LockConference(conference string, lock bool) error {
+	action := "ConfbridgeUnlock"
+	if lock {
+		action = "ConfbridgeLock"
+	}
+	return conferenceAction(action, map[string]string{
+		"Conference": conference,
+	})
+}
+
+// conferenceAction sends a ConfBridge action that only returns success or failure
+func conferenceAction(action string, fields map[string]string) error {
+	client := GetAMIClient()
+	if client == nil {
+		return fmt.Errorf("AMI client not available")
+	}
+
+	response, err := client.SendCommand(action, fields)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", action, err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("%s failed: %s", action, response.Error)
+	}
+
+	log.Printf("%s succeeded for conference %s %s", action, fields["Conference"], fields["Channel"])
+	return nil
+}
+
+// isYes parses the Yes/No flags of ConfBridge events
+func isYes(value string) bool {
+	return strings.EqualFold(value, "yes") || strings.EqualFold(value, "true")
+}
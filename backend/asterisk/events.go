@@ -0,0 +1,271 @@
+package asterisk
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AMI event types the backend reacts to
+const (
+	EventNewchannel        = "Newchannel"
+	EventNewstate          = "Newstate"
+	EventNewCallerid       = "NewCallerid"
+	EventDialBegin         = "DialBegin"
+	EventDialEnd           = "DialEnd"
+	EventBridgeEnter       = "BridgeEnter"
+	EventBridgeLeave       = "BridgeLeave"
+	EventHangup            = "Hangup"
+	EventHold              = "Hold"
+	EventUnhold            = "Unhold"
+	EventDeviceStateChange = "DeviceStateChange"
+	EventContactStatus     = "ContactStatus"
+
+	// Synthetic events published by the client itself when the AMI
+	// connection comes up or goes away, so subscribers can resynchronise
+	EventAMIConnected    = "AMIConnected"
+	EventAMIDisconnected = "AMIDisconnected"
+)
+
+// defaultSubscriptionBuffer is used when Subscribe is called with a buffer size <= 0
+const defaultSubscriptionBuffer = 256
+
+// EventFilter selects which events a subscription receives. Empty fields
+// match everything; all non-empty fields must match.
+type EventFilter struct {
+	// Types restricts delivery to these event names (Newchannel, Hangup, ...)
+	Types []string
+
+	// Channel matches Channel or DestChannel
+	Channel string
+
+	// Uniqueid matches Uniqueid, Linkedid, DestUniqueid or DestLinkedid
+	Uniqueid string
+
+	// Extension matches caller/connected/destination numbers, the dialled
+	// extension, PJSIP endpoint names and PJSIP/<ext> channels and devices
+	Extension string
+}
+
+// Matches reports whether the event passes the filter
+func (f EventFilter) Matches(event AMIEvent) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, eventType := range f.Types {
+			if strings.EqualFold(eventType, event.Type) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Channel != "" && !fieldEquals(event, f.Channel, "Channel", "DestChannel") {
+		return false
+	}
+
+	if f.Uniqueid != "" && !fieldEquals(event, f.Uniqueid, "Uniqueid", "Linkedid", "DestUniqueid", "DestLinkedid") {
+		return false
+	}
+
+	if f.Extension != "" && !matchesExtension(event, f.Extension) {
+		return false
+	}
+
+	return true
+}
+
+// Subscription receives the events matching its filter on a private buffered channel
+type Subscription struct {
+	id      uint64
+	filter  EventFilter
+	events  chan AMIEvent
+	dropped uint64
+	bus     *EventBus
+}
+
+// Events returns the channel events are delivered on. It is closed by Unsubscribe.
+func (s *Subscription) Events() <-chan AMIEvent {
+	return s.events
+}
+
+// Dropped returns how many events were discarded because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivery and closes the events channel
+func (s *Subscription) Unsubscribe() {
+	s.bus.unsubscribe(s)
+}
+
+// EventBus fans AMI events out to subscribers. A single process-wide bus is
+// fed by whichever AMIClient is currently connected, so subscriptions
+// outlive reconnects.
+type EventBus struct {
+	subscribers map[uint64]*Subscription
+	mutex       sync.RWMutex
+	nextID      uint64
+	published   uint64
+	dropped     uint64
+}
+
+// NewEventBus creates an empty event bus
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[uint64]*Subscription),
+	}
+}
+
+var eventBus = NewEventBus()
+
+// GetEventBus returns the process-wide AMI event bus
+func GetEventBus() *EventBus {
+	return eventBus
+}
+
+// Subscribe registers a subscriber on the process-wide AMI event bus
+func Subscribe(filter EventFilter, bufferSize int) *Subscription {
+	return eventBus.Subscribe(filter, bufferSize)
+}
+
+// Subscribe registers a new subscriber with its own buffer
+func (b *EventBus) Subscribe(filter EventFilter, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = defaultSubscriptionBuffer
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.nextID++
+	sub := &Subscription{
+		id:     b.nextID,
+		filter: filter,
+		events: make(chan AMIEvent, bufferSize),
+		bus:    b,
+	}
+	b.subscribers[sub.id] = sub
+
+	return sub
+}
+
+// unsubscribe removes a subscriber and closes its channel
+func (b *EventBus) unsubscribe(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[sub.id]; ok {
+		delete(b.subscribers, sub.id)
+		close(sub.events)
+	}
+}
+
+// Publish delivers an event to every matching subscriber without blocking.
+// Subscribers whose buffer is full lose the event and their drop counter
+// is incremented.
+func (b *EventBus) Publish(event AMIEvent) {
+	atomic.AddUint64(&b.published, 1)
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, sub := range b.subscribers {
+		if !sub.filter.Matches(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			dropped := atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&b.dropped, 1)
+			// Avoid flooding the log when a subscriber is stuck
+			if dropped == 1 || dropped%100 == 0 {
+				log.Printf("[AMI] Subscriber %d buffer full, dropped %d events (last: %s)", sub.id, dropped, event.Type)
+			}
+		}
+	}
+}
+
+// Stats returns counters for diagnostics
+func (b *EventBus) Stats() map[string]interface{} {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	subscribers := make([]map[string]interface{}, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		subscribers = append(subscribers, map[string]interface{}{
+			"id":       sub.id,
+			"types":    sub.filter.Types,
+			"buffered": len(sub.events),
+			"capacity": cap(sub.events),
+			"dropped":  sub.Dropped(),
+		})
+	}
+
+	return map[string]interface{}{
+		"subscriber_count": len(b.subscribers),
+		"published":        atomic.LoadUint64(&b.published),
+		"dropped":          atomic.LoadUint64(&b.dropped),
+		"subscribers":      subscribers,
+	}
+}
+
+// publishConnectionEvent emits one of the synthetic connection events
+func publishConnectionEvent(eventType string) {
+	eventBus.Publish(AMIEvent{
+		Type: eventType,
+		Fields: map[string]string{
+			"Event":     eventType,
+			"Synthetic": "true",
+			"Timestamp": time.Now().Format(time.RFC3339),
+		},
+	})
+}
+
+// fieldEquals reports whether any of the named fields equals value
+func fieldEquals(event AMIEvent, value string, keys ...string) bool {
+	for _, key := range keys {
+		if v := event.Fields[key]; v != "" && v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExtension reports whether the event concerns the given extension
+func matchesExtension(event AMIEvent, extension string) bool {
+	if fieldEquals(event, extension,
+		"CallerIDNum", "ConnectedLineNum", "Exten",
+		"DestCallerIDNum", "DestConnectedLineNum", "DestExten",
+		"Endpoint", "EndpointName", "AOR", "Aor") {
+		return true
+	}
+
+	// Channels look like PJSIP/1001-00000012, devices like PJSIP/1001
+	for _, key := range []string{"Channel", "DestChannel", "Device", "Peer"} {
+		if ExtensionFromChannel(event.Fields[key]) == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExtensionFromChannel extracts the extension from a PJSIP channel or device
+// name such as "PJSIP/1001-00000012". It returns "" for other technologies.
+func ExtensionFromChannel(channel string) string {
+	if !strings.HasPrefix(channel, "PJSIP/") {
+		return ""
+	}
+	name := strings.TrimPrefix(channel, "PJSIP/")
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
@@ -0,0 +1,218 @@
+package asterisk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Channel is one entry of a CoreShowChannels listing
+type Channel struct {
+	Channel          string `json:"channel"`
+	Uniqueid         string `json:"uniqueid"`
+	Linkedid         string `json:"linkedid"`
+	ChannelState     string `json:"channel_state"`
+	ChannelStateDesc string `json:"channel_state_desc"`
+	CallerIDNum      string `json:"caller_id_num"`
+	CallerIDName     string `json:"caller_id_name"`
+	ConnectedLineNum string `json:"connected_line_num"`
+	Context          string `json:"context"`
+	Exten            string `json:"exten"`
+	Application      string `json:"application"`
+	ApplicationData  string `json:"application_data"`
+	Duration         string `json:"duration"`
+	BridgeID         string `json:"bridge_id"`
+}
+
+// Endpoint is one entry of a PJSIPShowEndpoints listing
+type Endpoint struct {
+	Name           string `json:"name"`
+	Transport      string `json:"transport"`
+	Aor            string `json:"aor"`
+	Auths          string `json:"auths"`
+	Contacts       string `json:"contacts"`
+	DeviceState    string `json:"device_state"`
+	ActiveChannels string `json:"active_channels"`
+}
+
+// Contact is a registered PJSIP contact, either from a PJSIPShowContacts
+// listing (ContactList) or from the details of a single endpoint
+// (ContactStatusDetail)
+type Contact struct {
+	Endpoint      string `json:"endpoint"`
+	Aor           string `json:"aor"`
+	URI           string `json:"uri"`
+	Status        string `json:"status"`
+	RoundtripUsec int64  `json:"roundtrip_usec"`
+	UserAgent     string `json:"user_agent"`
+	ViaAddress    string `json:"via_address"`
+	RegExpire     string `json:"reg_expire"`
+}
+
+// IsReachable reports whether Asterisk considers the contact usable
+func (c Contact) IsReachable() bool {
+	switch strings.ToLower(c.Status) {
+	case "reachable", "nonqualified", "created", "updated":
+		return true
+	}
+	return false
+}
+
+// EndpointDetail is the result of PJSIPShowEndpoint for a single endpoint
+type EndpointDetail struct {
+	Name     string            `json:"name"`
+	Fields   map[string]string `json:"fields"`
+	Contacts []Contact         `json:"contacts"`
+}
+
+// ListEndpoints lists every configured PJSIP endpoint
+func ListEndpoints() ([]Endpoint, error) {
+	events, err := listAction("PJSIPShowEndpoints", nil, "EndpointList")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(events))
+	for _, event := range events {
+		f := event.Fields
+		endpoints = append(endpoints, Endpoint{
+			Name:           f["ObjectName"],
+			Transport:      f["Transport"],
+			Aor:            f["Aor"],
+			Auths:          f["Auths"],
+			Contacts:       f["Contacts"],
+			DeviceState:    f["DeviceState"],
+			ActiveChannels: f["ActiveChannels"],
+		})
+	}
+	return endpoints, nil
+}
+
+// ListContacts lists every PJSIP contact currently known to Asterisk
+func ListContacts() ([]Contact, error) {
+	events, err := listAction("PJSIPShowContacts", nil, "ContactList")
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := make([]Contact, 0, len(events))
+	for _, event := range events {
+		f := event.Fields
+		contact := Contact{
+			Endpoint:   f["Endpoint"],
+			Aor:        f["Aor"],
+			URI:        f["Uri"],
+			Status:     f["Status"],
+			UserAgent:  f["UserAgent"],
+			ViaAddress: f["ViaAddr"],
+			RegExpire:  f["RegExpire"],
+		}
+		contact.RoundtripUsec, _ = strconv.ParseInt(f["RoundtripUsec"], 10, 64)
+
+		// Older Asterisk versions omit Endpoint; ObjectName is "<aor>;@<hash>"
+		if contact.Aor == "" {
+			contact.Aor = strings.SplitN(f["ObjectName"], ";", 2)[0]
+		}
+		if contact.Endpoint == "" {
+			contact.Endpoint = contact.Aor
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+// ErrEndpointNotFound is returned by GetEndpointDetail when Asterisk has no
+// such endpoint, as opposed to failing to answer
+var ErrEndpointNotFound = errors.New("endpoint not configured in Asterisk")
+
+// GetEndpointDetail returns the configuration and contacts of a single endpoint
+func GetEndpointDetail(extension string) (*EndpointDetail, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return nil, fmt.Errorf("AMI client not available")
+	}
+
+	response, events, err := client.SendListCommand("PJSIPShowEndpoint", map[string]string{
+		"Endpoint": extension,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to show endpoint: %v", err)
+	}
+	if !response.Success {
+		// Asterisk answers "Unable to retrieve endpoint" for unknown endpoints
+		if strings.HasPrefix(response.Error, "Unable to retrieve endpoint") {
+			return nil, fmt.Errorf("%w: %s", ErrEndpointNotFound, extension)
+		}
+		return nil, fmt.Errorf("failed to show endpoint %s: %s", extension, response.Error)
+	}
+
+	detail := &EndpointDetail{
+		Name:     extension,
+		Fields:   map[string]string{},
+		Contacts: []Contact{},
+	}
+
+	for _, event := range events {
+		f := event.Fields
+		switch event.Type {
+		case "EndpointDetail":
+			detail.Fields = f
+		case "ContactStatusDetail":
+			contact := Contact{
+				Endpoint:   f["EndpointName"],
+				Aor:        f["AOR"],
+				URI:        f["URI"],
+				Status:     f["Status"],
+				UserAgent:  f["UserAgent"],
+				ViaAddress: f["ViaAddress"],
+				RegExpire:  f["RegExpire"],
+			}
+			contact.RoundtripUsec, _ = strconv.ParseInt(f["RoundtripUsec"], 10, 64)
+			if contact.Endpoint == "" {
+				contact.Endpoint = extension
+			}
+			detail.Contacts = append(detail.Contacts, contact)
+		}
+	}
+
+	return detail, nil
+}
+
+// listAction runs a list action and returns only the entry events of the
+// given type. Asterisk answers an empty listing with an error such as
+// "No endpoints found", which is reported as an empty result.
+func listAction(action string, fields map[string]string, entryEvent string) ([]AMIEvent, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return nil, fmt.Errorf("AMI client not available")
+	}
+
+	response, events, err := client.SendListCommand(action, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %v", action, err)
+	}
+
+	if !response.Success {
+		if isEmptyListMessage(response.Error) {
+			return []AMIEvent{}, nil
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, response.Error)
+	}
+
+	entries := make([]AMIEvent, 0, len(events))
+	for _, event := range events {
+		if event.Type == entryEvent {
+			entries = append(entries, event)
+		}
+	}
+	return entries, nil
+}
+
+// isEmptyListMessage matches the "No ... found" and "No active ..." errors
+// Asterisk uses for empty lists
+func isEmptyListMessage(message string) bool {
+	message = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(message, ".")))
+	return strings.HasPrefix(message, "no ") &&
+		(strings.HasSuffix(message, "found") || strings.HasPrefix(message, "no active "))
+}
@@ -0,0 +1,326 @@
+package asterisk
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AMI events raised by app_queue
+const (
+	EventQueueCallerJoin    = "QueueCallerJoin"
+	EventQueueCallerLeave   = "QueueCallerLeave"
+	EventQueueCallerAbandon = "QueueCallerAbandon"
+	EventQueueMemberAdded   = "QueueMemberAdded"
+	EventQueueMemberRemoved = "QueueMemberRemoved"
+	EventQueueMemberPause   = "QueueMemberPause"
+	EventQueueMemberStatus  = "QueueMemberStatus"
+	EventAgentCalled        = "AgentCalled"
+	EventAgentConnect       = "AgentConnect"
+	EventAgentComplete      = "AgentComplete"
+	EventAgentRingNoAnswer  = "AgentRingNoAnswer"
+)
+
+// Device states reported in the Status field of queue members
+const (
+	DeviceUnknown     = 0
+	DeviceNotInUse    = 1
+	DeviceInUse       = 2
+	DeviceBusy        = 3
+	DeviceInvalid     = 4
+	DeviceUnavailable = 5
+	DeviceRinging     = 6
+	DeviceRingInUse   = 7
+	DeviceOnHold      = 8
+)
+
+// QueueMember is an agent logged into a queue, from a QueueMember* event or
+// a QueueStatus listing
+type QueueMember struct {
+	Queue        string     `json:"queue"`
+	Interface    string     `json:"interface"`
+	MemberName   string     `json:"member_name"`
+	Extension    string     `json:"extension"`
+	Status       int        `json:"status"`
+	StatusText   string     `json:"status_text"`
+	Paused       bool       `json:"paused"`
+	PausedReason string     `json:"paused_reason,omitempty"`
+	InCall       bool       `json:"in_call"`
+	CallsTaken   int        `json:"calls_taken"`
+	LastCall     *time.Time `json:"last_call,omitempty"`
+}
+
+// IsAvailable reports whether the queue would offer the member a call now
+func (m QueueMember) IsAvailable() bool {
+	return !m.Paused && !m.InCall && m.Status == DeviceNotInUse
+}
+
+// QueueCaller is a caller waiting in a queue
+type QueueCaller struct {
+	Queue        string    `json:"queue"`
+	Channel      string    `json:"channel"`
+	Uniqueid     string    `json:"uniqueid"`
+	Linkedid     string    `json:"linkedid"`
+	CallerIDNum  string    `json:"caller_id_num"`
+	CallerIDName string    `json:"caller_id_name"`
+	Position     int       `json:"position"`
+	JoinedAt     time.Time `json:"joined_at"`
+}
+
+// QueueParams are the counters of a queue from a QueueStatus listing
+type QueueParams struct {
+	Queue     string `json:"queue"`
+	Strategy  string `json:"strategy"`
+	Calls     int    `json:"calls"`
+	Holdtime  int    `json:"holdtime"` // average seconds callers wait
+	TalkTime  int    `json:"talktime"` // average seconds agents talk
+	Completed int    `json:"completed"`
+	Abandoned int    `json:"abandoned"`
+}
+
+// QueueStatus is the state of one queue from a QueueStatus listing
+type QueueStatus struct {
+	Params  QueueParams   `json:"params"`
+	Members []QueueMember `json:"members"`
+	Callers []QueueCaller `json:"callers"`
+}
+
+// QueueInterface returns the queue member interface of an extension
+func QueueInterface(extension string) string {
+	return fmt.Sprintf("PJSIP/%s", extension)
+}
+
+// DeviceStateText names a device state number
+func DeviceStateText(state int) string {
+	switch state {
+	case DeviceNotInUse:
+		return "not_in_use"
+	case DeviceInUse:
+		return "in_use"
+	case DeviceBusy:
+		return "busy"
+	case DeviceInvalid:
+		return "invalid"
+	case DeviceUnavailable:
+		return "unavailable"
+	case DeviceRinging:
+		return "ringing"
+	case DeviceRingInUse:
+		return "ring_in_use"
+	case DeviceOnHold:
+		return "on_hold"
+	}
+	return "unknown"
+}
+
+// ParseQueueMember converts a QueueMember* event or a QueueStatus entry into
+// a member. The listing names the interface Location and the member Name.
+func ParseQueueMember(event AMIEvent) QueueMember {
+	f := event.Fields
+	member := QueueMember{
+		Queue:        f["Queue"],
+		Interface:    f["Interface"],
+		MemberName:   f["MemberName"],
+		Paused:       isYes(f["Paused"]) || f["Paused"] == "1",
+		PausedReason: f["PausedReason"],
+		InCall:       isYes(f["InCall"]) || f["InCall"] == "1",
+	}
+	if member.Interface == "" {
+		member.Interface = f["Location"]
+	}
+	if member.MemberName == "" {
+		member.MemberName = f["Name"]
+	}
+	member.Extension = ExtensionFromChannel(member.Interface)
+	member.Status, _ = strconv.Atoi(f["Status"])
+	member.StatusText = DeviceStateText(member.Status)
+	member.CallsTaken, _ = strconv.Atoi(f["CallsTaken"])
+	if lastCall, _ := strconv.ParseInt(f["LastCall"], 10, 64); lastCall > 0 {
+		t := time.Unix(lastCall, 0)
+		member.LastCall = &t
+	}
+	return member
+}
+
+// ParseQueueCaller converts a QueueCallerJoin event or a QueueStatus entry
+// into a caller. Listings report how long the caller has waited in Wait.
+func ParseQueueCaller(event AMIEvent) QueueCaller {
+	f := event.Fields
+	caller := QueueCaller{
+		Queue:        f["Queue"],
+		Channel:      f["Channel"],
+		Uniqueid:     f["Uniqueid"],
+		Linkedid:     f["Linkedid"],
+		CallerIDNum:  f["CallerIDNum"],
+		CallerIDName: f["CallerIDName"],
+		JoinedAt:     time.Now(),
+	}
+	caller.Position, _ = strconv.Atoi(f["Position"])
+	if wait, err := strconv.Atoi(f["Wait"]); err == nil {
+		caller.JoinedAt = caller.JoinedAt.Add(-time.Duration(wait) * time.Second)
+	}
+	return caller
+}
+
+// DialIntoQueue calls an extension and places it in a queue once answered.
+// maxWait limits how long the caller waits for an agent, 0 for the queue's
+// own timeout.
+func DialIntoQueue(extension, queue, callID string, maxWait int) (string, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return "", fmt.Errorf("AMI client not available")
+	}
+
+	// Queue(queuename,options,URL,announceoverride,timeout)
+	data := queue
+	if maxWait > 0 {
+		data = fmt.Sprintf("%s,,,,%d", queue, maxWait)
+	}
+
+	channel := fmt.Sprintf("PJSIP/%s", extension)
+	fields := map[string]string{
+		"Channel":     channel,
+		"Application": "Queue",
+		"Data":        data,
+		"CallerID":    extension,
+		"Timeout":     "30000",
+		"Variable":    fmt.Sprintf("CALL_ID=%s", callID),
+		"ChannelId":   callID,
+		"Async":       "true",
+	}
+
+	response, err := client.SendCommand("Originate", fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to dial into queue: %v", err)
+	}
+
+	if !response.Success {
+		return "", fmt.Errorf("queue dial failed: %s", response.Error)
+	}
+
+	log.Printf("Dialling %s into queue %s (ID: %s)", extension, queue, callID)
+	return channel, nil
+}
+
+// GetQueueStatus returns the state of a queue, or of every queue when
+// queue is empty
+func GetQueueStatus(queue string) ([]QueueStatus, error) {
+	client := GetAMIClient()
+	if client == nil {
+		return nil, fmt.Errorf("AMI client not available")
+	}
+
+	var fields map[string]string
+	if queue != "" {
+		fields = map[string]string{"Queue": queue}
+	}
+
+	response, events, err := client.SendListCommand("QueueStatus", fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queue status: %v", err)
+	}
+	if !response.Success {
+		if isEmptyListMessage(response.Error) {
+			return []QueueStatus{}, nil
+		}
+		return nil, fmt.Errorf("QueueStatus failed: %s", response.Error)
+	}
+
+	var statuses []QueueStatus
+	index := make(map[string]int)
+	status := func(name string) *QueueStatus {
+		i, ok := index[name]
+		if !ok {
+			i = len(statuses)
+			index[name] = i
+			statuses = append(statuses, QueueStatus{
+				Params:  QueueParams{Queue: name},
+				Members: []QueueMember{},
+				Callers: []QueueCaller{},
+			})
+		}
+		return &statuses[i]
+	}
+
+	for _, event := range events {
+		f := event.Fields
+		switch event.Type {
+		case "QueueParams":
+			params := QueueParams{
+				Queue:    f["Queue"],
+				Strategy: f["Strategy"],
+			}
+			params.Calls, _ = strconv.Atoi(f["Calls"])
+			params.Holdtime, _ = strconv.Atoi(f["Holdtime"])
+			params.TalkTime, _ = strconv.Atoi(f["TalkTime"])
+			params.Completed, _ = strconv.Atoi(f["Completed"])
+			params.Abandoned, _ = strconv.Atoi(f["Abandoned"])
+			status(f["Queue"]).Params = params
+		case "QueueMember":
+			s := status(f["Queue"])
+			s.Members = append(s.Members, ParseQueueMember(event))
+		case "QueueEntry":
+			s := status(f["Queue"])
+			s.Callers = append(s.Callers, ParseQueueCaller(event))
+		}
+	}
+
+	if statuses == nil {
+		statuses = []QueueStatus{}
+	}
+	return statuses, nil
+}
+
+// AddQueueMember logs an extension into a queue
+func AddQueueMember(queue, extension, memberName string) error {
+	return queueAction("QueueAdd", map[string]string{
+		"Queue":          queue,
+		"Interface":      QueueInterface(extension),
+		"StateInterface": QueueInterface(extension),
+		"MemberName":     memberName,
+	})
+}
+
+// RemoveQueueMember logs an extension out of a queue
+func RemoveQueueMember(queue, extension string) error {
+	return queueAction("QueueRemove", map[string]string{
+		"Queue":     queue,
+		"Interface": QueueInterface(extension),
+	})
+}
+
+// PauseQueueMember pauses (paused true) or unpauses an extension in a queue.
+// A paused member stays logged in but is not offered calls.
+func PauseQueueMember(queue, extension string, paused bool, reason string) error {
+	fields := map[string]string{
+		"Queue":     queue,
+		"Interface": QueueInterface(extension),
+		"Paused":    strconv.FormatBool(paused),
+	}
+	if paused && reason != "" {
+		fields["Reason"] = reason
+	}
+	return queueAction("QueuePause", fields)
+}
+
+// queueAction sends a queue action that only returns success or failure
+func queueAction(action string, fields map[string]string) error {
+	client := GetAMIClient()
+	if client == nil {
+		return fmt.Errorf("AMI client not available")
+	}
+
+	response, err := client.SendCommand(action, fields)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", action, err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("%s failed: %s", action, strings.TrimSpace(response.Error))
+	}
+
+	log.Printf("%s succeeded for queue %s %s", action, fields["Queue"], fields["Interface"])
+	return nil
+}
@@ -13,18 +13,25 @@ type Claims struct {
 	Username  string `json:"username"`
 	Extension string `json:"extension"`
 	Role      string `json:"role"`
+	SessionID uint   `json:"sid"` // Session the token was issued to; revoking it revokes the token
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(userID uint, username, extension, role string) (string, error) {
-	expirationTime := time.Now().Add(time.Duration(config.AppConfig.JWTExpiryHours) * time.Hour)
+// AccessTokenTTL is how long an access token is valid
+func AccessTokenTTL() time.Duration {
+	return time.Duration(config.AppConfig.AccessTokenMinutes) * time.Minute
+}
+
+// GenerateToken generates a short-lived JWT access token for a user's session
+func GenerateToken(userID uint, username, extension, role string, sessionID uint) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenTTL())
 	
 	claims := &Claims{
 		UserID:    userID,
 		Username:  username,
 		Extension: extension,
 		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -70,14 +77,3 @@ func ValidateToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
-
-// RefreshToken generates a new token with extended expiry
-func RefreshToken(tokenString string) (string, error) {
-	claims, err := ValidateToken(tokenString)
-	if err != nil {
-		return "", err
-	}
-
-	// Generate new token with same claims but extended expiry
-	return GenerateToken(claims.UserID, claims.Username, claims.Extension, claims.Role)
-}
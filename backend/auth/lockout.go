@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"gorm.io/gorm"
+)
+
+// Failed attempts are forgotten after this long without one, or after the
+// longest delay if that is longer
+const attemptWindow = 15 * time.Minute
+
+// Registrations an IP address may attempt before it is slowed down
+const registerFreeAttempts = 5
+
+// Login protection. Usernames and IP addresses are throttled on this node;
+// account lockouts are stored with the user and apply on every node.
+var (
+	usernameThrottle *Throttle
+	ipThrottle       *Throttle
+	registerThrottle *Throttle
+)
+
+// InitLoginProtection sets up login and registration throttling from the
+// configuration
+func InitLoginProtection() {
+	maxDelay := time.Duration(config.AppConfig.LoginBackoffMaxSeconds) * time.Second
+	window := attemptWindow
+	if maxDelay > window {
+		window = maxDelay
+	}
+
+	usernameThrottle = NewThrottle(config.AppConfig.LoginBackoffAfter, time.Second, maxDelay, window)
+	ipThrottle = NewThrottle(config.AppConfig.LoginIPBackoffAfter, time.Second, maxDelay, window)
+	registerThrottle = NewThrottle(registerFreeAttempts, time.Second, maxDelay, window)
+	log.Printf("[AUTH] Login protection: backoff after %d failures per username and %d per IP, lockout after %d for %d minutes",
+		config.AppConfig.LoginBackoffAfter, config.AppConfig.LoginIPBackoffAfter,
+		config.AppConfig.LoginLockoutThreshold, config.AppConfig.LoginLockoutMinutes)
+}
+
+// LoginAttempt returns how long a login for a username from an IP address
+// must wait after the failures before it, or 0 once it counted the login
+// as failed. A login whose credentials turn out right, or that is refused
+// without checking them, is taken back with LoginReleased.
+func LoginAttempt(ip, username string) time.Duration {
+	if wait := ipThrottle.Attempt(ip); wait > 0 {
+		return wait
+	}
+	if wait := usernameThrottle.Attempt(usernameKey(username)); wait > 0 {
+		ipThrottle.Release(ip)
+		return wait
+	}
+	return 0
+}
+
+// LoginReleased takes back a login counted by LoginAttempt that did not
+// fail
+func LoginReleased(ip, username string) {
+	ipThrottle.Release(ip)
+	usernameThrottle.Release(usernameKey(username))
+}
+
+// AccountLockedFor returns how long a user's account stays locked, or 0
+func AccountLockedFor(user *models.User) time.Duration {
+	if user.LockedUntil == nil {
+		return 0
+	}
+	return waitUntil(*user.LockedUntil)
+}
+
+// LoginFailed records a failed login, with a wrong password or second
+// factor, whose attempt LoginAttempt already counted. The user is nil when
+// the username does not exist. Enough consecutive failures lock the user's
+// account.
+func LoginFailed(ip, username string, user *models.User) {
+	ipFailures := ipThrottle.Failures(ip)
+	if ipFailures == ipThrottle.FreeAttempts+1 {
+		log.Printf("[AUTH] Throttling logins from %s after %d failures", ip, ipFailures)
+		Audit(models.AuditIPThrottled, nil, nil, ip, fmt.Sprintf("%d failed logins", ipFailures))
+	}
+	key := usernameKey(username)
+	failures, wait := usernameThrottle.Failures(key), usernameThrottle.Blocked(key)
+	log.Printf("[AUTH] Failed login for %q from %s (%d in a row, next allowed in %s)", username, ip, failures, wait.Round(time.Second))
+
+	if user == nil || config.AppConfig.LoginLockoutThreshold <= 0 {
+		return
+	}
+	db := database.GetDB()
+	if err := db.Model(&models.User{}).Where("id = ?", user.ID).
+		UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error; err != nil {
+		log.Printf("[AUTH] Failed to count failed login of %s: %v", user.Username, err)
+		return
+	}
+
+	// The failure that reaches the threshold locks the account, and the
+	// count starts again for when the lock ends
+	lockedUntil := time.Now().Add(time.Duration(config.AppConfig.LoginLockoutMinutes) * time.Minute)
+	result := db.Model(&models.User{}).
+		Where("id = ? AND failed_logins >= ?", user.ID, config.AppConfig.LoginLockoutThreshold).
+		UpdateColumns(map[string]interface{}{"failed_logins": 0, "locked_until": lockedUntil})
+	if result.Error == nil && result.RowsAffected == 1 {
+		log.Printf("[AUTH] Locked account %s until %s after %d failed logins", user.Username, lockedUntil.Format(time.RFC3339), config.AppConfig.LoginLockoutThreshold)
+		Audit(models.AuditAccountLocked, user, nil, ip,
+			fmt.Sprintf("%d failed logins; locked until %s", config.AppConfig.LoginLockoutThreshold, lockedUntil.Format(time.RFC3339)))
+	}
+}
+
+// LoginSucceeded clears a user's failed logins once they are fully logged
+// in. The IP address keeps its failures, which a valid account must not
+// wipe.
+func LoginSucceeded(user *models.User) {
+	usernameThrottle.Reset(usernameKey(user.Username))
+	if user.FailedLogins > 0 {
+		database.GetDB().Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("failed_logins", 0)
+		user.FailedLogins = 0
+	}
+}
+
+// UnlockAccount lifts a user's lockout and login delays
+func UnlockAccount(user *models.User, actorID uint, ip string) error {
+	if err := database.GetDB().Model(&models.User{}).Where("id = ?", user.ID).
+		UpdateColumns(map[string]interface{}{"failed_logins": 0, "locked_until": nil}).Error; err != nil {
+		return err
+	}
+	usernameThrottle.Reset(usernameKey(user.Username))
+
+	log.Printf("[AUTH] Account %s unlocked by user %d", user.Username, actorID)
+	Audit(models.AuditAccountUnlocked, user, &actorID, ip, "")
+	return nil
+}
+
+// RegisterAttempt returns how long a registration from an IP address must
+// wait, or 0 once it counted the registration: every attempt counts, since
+// each may create an account
+func RegisterAttempt(ip string) time.Duration {
+	return registerThrottle.Attempt(ip)
+}
+
+// Audit records a security event in the audit trail
+func Audit(event string, user *models.User, actorID *uint, ip, details string) {
+	entry := models.AuditEvent{
+		Event:     event,
+		ActorID:   actorID,
+		IPAddress: ip,
+		Details:   details,
+	}
+	if user != nil {
+		entry.UserID = &user.ID
+		entry.Username = user.Username
+	}
+	if err := database.GetDB().Create(&entry).Error; err != nil {
+		log.Printf("[AUTH] Failed to record %s audit event: %v", event, err)
+	}
+}
+
+// usernameKey is the throttle key of a username, which matches however it
+// is capitalised
+func usernameKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidMFAToken = errors.New("invalid or expired MFA token")
+	ErrInvalidMFACode  = errors.New("invalid authentication code")
+	ErrMFANotPending   = errors.New("no two-factor enrollment in progress")
+)
+
+// How long the second step of a login may take
+const mfaTokenTTL = 5 * time.Minute
+
+// Recovery codes issued at once
+const recoveryCodeCount = 10
+
+const mfaAudience = "mfa"
+
+// MFAClaims are carried by the token a password login returns when a
+// second factor is still needed. It is not an access token: it is signed
+// with its own key and only completes the login.
+type MFAClaims struct {
+	UserID     uint   `json:"user_id"`
+	DeviceName string `json:"device_name,omitempty"`
+	Enroll     bool   `json:"enroll,omitempty"` // The user must enroll before the login completes
+	jwt.RegisteredClaims
+}
+
+// mfaKey is the signing key of MFA tokens, distinct from the access token key
+func mfaKey() []byte {
+	return []byte(mfaAudience + ":" + config.AppConfig.JWTSecret)
+}
+
+// MFATokenTTL is how long an MFA token is valid
+func MFATokenTTL() time.Duration {
+	return mfaTokenTTL
+}
+
+// GenerateMFAToken returns the token that completes a login whose password
+// was verified
+func GenerateMFAToken(userID uint, deviceName string, enroll bool) (string, error) {
+	now := time.Now()
+	claims := &MFAClaims{
+		UserID:     userID,
+		DeviceName: deviceName,
+		Enroll:     enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    "voip-backend",
+			Audience:  jwt.ClaimStrings{mfaAudience},
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(mfaKey())
+}
+
+// ValidateMFAToken validates an MFA token and returns its claims
+func ValidateMFAToken(tokenString string) (*MFAClaims, error) {
+	claims := &MFAClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("invalid signing method")
+		}
+		return mfaKey(), nil
+	}, jwt.WithAudience(mfaAudience))
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidMFAToken
+	}
+	return claims, nil
+}
+
+// MFARequired reports whether the policy makes two-factor authentication
+// mandatory for a role
+func MFARequired(role string) bool {
+	var policy models.MFARolePolicy
+	if err := database.GetDB().Where("role = ?", role).First(&policy).Error; err != nil {
+		return false
+	}
+	return policy.Required
+}
+
+// VerifyTOTP checks a user's TOTP code and consumes it, so that the same
+// code is refused until the next one
+func VerifyTOTP(user *models.User, code string) bool {
+	if !user.MFAEnabled || user.TOTPSecret == "" {
+		return false
+	}
+	step, ok := ValidateTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+
+	// Of two requests racing with the same code only one wins
+	result := database.GetDB().Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	user.TOTPLastStep = step
+	return true
+}
+
+// StartTOTPEnrollment gives a user a new TOTP secret to add to their
+// authenticator, and returns it with its provisioning URI. It only takes
+// effect once ConfirmTOTPEnrollment sees a code from it.
+func StartTOTPEnrollment(user *models.User) (string, string, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := database.GetDB().Model(&models.User{}).Where("id = ?", user.ID).
+		Update("totp_pending", secret).Error; err != nil {
+		return "", "", err
+	}
+	user.TOTPPending = secret
+	return secret, TOTPProvisioningURI(config.AppConfig.TOTPIssuer, user.Username, secret), nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication with the secret
+// being enrolled once a code from it is verified, replacing any previous
+// secret, and returns a new set of recovery codes
+func ConfirmTOTPEnrollment(user *models.User, code string) ([]string, error) {
+	if user.TOTPPending == "" {
+		return nil, ErrMFANotPending
+	}
+	step, ok := ValidateTOTP(user.TOTPPending, code, 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	var codes []string
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND totp_pending = ?", user.ID, user.TOTPPending).
+			Updates(map[string]interface{}{
+				"mfa_enabled":    true,
+				"totp_secret":    user.TOTPPending,
+				"totp_pending":   "",
+				"totp_last_step": step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrMFANotPending
+		}
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user.MFAEnabled = true
+	user.TOTPSecret = user.TOTPPending
+	user.TOTPPending = ""
+	user.TOTPLastStep = step
+	return codes, nil
+}
+
+// DisableMFA turns two-factor authentication off for a user and deletes
+// their secret and recovery codes
+func DisableMFA(userID uint) error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{
+				"mfa_enabled":    false,
+				"totp_secret":    "",
+				"totp_pending":   "",
+				"totp_last_step": 0,
+			}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes and returns the
+// new ones
+func RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	var codes []string
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// UseRecoveryCode consumes one of a user's unused recovery codes
+func UseRecoveryCode(userID uint, code string) bool {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if code == "" {
+		return false
+	}
+
+	result := database.GetDB().Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes a user has
+func RecoveryCodesLeft(userID uint) int64 {
+	var count int64
+	database.GetDB().Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and stores hashes of
+// new ones, which it returns formatted as xxxxx-xxxxx
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		data := make([]byte, 8)
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(data))[:10]
+		if err := tx.Create(&models.MFARecoveryCode{UserID: userID, CodeHash: hashToken(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
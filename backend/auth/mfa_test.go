@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	config.AppConfig = &config.Config{
+		DBPath:     filepath.Join(dir, "test.db"),
+		JWTSecret:  "test-secret",
+		TOTPIssuer: "VoIP Test",
+	}
+	database.InitDatabase()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// enrolledUser returns a test user with two-factor authentication enabled
+// and the key of their TOTP secret
+func enrolledUser(t *testing.T, username string) (models.User, []byte) {
+	t.Helper()
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	var user models.User
+	db := database.GetDB()
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("Failed to load user %s: %v", username, err)
+	}
+	db.Model(&user).Updates(map[string]interface{}{"mfa_enabled": true, "totp_secret": secret, "totp_last_step": 0})
+	db.First(&user, user.ID)
+	t.Cleanup(func() { DisableMFA(user.ID) })
+
+	key, _ := totpEncoding.DecodeString(secret)
+	return user, key
+}
+
+func TestVerifyTOTPRefusesReplay(t *testing.T) {
+	user, key := enrolledUser(t, "user1")
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	// A second request racing with the same code holds the user as loaded
+	// before the first one
+	stale := user
+	if !VerifyTOTP(&user, code) {
+		t.Fatal("VerifyTOTP refused the current code")
+	}
+	if VerifyTOTP(&user, code) {
+		t.Error("VerifyTOTP accepted the same code twice")
+	}
+	if VerifyTOTP(&stale, code) {
+		t.Error("VerifyTOTP accepted a code another request used")
+	}
+
+	var reloaded models.User
+	database.GetDB().First(&reloaded, user.ID)
+	if VerifyTOTP(&reloaded, code) {
+		t.Error("VerifyTOTP accepted a used code after a reload")
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	user, _ := enrolledUser(t, "user2")
+	codes, err := RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	if !UseRecoveryCode(user.ID, codes[0]) {
+		t.Fatal("UseRecoveryCode refused a new code")
+	}
+	if UseRecoveryCode(user.ID, codes[0]) {
+		t.Error("UseRecoveryCode accepted a code twice")
+	}
+	// Codes may be typed without the dash and in capitals
+	if !UseRecoveryCode(user.ID, strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))) {
+		t.Error("UseRecoveryCode refused a code typed without its dash")
+	}
+	if left := RecoveryCodesLeft(user.ID); left != int64(recoveryCodeCount-2) {
+		t.Errorf("%d codes left, want %d", left, recoveryCodeCount-2)
+	}
+
+	// Codes of another user and replaced codes are refused
+	var other models.User
+	database.GetDB().Where("username = ?", "user3").First(&other)
+	if UseRecoveryCode(other.ID, codes[2]) {
+		t.Error("UseRecoveryCode accepted another user's code")
+	}
+	if _, err := RegenerateRecoveryCodes(user.ID); err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+	if UseRecoveryCode(user.ID, codes[2]) {
+		t.Error("UseRecoveryCode accepted a replaced code")
+	}
+}
+
+func TestConfirmTOTPEnrollment(t *testing.T) {
+	var user models.User
+	database.GetDB().Where("username = ?", "user3").First(&user)
+	t.Cleanup(func() { DisableMFA(user.ID) })
+
+	if _, err := ConfirmTOTPEnrollment(&user, "123456"); err != ErrMFANotPending {
+		t.Fatalf("ConfirmTOTPEnrollment without enrollment = %v, want ErrMFANotPending", err)
+	}
+	secret, _, err := StartTOTPEnrollment(&user)
+	if err != nil {
+		t.Fatalf("StartTOTPEnrollment: %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	current := time.Now().Unix() / totpPeriod
+	code := totpCode(key, current)
+
+	if _, err := ConfirmTOTPEnrollment(&user, totpCode(key, current+5)); err != ErrInvalidMFACode {
+		t.Errorf("ConfirmTOTPEnrollment with a wrong code = %v, want ErrInvalidMFACode", err)
+	}
+	codes, err := ConfirmTOTPEnrollment(&user, code)
+	if err != nil {
+		t.Fatalf("ConfirmTOTPEnrollment: %v", err)
+	}
+	if len(codes) != recoveryCodeCount || !user.MFAEnabled {
+		t.Errorf("enabled = %v with %d recovery codes", user.MFAEnabled, len(codes))
+	}
+
+	// The code that confirmed the enrollment cannot log in again
+	if VerifyTOTP(&user, code) {
+		t.Error("VerifyTOTP accepted the code that confirmed the enrollment")
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"voip-backend/database"
+	"voip-backend/models"
+)
+
+// How long role permissions are cached. Changes made on this node apply at
+// once, changes made on another node after this long.
+const roleCacheTTL = 30 * time.Second
+
+var roleCache struct {
+	sync.Mutex
+	permissions map[string]map[string]bool // role -> permissions
+	loadedAt    time.Time
+}
+
+// rolePermissions returns the permissions of every role
+func rolePermissions() map[string]map[string]bool {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	if roleCache.permissions != nil && time.Since(roleCache.loadedAt) < roleCacheTTL {
+		return roleCache.permissions
+	}
+
+	var roles []models.Role
+	if err := database.GetDB().Preload("Permissions").Find(&roles).Error; err != nil {
+		log.Printf("[AUTH] Failed to load roles: %v", err)
+		if roleCache.permissions != nil {
+			return roleCache.permissions
+		}
+		return map[string]map[string]bool{}
+	}
+
+	permissions := make(map[string]map[string]bool, len(roles))
+	for _, role := range roles {
+		granted := make(map[string]bool, len(role.Permissions))
+		for _, permission := range role.Permissions {
+			granted[permission.Permission] = true
+		}
+		permissions[role.Name] = granted
+	}
+	roleCache.permissions = permissions
+	roleCache.loadedAt = time.Now()
+	return permissions
+}
+
+// InvalidateRoles makes the next permission check reload the roles
+func InvalidateRoles() {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	roleCache.permissions = nil
+}
+
+// RoleExists reports whether a role is defined
+func RoleExists(role string) bool {
+	_, exists := rolePermissions()[role]
+	return exists
+}
+
+// HasPermission reports whether a role grants a permission
+func HasPermission(role, permission string) bool {
+	granted := rolePermissions()[role]
+	return granted[models.PermAll] || granted[permission]
+}
+
+// RolePermissions returns the permissions a role grants, sorted
+func RolePermissions(role string) []string {
+	permissions := make([]string, 0)
+	for permission := range rolePermissions()[role] {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// RolesWithPermission returns the roles that grant a permission
+func RolesWithPermission(permission string) []string {
+	var roles []string
+	for role, granted := range rolePermissions() {
+		if granted[models.PermAll] || granted[permission] {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// CanGrant reports whether a role holds every one of some permissions, as
+// it must to give them to a role or a user: nobody grants more than they
+// have
+func CanGrant(role string, permissions []string) bool {
+	granted := rolePermissions()[role]
+	if granted[models.PermAll] {
+		return true
+	}
+	for _, permission := range permissions {
+		if !granted[permission] {
+			return false
+		}
+	}
+	return true
+}
+
+// CanManageRole reports whether a role may assign another role to users,
+// or manage the users who have it
+func CanManageRole(role, target string) bool {
+	return CanGrant(role, RolePermissions(target))
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used; the session has been revoked")
+	ErrSessionExpired      = errors.New("session expired")
+	ErrSessionRevoked      = errors.New("session revoked")
+)
+
+// Why a session was revoked
+const (
+	RevokedLogout      = "logout"
+	RevokedTokenReused = "refresh_token_reused"
+	RevokedByUser      = "revoked"
+	RevokedByAdmin     = "revoked_by_admin"
+)
+
+// How often a session's last activity is stored while its access tokens
+// are in use
+const activityInterval = time.Minute
+
+// RefreshTokenTTL is how long a session lasts without its refresh token
+// being used
+func RefreshTokenTTL() time.Duration {
+	return time.Duration(config.AppConfig.RefreshTokenDays) * 24 * time.Hour
+}
+
+// newRefreshToken returns a random opaque refresh token and its hash
+func newRefreshToken() (string, string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash a refresh token is stored under
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a session for a user on a device and returns it
+// with its first refresh token
+func CreateSession(userID uint, deviceName, userAgent, ipAddress string) (*models.Session, string, error) {
+	token, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:           userID,
+		RefreshTokenHash: hash,
+		DeviceName:       deviceName,
+		UserAgent:        userAgent,
+		IPAddress:        ipAddress,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(RefreshTokenTTL()),
+	}
+	if err := database.GetDB().Create(&session).Error; err != nil {
+		return nil, "", err
+	}
+
+	pruneSessions(userID)
+	return &session, token, nil
+}
+
+// RotateSession exchanges a refresh token for a new one and extends the
+// session. A token the session already exchanged revokes it, and the
+// session is returned with ErrRefreshTokenReused so that its connections
+// can be closed.
+func RotateSession(refreshToken, userAgent, ipAddress string) (*models.Session, string, error) {
+	db := database.GetDB()
+	hash := hashToken(refreshToken)
+
+	var session models.Session
+	if err := db.Where("refresh_token_hash = ?", hash).First(&session).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", err
+		}
+		return reusedToken(hash)
+	}
+	if session.RevokedAt != nil {
+		return nil, "", ErrSessionRevoked
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, "", ErrSessionExpired
+	}
+
+	token, newHash, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Only one of two requests racing with the same token wins
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, hash).
+			Updates(map[string]interface{}{
+				"refresh_token_hash": newHash,
+				"user_agent":         userAgent,
+				"ip_address":         ipAddress,
+				"last_used_at":       now,
+				"expires_at":         now.Add(RefreshTokenTTL()),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+		return tx.Create(&models.SessionToken{Hash: hash, SessionID: session.ID, RotatedAt: now}).Error
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		return reusedToken(hash)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	db.First(&session, session.ID)
+	return &session, token, nil
+}
+
+// reusedToken revokes the session a refresh token was exchanged in, if it
+// was
+func reusedToken(hash string) (*models.Session, string, error) {
+	db := database.GetDB()
+
+	var used models.SessionToken
+	if err := db.Where("hash = ?", hash).First(&used).Error; err != nil {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	var session models.Session
+	if err := db.First(&session, used.SessionID).Error; err != nil {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	log.Printf("[AUTH] Refresh token of session %d (user %d) was used twice; revoking the session", session.ID, session.UserID)
+	if err := RevokeSession(session.ID, RevokedTokenReused); err != nil {
+		log.Printf("[AUTH] Failed to revoke session %d: %v", session.ID, err)
+	}
+	return &session, "", ErrRefreshTokenReused
+}
+
+// RevokeSession ends a session. Its refresh token stops working at once and
+// so do its access tokens, which CheckSession rejects.
+func RevokeSession(sessionID uint, reason string) error {
+	now := time.Now()
+	return database.GetDB().Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": reason}).Error
+}
+
+// RevokeUserSessions ends every active session of a user but exceptID (0
+// for none), and returns the IDs of the sessions it ended
+func RevokeUserSessions(userID, exceptID uint, reason string) ([]uint, error) {
+	db := database.GetDB()
+
+	var sessionIDs []uint
+	if err := db.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL AND expires_at > ?", userID, exceptID, time.Now()).
+		Pluck("id", &sessionIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(sessionIDs) == 0 {
+		return sessionIDs, nil
+	}
+
+	now := time.Now()
+	if err := db.Model(&models.Session{}).
+		Where("id IN ? AND revoked_at IS NULL", sessionIDs).
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_reason": reason}).Error; err != nil {
+		return nil, err
+	}
+	return sessionIDs, nil
+}
+
+// CheckSession makes sure the session an access token was issued to still
+// belongs to its user and has not been revoked, and records its activity
+func CheckSession(claims *Claims) error {
+	if claims.SessionID == 0 {
+		return errors.New("token has no session")
+	}
+
+	db := database.GetDB()
+	var session models.Session
+	if err := db.Select("id", "user_id", "last_used_at", "revoked_at").First(&session, claims.SessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	if session.UserID != claims.UserID || session.RevokedAt != nil {
+		return ErrSessionRevoked
+	}
+
+	if time.Since(session.LastUsedAt) > activityInterval {
+		db.Model(&models.Session{}).Where("id = ?", session.ID).Update("last_used_at", time.Now())
+	}
+	return nil
+}
+
+// pruneSessions deletes a user's sessions that expired, with the tokens
+// they exchanged
+func pruneSessions(userID uint) {
+	db := database.GetDB()
+	expired := db.Model(&models.Session{}).Select("id").Where("user_id = ? AND expires_at < ?", userID, time.Now())
+	if err := db.Where("session_id IN (?)", expired).Delete(&models.SessionToken{}).Error; err != nil {
+		log.Printf("[AUTH] Failed to prune refresh tokens of user %d: %v", userID, err)
+		return
+	}
+	if err := db.Where("user_id = ? AND expires_at < ?", userID, time.Now()).Delete(&models.Session{}).Error; err != nil {
+		log.Printf("[AUTH] Failed to prune sessions of user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle counts failed attempts by key, e.g. a username or an IP address.
+// Once a key has used its free attempts, each further failure blocks it for
+// twice as long as the previous one, up to a maximum. A key is forgotten
+// once it has not failed for the window.
+type Throttle struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+
+	mutex     sync.Mutex
+	attempts  map[string]*attempts
+	lastSweep time.Time
+}
+
+type attempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// NewThrottle returns a throttle allowing free failed attempts per key
+// before delays of baseDelay doubling up to maxDelay
+func NewThrottle(free int, baseDelay, maxDelay, window time.Duration) *Throttle {
+	return &Throttle{
+		FreeAttempts: free,
+		BaseDelay:    baseDelay,
+		MaxDelay:     maxDelay,
+		Window:       window,
+		attempts:     make(map[string]*attempts),
+		lastSweep:    time.Now(),
+	}
+}
+
+// Attempt returns how long a key is still blocked, or counts an attempt as
+// failed before it is made and returns 0. Checking and counting together
+// keeps concurrent attempts from all passing before any of them fails. An
+// attempt that does not fail is taken back with Release.
+func (t *Throttle) Attempt(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	t.sweepLocked(now)
+
+	entry, exists := t.attempts[key]
+	if exists {
+		if wait := waitUntil(entry.blockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	if !exists || now.Sub(entry.lastFailure) > t.Window {
+		entry = &attempts{}
+		t.attempts[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+
+	if excess := entry.failures - t.FreeAttempts; excess > 0 {
+		delay := t.MaxDelay
+		if excess <= 30 && t.BaseDelay<<(excess-1) < t.MaxDelay {
+			delay = t.BaseDelay << (excess - 1)
+		}
+		entry.blockedUntil = now.Add(delay)
+	}
+	return 0
+}
+
+// Release takes back an attempt that did not fail
+func (t *Throttle) Release(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, exists := t.attempts[key]
+	if !exists || entry.failures == 0 {
+		return
+	}
+	entry.failures--
+	if entry.failures <= t.FreeAttempts {
+		entry.blockedUntil = time.Time{}
+	}
+}
+
+// Failures returns how many attempts a key has failed in a row
+func (t *Throttle) Failures(key string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if entry, exists := t.attempts[key]; exists {
+		return entry.failures
+	}
+	return 0
+}
+
+// Blocked returns how long a key is still blocked, or 0
+func (t *Throttle) Blocked(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if entry, exists := t.attempts[key]; exists {
+		return waitUntil(entry.blockedUntil)
+	}
+	return 0
+}
+
+// Reset forgets a key's failures
+func (t *Throttle) Reset(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.attempts, key)
+}
+
+// sweepLocked forgets the keys that have not failed for the window, at
+// most once per window. The caller holds t.mutex.
+func (t *Throttle) sweepLocked(now time.Time) {
+	if now.Sub(t.lastSweep) < t.Window {
+		return
+	}
+	t.lastSweep = now
+	for key, entry := range t.attempts {
+		if now.Sub(entry.lastFailure) > t.Window && !now.Before(entry.blockedUntil) {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// waitUntil returns the time left until a deadline, or 0 once it passed
+func waitUntil(deadline time.Time) time.Duration {
+	if wait := time.Until(deadline); wait > 0 {
+		return wait
+	}
+	return 0
+}
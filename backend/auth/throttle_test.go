@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottleConcurrentAttempts(t *testing.T) {
+	throttle := NewThrottle(3, time.Minute, time.Hour, time.Hour)
+
+	// A burst of parallel attempts gets no more than the free attempts and
+	// the one that starts the delay
+	var passed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if throttle.Attempt("alice") == 0 {
+				atomic.AddInt32(&passed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if passed != 4 {
+		t.Errorf("%d attempts passed, want 4", passed)
+	}
+	if throttle.Blocked("alice") == 0 {
+		t.Error("alice is not blocked after the burst")
+	}
+	if throttle.Attempt("bob") != 0 {
+		t.Error("another key was blocked")
+	}
+}
+
+func TestThrottleRelease(t *testing.T) {
+	throttle := NewThrottle(1, time.Minute, time.Hour, time.Hour)
+
+	// Attempts that do not fail are taken back and never add up
+	for i := 0; i < 5; i++ {
+		if wait := throttle.Attempt("alice"); wait != 0 {
+			t.Fatalf("attempt %d blocked for %s", i+1, wait)
+		}
+		throttle.Release("alice")
+	}
+	if failures := throttle.Failures("alice"); failures != 0 {
+		t.Errorf("failures = %d, want 0", failures)
+	}
+
+	throttle.Attempt("alice")
+	throttle.Attempt("alice")
+	if throttle.Blocked("alice") == 0 {
+		t.Fatal("alice is not blocked after two failures")
+	}
+	throttle.Release("alice")
+	if wait := throttle.Blocked("alice"); wait != 0 {
+		t.Errorf("alice still blocked for %s after the attempt was taken back", wait)
+	}
+}
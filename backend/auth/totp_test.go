@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238 appendix B, truncated to six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	current := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		want     bool
+	}{
+		{"current code", totpCode(key, current), 0, true},
+		{"spaced code", totpCode(key, current)[:3] + " " + totpCode(key, current)[3:], 0, true},
+		{"previous code within the skew", totpCode(key, current-1), 0, true},
+		{"next code within the skew", totpCode(key, current+1), 0, true},
+		{"code outside the skew", totpCode(key, current-2), 0, false},
+		{"code already used", totpCode(key, current), current, false},
+		{"code before the last one used", totpCode(key, current-1), current, false},
+		{"short code", "12345", 0, false},
+		{"empty code", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(secret, tt.code, tt.lastStep)
+			if ok != tt.want {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, tt.want)
+			}
+			if ok && step <= tt.lastStep {
+				t.Errorf("step = %d, want after %d", step, tt.lastStep)
+			}
+		})
+	}
+
+	if _, ok := ValidateTOTP("not base32!", totpCode(key, current), 0); ok {
+		t.Error("ValidateTOTP accepted an invalid secret")
+	}
+}
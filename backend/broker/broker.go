@@ -0,0 +1,293 @@
+// Package broker carries WebSocket hub traffic between the backend nodes of
+// a cluster, so that a message for an extension reaches its sockets
+// whichever node they are connected to, and each node knows which
+// extensions are connected elsewhere.
+//
+// A node's hub delivers to its own sockets and hands the message to the
+// broker, which passes it to the hubs of the other nodes. The memory broker
+// connects hubs in one process; the Redis broker connects nodes through
+// Redis pub/sub.
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"voip-backend/config"
+	"voip-backend/protocol"
+)
+
+// Broker fans hub traffic out to the other nodes of a cluster
+type Broker interface {
+	// NodeID identifies this node in the cluster
+	NodeID() string
+
+	// Start passes traffic from the other nodes to handler until Close
+	Start(handler Handler) error
+
+	// SendToExtension passes a message for an extension to the other nodes
+	SendToExtension(extension string, msg protocol.Message) error
+
+	// Broadcast passes a message for every client to the other nodes
+	Broadcast(msg protocol.Message) error
+
+	// DisconnectUser asks the other nodes to close the user's connections,
+	// or only those of one of their sessions when sessionID is not zero
+	DisconnectUser(userID, sessionID uint, code int, reason string) error
+
+	// SetPresence records how many clients this node has for an extension;
+	// zero means the extension may still resume its connection here.
+	// ClearPresence records that the extension is gone from this node.
+	// Neither blocks on the network.
+	SetPresence(extension string, clients int)
+	ClearPresence(extension string)
+
+	// RemotePresence returns the extensions present on the other nodes with
+	// their client counts
+	RemotePresence() map[string]int
+
+	Close() error
+}
+
+// Handler receives the traffic of the other nodes. The hub implements it
+// by delivering to its own sockets only.
+type Handler interface {
+	DeliverToExtension(extension string, msg protocol.Message)
+	DeliverBroadcast(msg protocol.Message)
+	DeliverDisconnectUser(userID, sessionID uint, code int, reason string)
+}
+
+// Kinds of envelope exchanged between nodes
+const (
+	KindExtension      = "extension"
+	KindBroadcast      = "broadcast"
+	KindDisconnectUser = "disconnect_user"
+	KindPresence       = "presence"
+	KindLeave          = "leave"
+)
+
+// Envelope is the unit of traffic between nodes
+type Envelope struct {
+	Node string `json:"node"` // sending node
+	Kind string `json:"kind"`
+
+	// extension and broadcast
+	Extension     string          `json:"extension,omitempty"`
+	Type          string          `json:"type,omitempty"`
+	ID            string          `json:"id,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+
+	// disconnect_user
+	UserID    uint   `json:"user_id,omitempty"`
+	SessionID uint   `json:"session_id,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+
+	// presence: the sender's full client counts. Sync asks the other nodes
+	// to send theirs at once, which a node does when it joins.
+	Presence map[string]int `json:"presence,omitempty"`
+	Sync     bool           `json:"sync,omitempty"`
+}
+
+// messageEnvelope wraps a hub message for the other nodes
+func messageEnvelope(node, kind, extension string, msg protocol.Message) (Envelope, error) {
+	envelope := Envelope{
+		Node:          node,
+		Kind:          kind,
+		Extension:     extension,
+		Type:          msg.Type,
+		ID:            msg.ID,
+		CorrelationID: msg.CorrelationID,
+	}
+	if envelope.ID == "" {
+		envelope.ID = protocol.NewID()
+	}
+	if msg.Payload != nil {
+		payload, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return envelope, fmt.Errorf("failed to encode %s: %v", msg.Type, err)
+		}
+		envelope.Payload = payload
+	}
+	return envelope, nil
+}
+
+// Message returns the hub message an extension or broadcast envelope carries
+func (e Envelope) Message() protocol.Message {
+	msg := protocol.Message{Type: e.Type, ID: e.ID, CorrelationID: e.CorrelationID}
+	if len(e.Payload) > 0 {
+		msg.Payload = e.Payload
+	}
+	return msg
+}
+
+// dispatch passes an envelope from another node to the handler
+func dispatch(handler Handler, envelope Envelope) {
+	switch envelope.Kind {
+	case KindExtension:
+		handler.DeliverToExtension(envelope.Extension, envelope.Message())
+	case KindBroadcast:
+		handler.DeliverBroadcast(envelope.Message())
+	case KindDisconnectUser:
+		handler.DeliverDisconnectUser(envelope.UserID, envelope.SessionID, envelope.Code, envelope.Reason)
+	}
+}
+
+// presenceTable keeps the client counts the other nodes reported. With a
+// ttl, nodes that stop reporting are forgotten.
+type presenceTable struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	nodes map[string]*nodePresence
+}
+
+type nodePresence struct {
+	extensions map[string]int
+	seen       time.Time
+}
+
+func newPresenceTable(ttl time.Duration) *presenceTable {
+	return &presenceTable{ttl: ttl, nodes: make(map[string]*nodePresence)}
+}
+
+// update replaces the counts of a node
+func (t *presenceTable) update(node string, extensions map[string]int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, known := t.nodes[node]; !known {
+		log.Printf("[BROKER] Node %s joined with %d extensions", node, len(extensions))
+	}
+	t.nodes[node] = &nodePresence{extensions: extensions, seen: time.Now()}
+}
+
+// remove forgets a node that left
+func (t *presenceTable) remove(node string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, known := t.nodes[node]; known {
+		delete(t.nodes, node)
+		log.Printf("[BROKER] Node %s left", node)
+	}
+}
+
+// aggregate sums the counts of every node but exclude
+func (t *presenceTable) aggregate(exclude string) map[string]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	total := make(map[string]int)
+	for node, presence := range t.nodes {
+		if t.ttl > 0 && time.Since(presence.seen) > t.ttl {
+			delete(t.nodes, node)
+			log.Printf("[BROKER] Node %s stopped reporting presence", node)
+			continue
+		}
+		if node == exclude {
+			continue
+		}
+		for extension, clients := range presence.extensions {
+			total[extension] += clients
+		}
+	}
+	return total
+}
+
+// localPresence is the client counts of this node, copied for reporting
+type localPresence struct {
+	mutex      sync.Mutex
+	extensions map[string]int
+}
+
+func (p *localPresence) set(extension string, clients int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.extensions == nil {
+		p.extensions = make(map[string]int)
+	}
+	p.extensions[extension] = clients
+}
+
+func (p *localPresence) clear(extension string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.extensions, extension)
+}
+
+func (p *localPresence) snapshot() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	snapshot := make(map[string]int, len(p.extensions))
+	for extension, clients := range p.extensions {
+		snapshot[extension] = clients
+	}
+	return snapshot
+}
+
+var (
+	globalBroker Broker
+	brokerMutex  sync.Mutex
+)
+
+// InitBroker creates the broker selected by the BROKER setting. The Redis
+// broker keeps reconnecting in the background, so only a bad setting is an
+// error.
+func InitBroker() error {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+
+	node := config.AppConfig.NodeID
+	if node == "" {
+		node = defaultNodeID()
+	}
+
+	switch strings.ToLower(config.AppConfig.Broker) {
+	case "", "memory":
+		globalBroker = NewMemoryBroker(NewMemoryBus(), node)
+		log.Printf("[BROKER] Using the in-memory broker (single node %s)", node)
+	case "redis":
+		globalBroker = NewRedisBroker(RedisConfig{
+			Address:  config.AppConfig.RedisAddr,
+			Password: config.AppConfig.RedisPassword,
+			Channel:  config.AppConfig.RedisChannel,
+			Node:     node,
+		})
+		log.Printf("[BROKER] Using the Redis broker at %s (node %s)", config.AppConfig.RedisAddr, node)
+	default:
+		return fmt.Errorf("unknown broker %q (use memory or redis)", config.AppConfig.Broker)
+	}
+	return nil
+}
+
+// GetBroker returns the global broker
+func GetBroker() Broker {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	return globalBroker
+}
+
+// StopBroker leaves the cluster
+func StopBroker() {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+
+	if globalBroker != nil {
+		globalBroker.Close()
+		globalBroker = nil
+	}
+}
+
+// defaultNodeID names a node after its host and process
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "node"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"voip-backend/protocol"
+)
+
+// memoryQueueSize is how many envelopes a node of a memory bus may have
+// waiting before new ones are dropped
+const memoryQueueSize = 1024
+
+// MemoryBus connects the memory brokers of the hubs in one process. A bus
+// with a single broker is the single-node setup.
+type MemoryBus struct {
+	mutex    sync.RWMutex
+	nodes    map[string]chan Envelope
+	presence *presenceTable
+}
+
+// NewMemoryBus creates an empty bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		nodes:    make(map[string]chan Envelope),
+		presence: newPresenceTable(0),
+	}
+}
+
+// publish queues an envelope for every node but its sender
+func (b *MemoryBus) publish(envelope Envelope) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for node, queue := range b.nodes {
+		if node == envelope.Node {
+			continue
+		}
+		select {
+		case queue <- envelope:
+		default:
+			log.Printf("[BROKER] Queue of node %s is full, dropping %s", node, envelope.Kind)
+		}
+	}
+}
+
+// MemoryBroker is a node of a MemoryBus
+type MemoryBroker struct {
+	bus   *MemoryBus
+	node  string
+	local localPresence
+
+	queue     chan Envelope
+	closeOnce sync.Once
+}
+
+// NewMemoryBroker joins a bus as the given node
+func NewMemoryBroker(bus *MemoryBus, node string) *MemoryBroker {
+	return &MemoryBroker{bus: bus, node: node, queue: make(chan Envelope, memoryQueueSize)}
+}
+
+// NodeID returns the node name
+func (b *MemoryBroker) NodeID() string {
+	return b.node
+}
+
+// Start delivers the envelopes of the other nodes to handler in order
+func (b *MemoryBroker) Start(handler Handler) error {
+	b.bus.mutex.Lock()
+	b.bus.nodes[b.node] = b.queue
+	b.bus.mutex.Unlock()
+
+	go func() {
+		for envelope := range b.queue {
+			dispatch(handler, envelope)
+		}
+	}()
+	return nil
+}
+
+// SendToExtension passes a message for an extension to the other nodes
+func (b *MemoryBroker) SendToExtension(extension string, msg protocol.Message) error {
+	envelope, err := messageEnvelope(b.node, KindExtension, extension, msg)
+	if err != nil {
+		return err
+	}
+	b.bus.publish(envelope)
+	return nil
+}
+
+// Broadcast passes a message for every client to the other nodes
+func (b *MemoryBroker) Broadcast(msg protocol.Message) error {
+	envelope, err := messageEnvelope(b.node, KindBroadcast, "", msg)
+	if err != nil {
+		return err
+	}
+	b.bus.publish(envelope)
+	return nil
+}
+
+// DisconnectUser asks the other nodes to close the user's connections
+func (b *MemoryBroker) DisconnectUser(userID, sessionID uint, code int, reason string) error {
+	b.bus.publish(Envelope{Node: b.node, Kind: KindDisconnectUser, UserID: userID, SessionID: sessionID, Code: code, Reason: reason})
+	return nil
+}
+
+// SetPresence records how many clients this node has for an extension
+func (b *MemoryBroker) SetPresence(extension string, clients int) {
+	b.local.set(extension, clients)
+	b.bus.presence.update(b.node, b.local.snapshot())
+}
+
+// ClearPresence records that an extension is gone from this node
+func (b *MemoryBroker) ClearPresence(extension string) {
+	b.local.clear(extension)
+	b.bus.presence.update(b.node, b.local.snapshot())
+}
+
+// RemotePresence returns the extensions present on the other nodes
+func (b *MemoryBroker) RemotePresence() map[string]int {
+	return b.bus.presence.aggregate(b.node)
+}
+
+// Close leaves the bus
+func (b *MemoryBroker) Close() error {
+	b.closeOnce.Do(func() {
+		b.bus.mutex.Lock()
+		delete(b.bus.nodes, b.node)
+		b.bus.mutex.Unlock()
+		b.bus.presence.remove(b.node)
+		close(b.queue)
+	})
+	return nil
+}
@@ -0,0 +1,332 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"voip-backend/protocol"
+)
+
+const (
+	// redisDialTimeout bounds connecting to Redis and waiting for a reply
+	redisDialTimeout = 5 * time.Second
+
+	// Default pub/sub channel and presence report interval
+	defaultRedisChannel     = "voip:hub"
+	defaultPresenceInterval = 5 * time.Second
+)
+
+// RedisConfig configures a Redis broker
+type RedisConfig struct {
+	Address  string // host:port
+	Password string
+	Channel  string // pub/sub channel shared by the nodes
+	Node     string
+
+	// How often the node reports its presence. Nodes that miss three
+	// reports in a row are forgotten.
+	PresenceInterval time.Duration
+}
+
+// RedisBroker connects the nodes of a cluster through Redis pub/sub. Every
+// node publishes to and subscribes to one channel; presence is reported in
+// the same channel, so no Redis keys are used.
+type RedisBroker struct {
+	config RedisConfig
+	local  localPresence
+	remote *presenceTable
+
+	// Connection for PUBLISH, dialled on demand. After a failed dial,
+	// publishing fails fast until pubRetryAt.
+	pubMutex   sync.Mutex
+	pubConn    net.Conn
+	pubReader  *bufio.Reader
+	pubWriter  *bufio.Writer
+	pubRetryAt time.Time
+
+	// Connection in subscribe mode, replaced on reconnect
+	subMutex sync.Mutex
+	subConn  net.Conn
+
+	presenceChanged chan struct{}
+	quit            chan struct{}
+	closeOnce       sync.Once
+}
+
+// NewRedisBroker creates a broker; Start connects it
+func NewRedisBroker(config RedisConfig) *RedisBroker {
+	if config.Channel == "" {
+		config.Channel = defaultRedisChannel
+	}
+	if config.PresenceInterval <= 0 {
+		config.PresenceInterval = defaultPresenceInterval
+	}
+
+	return &RedisBroker{
+		config:          config,
+		remote:          newPresenceTable(3 * config.PresenceInterval),
+		presenceChanged: make(chan struct{}, 1),
+		quit:            make(chan struct{}),
+	}
+}
+
+// NodeID returns the node name
+func (b *RedisBroker) NodeID() string {
+	return b.config.Node
+}
+
+// Start subscribes to the channel, reconnecting in the background whenever
+// the connection drops, and starts reporting presence
+func (b *RedisBroker) Start(handler Handler) error {
+	go b.subscribeLoop(handler)
+	go b.presenceLoop()
+	return nil
+}
+
+// dial connects and authenticates
+func (b *RedisBroker) dial() (net.Conn, *bufio.Reader, *bufio.Writer, error) {
+	conn, err := net.DialTimeout("tcp", b.config.Address, redisDialTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	if b.config.Password != "" {
+		conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		if err := writeCommand(writer, "AUTH", b.config.Password); err == nil {
+			_, err = readReply(reader)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, nil, fmt.Errorf("AUTH failed: %v", err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, reader, writer, nil
+}
+
+// subscribeLoop receives the channel's envelopes until Close
+func (b *RedisBroker) subscribeLoop(handler Handler) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := b.subscribe(handler)
+		if time.Since(started) > 10*time.Second {
+			backoff = time.Second // the subscription was up for a while
+		}
+
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+
+		log.Printf("[BROKER] Redis subscription lost: %v; reconnecting in %s", err, backoff)
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// subscribe runs one subscription until its connection fails
+func (b *RedisBroker) subscribe(handler Handler) error {
+	conn, reader, writer, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b.subMutex.Lock()
+	b.subConn = conn
+	b.subMutex.Unlock()
+
+	if err := writeCommand(writer, "SUBSCRIBE", b.config.Channel); err != nil {
+		return err
+	}
+	log.Printf("[BROKER] Subscribed to Redis channel %s at %s", b.config.Channel, b.config.Address)
+
+	// Ask the other nodes who is where
+	b.publishPresence(true)
+
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue // subscribe confirmations
+		}
+		payload, _ := items[2].(string)
+
+		var envelope Envelope
+		if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+			log.Printf("[BROKER] Ignoring malformed envelope: %v", err)
+			continue
+		}
+		if envelope.Node == b.config.Node {
+			continue
+		}
+
+		switch envelope.Kind {
+		case KindPresence:
+			b.remote.update(envelope.Node, envelope.Presence)
+			if envelope.Sync {
+				b.reportPresence()
+			}
+		case KindLeave:
+			b.remote.remove(envelope.Node)
+		default:
+			dispatch(handler, envelope)
+		}
+	}
+}
+
+// publish sends an envelope to the channel, redialling once if the
+// connection went stale
+func (b *RedisBroker) publish(envelope Envelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	b.pubMutex.Lock()
+	defer b.pubMutex.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pubConn == nil {
+			if time.Now().Before(b.pubRetryAt) {
+				return fmt.Errorf("no connection to Redis at %s", b.config.Address)
+			}
+			if b.pubConn, b.pubReader, b.pubWriter, err = b.dial(); err != nil {
+				b.pubConn = nil
+				b.pubRetryAt = time.Now().Add(2 * time.Second)
+				return fmt.Errorf("failed to connect to Redis: %v", err)
+			}
+		}
+
+		b.pubConn.SetDeadline(time.Now().Add(redisDialTimeout))
+		if err = writeCommand(b.pubWriter, "PUBLISH", b.config.Channel, string(data)); err == nil {
+			_, err = readReply(b.pubReader)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, isReply := err.(redisError); isReply {
+			return err
+		}
+		b.pubConn.Close()
+		b.pubConn = nil
+	}
+	return fmt.Errorf("failed to publish to Redis: %v", err)
+}
+
+// SendToExtension passes a message for an extension to the other nodes
+func (b *RedisBroker) SendToExtension(extension string, msg protocol.Message) error {
+	envelope, err := messageEnvelope(b.config.Node, KindExtension, extension, msg)
+	if err != nil {
+		return err
+	}
+	return b.publish(envelope)
+}
+
+// Broadcast passes a message for every client to the other nodes
+func (b *RedisBroker) Broadcast(msg protocol.Message) error {
+	envelope, err := messageEnvelope(b.config.Node, KindBroadcast, "", msg)
+	if err != nil {
+		return err
+	}
+	return b.publish(envelope)
+}
+
+// DisconnectUser asks the other nodes to close the user's connections
+func (b *RedisBroker) DisconnectUser(userID, sessionID uint, code int, reason string) error {
+	return b.publish(Envelope{Node: b.config.Node, Kind: KindDisconnectUser, UserID: userID, SessionID: sessionID, Code: code, Reason: reason})
+}
+
+// SetPresence records how many clients this node has for an extension
+func (b *RedisBroker) SetPresence(extension string, clients int) {
+	b.local.set(extension, clients)
+	b.reportPresence()
+}
+
+// ClearPresence records that an extension is gone from this node
+func (b *RedisBroker) ClearPresence(extension string) {
+	b.local.clear(extension)
+	b.reportPresence()
+}
+
+// RemotePresence returns the extensions present on the other nodes
+func (b *RedisBroker) RemotePresence() map[string]int {
+	return b.remote.aggregate(b.config.Node)
+}
+
+// reportPresence asks presenceLoop to publish the node's presence soon
+func (b *RedisBroker) reportPresence() {
+	select {
+	case b.presenceChanged <- struct{}{}:
+	default:
+	}
+}
+
+// presenceLoop publishes the node's presence when it changes and on every
+// interval, so that other nodes can tell it is still alive
+func (b *RedisBroker) presenceLoop() {
+	ticker := time.NewTicker(b.config.PresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		case <-b.presenceChanged:
+		}
+		b.publishPresence(false)
+	}
+}
+
+func (b *RedisBroker) publishPresence(requestSync bool) {
+	err := b.publish(Envelope{
+		Node:     b.config.Node,
+		Kind:     KindPresence,
+		Presence: b.local.snapshot(),
+		Sync:     requestSync,
+	})
+	if err != nil {
+		log.Printf("[BROKER] Failed to publish presence: %v", err)
+	}
+}
+
+// Close tells the other nodes this one is leaving and disconnects
+func (b *RedisBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+		if err := b.publish(Envelope{Node: b.config.Node, Kind: KindLeave}); err != nil {
+			log.Printf("[BROKER] Failed to announce leaving: %v", err)
+		}
+
+		b.subMutex.Lock()
+		if b.subConn != nil {
+			b.subConn.Close()
+		}
+		b.subMutex.Unlock()
+
+		b.pubMutex.Lock()
+		if b.pubConn != nil {
+			b.pubConn.Close()
+			b.pubConn = nil
+		}
+		b.pubMutex.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package redistest provides an in-process stand-in for Redis pub/sub. It
+// speaks enough of the RESP protocol (PING, AUTH, PUBLISH, SUBSCRIBE,
+// UNSUBSCRIBE and QUIT) for the Redis broker to run without a Redis server,
+// and lets callers drop connections to simulate a restart.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config controls the behaviour of the fake server
+type Config struct {
+	// Password required by AUTH; empty accepts every connection
+	Password string
+
+	// Logf receives debug output; nil disables logging
+	Logf func(format string, args ...interface{})
+}
+
+// Server is a fake Redis server listening on a local TCP port
+type Server struct {
+	config   Config
+	listener net.Listener
+	address  string
+
+	mutex     sync.Mutex
+	sessions  map[*Session]bool
+	published int
+
+	wg     sync.WaitGroup
+	closed chan struct{}
+}
+
+// Session is one client connection
+type Session struct {
+	server *Server
+	conn   net.Conn
+
+	writeMutex    sync.Mutex
+	writer        *bufio.Writer
+	authenticated bool
+	channels      map[string]bool // guarded by server.mutex
+}
+
+// NewServer creates a server with the given configuration. Use Start to
+// begin listening.
+func NewServer(config Config) *Server {
+	return &Server{
+		config:   config,
+		sessions: make(map[*Session]bool),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Start listens on the given address ("127.0.0.1:0" picks a free port)
+func (s *Server) Start(address string) error {
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", address, err)
+	}
+
+	s.mutex.Lock()
+	s.listener = listener
+	s.address = listener.Addr().String()
+	s.closed = make(chan struct{})
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go s.acceptLoop(listener)
+
+	s.logf("Fake Redis listening on %s", s.address)
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.address
+}
+
+// Close stops listening and drops every connection
+func (s *Server) Close() {
+	s.mutex.Lock()
+	listener := s.listener
+	s.listener = nil
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+// DropConnections forcibly closes every client connection while the
+// server keeps accepting new ones
+func (s *Server) DropConnections() {
+	s.mutex.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.conn.Close()
+	}
+}
+
+// Published returns how many messages have been published so far
+func (s *Server) Published() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.published
+}
+
+// Subscribers returns how many connections are subscribed to a channel
+func (s *Server) Subscribers(channel string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for session := range s.sessions {
+		if session.channels[channel] {
+			count++
+		}
+	}
+	return count
+}
+
+// acceptLoop accepts connections until the listener is closed
+func (s *Server) acceptLoop(listener net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		session := &Session{
+			server:        s,
+			conn:          conn,
+			writer:        bufio.NewWriter(conn),
+			authenticated: s.config.Password == "",
+			channels:      make(map[string]bool),
+		}
+		s.mutex.Lock()
+		s.sessions[session] = true
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go session.serve()
+	}
+}
+
+// serve reads commands from one connection
+func (session *Session) serve() {
+	s := session.server
+	defer func() {
+		session.conn.Close()
+		s.mutex.Lock()
+		delete(s.sessions, session)
+		s.mutex.Unlock()
+		s.wg.Done()
+	}()
+
+	reader := bufio.NewReader(session.conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				s.logf("Fake Redis: closing connection: %v", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !session.handle(args) {
+			return
+		}
+	}
+}
+
+// handle runs one command; false closes the connection
+func (session *Session) handle(args []string) bool {
+	s := session.server
+	command := strings.ToUpper(args[0])
+
+	if !session.authenticated && command != "AUTH" && command != "QUIT" {
+		session.write(errorReply("NOAUTH Authentication required."))
+		return true
+	}
+
+	switch command {
+	case "PING":
+		if len(args) > 1 {
+			session.write(bulkReply(args[1]))
+		} else {
+			session.write("+PONG\r\n")
+		}
+	case "AUTH":
+		if len(args) != 2 {
+			session.write(errorReply("ERR wrong number of arguments for 'auth' command"))
+		} else if s.config.Password == "" {
+			session.write(errorReply("ERR AUTH <password> called without any password configured for the default user"))
+		} else if args[1] != s.config.Password {
+			session.write(errorReply("WRONGPASS invalid username-password pair or user is disabled."))
+		} else {
+			session.authenticated = true
+			session.write("+OK\r\n")
+		}
+	case "PUBLISH":
+		if len(args) != 3 {
+			session.write(errorReply("ERR wrong number of arguments for 'publish' command"))
+			return true
+		}
+		session.write(fmt.Sprintf(":%d\r\n", s.publish(args[1], args[2])))
+	case "SUBSCRIBE":
+		if len(args) < 2 {
+			session.write(errorReply("ERR wrong number of arguments for 'subscribe' command"))
+			return true
+		}
+		for _, channel := range args[1:] {
+			s.mutex.Lock()
+			session.channels[channel] = true
+			count := len(session.channels)
+			s.mutex.Unlock()
+			session.write(arrayReply(bulkReply("subscribe"), bulkReply(channel), fmt.Sprintf(":%d\r\n", count)))
+		}
+	case "UNSUBSCRIBE":
+		s.mutex.Lock()
+		channels := args[1:]
+		if len(channels) == 0 {
+			for channel := range session.channels {
+				channels = append(channels, channel)
+			}
+		}
+		s.mutex.Unlock()
+		for _, channel := range channels {
+			s.mutex.Lock()
+			delete(session.channels, channel)
+			count := len(session.channels)
+			s.mutex.Unlock()
+			session.write(arrayReply(bulkReply("unsubscribe"), bulkReply(channel), fmt.Sprintf(":%d\r\n", count)))
+		}
+	case "QUIT":
+		session.write("+OK\r\n")
+		return false
+	default:
+		session.write(errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0])))
+	}
+	return true
+}
+
+// publish sends a message to the subscribers of a channel and returns how
+// many received it
+func (s *Server) publish(channel, message string) int {
+	s.mutex.Lock()
+	s.published++
+	var subscribers []*Session
+	for session := range s.sessions {
+		if session.channels[channel] {
+			subscribers = append(subscribers, session)
+		}
+	}
+	s.mutex.Unlock()
+
+	reply := arrayReply(bulkReply("message"), bulkReply(channel), bulkReply(message))
+	for _, session := range subscribers {
+		session.write(reply)
+	}
+	return len(subscribers)
+}
+
+// write sends a raw reply
+func (session *Session) write(data string) {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	session.writer.WriteString(data)
+	if err := session.writer.Flush(); err != nil {
+		session.conn.Close()
+	}
+}
+
+func bulkReply(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func errorReply(message string) string {
+	return "-" + message + "\r\n"
+}
+
+func arrayReply(items ...string) string {
+	return fmt.Sprintf("*%d\r\n", len(items)) + strings.Join(items, "")
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings, or as an
+// inline command line
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("bad array length %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("expected bulk string, got %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("bad bulk length %q", header)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, errors.New("bulk string not terminated by CRLF")
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.config.Logf != nil {
+		s.config.Logf(format, args...)
+	}
+}
+
+// StdLogf can be used as Config.Logf to log through the standard logger
+func StdLogf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
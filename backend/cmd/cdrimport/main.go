@@ -0,0 +1,66 @@
+// Command cdrimport replays Asterisk CSV CDR files into the call logs, for
+// backfilling calls made while the backend was down or before CDR ingestion
+// was enabled:
+//
+//	go run ./cmd/cdrimport -file /var/log/asterisk/cdr-csv/Master.csv
+//
+// It uses the same configuration (DB_PATH, ...) as the backend. Records that
+// were already applied are skipped, so a file can be replayed safely.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"voip-backend/asterisk"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/services"
+)
+
+func main() {
+	file := flag.String("file", "", "CDR CSV file to import (- for stdin)")
+	dryRun := flag.Bool("dry-run", false, "parse the file and print the records without touching the database")
+	flag.Parse()
+
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var reader io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatalf("Failed to open CDR file: %v", err)
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	records, err := asterisk.ReadCDRCSV(reader)
+	if err != nil {
+		log.Fatalf("Failed to read CDR file: %v", err)
+	}
+	log.Printf("Read %d CDRs from %s", len(records), *file)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	if *dryRun {
+		encoder.Encode(records)
+		return
+	}
+
+	config.LoadConfig()
+	database.InitDatabase()
+
+	result := services.ImportCDRs(records)
+	encoder.Encode(result)
+
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+// Command fakeami runs the in-process fake Asterisk AMI server on its own so
+// the backend can be started on a laptop without Asterisk:
+//
+//	go run ./cmd/fakeami -listen 127.0.0.1:5038 -endpoints 1000,1001,1002,1003
+//
+// then start the backend with ASTERISK_HOST=127.0.0.1 ASTERISK_AMI_PORT=5038.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"voip-backend/asterisk/amitest"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:5038", "address to listen on")
+	username := flag.String("username", "admin", "AMI username accepted by Login")
+	secret := flag.String("secret", "amp111", "AMI secret accepted by Login")
+	endpoints := flag.String("endpoints", "1000,1001,1002,1003", "comma separated PJSIP endpoints reported as registered")
+	queues := flag.String("queues", "support", "comma separated queues defined as if in queues.conf")
+	answerAfter := flag.Duration("answer-after", 3*time.Second, "auto-answer dialled extensions after this delay (0 keeps them ringing)")
+	flag.Parse()
+
+	server := amitest.NewServer(amitest.Config{
+		Username:    *username,
+		Secret:      *secret,
+		AnswerAfter: *answerAfter,
+		Logf:        amitest.StdLogf,
+	})
+
+	for _, endpoint := range strings.Split(*endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			server.AddEndpoint(endpoint, true)
+		}
+	}
+
+	for _, queue := range strings.Split(*queues, ",") {
+		if queue = strings.TrimSpace(queue); queue != "" {
+			server.AddQueue(queue)
+		}
+	}
+
+	// Answer is not a real AMI action, but the REST answer flow sends it;
+	// accept it so calls can be answered from the browser during development
+	server.Handle("Answer", func(session *amitest.Session, action amitest.Action) {
+		if err := server.Answer(action.Fields["Channel"]); err != nil {
+			session.Reply(action, amitest.Frame{"Response": "Error", "Message": err.Error()})
+			return
+		}
+		session.Reply(action, amitest.Frame{"Response": "Success", "Message": "Channel answered"})
+	})
+
+	if err := server.Start(*listen); err != nil {
+		log.Fatalf("Failed to start fake AMI server: %v", err)
+	}
+	log.Printf("Fake AMI server ready on %s (username: %s)", server.Addr(), *username)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down fake AMI server")
+	server.Close()
+}
@@ -0,0 +1,40 @@
+// Command fakeredis runs the in-process Redis pub/sub stand-in on its own so
+// several backend nodes can be clustered on a laptop without Redis:
+//
+//	go run ./cmd/fakeredis -listen 127.0.0.1:6379
+//
+// then start each backend with BROKER=redis REDIS_ADDR=127.0.0.1:6379 and
+// its own PORT and NODE_ID.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"voip-backend/broker/redistest"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:6379", "address to listen on")
+	password := flag.String("password", "", "password required by AUTH (empty accepts any client)")
+	flag.Parse()
+
+	server := redistest.NewServer(redistest.Config{
+		Password: *password,
+		Logf:     redistest.StdLogf,
+	})
+
+	if err := server.Start(*listen); err != nil {
+		log.Fatalf("Failed to start fake Redis server: %v", err)
+	}
+	log.Printf("Fake Redis server ready on %s", server.Addr())
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down fake Redis server")
+	server.Close()
+}
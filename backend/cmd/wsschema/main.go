@@ -0,0 +1,35 @@
+// Command wsschema prints the JSON Schema of the WebSocket protocol, for
+// generating client types and validating messages in tests:
+//
+//	go run ./cmd/wsschema -o ../src/protocol/websocket.schema.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"voip-backend/protocol"
+)
+
+func main() {
+	output := flag.String("o", "-", "file to write the schema to (- for stdout)")
+	flag.Parse()
+
+	var writer io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create schema file: %v", err)
+		}
+		defer f.Close()
+		writer = f
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(protocol.Schema()); err != nil {
+		log.Fatalf("Failed to write schema: %v", err)
+	}
+}
@@ -14,9 +14,26 @@ type Config struct {
 	Port string
 	Host string
 
-	// JWT Configuration
-	JWTSecret      string
-	JWTExpiryHours int
+	// JWT Configuration: access tokens last minutes, the refresh tokens
+	// that renew them days
+	JWTSecret          string
+	AccessTokenMinutes int
+	RefreshTokenDays   int
+
+	// Issuer shown by authenticator apps for TOTP two-factor accounts
+	TOTPIssuer string
+
+	// Login protection: failed attempts allowed per username and per IP
+	// before each further one doubles a delay of up to LoginBackoffMaxSeconds,
+	// and consecutive failures that lock an account for LoginLockoutMinutes
+	LoginBackoffAfter      int
+	LoginIPBackoffAfter    int
+	LoginBackoffMaxSeconds int
+	LoginLockoutThreshold  int
+	LoginLockoutMinutes    int
+
+	// Proxies whose X-Forwarded-For / X-Real-IP headers give the client IP
+	TrustedProxies []string
 
 	// Database Configuration
 	DBPath string
@@ -34,6 +51,18 @@ type Config struct {
 	// CORS Configuration
 	CORSOrigins []string
 
+	// WebSocket resume: seconds an extension stays online after its last
+	// connection drops, and events kept per extension for replay
+	WSResumeGraceSeconds int
+	WSReplayBufferSize   int
+
+	// Cluster broker between backend nodes: memory (single node) or redis
+	Broker        string
+	NodeID        string
+	RedisAddr     string
+	RedisPassword string
+	RedisChannel  string
+
 	// Debug Mode
 	Debug bool
 
@@ -53,22 +82,37 @@ func LoadConfig() {
 	}
 
 	AppConfig = &Config{
-		Port:                getEnv("PORT", "8080"),
-		Host:                getEnv("HOST", "0.0.0.0"),
-		JWTSecret:           getEnv("JWT_SECRET", "default-secret-change-this"),
-		JWTExpiryHours:      getEnvAsInt("JWT_EXPIRY_HOURS", 24),
-		DBPath:              getEnv("DB_PATH", "./voip.db"),
-		AsteriskHost:        getEnv("ASTERISK_HOST", "asterisk.local"),
-		AsteriskAMIPort:     getEnv("ASTERISK_AMI_PORT", "5038"),
-		AsteriskAMIUsername: getEnv("ASTERISK_AMI_USERNAME", "admin"),
-		AsteriskAMISecret:   getEnv("ASTERISK_AMI_SECRET", "amp111"),
-		SIPDomain:           getEnv("SIP_DOMAIN", "asterisk.local"),
-		SIPPort:             getEnv("SIP_PORT", "8088"),
-		Debug:               getEnvAsBool("DEBUG", true),
-		Environment:         getEnv("ENVIRONMENT", "development"),
-		ServiceName:         getEnv("SERVICE_NAME", "voip-backend"),
-		DiscoveryMode:       getEnv("DISCOVERY_MODE", "auto"),
-		PublicHost:          getEnv("PUBLIC_HOST", ""),
+		Port:                   getEnv("PORT", "8080"),
+		Host:                   getEnv("HOST", "0.0.0.0"),
+		JWTSecret:              getEnv("JWT_SECRET", "default-secret-change-this"),
+		AccessTokenMinutes:     getEnvAsInt("ACCESS_TOKEN_TTL_MINUTES", 15),
+		RefreshTokenDays:       getEnvAsInt("REFRESH_TOKEN_TTL_DAYS", 30),
+		TOTPIssuer:             getEnv("TOTP_ISSUER", "Enterprise VoIP"),
+		LoginBackoffAfter:      getEnvAsInt("LOGIN_BACKOFF_AFTER", 3),
+		LoginIPBackoffAfter:    getEnvAsInt("LOGIN_IP_BACKOFF_AFTER", 20),
+		LoginBackoffMaxSeconds: getEnvAsInt("LOGIN_BACKOFF_MAX_SECONDS", 900),
+		LoginLockoutThreshold:  getEnvAsInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		LoginLockoutMinutes:    getEnvAsInt("LOGIN_LOCKOUT_MINUTES", 15),
+		TrustedProxies:         getEnvAsSlice("TRUSTED_PROXIES", []string{"127.0.0.1", "172.20.10.0/24"}),
+		DBPath:                 getEnv("DB_PATH", "./voip.db"),
+		AsteriskHost:           getEnv("ASTERISK_HOST", "asterisk.local"),
+		AsteriskAMIPort:        getEnv("ASTERISK_AMI_PORT", "5038"),
+		AsteriskAMIUsername:    getEnv("ASTERISK_AMI_USERNAME", "admin"),
+		AsteriskAMISecret:      getEnv("ASTERISK_AMI_SECRET", "amp111"),
+		SIPDomain:              getEnv("SIP_DOMAIN", "asterisk.local"),
+		SIPPort:                getEnv("SIP_PORT", "8088"),
+		WSResumeGraceSeconds:   getEnvAsInt("WS_RESUME_GRACE_SECONDS", 15),
+		WSReplayBufferSize:     getEnvAsInt("WS_REPLAY_BUFFER_SIZE", 200),
+		Broker:                 getEnv("BROKER", "memory"),
+		NodeID:                 getEnv("NODE_ID", ""),
+		RedisAddr:              getEnv("REDIS_ADDR", "127.0.0.1:6379"),
+		RedisPassword:          getEnv("REDIS_PASSWORD", ""),
+		RedisChannel:           getEnv("REDIS_CHANNEL", "voip:hub"),
+		Debug:                  getEnvAsBool("DEBUG", true),
+		Environment:            getEnv("ENVIRONMENT", "development"),
+		ServiceName:            getEnv("SERVICE_NAME", "voip-backend"),
+		DiscoveryMode:          getEnv("DISCOVERY_MODE", "auto"),
+		PublicHost:             getEnv("PUBLIC_HOST", ""),
 	}
 
 	// Resolve dynamic configurations
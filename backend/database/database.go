@@ -24,8 +24,10 @@ func InitDatabase() {
 		gormConfig.Logger = logger.Default.LogMode(logger.Silent)
 	}
 
-	// Connect to SQLite database using pure Go driver (modernc.org/sqlite)
-	dsn := config.AppConfig.DBPath + "?_pragma=foreign_keys(1)"
+	// Connect to SQLite database using pure Go driver (modernc.org/sqlite).
+	// Background services write concurrently with request handlers, so wait
+	// for locks instead of failing with SQLITE_BUSY.
+	dsn := config.AppConfig.DBPath + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
 	DB, err = gorm.Open(sqlite.Dialector{
 		DriverName: "sqlite",
 		DSN:        dsn,
@@ -41,6 +43,20 @@ func InitDatabase() {
 		&models.User{},
 		&models.CallLog{},
 		&models.ActiveCall{},
+		&models.WebRTCTransfer{},
+		&models.ConferenceRoom{},
+		&models.CallQueue{},
+		&models.Conversation{},
+		&models.ConversationMember{},
+		&models.ChatMessage{},
+		&models.PresenceTransition{},
+		&models.Session{},
+		&models.SessionToken{},
+		&models.MFARecoveryCode{},
+		&models.MFARolePolicy{},
+		&models.AuditEvent{},
+		&models.Role{},
+		&models.RolePermission{},
 	)
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
@@ -48,10 +64,33 @@ func InitDatabase() {
 
 	log.Println("Database migration completed")
 
-	// Create default admin user if not exists
+	// Create the built-in roles and the default admin user if not exists
+	createDefaultRoles()
 	createDefaultUsers()
 }
 
+// createDefaultRoles creates the built-in roles that are missing. Roles that
+// exist keep the permissions they were given.
+func createDefaultRoles() {
+	for _, def := range models.DefaultRoles {
+		var count int64
+		DB.Model(&models.Role{}).Where("name = ?", def.Name).Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		role := models.Role{Name: def.Name, Description: def.Description, BuiltIn: true}
+		for _, permission := range def.Permissions {
+			role.Permissions = append(role.Permissions, models.RolePermission{Role: def.Name, Permission: permission})
+		}
+		if err := DB.Create(&role).Error; err != nil {
+			log.Printf("Failed to create role %s: %v", def.Name, err)
+			continue
+		}
+		log.Printf("Created built-in role %s", def.Name)
+	}
+}
+
 func createDefaultUsers() {
 	var adminUser models.User
 	result := DB.Where("username = ?", "admin").First(&adminUser)
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most audit events returned at once
+const maxAuditEvents = 500
+
+// ListAuditEvents returns the latest security audit events, optionally of
+// one event type or user (admin only)
+func ListAuditEvents(c *gin.Context) {
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid limit",
+			})
+			return
+		}
+		limit = min(parsed, maxAuditEvents)
+	}
+
+	query := database.GetDB().Model(&models.AuditEvent{})
+	if event := c.Query("event"); event != "" {
+		query = query.Where("event = ?", event)
+	}
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid user ID format",
+			})
+			return
+		}
+		query = query.Where("user_id = ?", uint(userID))
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve audit events",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"events":  events,
+		"count":   len(events),
+	})
+}
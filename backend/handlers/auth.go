@@ -1,17 +1,27 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 	"voip-backend/auth"
 	"voip-backend/database"
+	"voip-backend/middleware"
 	"voip-backend/models"
+	"voip-backend/services"
+	"voip-backend/websocket"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+// dummyPasswordHash is compared against for unknown usernames. Its cost
+// matches the hashes of stored passwords.
+const dummyPasswordHash = "$2a$10$UHpM8ryQMN0GWidQ8iJ9e.X0t0UYYWCjY0wsSMK.e5MpJScXWnsgG"
+
 // Login handles user login
 func Login(c *gin.Context) {
 	var req models.LoginRequest
@@ -22,40 +32,99 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Slow down guessing from this IP address or at this username
+	ip := c.ClientIP()
+	if wait := auth.LoginAttempt(ip, req.Username); wait > 0 {
+		tooManyAttempts(c, wait, "Too many failed login attempts; try again later")
+		return
+	}
+
 	// Find user by username
 	var user models.User
 	if err := database.GetDB().Where("username = ?", req.Username).First(&user).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
+			// Take as long as a wrong password, so that timing does not
+			// tell which usernames exist
+			bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(req.Password))
+			auth.LoginFailed(ip, req.Username, nil)
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "Invalid credentials",
 			})
 			return
 		}
+		auth.LoginReleased(ip, req.Username)
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Database error",
 		})
 		return
 	}
 
+	// A locked account refuses even the right password
+	if locked := auth.AccountLockedFor(&user); locked > 0 {
+		auth.LoginReleased(ip, req.Username)
+		tooManyAttempts(c, locked, "Account temporarily locked after too many failed logins")
+		return
+	}
+
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		auth.LoginFailed(ip, req.Username, &user)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "Invalid credentials",
 		})
 		return
 	}
+	auth.LoginReleased(ip, req.Username)
+
+	// A second factor completes the login when the user has one, or when
+	// their role requires one and they must enroll first
+	if user.MFAEnabled || auth.MFARequired(user.Role) {
+		mfaToken, err := auth.GenerateMFAToken(user.ID, req.DeviceName, !user.MFAEnabled)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to generate token",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success":                 true,
+			"message":                 "Two-factor authentication required",
+			"mfa_required":            true,
+			"mfa_enrollment_required": !user.MFAEnabled,
+			"mfa_token":               mfaToken,
+			"expires_in":              int(auth.MFATokenTTL().Seconds()),
+		})
+		return
+	}
+
+	completeLogin(c, &user, req.DeviceName, nil)
+}
+
+// completeLogin starts a session for a user whose credentials were verified
+// and answers with its tokens. Recovery codes just issued are included.
+func completeLogin(c *gin.Context, user *models.User, deviceName string, recoveryCodes []string) {
+	auth.LoginSucceeded(user)
 
-	// Update user status to online and set login time
+	// Set login time; logging in counts as a heartbeat for presence
 	now := time.Now()
-	database.GetDB().Model(&user).Updates(map[string]interface{}{
-		"status":     "online",
-		"is_online":  true,
+	database.GetDB().Model(user).Updates(map[string]interface{}{
 		"last_login": now,
 		"last_seen":  now,
 	})
+	if presence := services.GetPresenceService(); presence != nil {
+		presence.LoggedIn(user.Extension)
+		database.GetDB().First(user, user.ID)
+	}
 
-	// Generate JWT token
-	token, err := auth.GenerateToken(user.ID, user.Username, user.Extension, user.Role)
+	// Start a session on this device with a short-lived access token
+	session, refreshToken, err := auth.CreateSession(user.ID, deviceName, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create session",
+		})
+		return
+	}
+	token, err := auth.GenerateToken(user.ID, user.Username, user.Extension, user.Role, session.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to generate token",
@@ -63,12 +132,20 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Login successful",
-		"token":   token,
-		"user":    user.ToResponse(),
-	})
+	response := gin.H{
+		"success":       true,
+		"message":       "Login successful",
+		"token":         token,
+		"expires_in":    int(auth.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshToken,
+		"session_id":    session.ID,
+		"user":          user.ToResponse(),
+		"permissions":   auth.RolePermissions(user.Role),
+	}
+	if recoveryCodes != nil {
+		response["recovery_codes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // Register handles user registration
@@ -80,6 +157,10 @@ func Register(c *gin.Context) {
 		})
 		return
 	}
+	if wait := auth.RegisterAttempt(c.ClientIP()); wait > 0 {
+		tooManyAttempts(c, wait, "Too many registration attempts; try again later")
+		return
+	}
 
 	// Check if username already exists
 	var existingUser models.User
@@ -141,21 +222,33 @@ func Register(c *gin.Context) {
 
 // Logout handles user logout
 func Logout(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "User not authenticated",
 		})
 		return
 	}
 
-	// Update user status to offline
-	now := time.Now()
-	database.GetDB().Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
-		"status":    "offline",
-		"is_online": false,
-		"last_seen": now,
-	})
+	// End the session: its refresh token and access tokens stop working and
+	// its sockets are closed
+	sessionID := c.GetUint("session_id")
+	if err := auth.RevokeSession(sessionID, auth.RevokedLogout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to end session",
+		})
+		return
+	}
+	if hub := websocket.GetHub(); hub != nil {
+		hub.DisconnectSession(userID, sessionID, websocket.CloseLoggedOut, "logged out")
+	}
+
+	// The user stays online while another connection or a SIP phone keeps
+	// them reachable
+	database.GetDB().Model(&models.User{}).Where("id = ?", userID).Update("last_seen", time.Now())
+	if presence := services.GetPresenceService(); presence != nil {
+		presence.LoggedOut(extension)
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -163,28 +256,70 @@ func Logout(c *gin.Context) {
 	})
 }
 
-// RefreshToken handles token refresh
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Presenting a refresh token that was already exchanged
+// revokes its session.
 func RefreshToken(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Authorization header required",
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
 		})
 		return
 	}
 
-	tokenString := authHeader[7:] // Remove "Bearer " prefix
-	newToken, err := auth.RefreshToken(tokenString)
+	session, refreshToken, err := auth.RotateSession(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrRefreshTokenReused):
+			if hub := websocket.GetHub(); hub != nil {
+				hub.DisconnectSession(session.UserID, session.ID, websocket.CloseLoggedOut, "session revoked")
+			}
+			fallthrough
+		case errors.Is(err, auth.ErrInvalidRefreshToken), errors.Is(err, auth.ErrSessionExpired), errors.Is(err, auth.ErrSessionRevoked):
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Failed to refresh token: " + err.Error(),
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to refresh token",
+			})
+		}
+		return
+	}
+
+	// The new access token carries the user's current extension and role
+	var user models.User
+	if err := database.GetDB().First(&user, session.UserID).Error; err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Failed to refresh token",
+			"error": "User not found",
+		})
+		return
+	}
+	token, err := auth.GenerateToken(user.ID, user.Username, user.Extension, user.Role, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to generate token",
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"token":   newToken,
+		"success":       true,
+		"token":         token,
+		"expires_in":    int(auth.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshToken,
+	})
+}
+
+// tooManyAttempts refuses a request made before the wait imposed by
+// earlier attempts is over, and says when to retry
+func tooManyAttempts(c *gin.Context, wait time.Duration, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"retry_after": seconds,
 	})
 }
 
@@ -207,7 +342,8 @@ func GetProfile(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"user":    user.ToResponse(),
+		"success":     true,
+		"user":        user.ToResponse(),
+		"permissions": auth.RolePermissions(user.Role),
 	})
 }
@@ -12,6 +12,8 @@ import (
 	"voip-backend/database"
 	"voip-backend/middleware"
 	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/services"
 	"voip-backend/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -37,6 +39,14 @@ func InitiateCall(c *gin.Context) {
 		return
 	}
 
+	// Queue numbers put the caller in line for the next free agent, which
+	// needs Asterisk whichever call method was asked for
+	var callQueue models.CallQueue
+	if err := database.GetDB().Where("number = ?", req.TargetExtension).First(&callQueue).Error; err == nil {
+		initiateQueueCall(c, userID, username, extension, callQueue)
+		return
+	}
+
 	// Check if we should use WebRTC direct calling instead of AMI
 	useWebRTC := c.Query("method") == "webrtc" || c.GetHeader("X-Call-Method") == "webrtc"
 
@@ -65,16 +75,23 @@ func InitiateCall(c *gin.Context) {
 		return
 	}
 
-	log.Printf("[CALL] Target user found: %s (ext: %s, status: %s)", targetUser.Username, targetUser.Extension, targetUser.Status)
+	log.Printf("[CALL] Target user found: %s (ext: %s, presence: %s)", targetUser.Username, targetUser.Extension, targetUser.Presence)
 
-	// Check if target user is online
-	if targetUser.Status != "online" {
-		log.Printf("[CALL] ERROR: Target user %s is not online (status: %s)", targetUser.Username, targetUser.Status)
+	// Check if target user is online and accepting calls
+	if !targetUser.IsOnline {
+		log.Printf("[CALL] ERROR: Target user %s is not online (presence: %s)", targetUser.Username, targetUser.Presence)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Target extension is not online",
 		})
 		return
 	}
+	if targetUser.Presence == services.PresenceDND {
+		log.Printf("[CALL] ERROR: Target user %s is set to do not disturb", targetUser.Username)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Target extension is set to do not disturb",
+		})
+		return
+	}
 
 	// Check if caller is trying to call themselves
 	if extension == req.TargetExtension {
@@ -87,25 +104,17 @@ func InitiateCall(c *gin.Context) {
 
 	log.Printf("[CALL] Initiating Asterisk call from %s to %s", extension, req.TargetExtension)
 
-	// Initiate call through Asterisk
-	channel, err := asterisk.InitiateCall(extension, req.TargetExtension)
-	if err != nil {
-		log.Printf("[CALL] ERROR: Asterisk call initiation failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to initiate call: " + err.Error(),
-		})
-		return
-	}
-
-	log.Printf("[CALL] Asterisk call initiated successfully, channel: %s", channel)
+	// Create the call records before originating, since AMI events for the
+	// call can arrive before Originate returns
+	callID := asterisk.NewCallID()
 
 	// Create call log entry
 	callLog := models.CallLog{
 		CallerID:  userID,
-		CalleeID:  targetUser.ID,
+		CalleeID:  &targetUser.ID,
 		StartTime: time.Now(),
 		Status:    "initiated",
-		Channel:   channel,
+		Linkedid:  callID,
 		Direction: "outbound",
 	}
 
@@ -117,8 +126,8 @@ func InitiateCall(c *gin.Context) {
 	// Create active call entry
 	activeCall := models.ActiveCall{
 		CallerID:  userID,
-		CalleeID:  targetUser.ID,
-		Channel:   channel,
+		CalleeID:  &targetUser.ID,
+		Linkedid:  callID,
 		Status:    "ringing",
 		StartTime: time.Now(),
 	}
@@ -128,16 +137,37 @@ func InitiateCall(c *gin.Context) {
 		c.Header("X-Warning", "Failed to create active call record")
 	}
 
+	// Initiate call through Asterisk
+	channel, err := asterisk.InitiateCall(extension, req.TargetExtension, callID)
+	if err != nil {
+		log.Printf("[CALL] ERROR: Asterisk call initiation failed: %v", err)
+		database.GetDB().Model(&callLog).Updates(map[string]interface{}{
+			"status":   "failed",
+			"end_time": time.Now(),
+		})
+		database.GetDB().Where("linkedid = ?", callID).Delete(&models.ActiveCall{})
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to initiate call: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[CALL] Asterisk call initiated successfully, channel: %s", channel)
+
+	database.GetDB().Model(&models.CallLog{}).Where("linkedid = ?", callID).Update("channel", channel)
+	database.GetDB().Model(&models.ActiveCall{}).Where("linkedid = ?", callID).Update("channel", channel)
+
 	// Notify target user via WebSocket
 	hub := websocket.GetHub()
 	if hub != nil {
-		hub.NotifyIncomingCall(extension, req.TargetExtension, channel)
+		hub.NotifyIncomingCall(extension, req.TargetExtension, channel, callID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Call initiated successfully",
 		"channel": channel,
+		"call_id": callID,
 		"caller":  username,
 		"callee":  targetUser.Username,
 	})
@@ -178,12 +208,27 @@ func AnswerCall(c *gin.Context) {
 		return
 	}
 
-	// Update active call status
-	database.GetDB().Model(&activeCall).Update("status", "connected")
+	// Update active call status, keeping the answer time the call tracker
+	// may already have recorded
+	answerTime := time.Now()
+	if activeCall.AnswerTime != nil {
+		answerTime = *activeCall.AnswerTime
+	}
+	database.GetDB().Model(&activeCall).Updates(map[string]interface{}{
+		"status":      "connected",
+		"answer_time": &answerTime,
+	})
 
 	// Update call log
-	database.GetDB().Model(&models.CallLog{}).Where("channel = ?", req.Channel).Updates(map[string]interface{}{
-		"status": "answered",
+	callLogs := database.GetDB().Model(&models.CallLog{})
+	if activeCall.Linkedid != "" {
+		callLogs = callLogs.Where("linkedid = ?", activeCall.Linkedid)
+	} else {
+		callLogs = callLogs.Where("channel = ? AND end_time IS NULL", req.Channel)
+	}
+	callLogs.Updates(map[string]interface{}{
+		"status":      "answered",
+		"answer_time": &answerTime,
 	})
 
 	// Notify via WebSocket
@@ -192,7 +237,7 @@ func AnswerCall(c *gin.Context) {
 		// Get caller info
 		var caller models.User
 		if err := database.GetDB().First(&caller, activeCall.CallerID).Error; err == nil {
-			hub.NotifyCallStatus(caller.Extension, extension, "connected", req.Channel)
+			hub.NotifyCallStatus(caller.Extension, extension, "connected", req.Channel, activeCall.Linkedid)
 		}
 	}
 
@@ -254,9 +299,20 @@ func HangupCall(c *gin.Context) {
 	if isWebRTCCall {
 		log.Printf("[HANGUP] Handling WebRTC call hangup for channel: %s", req.Channel)
 		// For WebRTC calls, we don't need to call Asterisk
+		if hub := websocket.GetHub(); hub != nil {
+			hub.EndWebRTCCallHold(req.Channel)
+			hub.EndCallSession(req.Channel)
+		}
+		// The call session may live on another node
+		EndWebRTCTransfers(req.Channel)
 	} else {
-		// Hangup traditional calls through Asterisk
-		if err := asterisk.HangupCall(req.Channel); err != nil {
+		// Hangup traditional calls through Asterisk, using the real channel
+		// name once the call tracker has learned it
+		asteriskChannel := req.Channel
+		if activeCall.CallerChannel != "" {
+			asteriskChannel = activeCall.CallerChannel
+		}
+		if err := asterisk.HangupCall(asteriskChannel); err != nil {
 			log.Printf("[HANGUP] Asterisk hangup failed for channel %s: %v", req.Channel, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": "Failed to hangup call: " + err.Error(),
@@ -271,12 +327,30 @@ func HangupCall(c *gin.Context) {
 	if activeCall.ID != 0 {
 		duration = int(time.Since(activeCall.StartTime).Seconds())
 
-		// Update call log
+		// A hold still in progress counts towards the call's hold time
+		services.TakeOffHold(activeCall)
+
+		// Update call log. Duration includes ring time; billsec only counts
+		// from the answer. Asterisk's CDR replaces both when it arrives.
 		endTime := time.Now()
-		database.GetDB().Model(&models.CallLog{}).Where("channel = ?", req.Channel).Updates(map[string]interface{}{
-			"status":   "ended",
-			"end_time": &endTime,
-			"duration": duration,
+		billsec := 0
+		disposition := asterisk.DispositionNoAnswer
+		if activeCall.AnswerTime != nil {
+			billsec = int(endTime.Sub(*activeCall.AnswerTime).Seconds())
+			disposition = asterisk.DispositionAnswered
+		}
+		callLogs := database.GetDB().Model(&models.CallLog{}).Where("cdr_imported = ?", false)
+		if activeCall.Linkedid != "" {
+			callLogs = callLogs.Where("linkedid = ?", activeCall.Linkedid)
+		} else {
+			callLogs = callLogs.Where("channel = ? AND end_time IS NULL", req.Channel)
+		}
+		callLogs.Updates(map[string]interface{}{
+			"status":      "ended",
+			"end_time":    &endTime,
+			"duration":    duration,
+			"billsec":     billsec,
+			"disposition": disposition,
 		})
 
 		// Remove active call
@@ -285,16 +359,20 @@ func HangupCall(c *gin.Context) {
 		// Notify via WebSocket
 		hub := websocket.GetHub()
 		if hub != nil {
+			hub.EndCallSession(activeCall.Linkedid)
+
 			// Get other party info
 			var otherUser models.User
 			if activeCall.CallerID == userID {
-				database.GetDB().First(&otherUser, activeCall.CalleeID)
+				if activeCall.CalleeID != nil {
+					database.GetDB().First(&otherUser, *activeCall.CalleeID)
+				}
 			} else {
 				database.GetDB().First(&otherUser, activeCall.CallerID)
 			}
 
 			if otherUser.ID != 0 {
-				hub.NotifyCallStatus(extension, otherUser.Extension, "ended", req.Channel)
+				hub.NotifyCallStatus(extension, otherUser.Extension, "ended", req.Channel, activeCall.Linkedid)
 			}
 		}
 	} else {
@@ -302,14 +380,14 @@ func HangupCall(c *gin.Context) {
 		log.Printf("[HANGUP] Sending WebSocket hangup notification for WebRTC call: %s", req.Channel)
 		hub := websocket.GetHub()
 		if hub != nil {
-			// Send a general hangup message
-			hangupMsg := websocket.Message{
-				Type:    "call_ended",
-				From:    extension,
-				Channel: req.Channel,
-				Status:  "ended",
+			// Tell the other parties of the call
+			err := hub.NotifyCallParties(req.Channel, extension, protocol.New(protocol.TypeCallEnded, protocol.CallEvent{
+				Signal: protocol.Signal{From: extension, Channel: req.Channel},
+				Status: "ended",
+			}))
+			if err != nil {
+				log.Printf("[HANGUP] Failed to notify the parties of %s: %v", req.Channel, err)
 			}
-			hub.BroadcastMessage(hangupMsg)
 		}
 		duration = 0
 	}
@@ -410,6 +488,29 @@ func GetSystemDiagnostics(c *gin.Context) {
 		diagnostics["errors"] = append(diagnostics["errors"].([]string), "AMI client not available")
 	} else {
 		diagnostics["ami_status"] = "connected"
+		diagnostics["event_bus"] = asterisk.GetEventBus().Stats()
+		if tracker := services.GetCallTracker(); tracker != nil {
+			diagnostics["tracked_calls"] = tracker.Calls()
+		}
+		if ingest := services.GetCDRIngest(); ingest != nil {
+			diagnostics["cdr_ingest"] = ingest.Stats()
+		}
+
+		// Channels currently up in Asterisk
+		if channels, err := asterisk.ListChannels(); err != nil {
+			diagnostics["errors"] = append(diagnostics["errors"].([]string), fmt.Sprintf("Failed to list channels: %v", err))
+		} else {
+			diagnostics["channels"] = channels
+			diagnostics["channel_count"] = len(channels)
+		}
+
+		// Every registered PJSIP contact
+		if contacts, err := asterisk.ListContacts(); err != nil {
+			diagnostics["errors"] = append(diagnostics["errors"].([]string), fmt.Sprintf("Failed to list contacts: %v", err))
+		} else {
+			diagnostics["contacts"] = contacts
+			diagnostics["contact_count"] = len(contacts)
+		}
 
 		// Check specific endpoints that are failing
 		problematicExtensions := []string{"1001", "1004", "1000"}
@@ -630,7 +731,7 @@ func testWebSocketConnection() map[string]interface{} {
 func testAMIConnectionWithConfig(asteriskHost, amiPort string) map[string]interface{} {
 	// For public endpoint, we can't test actual AMI connection without credentials
 	// Instead, test if the AMI port is reachable
-	address := fmt.Sprintf("%s:%s", asteriskHost, amiPort)
+	address := net.JoinHostPort(asteriskHost, amiPort)
 
 	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
 	if err != nil {
@@ -736,16 +837,23 @@ func initiateWebRTCCall(c *gin.Context, userID uint, username, extension string,
 		return
 	}
 
-	log.Printf("[WEBRTC] Target user found: %s (ext: %s, status: %s, online: %t)",
-		targetUser.Username, targetUser.Extension, targetUser.Status, targetUser.IsOnline)
+	log.Printf("[WEBRTC] Target user found: %s (ext: %s, presence: %s)",
+		targetUser.Username, targetUser.Extension, targetUser.Presence)
 
 	// Check if target user is online (be more lenient for testing)
-	if targetUser.Status != "online" && !targetUser.IsOnline {
-		log.Printf("[WEBRTC] WARNING: Target user %s is not online (status: %s, is_online: %t)",
-			targetUser.Username, targetUser.Status, targetUser.IsOnline)
+	if !targetUser.IsOnline {
+		log.Printf("[WEBRTC] WARNING: Target user %s is not online (presence: %s)",
+			targetUser.Username, targetUser.Presence)
 		// For testing, allow calls to offline users but warn
 		log.Printf("[WEBRTC] Proceeding with call despite user being offline (for testing)")
 	}
+	if targetUser.Presence == services.PresenceDND {
+		log.Printf("[WEBRTC] ERROR: Target user %s is set to do not disturb", targetUser.Username)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Target extension is set to do not disturb",
+		})
+		return
+	}
 
 	// Check if target user has active WebSocket connection
 	hub := websocket.GetHub()
@@ -770,12 +878,12 @@ func initiateWebRTCCall(c *gin.Context, userID uint, username, extension string,
 	}
 
 	// Generate call ID
-	callID := fmt.Sprintf("webrtc-call-%d", time.Now().Unix())
+	callID := fmt.Sprintf("webrtc-call-%d", time.Now().UnixNano())
 
 	// Create call log entry
 	callLog := models.CallLog{
 		CallerID:  userID,
-		CalleeID:  targetUser.ID,
+		CalleeID:  &targetUser.ID,
 		StartTime: time.Now(),
 		Status:    "initiated",
 		Channel:   callID,
@@ -792,19 +900,21 @@ func initiateWebRTCCall(c *gin.Context, userID uint, username, extension string,
 
 	// Send WebRTC call invitation via WebSocket
 	if hub != nil {
-		callInvitation := map[string]interface{}{
-			"type":             "webrtc_call_invitation",
-			"call_id":          callID,
-			"caller_id":        userID,
-			"caller_username":  username,
-			"caller_extension": extension,
-			"target_extension": req.TargetExtension,
-			"timestamp":        time.Now().Format(time.RFC3339),
-		}
+		// Only the two parties may exchange signaling for the call
+		hub.StartCallSession(callID, extension, req.TargetExtension)
+
+		callInvitation := protocol.New(protocol.TypeWebRTCCallInvitation, protocol.CallInvitation{
+			CallID:          callID,
+			CallerID:        userID,
+			CallerUsername:  username,
+			CallerExtension: extension,
+			TargetExtension: req.TargetExtension,
+		})
 
 		// Send to target user
 		if err := hub.SendToExtension(req.TargetExtension, callInvitation); err != nil {
 			log.Printf("[WEBRTC] ERROR: Failed to send call invitation to %s: %v", req.TargetExtension, err)
+			hub.EndCallSession(callID)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": "Failed to notify target user",
 			})
@@ -812,12 +922,11 @@ func initiateWebRTCCall(c *gin.Context, userID uint, username, extension string,
 		}
 
 		// Send confirmation to caller
-		callerConfirmation := map[string]interface{}{
-			"type":    "webrtc_call_initiated",
-			"call_id": callID,
-			"status":  "calling",
-			"target":  req.TargetExtension,
-		}
+		callerConfirmation := protocol.New(protocol.TypeWebRTCCallInitiated, protocol.CallInitiated{
+			CallID: callID,
+			Status: "calling",
+			Target: req.TargetExtension,
+		})
 
 		if err := hub.SendToExtension(extension, callerConfirmation); err != nil {
 			log.Printf("[WEBRTC] WARNING: Failed to send confirmation to caller %s: %v", extension, err)
@@ -837,6 +946,32 @@ func initiateWebRTCCall(c *gin.Context, userID uint, username, extension string,
 	})
 }
 
+// LookupCallParties returns the extensions of the parties of a live call by
+// the call_id InitiateCall returned, so the WebSocket hub can relay signaling
+// for calls it has no session for. Calls that ended are refused. Channels
+// are not looked up: every call of an extension has the same one.
+func LookupCallParties(callID string) ([]string, error) {
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Preload("Caller").Preload("Callee").
+		Where("linkedid = ?", callID).First(&activeCall).Error; err == nil {
+		var parties []string
+		for _, user := range []models.User{activeCall.Caller, activeCall.Callee} {
+			if user.Extension != "" {
+				parties = append(parties, user.Extension)
+			}
+		}
+		return parties, nil
+	}
+
+	// Calls placed directly in Asterisk are known by their Linkedid
+	if tracker := services.GetCallTracker(); tracker != nil {
+		if call, ok := tracker.GetCall(callID); ok && call.CallerExtension != "" && call.CalleeExtension != "" {
+			return []string{call.CallerExtension, call.CalleeExtension}, nil
+		}
+	}
+	return nil, fmt.Errorf("no live call %s", callID)
+}
+
 // DeleteCallLog deletes a specific call log (admin only)
 func DeleteCallLog(c *gin.Context) {
 	logID := c.Param("id")
@@ -1066,27 +1201,37 @@ func exportCallLogsCSV(c *gin.Context, callLogs []models.CallLog) {
 	c.Header("Content-Disposition", "attachment; filename=call-logs.csv")
 
 	// Write CSV header
-	csvData := "ID,Caller,Caller Extension,Callee,Callee Extension,Start Time,End Time,Duration,Status,Direction,Channel\n"
+	csvData := "ID,Caller,Caller Extension,Callee,Callee Extension,Start Time,Answer Time,End Time,Duration,Billsec,Hold Duration,Status,Disposition,Hangup Cause,Direction,Channel,Uniqueid\n"
 
 	// Write data rows
 	for _, log := range callLogs {
+		answerTime := ""
+		if log.AnswerTime != nil {
+			answerTime = log.AnswerTime.Format("2006-01-02 15:04:05")
+		}
 		endTime := ""
 		if log.EndTime != nil {
 			endTime = log.EndTime.Format("2006-01-02 15:04:05")
 		}
 
-		csvData += fmt.Sprintf("%d,%s,%s,%s,%s,%s,%s,%d,%s,%s,%s\n",
+		csvData += fmt.Sprintf("%d,%s,%s,%s,%s,%s,%s,%s,%d,%d,%d,%s,%s,%d,%s,%s,%s\n",
 			log.ID,
 			log.Caller.Username,
 			log.Caller.Extension,
 			log.Callee.Username,
 			log.Callee.Extension,
 			log.StartTime.Format("2006-01-02 15:04:05"),
+			answerTime,
 			endTime,
 			log.Duration,
+			log.Billsec,
+			log.HoldDuration,
 			log.Status,
+			log.Disposition,
+			log.HangupCause,
 			log.Direction,
 			log.Channel,
+			log.Uniqueid,
 		)
 	}
 
@@ -1113,6 +1258,7 @@ type CallStatistics struct {
 	AvgDuration     int     `json:"avg_duration_seconds"`
 	AvgDurationStr  string  `json:"avg_duration_formatted"`
 	TotalDuration   int64   `json:"total_duration_seconds"`
+	TotalHoldTime   int64   `json:"total_hold_seconds"`
 }
 
 // calculateCallStatistics calculates call performance metrics
@@ -1122,15 +1268,19 @@ func calculateCallStatistics() CallStatistics {
 	// Get total call count
 	database.GetDB().Model(&models.CallLog{}).Count(&stats.TotalCalls)
 
-	// Get successful calls (answered and ended calls)
-	database.GetDB().Model(&models.CallLog{}).Where("status IN (?)", []string{"answered", "ended"}).Count(&stats.SuccessfulCalls)
+	// Get successful calls: answered according to Asterisk's disposition,
+	// falling back to our own status for calls without one
+	database.GetDB().Model(&models.CallLog{}).
+		Where("disposition = ? OR (disposition = '' AND status IN (?))", asterisk.DispositionAnswered, []string{"answered", "ended"}).
+		Count(&stats.SuccessfulCalls)
 
 	// Calculate success rate
 	if stats.TotalCalls > 0 {
 		stats.SuccessRate = float64(stats.SuccessfulCalls) / float64(stats.TotalCalls) * 100
 	}
 
-	// Calculate average duration for completed calls
+	// Calculate average talk time of answered calls. Billsec excludes ring
+	// time, unlike duration.
 	type DurationResult struct {
 		TotalDuration int64
 		CallCount     int64
@@ -1138,8 +1288,8 @@ func calculateCallStatistics() CallStatistics {
 
 	var result DurationResult
 	database.GetDB().Model(&models.CallLog{}).
-		Select("COALESCE(SUM(duration), 0) as total_duration, COUNT(*) as call_count").
-		Where("status = ? AND duration > 0", "ended").
+		Select("COALESCE(SUM(billsec), 0) as total_duration, COUNT(*) as call_count").
+		Where("status = ? AND billsec > 0", "ended").
 		Scan(&result)
 
 	if result.CallCount > 0 {
@@ -1154,6 +1304,11 @@ func calculateCallStatistics() CallStatistics {
 		stats.AvgDurationStr = "0:00"
 	}
 
+	// Total time calls spent on hold
+	database.GetDB().Model(&models.CallLog{}).
+		Select("COALESCE(SUM(hold_duration), 0)").
+		Scan(&stats.TotalHoldTime)
+
 	return stats
 }
 
@@ -1163,9 +1318,8 @@ func GetRealTimeMetrics(c *gin.Context) {
 	var totalUsers, onlineUsers, activeCalls, callsToday int64
 
 	database.GetDB().Model(&models.User{}).Count(&totalUsers)
-	// Count online users (users who are marked as online AND have recent activity)
-	fiveMinutesAgo := time.Now().Add(-5 * time.Minute)
-	database.GetDB().Model(&models.User{}).Where("status = ? AND is_online = ? AND last_seen > ?", "online", true, fiveMinutesAgo).Count(&onlineUsers)
+	// Count online users (the presence service keeps is_online up to date)
+	database.GetDB().Model(&models.User{}).Where("is_online = ?", true).Count(&onlineUsers)
 	database.GetDB().Model(&models.ActiveCall{}).Count(&activeCalls)
 	database.GetDB().Model(&models.CallLog{}).Where("DATE(created_at) = DATE(NOW())").Count(&callsToday)
 
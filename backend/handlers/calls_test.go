@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/asterisk/amitest"
+	"voip-backend/auth"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/services"
+	"voip-backend/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAMI stands in for Asterisk in every test of the package
+var fakeAMI *amitest.Server
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := os.MkdirTemp("", "handlers-test")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+
+	fakeAMI = amitest.NewServer(amitest.Config{AnswerAfter: 100 * time.Millisecond})
+	if err := fakeAMI.Start(""); err != nil {
+		log.Fatalf("Failed to start fake AMI: %v", err)
+	}
+	fakeAMI.AddEndpoint("1001", true)
+	fakeAMI.AddEndpoint("1002", true)
+
+	host, port := fakeAMI.HostPort()
+	config.AppConfig = &config.Config{
+		DBPath:              filepath.Join(dir, "test.db"),
+		AsteriskHost:        host,
+		AsteriskAMIPort:     port,
+		AsteriskAMIUsername: "admin",
+		AsteriskAMISecret:   "amp111",
+		JWTSecret:           "test-secret",
+		TOTPIssuer:          "VoIP Test",
+		AccessTokenMinutes:  15,
+		RefreshTokenDays:    30,
+
+		LoginBackoffAfter:      3,
+		LoginIPBackoffAfter:    20,
+		LoginBackoffMaxSeconds: 900,
+		LoginLockoutThreshold:  10,
+		LoginLockoutMinutes:    15,
+	}
+	database.InitDatabase()
+	auth.InitLoginProtection()
+	websocket.InitHub()
+	websocket.GetHub().OnCallSession = func(callID string, parties []string, state string) {
+		if state == "ended" {
+			EndWebRTCTransfers(callID)
+		}
+	}
+	services.InitCallTracker()
+	asterisk.InitAMI()
+
+	code := m.Run()
+	asterisk.GetAMIClient().Close()
+	fakeAMI.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// callRouter serves the call endpoints as the given user
+func callRouter(t *testing.T, username string) *gin.Engine {
+	t.Helper()
+
+	r := userRouter(t, username)
+	r.POST("/call/initiate", InitiateCall)
+	r.POST("/call/hangup", HangupCall)
+	return r
+}
+
+// userRouter serves requests as the given user, in place of the JWT
+// middleware
+func userRouter(t *testing.T, username string) *gin.Engine {
+	t.Helper()
+
+	var user models.User
+	if err := database.GetDB().Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("Failed to load user %s: %v", username, err)
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("extension", user.Extension)
+		c.Set("role", user.Role)
+		c.Next()
+	})
+	return r
+}
+
+// post sends a JSON request and decodes the JSON answer
+func post(t *testing.T, r *gin.Engine, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s answered %d with invalid JSON: %s", path, w.Code, w.Body.String())
+	}
+	return w.Code, response
+}
+
+// setOnline marks a user online and available to take calls
+func setOnline(t *testing.T, username string, online bool) {
+	t.Helper()
+
+	presence := "offline"
+	if online {
+		presence = "available"
+	}
+	err := database.GetDB().Model(&models.User{}).Where("username = ?", username).
+		Updates(map[string]interface{}{"is_online": online, "presence": presence}).Error
+	if err != nil {
+		t.Fatalf("Failed to update user %s: %v", username, err)
+	}
+}
+
+func TestInitiateAndHangupCall(t *testing.T) {
+	setOnline(t, "user2", true)
+	r := callRouter(t, "user1")
+
+	code, response := post(t, r, "/call/initiate", `{"target_extension":"1002"}`)
+	if code != http.StatusOK {
+		t.Fatalf("initiate = %d %v, want 200", code, response)
+	}
+	channel, _ := response["channel"].(string)
+	callID, _ := response["call_id"].(string)
+	if channel != "PJSIP/1001" {
+		t.Errorf("channel = %q, want PJSIP/1001", channel)
+	}
+
+	// The call was originated from the caller's endpoint to the callee
+	var originate *amitest.Action
+	for _, action := range fakeAMI.Actions() {
+		if action.Name == "Originate" && action.Fields["ChannelId"] == callID {
+			originate = &action
+		}
+	}
+	if originate == nil {
+		t.Fatal("no Originate sent for the call")
+	}
+	if originate.Fields["Channel"] != "PJSIP/1001" || originate.Fields["Exten"] != "1002" {
+		t.Errorf("Originate %s to %s, want PJSIP/1001 to 1002", originate.Fields["Channel"], originate.Fields["Exten"])
+	}
+
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Where("linkedid = ?", callID).First(&activeCall).Error; err != nil {
+		t.Fatalf("no active call recorded: %v", err)
+	}
+	if activeCall.Channel != channel {
+		t.Errorf("active call channel = %q, want %q", activeCall.Channel, channel)
+	}
+
+	// The call tracker learns the caller's channel from the AMI events, and
+	// hangup uses it
+	waitForChannels(t, 2)
+	if parties, err := LookupCallParties(callID); err != nil || len(parties) != 2 {
+		t.Errorf("parties of the live call = %v, %v, want 1001 and 1002", parties, err)
+	}
+	// Every call from 1001 has its channel, so it does not identify the call
+	if parties, err := LookupCallParties(channel); err == nil {
+		t.Errorf("parties of channel %s = %v, want an error", channel, parties)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for activeCall.CallerChannel == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("the call tracker did not record the caller's channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+		database.GetDB().Where("linkedid = ?", callID).First(&activeCall)
+	}
+	if !strings.HasPrefix(activeCall.CallerChannel, "PJSIP/1001-") {
+		t.Errorf("caller channel = %q, want a PJSIP/1001 channel", activeCall.CallerChannel)
+	}
+
+	code, response = post(t, r, "/call/hangup", `{"channel":"`+channel+`"}`)
+	if code != http.StatusOK {
+		t.Fatalf("hangup = %d %v, want 200", code, response)
+	}
+
+	var count int64
+	database.GetDB().Model(&models.ActiveCall{}).Where("linkedid = ?", callID).Count(&count)
+	if count != 0 {
+		t.Error("the active call was not removed")
+	}
+	var callLog models.CallLog
+	if err := database.GetDB().Where("linkedid = ?", callID).First(&callLog).Error; err != nil {
+		t.Fatalf("no call log recorded: %v", err)
+	}
+	if callLog.Status != "ended" || callLog.EndTime == nil {
+		t.Errorf("call log status = %s, end time = %v, want ended", callLog.Status, callLog.EndTime)
+	}
+	waitForChannels(t, 0)
+
+	// The call log remains, but once the call tracker has seen the last leg
+	// hang up its parties may no longer signal each other
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		parties, err := LookupCallParties(callID)
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("parties of the ended call = %v, want an error", parties)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInitiateCallRefusesOfflineTarget(t *testing.T) {
+	setOnline(t, "user2", false)
+	r := callRouter(t, "user1")
+	originates := countActions("Originate")
+
+	code, response := post(t, r, "/call/initiate", `{"target_extension":"1002"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("initiate = %d %v, want 400", code, response)
+	}
+	if countActions("Originate") != originates {
+		t.Error("a call to an offline user reached Asterisk")
+	}
+}
+
+func TestHangupUnknownCall(t *testing.T) {
+	r := callRouter(t, "user1")
+
+	code, _ := post(t, r, "/call/hangup", `{"channel":"PJSIP/1001-99999999"}`)
+	if code != http.StatusNotFound {
+		t.Errorf("hangup = %d, want 404", code)
+	}
+}
+
+// waitForChannels waits until the fake server has the given number of
+// live channels
+func waitForChannels(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fakeAMI.Channels()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("fake AMI has %d channels, want %d", len(fakeAMI.Channels()), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// countActions counts the actions of a kind the fake server received
+func countActions(name string) int {
+	count := 0
+	for _, action := range fakeAMI.Actions() {
+		if action.Name == name {
+			count++
+		}
+	}
+	return count
+}
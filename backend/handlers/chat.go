@@ -0,0 +1,811 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/websocket"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Page sizes of the message history
+const (
+	defaultChatPageSize = 50
+	maxChatPageSize     = 100
+)
+
+// Most stored messages delivered to a user when they connect; older ones
+// stay in the history
+const chatPendingLimit = 200
+
+var errUnknownChatMessage = errors.New("message is not part of the conversation")
+
+// ListConversations returns the user's conversations, most recently active first
+func ListConversations(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var conversations []models.Conversation
+	if err := database.GetDB().Preload("Members.User").
+		Joins("JOIN conversation_members ON conversation_members.conversation_id = conversations.id AND conversation_members.user_id = ?", userID).
+		Order("COALESCE(conversations.last_message_at, conversations.created_at) DESC").
+		Find(&conversations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve conversations",
+		})
+		return
+	}
+
+	response := make([]conversationView, 0, len(conversations))
+	for i := range conversations {
+		response = append(response, conversationResponse(&conversations[i], userID))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"conversations": response,
+		"count":         len(response),
+	})
+}
+
+// CreateConversation opens the direct conversation with another user, or
+// creates a group conversation
+func CreateConversation(c *gin.Context) {
+	userID, username, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.ConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+
+	var others []string
+	for _, memberExtension := range uniqueStrings(req.MemberExtensions) {
+		if memberExtension != extension {
+			others = append(others, memberExtension)
+		}
+	}
+	if len(others) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "A conversation needs at least one other member",
+		})
+		return
+	}
+
+	db := database.GetDB()
+
+	var users []models.User
+	if err := db.Where("extension IN ?", others).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Database error",
+		})
+		return
+	}
+	if len(users) != len(others) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown member extension",
+		})
+		return
+	}
+
+	now := time.Now()
+	conversation := models.Conversation{
+		Type:        models.ConversationGroup,
+		Name:        req.Name,
+		CreatedByID: userID,
+		Members:     []models.ConversationMember{{UserID: userID, JoinedAt: now}},
+	}
+	for _, user := range users {
+		conversation.Members = append(conversation.Members, models.ConversationMember{UserID: user.ID, JoinedAt: now})
+	}
+
+	if req.Name == "" {
+		if len(users) > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "A group conversation needs a name",
+			})
+			return
+		}
+
+		// There is one direct conversation per pair of users
+		key := directConversationKey(userID, users[0].ID)
+		conversation.Type = models.ConversationDirect
+		conversation.DirectKey = &key
+
+		var existing models.Conversation
+		if err := db.Where("direct_key = ?", key).First(&existing).Error; err == nil {
+			respondWithConversation(c, http.StatusOK, "Conversation already exists", existing.ID, userID)
+			return
+		}
+	}
+
+	if err := db.Create(&conversation).Error; err != nil {
+		// Another request may have opened the same direct conversation
+		var existing models.Conversation
+		if conversation.DirectKey != nil && db.Where("direct_key = ?", *conversation.DirectKey).First(&existing).Error == nil {
+			respondWithConversation(c, http.StatusOK, "Conversation already exists", existing.ID, userID)
+			return
+		}
+		log.Printf("[CHAT] Failed to create conversation for %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create conversation",
+		})
+		return
+	}
+
+	log.Printf("[CHAT] User %s created %s conversation %d with %v", username, conversation.Type, conversation.ID, others)
+	respondWithConversation(c, http.StatusCreated, "Conversation created", conversation.ID, userID)
+}
+
+// GetConversation returns one of the user's conversations
+func GetConversation(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"conversation": conversationResponse(&conversation, userID),
+	})
+}
+
+// AddConversationMembers adds users to a group conversation. New members
+// can read the history but are not sent the messages from before they
+// joined.
+func AddConversationMembers(c *gin.Context) {
+	userID, username, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+	if conversation.Type != models.ConversationGroup {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Members can only be added to group conversations",
+		})
+		return
+	}
+
+	var req models.ConversationMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	db := database.GetDB()
+	extensions := uniqueStrings(req.Extensions)
+
+	var users []models.User
+	if err := db.Where("extension IN ?", extensions).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Database error",
+		})
+		return
+	}
+	if len(users) != len(extensions) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown member extension",
+		})
+		return
+	}
+
+	var latest models.ChatMessage
+	db.Where("conversation_id = ?", conversation.ID).Order("id DESC").Limit(1).Find(&latest)
+
+	var added []string
+	now := time.Now()
+	for _, user := range users {
+		if conversation.Member(user.ID) != nil {
+			continue
+		}
+		member := models.ConversationMember{
+			ConversationID:         conversation.ID,
+			UserID:                 user.ID,
+			LastDeliveredMessageID: latest.ID,
+			LastReadMessageID:      latest.ID,
+			JoinedAt:               now,
+		}
+		if err := db.Create(&member).Error; err != nil {
+			log.Printf("[CHAT] Failed to add %s to conversation %d: %v", user.Extension, conversation.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to add members",
+			})
+			return
+		}
+		added = append(added, user.Extension)
+	}
+
+	if len(added) > 0 {
+		log.Printf("[CHAT] User %s added %v to conversation %d", username, added, conversation.ID)
+	}
+	respondWithConversation(c, http.StatusOK, fmt.Sprintf("%d members added", len(added)), conversation.ID, userID)
+}
+
+// LeaveConversation removes the user from a group conversation. The
+// conversation is deleted with its messages when its last member leaves.
+func LeaveConversation(c *gin.Context) {
+	userID, username, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+	if conversation.Type != models.ConversationGroup {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Only group conversations can be left",
+		})
+		return
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ? AND user_id = ?", conversation.ID, userID).
+			Delete(&models.ConversationMember{}).Error; err != nil {
+			return err
+		}
+		if len(conversation.Members) > 1 {
+			return nil
+		}
+		if err := tx.Where("conversation_id = ?", conversation.ID).Delete(&models.ChatMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&conversation).Error
+	})
+	if err != nil {
+		log.Printf("[CHAT] Failed to remove %s from conversation %d: %v", username, conversation.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to leave conversation",
+		})
+		return
+	}
+
+	log.Printf("[CHAT] User %s left conversation %d", username, conversation.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Left conversation",
+	})
+}
+
+// GetChatMessages returns a page of a conversation's messages in the order
+// they were sent: the latest ones, those before the message ID in "before",
+// or those after the message ID in "after"
+func GetChatMessages(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	limit := defaultChatPageSize
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid limit",
+			})
+			return
+		}
+		limit = min(parsed, maxChatPageSize)
+	}
+
+	var before, after uint64
+	var err error
+	if value := c.Query("before"); value != "" {
+		if before, err = strconv.ParseUint(value, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid before message ID",
+			})
+			return
+		}
+	}
+	if value := c.Query("after"); value != "" {
+		if after, err = strconv.ParseUint(value, 10, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid after message ID",
+			})
+			return
+		}
+	}
+
+	query := database.GetDB().Preload("Sender").Where("conversation_id = ?", conversation.ID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+	if after > 0 {
+		query = query.Where("id > ?", after).Order("id ASC")
+	} else {
+		query = query.Order("id DESC")
+	}
+
+	// One more than the page tells whether there are more
+	var messages []models.ChatMessage
+	if err := query.Limit(limit + 1).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve messages",
+		})
+		return
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if after == 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	response := make([]protocol.ChatMessage, 0, len(messages))
+	for i := range messages {
+		response = append(response, chatMessagePayload(&messages[i]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"messages": response,
+		"count":    len(response),
+		"has_more": hasMore,
+	})
+}
+
+// SendChatMessage stores a message and delivers it to the members that are
+// connected. The others get it when they next connect.
+func SendChatMessage(c *gin.Context) {
+	userID, username, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	var req models.ChatMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Message body is empty",
+		})
+		return
+	}
+
+	db := database.GetDB()
+
+	// A retried send returns the message stored the first time
+	if req.ClientID != "" {
+		var existing models.ChatMessage
+		if err := db.Preload("Sender").Where("conversation_id = ? AND sender_id = ? AND client_id = ?",
+			conversation.ID, userID, req.ClientID).First(&existing).Error; err == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success":      true,
+				"message":      "Message already sent",
+				"chat_message": chatMessagePayload(&existing),
+			})
+			return
+		}
+	}
+
+	message := models.ChatMessage{
+		ConversationID: conversation.ID,
+		SenderID:       userID,
+		Body:           req.Body,
+		ClientID:       req.ClientID,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&conversation).Update("last_message_at", message.CreatedAt).Error; err != nil {
+			return err
+		}
+		// The sender has seen their own message
+		return tx.Model(&models.ConversationMember{}).
+			Where("conversation_id = ? AND user_id = ?", conversation.ID, userID).
+			Updates(map[string]interface{}{
+				"last_delivered_message_id": message.ID,
+				"last_read_message_id":      message.ID,
+			}).Error
+	})
+	if err != nil {
+		log.Printf("[CHAT] Failed to store message from %s in conversation %d: %v", username, conversation.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to send message",
+		})
+		return
+	}
+	message.Sender = conversation.Member(userID).User
+
+	payload := chatMessagePayload(&message)
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyChat(memberExtensions(&conversation), protocol.New(protocol.TypeChatMessage, payload))
+
+		// Members that were connected have it; the rest get it on connect
+		for _, member := range conversation.Members {
+			if member.UserID == userID || !hub.IsExtensionConnected(member.User.Extension) {
+				continue
+			}
+			db.Model(&models.ConversationMember{}).
+				Where("conversation_id = ? AND user_id = ? AND last_delivered_message_id < ?", conversation.ID, member.UserID, message.ID).
+				Update("last_delivered_message_id", message.ID)
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success":      true,
+		"message":      "Message sent",
+		"chat_message": payload,
+	})
+}
+
+// MarkConversationRead marks a conversation read up to a message and sends
+// the read receipt to its members
+func MarkConversationRead(c *gin.Context) {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	conversation, ok := loadConversation(c, userID)
+	if !ok {
+		return
+	}
+
+	var req models.ChatReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	err := readConversation(&conversation, protocol.ChatRead{
+		ConversationID: conversation.ID,
+		MessageID:      req.MessageID,
+		UserID:         userID,
+		Extension:      extension,
+	})
+	if errors.Is(err, errUnknownChatMessage) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown message",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to mark conversation read",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Conversation marked read",
+	})
+}
+
+// RecordChatRead stores a read receipt sent over the WebSocket
+func RecordChatRead(read protocol.ChatRead) error {
+	var conversation models.Conversation
+	if err := database.GetDB().Preload("Members.User").First(&conversation, read.ConversationID).Error; err != nil {
+		return protocol.NewError(protocol.CodeNotFound, "conversation not found")
+	}
+	if conversation.Member(read.UserID) == nil {
+		return protocol.NewError(protocol.CodeForbidden, "not a member of the conversation")
+	}
+
+	err := readConversation(&conversation, read)
+	if errors.Is(err, errUnknownChatMessage) {
+		return protocol.NewError(protocol.CodeRejected, err.Error())
+	}
+	return err
+}
+
+// LookupChatMembers returns the extensions of a conversation's members, so
+// the WebSocket hub can relay typing indicators to them
+func LookupChatMembers(conversationID, userID uint) ([]string, error) {
+	var conversation models.Conversation
+	if err := database.GetDB().Preload("Members.User").First(&conversation, conversationID).Error; err != nil {
+		return nil, protocol.NewError(protocol.CodeNotFound, "conversation not found")
+	}
+	if conversation.Member(userID) == nil {
+		return nil, protocol.NewError(protocol.CodeForbidden, "not a member of the conversation")
+	}
+	return memberExtensions(&conversation), nil
+}
+
+// DeliverPendingChat sends a user the messages stored while they were not
+// connected. Messages a resumed connection already replayed may be sent
+// again; clients drop duplicates by ID.
+func DeliverPendingChat(userID uint, extension string) {
+	hub := websocket.GetHub()
+	if hub == nil {
+		return
+	}
+
+	db := database.GetDB()
+
+	var messages []models.ChatMessage
+	if err := db.Preload("Sender").
+		Joins("JOIN conversation_members ON conversation_members.conversation_id = chat_messages.conversation_id").
+		Where("conversation_members.user_id = ? AND chat_messages.id > conversation_members.last_delivered_message_id AND chat_messages.sender_id <> ?", userID, userID).
+		Order("chat_messages.id DESC").Limit(chatPendingLimit).
+		Find(&messages).Error; err != nil {
+		log.Printf("[CHAT] Failed to load pending messages for %s: %v", extension, err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if err := hub.SendToExtension(extension, protocol.New(protocol.TypeChatMessage, chatMessagePayload(&messages[i]))); err != nil {
+			log.Printf("[CHAT] Failed to deliver pending message %d to %s: %v", messages[i].ID, extension, err)
+			return
+		}
+	}
+
+	// Messages past the limit are left to the history
+	if err := db.Model(&models.ConversationMember{}).Where("user_id = ?", userID).
+		Update("last_delivered_message_id", gorm.Expr(
+			"COALESCE((SELECT MAX(id) FROM chat_messages WHERE chat_messages.conversation_id = conversation_members.conversation_id), 0)")).Error; err != nil {
+		log.Printf("[CHAT] Failed to record delivery to %s: %v", extension, err)
+	}
+	log.Printf("[CHAT] Delivered %d pending messages to %s", len(messages), extension)
+}
+
+// readConversation moves a member's read watermark forward to a message of
+// the conversation and, when it moved, sends the read receipt to the
+// members, including the reader's other connections
+func readConversation(conversation *models.Conversation, read protocol.ChatRead) error {
+	db := database.GetDB()
+
+	var count int64
+	if err := db.Model(&models.ChatMessage{}).
+		Where("id = ? AND conversation_id = ?", read.MessageID, conversation.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return errUnknownChatMessage
+	}
+
+	var moved int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.ConversationMember{}).
+			Where("conversation_id = ? AND user_id = ? AND last_read_message_id < ?", conversation.ID, read.UserID, read.MessageID).
+			Update("last_read_message_id", read.MessageID)
+		if result.Error != nil {
+			return result.Error
+		}
+		moved = result.RowsAffected
+
+		// What was read was delivered
+		return tx.Model(&models.ConversationMember{}).
+			Where("conversation_id = ? AND user_id = ? AND last_delivered_message_id < ?", conversation.ID, read.UserID, read.MessageID).
+			Update("last_delivered_message_id", read.MessageID).Error
+	})
+	if err != nil {
+		log.Printf("[CHAT] Failed to mark conversation %d read for %s: %v", conversation.ID, read.Extension, err)
+		return err
+	}
+
+	if moved > 0 {
+		if hub := websocket.GetHub(); hub != nil {
+			hub.NotifyChat(memberExtensions(conversation), protocol.New(protocol.TypeChatRead, read))
+		}
+	}
+	return nil
+}
+
+// loadConversation loads the conversation named by the :id parameter with
+// its members, answering with an error unless the user is one of them
+func loadConversation(c *gin.Context, userID uint) (models.Conversation, bool) {
+	var conversation models.Conversation
+
+	conversationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid conversation ID",
+		})
+		return conversation, false
+	}
+
+	if err := database.GetDB().Preload("Members.User").First(&conversation, uint(conversationID)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Conversation not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return conversation, false
+	}
+
+	if conversation.Member(userID) == nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You are not a member of this conversation",
+		})
+		return conversation, false
+	}
+	return conversation, true
+}
+
+// respondWithConversation reloads a conversation and returns it
+func respondWithConversation(c *gin.Context, status int, message string, conversationID, userID uint) {
+	var conversation models.Conversation
+	if err := database.GetDB().Preload("Members.User").First(&conversation, conversationID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Database error",
+		})
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"success":      true,
+		"message":      message,
+		"conversation": conversationResponse(&conversation, userID),
+	})
+}
+
+type conversationMemberView struct {
+	UserID            uint      `json:"user_id"`
+	Username          string    `json:"username"`
+	Extension         string    `json:"extension"`
+	IsOnline          bool      `json:"is_online"`
+	LastReadMessageID uint      `json:"last_read_message_id"`
+	JoinedAt          time.Time `json:"joined_at"`
+}
+
+type conversationView struct {
+	ID            uint                     `json:"id"`
+	Type          string                   `json:"type"`
+	Name          string                   `json:"name"`
+	CreatedByID   uint                     `json:"created_by_id"`
+	Members       []conversationMemberView `json:"members"`
+	LastMessage   *protocol.ChatMessage    `json:"last_message"`
+	UnreadCount   int64                    `json:"unread_count"`
+	LastMessageAt *time.Time               `json:"last_message_at"`
+	CreatedAt     time.Time                `json:"created_at"`
+}
+
+// conversationResponse adds a conversation's last message and the number of
+// messages the user has not read to it
+func conversationResponse(conversation *models.Conversation, userID uint) conversationView {
+	db := database.GetDB()
+
+	view := conversationView{
+		ID:            conversation.ID,
+		Type:          conversation.Type,
+		Name:          conversation.Name,
+		CreatedByID:   conversation.CreatedByID,
+		Members:       make([]conversationMemberView, 0, len(conversation.Members)),
+		LastMessageAt: conversation.LastMessageAt,
+		CreatedAt:     conversation.CreatedAt,
+	}
+	for _, member := range conversation.Members {
+		view.Members = append(view.Members, conversationMemberView{
+			UserID:            member.UserID,
+			Username:          member.User.Username,
+			Extension:         member.User.Extension,
+			IsOnline:          member.User.IsOnline,
+			LastReadMessageID: member.LastReadMessageID,
+			JoinedAt:          member.JoinedAt,
+		})
+	}
+
+	var last models.ChatMessage
+	if err := db.Preload("Sender").Where("conversation_id = ?", conversation.ID).
+		Order("id DESC").First(&last).Error; err == nil {
+		payload := chatMessagePayload(&last)
+		view.LastMessage = &payload
+	}
+
+	if member := conversation.Member(userID); member != nil {
+		db.Model(&models.ChatMessage{}).
+			Where("conversation_id = ? AND id > ? AND sender_id <> ?", conversation.ID, member.LastReadMessageID, userID).
+			Count(&view.UnreadCount)
+	}
+	return view
+}
+
+// chatMessagePayload converts a stored message, with its sender, to the
+// form clients receive
+func chatMessagePayload(message *models.ChatMessage) protocol.ChatMessage {
+	return protocol.ChatMessage{
+		ID:             message.ID,
+		ConversationID: message.ConversationID,
+		SenderID:       message.SenderID,
+		SenderUsername: message.Sender.Username,
+		From:           message.Sender.Extension,
+		Body:           message.Body,
+		ClientID:       message.ClientID,
+		SentAt:         message.CreatedAt,
+	}
+}
+
+// memberExtensions returns the extensions of a conversation's members
+func memberExtensions(conversation *models.Conversation) []string {
+	extensions := make([]string, 0, len(conversation.Members))
+	for _, member := range conversation.Members {
+		if member.User.Extension != "" {
+			extensions = append(extensions, member.User.Extension)
+		}
+	}
+	return extensions
+}
+
+// directConversationKey identifies the direct conversation of two users
+func directConversationKey(a, b uint) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Wrong PINs a user may give for a room before each further one delays them
+const conferencePINFreeAttempts = 5
+
+// conferencePINThrottle counts the wrong PINs of each user for each room
+var conferencePINThrottle = auth.NewThrottle(conferencePINFreeAttempts, time.Second, 15*time.Minute, 15*time.Minute)
+
+// ListConferenceRooms returns every conference room with its live state
+func ListConferenceRooms(c *gin.Context) {
+	var rooms []models.ConferenceRoom
+	if err := database.GetDB().Preload("Owner").Preload("Moderators").Order("number").Find(&rooms).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve conference rooms",
+		})
+		return
+	}
+
+	response := make([]conferenceRoomView, 0, len(rooms))
+	for i := range rooms {
+		response = append(response, conferenceRoomResponse(&rooms[i]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"rooms":   response,
+		"count":   len(response),
+	})
+}
+
+// CreateConferenceRoom creates a conference room owned and moderated by the user
+func CreateConferenceRoom(c *gin.Context) {
+	userID, username, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.ConferenceRoomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	db := database.GetDB()
+
+	if req.Number == "" {
+		number, err := nextFreeNumber(8001, 8999)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to allocate a conference number",
+			})
+			return
+		}
+		req.Number = number
+	} else if !validDialNumber(req.Number) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Conference number must be 3 to 10 digits",
+		})
+		return
+	} else if !checkNumberFree(c, req.Number) {
+		return
+	}
+
+	var moderators []models.User
+	if len(req.ModeratorExtensions) > 0 {
+		if err := db.Where("extension IN ?", req.ModeratorExtensions).Find(&moderators).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+			return
+		}
+		if len(moderators) != len(uniqueStrings(req.ModeratorExtensions)) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Unknown moderator extension",
+			})
+			return
+		}
+	}
+
+	room := models.ConferenceRoom{
+		Name:            req.Name,
+		Number:          req.Number,
+		PIN:             req.PIN,
+		MaxParticipants: req.MaxParticipants,
+		OwnerID:         userID,
+		Moderators:      moderators,
+	}
+	if err := db.Create(&room).Error; err != nil {
+		log.Printf("[CONFERENCE] Failed to create room %s: %v", req.Number, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create conference room",
+		})
+		return
+	}
+
+	log.Printf("[CONFERENCE] User %s created room %s (%s)", username, room.Number, room.Name)
+
+	db.Preload("Owner").Preload("Moderators").First(&room, room.ID)
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "Conference room created",
+		"room":    conferenceRoomResponse(&room),
+	})
+}
+
+// GetConferenceRoom returns a conference room and its participants
+func GetConferenceRoom(c *gin.Context) {
+	room, ok := loadConferenceRoom(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"room":    conferenceRoomResponse(&room),
+	})
+}
+
+// DeleteConferenceRoom deletes a conference room (owner or conference moderators only)
+func DeleteConferenceRoom(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	room, ok := loadConferenceRoom(c)
+	if !ok {
+		return
+	}
+
+	if room.OwnerID != userID && !middleware.HasPermission(c, models.PermConferencesModerate) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only the owner can delete a conference room",
+		})
+		return
+	}
+
+	if len(services.GetConferenceService().Participants(room.Number)) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Conference is in progress",
+		})
+		return
+	}
+
+	if err := database.GetDB().Select("Moderators").Delete(&room).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete conference room",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Conference room deleted",
+	})
+}
+
+// JoinConferenceRoom dials the user's own extension into a conference
+func JoinConferenceRoom(c *gin.Context) {
+	userID, username, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.ConferenceJoinRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	room, ok := loadConferenceRoom(c)
+	if !ok {
+		return
+	}
+
+	moderator := room.IsModerator(userID) || middleware.HasPermission(c, models.PermConferencesModerate)
+	conferences := services.GetConferenceService()
+
+	if !moderator {
+		if room.PIN != "" {
+			key := fmt.Sprintf("%d:%d", userID, room.ID)
+			if wait := conferencePINThrottle.Attempt(key); wait > 0 {
+				tooManyAttempts(c, wait, "Too many wrong PINs; try again later")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(req.PIN), []byte(room.PIN)) != 1 {
+				log.Printf("[CONFERENCE] User %s gave a wrong PIN for room %s", username, room.Number)
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "Invalid PIN",
+				})
+				return
+			}
+			conferencePINThrottle.Reset(key)
+		}
+		if conferences.IsLocked(room.Number) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Conference is locked",
+			})
+			return
+		}
+	}
+
+	dialIntoConference(c, room, extension, moderator)
+}
+
+// DialConferenceParticipant dials another extension into a conference (moderators only)
+func DialConferenceParticipant(c *gin.Context) {
+	room, ok := requireConferenceModerator(c)
+	if !ok {
+		return
+	}
+
+	var req models.ConferenceDialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	var target models.User
+	if err := database.GetDB().Where("extension = ?", req.Extension).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Extension not found",
+		})
+		return
+	}
+
+	moderator := room.IsModerator(target.ID)
+	if !moderator && services.GetConferenceService().IsLocked(room.Number) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Conference is locked",
+		})
+		return
+	}
+
+	dialIntoConference(c, room, target.Extension, moderator)
+}
+
+// MuteConferenceParticipant mutes a participant
+func MuteConferenceParticipant(c *gin.Context) {
+	setConferenceMute(c, true)
+}
+
+// UnmuteConferenceParticipant unmutes a participant
+func UnmuteConferenceParticipant(c *gin.Context) {
+	setConferenceMute(c, false)
+}
+
+// KickConferenceParticipant removes a participant from a conference.
+// Participants may also remove themselves.
+func KickConferenceParticipant(c *gin.Context) {
+	room, participant, ok := loadConferenceParticipant(c)
+	if !ok {
+		return
+	}
+
+	if err := asterisk.KickConferenceParticipant(room.Number, participant.Channel); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to remove participant: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Participant removed",
+		"channel": participant.Channel,
+	})
+}
+
+// LockConferenceRoom stops anyone but moderators from joining a conference
+func LockConferenceRoom(c *gin.Context) {
+	setConferenceLock(c, true)
+}
+
+// UnlockConferenceRoom lets participants join a conference again
+func UnlockConferenceRoom(c *gin.Context) {
+	setConferenceLock(c, false)
+}
+
+// setConferenceMute handles mute (mute true) and unmute requests. Moderators
+// may mute anyone; participants only themselves.
+func setConferenceMute(c *gin.Context, mute bool) {
+	room, participant, ok := loadConferenceParticipant(c)
+	if !ok {
+		return
+	}
+
+	if err := asterisk.MuteConferenceParticipant(room.Number, participant.Channel, mute); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to change mute state: " + err.Error(),
+		})
+		return
+	}
+	services.GetConferenceService().SetMuted(room.Number, participant.Channel, mute)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"channel": participant.Channel,
+		"muted":   mute,
+	})
+}
+
+// setConferenceLock handles lock (lock true) and unlock requests
+func setConferenceLock(c *gin.Context, lock bool) {
+	room, ok := requireConferenceModerator(c)
+	if !ok {
+		return
+	}
+
+	conferences := services.GetConferenceService()
+	if len(conferences.Participants(room.Number)) == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Conference is not in progress",
+		})
+		return
+	}
+
+	if err := asterisk.LockConference(room.Number, lock); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to change lock state: " + err.Error(),
+		})
+		return
+	}
+	conferences.SetLocked(room.Number, lock)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"locked":  lock,
+	})
+}
+
+// dialIntoConference dials an extension into a room if there is space
+func dialIntoConference(c *gin.Context, room models.ConferenceRoom, extension string, moderator bool) {
+	participants := services.GetConferenceService().Participants(room.Number)
+
+	for _, participant := range participants {
+		if participant.Extension == extension {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Extension " + extension + " is already in the conference",
+			})
+			return
+		}
+	}
+	if room.MaxParticipants > 0 && len(participants) >= room.MaxParticipants {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Conference is full",
+		})
+		return
+	}
+
+	channel, err := asterisk.DialIntoConference(extension, room.Number, asterisk.ConferenceDialOptions{
+		Admin:           moderator,
+		MaxParticipants: room.MaxParticipants,
+	})
+	if err != nil {
+		log.Printf("[CONFERENCE] Failed to dial %s into room %s: %v", extension, room.Number, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to dial into conference: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[CONFERENCE] Dialling %s into room %s (moderator: %t)", extension, room.Number, moderator)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"message":    "Dialling " + extension + " into the conference",
+		"conference": room.Number,
+		"channel":    channel,
+		"moderator":  moderator,
+	})
+}
+
+// loadConferenceRoom loads the room named by the :id parameter, writing an
+// error response if there is none
+func loadConferenceRoom(c *gin.Context) (models.ConferenceRoom, bool) {
+	var room models.ConferenceRoom
+
+	roomID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid conference room ID",
+		})
+		return room, false
+	}
+
+	if err := database.GetDB().Preload("Owner").Preload("Moderators").First(&room, uint(roomID)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Conference room not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return room, false
+	}
+	room.HasPIN = room.PIN != ""
+	return room, true
+}
+
+// requireConferenceModerator loads the room and makes sure the user may moderate it
+func requireConferenceModerator(c *gin.Context) (models.ConferenceRoom, bool) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return models.ConferenceRoom{}, false
+	}
+
+	room, ok := loadConferenceRoom(c)
+	if !ok {
+		return room, false
+	}
+
+	if !room.IsModerator(userID) && !middleware.HasPermission(c, models.PermConferencesModerate) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only moderators can do this",
+		})
+		return room, false
+	}
+	return room, true
+}
+
+// loadConferenceParticipant loads the room and the participant named in the
+// request body, which must be the user's own channel unless they moderate
+func loadConferenceParticipant(c *gin.Context) (models.ConferenceRoom, asterisk.ConferenceParticipant, bool) {
+	var participant asterisk.ConferenceParticipant
+
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return models.ConferenceRoom{}, participant, false
+	}
+
+	var req models.ConferenceParticipantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return models.ConferenceRoom{}, participant, false
+	}
+
+	room, ok := loadConferenceRoom(c)
+	if !ok {
+		return room, participant, false
+	}
+
+	participant, ok = services.GetConferenceService().Participant(room.Number, req.Channel)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Participant not found",
+		})
+		return room, participant, false
+	}
+
+	if participant.Extension != extension && !room.IsModerator(userID) && !middleware.HasPermission(c, models.PermConferencesModerate) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only moderators can do this",
+		})
+		return room, participant, false
+	}
+	return room, participant, true
+}
+
+// conferenceRoomView is a conference room together with its live state
+type conferenceRoomView struct {
+	models.ConferenceRoom
+	Locked       bool                             `json:"locked"`
+	Participants []asterisk.ConferenceParticipant `json:"participants"`
+}
+
+// conferenceRoomResponse adds the live state of a room to it
+func conferenceRoomResponse(room *models.ConferenceRoom) conferenceRoomView {
+	conferences := services.GetConferenceService()
+	room.HasPIN = room.PIN != ""
+
+	return conferenceRoomView{
+		ConferenceRoom: *room,
+		Locked:         conferences.IsLocked(room.Number),
+		Participants:   conferences.Participants(room.Number),
+	}
+}
+
+// uniqueStrings returns the distinct values of a slice
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
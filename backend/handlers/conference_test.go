@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConferencePermissionsUseCurrentRole(t *testing.T) {
+	db := database.GetDB()
+
+	var owner, user models.User
+	db.Where("username = ?", "user1").First(&owner)
+	db.Where("username = ?", "user2").First(&user)
+	room := models.ConferenceRoom{Name: "Stale role", Number: "8900", OwnerID: owner.ID}
+	if err := db.Create(&room).Error; err != nil {
+		t.Fatalf("Failed to create conference room: %v", err)
+	}
+	defer db.Delete(&room)
+
+	// The token still says admin, but the user's role is now user
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("extension", user.Extension)
+		c.Set("role", models.RoleAdmin)
+		c.Next()
+	})
+	r.DELETE("/conference/rooms/:id", DeleteConferenceRoom)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/conference/rooms/%d", room.ID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("delete = %d %s, want 403", w.Code, w.Body.String())
+	}
+}
+
+func TestConferencePINGuessesAreThrottled(t *testing.T) {
+	db := database.GetDB()
+
+	var owner, user models.User
+	db.Where("username = ?", "user1").First(&owner)
+	db.Where("username = ?", "user2").First(&user)
+	rooms := []models.ConferenceRoom{
+		{Name: "PIN guessing", Number: "8901", PIN: "4821", OwnerID: owner.ID},
+		{Name: "Other room", Number: "8902", PIN: "1234", OwnerID: owner.ID},
+	}
+	for i := range rooms {
+		if err := db.Create(&rooms[i]).Error; err != nil {
+			t.Fatalf("Failed to create conference room: %v", err)
+		}
+		room := rooms[i]
+		t.Cleanup(func() {
+			db.Delete(&room)
+			conferencePINThrottle.Reset(fmt.Sprintf("%d:%d", user.ID, room.ID))
+		})
+	}
+
+	r := userRouter(t, "user2")
+	r.POST("/conference/rooms/:id/join", JoinConferenceRoom)
+	join := func(room models.ConferenceRoom, pin string) (int, map[string]interface{}) {
+		return post(t, r, fmt.Sprintf("/conference/rooms/%d/join", room.ID), `{"pin":"`+pin+`"}`)
+	}
+
+	for i := 0; i < conferencePINFreeAttempts+1; i++ {
+		if code, response := join(rooms[0], "0000"); code != http.StatusForbidden {
+			t.Fatalf("wrong PIN %d = %d %v, want 403", i+1, code, response)
+		}
+	}
+
+	// Even the right PIN waits once the user has guessed too often
+	if code, response := join(rooms[0], "4821"); code != http.StatusTooManyRequests {
+		t.Errorf("right PIN after guessing = %d %v, want 429", code, response)
+	}
+	// Guesses for one room do not slow down another
+	if code, response := join(rooms[1], "0000"); code != http.StatusForbidden {
+		t.Errorf("wrong PIN for another room = %d %v, want 403", code, response)
+	}
+}
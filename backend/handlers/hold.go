@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/services"
+	"voip-backend/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HoldCall puts a call on hold; the other party hears music on hold
+func HoldCall(c *gin.Context) {
+	setCallHold(c, true)
+}
+
+// ResumeCall takes a call off hold
+func ResumeCall(c *gin.Context) {
+	setCallHold(c, false)
+}
+
+// setCallHold handles hold (held true) and resume requests
+func setCallHold(c *gin.Context, held bool) {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.CallHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	action := "resume"
+	if held {
+		action = "hold"
+	}
+	log.Printf("[HOLD] User %s requested %s on channel %s", extension, action, req.Channel)
+
+	if strings.HasPrefix(req.Channel, "webrtc-call-") {
+		holdWebRTCCall(c, req, userID, extension, held)
+		return
+	}
+
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Preload("Caller").Preload("Callee").
+		Where("channel = ? AND (caller_id = ? OR callee_id = ?)", req.Channel, userID, userID).
+		First(&activeCall).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Active call not found",
+		})
+		return
+	}
+
+	holder, peer, _, peerChannel := transferParties(activeCall, userID)
+
+	if held {
+		if activeCall.Status != "connected" {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Only connected calls can be put on hold (call is " + activeCall.Status + ")",
+			})
+			return
+		}
+	} else {
+		if activeCall.HoldStartTime == nil {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Call is not on hold",
+			})
+			return
+		}
+		if activeCall.HeldBy != holder.Extension {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Call was put on hold by the other party",
+			})
+			return
+		}
+	}
+	if peerChannel == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "The other party's channel is not known yet",
+		})
+		return
+	}
+
+	if held {
+		// Claim the hold before asking Asterisk so concurrent requests
+		// cannot both succeed
+		changed, err := services.PutOnHold(activeCall, holder.Extension)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to update call",
+			})
+			return
+		}
+		if !changed {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Call is already on hold",
+			})
+			return
+		}
+		if err := asterisk.HoldCall(peerChannel); err != nil {
+			services.TakeOffHold(activeCall)
+			log.Printf("[HOLD] Failed to hold channel %s: %v", peerChannel, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to hold call: " + err.Error(),
+			})
+			return
+		}
+	} else {
+		if err := asterisk.UnholdCall(peerChannel); err != nil {
+			log.Printf("[HOLD] Failed to resume channel %s: %v", peerChannel, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to resume call: " + err.Error(),
+			})
+			return
+		}
+		if _, _, err := services.TakeOffHold(activeCall); err != nil {
+			log.Printf("[HOLD] Failed to record end of hold on channel %s: %v", req.Channel, err)
+		}
+	}
+
+	// Report the state as stored, including the total time on hold. Read
+	// into a fresh struct: scanning NULL does not clear HoldStartTime.
+	var updated models.ActiveCall
+	database.GetDB().First(&updated, activeCall.ID)
+	activeCall.Status, activeCall.HeldBy = updated.Status, updated.HeldBy
+	holdSeconds := services.HoldSeconds(updated)
+
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyCallHold(activeCall.Caller.Extension, activeCall.Callee.Extension,
+			activeCall.Status, req.Channel, activeCall.HeldBy, holdSeconds)
+	}
+
+	log.Printf("[HOLD] Call on channel %s is now %s (%s and %s, %ds on hold in total)",
+		req.Channel, activeCall.Status, holder.Extension, peer.Extension, holdSeconds)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"message":       "Call " + activeCall.Status,
+		"channel":       req.Channel,
+		"status":        activeCall.Status,
+		"held_by":       activeCall.HeldBy,
+		"hold_duration": holdSeconds,
+	})
+}
+
+// holdWebRTCCall holds or resumes a WebRTC-direct call through the hub,
+// which relays the signal to the other browser and tracks the hold state
+func holdWebRTCCall(c *gin.Context, req models.CallHoldRequest, userID uint, extension string, held bool) {
+	hub := websocket.GetHub()
+	if hub == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "WebSocket hub not available",
+		})
+		return
+	}
+
+	var callLog models.CallLog
+	if err := database.GetDB().Preload("Caller").Preload("Callee").
+		Where("channel = ? AND end_time IS NULL AND (caller_id = ? OR callee_id = ?)", req.Channel, userID, userID).
+		Order("id DESC").First(&callLog).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Call not found",
+		})
+		return
+	}
+
+	peer := callLog.Callee.Extension
+	if callLog.IsCallee(userID) {
+		peer = callLog.Caller.Extension
+	}
+
+	hold, err := hub.HoldWebRTCCall(req.Channel, extension, peer, held)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Cannot change hold state: " + err.Error(),
+		})
+		return
+	}
+
+	status := "connected"
+	if held {
+		status = "on_hold"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"message":       "Call " + status,
+		"channel":       req.Channel,
+		"status":        status,
+		"held_by":       hold.HeldBy,
+		"hold_duration": hold.Seconds(),
+	})
+}
+
+// RecordWebRTCHold adds the seconds of a finished hold of a WebRTC-direct
+// call to its call log
+func RecordWebRTCHold(channel string, seconds int) error {
+	var callLog models.CallLog
+	if err := database.GetDB().Where("channel = ?", channel).Order("id DESC").First(&callLog).Error; err != nil {
+		return err
+	}
+	return database.GetDB().Model(&callLog).
+		Update("hold_duration", callLog.HoldDuration+seconds).Error
+}
@@ -0,0 +1,471 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoginMFA completes a login with a TOTP code or a recovery code. A login
+// that requires enrollment confirms it with the first code from the new
+// secret, and the answer carries the user's recovery codes.
+func LoginMFA(c *gin.Context) {
+	var req models.MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "code or recovery_code is required",
+		})
+		return
+	}
+
+	user, claims, ok := loadMFALogin(c, req.MFAToken)
+	if !ok {
+		return
+	}
+	ip := c.ClientIP()
+	if wait := auth.LoginAttempt(ip, user.Username); wait > 0 {
+		tooManyAttempts(c, wait, "Too many failed login attempts; try again later")
+		return
+	}
+	if locked := auth.AccountLockedFor(&user); locked > 0 {
+		auth.LoginReleased(ip, user.Username)
+		tooManyAttempts(c, locked, "Account temporarily locked after too many failed logins")
+		return
+	}
+
+	// Enrolling: the code must come from the secret just set up
+	if !user.MFAEnabled {
+		if !claims.Enroll {
+			auth.LoginReleased(ip, user.Username)
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Two-factor authentication was reset; log in again",
+			})
+			return
+		}
+		codes, err := auth.ConfirmTOTPEnrollment(&user, req.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidMFACode):
+				auth.LoginFailed(ip, user.Username, &user)
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "Failed to enroll: " + err.Error(),
+				})
+			case errors.Is(err, auth.ErrMFANotPending):
+				auth.LoginReleased(ip, user.Username)
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": "Failed to enroll: " + err.Error(),
+				})
+			default:
+				auth.LoginReleased(ip, user.Username)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "Failed to enable two-factor authentication",
+				})
+			}
+			return
+		}
+		auth.LoginReleased(ip, user.Username)
+		log.Printf("[AUTH] User %s enrolled in two-factor authentication at login", user.Username)
+		completeLogin(c, &user, claims.DeviceName, codes)
+		return
+	}
+
+	switch {
+	case req.Code != "" && auth.VerifyTOTP(&user, req.Code):
+	case req.RecoveryCode != "" && auth.UseRecoveryCode(user.ID, req.RecoveryCode):
+		log.Printf("[AUTH] User %s logged in with a recovery code (%d left)", user.Username, auth.RecoveryCodesLeft(user.ID))
+	default:
+		log.Printf("[AUTH] Invalid second factor for user %s", user.Username)
+		auth.LoginFailed(ip, user.Username, &user)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid authentication code",
+		})
+		return
+	}
+	auth.LoginReleased(ip, user.Username)
+
+	completeLogin(c, &user, claims.DeviceName, nil)
+}
+
+// LoginMFAEnroll gives a user who must enroll before logging in the TOTP
+// secret to add to their authenticator
+func LoginMFAEnroll(c *gin.Context) {
+	var req models.MFAEnrollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	user, claims, ok := loadMFALogin(c, req.MFAToken)
+	if !ok {
+		return
+	}
+	if !claims.Enroll || user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	startEnrollment(c, &user)
+}
+
+// GetMFAStatus returns the current user's two-factor authentication state
+func GetMFAStatus(c *gin.Context) {
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":             true,
+		"enabled":             user.MFAEnabled,
+		"required":            auth.MFARequired(user.Role),
+		"enrollment_pending":  user.TOTPPending != "",
+		"recovery_codes_left": auth.RecoveryCodesLeft(user.ID),
+	})
+}
+
+// SetupMFA starts enrolling the current user: it returns a new TOTP secret
+// and its provisioning URI, to be confirmed with VerifyMFA
+func SetupMFA(c *gin.Context) {
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	startEnrollment(c, &user)
+}
+
+// VerifyMFA enables two-factor authentication with the first code from the
+// secret being enrolled, and returns the recovery codes
+func VerifyMFA(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	var err error
+	if !checkMFACode(c, &user, func() bool {
+		codes, err = auth.ConfirmTOTPEnrollment(&user, req.Code)
+		return !errors.Is(err, auth.ErrInvalidMFACode)
+	}) {
+		return
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrMFANotPending):
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Start enrollment first",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to enable two-factor authentication",
+			})
+		}
+		return
+	}
+
+	log.Printf("[AUTH] User %s enabled two-factor authentication", user.Username)
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns off the current user's two-factor authentication after
+// checking a TOTP code or recovery code, unless their role requires it
+func DisableMFA(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Two-factor authentication is not enabled",
+		})
+		return
+	}
+	if auth.MFARequired(user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Two-factor authentication is required for your role",
+		})
+		return
+	}
+	if !checkMFACode(c, &user, func() bool {
+		return auth.VerifyTOTP(&user, req.Code) || auth.UseRecoveryCode(user.ID, req.Code)
+	}) {
+		return
+	}
+
+	if err := auth.DisableMFA(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	log.Printf("[AUTH] User %s disabled two-factor authentication", user.Username)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes after
+// checking a TOTP code
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Two-factor authentication is not enabled",
+		})
+		return
+	}
+	if !checkMFACode(c, &user, func() bool {
+		return auth.VerifyTOTP(&user, req.Code)
+	}) {
+		return
+	}
+
+	codes, err := auth.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to generate recovery codes",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Recovery codes regenerated",
+		"recovery_codes": codes,
+	})
+}
+
+// checkMFACode runs a check of the current user's second factor through
+// the login throttle, so that a stolen session cannot guess codes without
+// limit. It answers the request when the user must wait or the check fails.
+func checkMFACode(c *gin.Context, user *models.User, check func() bool) bool {
+	ip := c.ClientIP()
+	if wait := auth.LoginAttempt(ip, user.Username); wait > 0 {
+		tooManyAttempts(c, wait, "Too many invalid authentication codes; try again later")
+		return false
+	}
+	if locked := auth.AccountLockedFor(user); locked > 0 {
+		auth.LoginReleased(ip, user.Username)
+		tooManyAttempts(c, locked, "Account temporarily locked after too many failed logins")
+		return false
+	}
+
+	if !check() {
+		log.Printf("[AUTH] Invalid second factor for user %s", user.Username)
+		auth.LoginFailed(ip, user.Username, user)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid authentication code",
+		})
+		return false
+	}
+	auth.LoginReleased(ip, user.Username)
+	return true
+}
+
+// ResetUserMFA turns off a user's two-factor authentication, e.g. when they
+// lost their authenticator and recovery codes (admin only). A user whose
+// role requires it enrolls again at their next login.
+func ResetUserMFA(c *gin.Context) {
+	user, ok := loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	if err := auth.DisableMFA(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to reset two-factor authentication",
+		})
+		return
+	}
+
+	adminID, _ := c.Get("user_id")
+	log.Printf("[AUTH] Two-factor authentication of user %s reset by admin %v", user.Username, adminID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Two-factor authentication reset successfully",
+	})
+}
+
+// ListMFAPolicies returns whether each role requires two-factor
+// authentication (admin only)
+func ListMFAPolicies(c *gin.Context) {
+	var roles []models.Role
+	if err := database.GetDB().Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve roles",
+		})
+		return
+	}
+	var policies []models.MFARolePolicy
+	if err := database.GetDB().Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve policies",
+		})
+		return
+	}
+
+	// Roles without a stored policy do not require it
+	byRole := make(map[string]models.MFARolePolicy)
+	for _, policy := range policies {
+		byRole[policy.Role] = policy
+	}
+	result := make([]models.MFARolePolicy, 0, len(roles))
+	for _, role := range roles {
+		policy, exists := byRole[role.Name]
+		if !exists {
+			policy = models.MFARolePolicy{Role: role.Name}
+		}
+		result = append(result, policy)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"policies": result,
+	})
+}
+
+// SetMFAPolicy sets whether a role requires two-factor authentication
+// (admin only). It applies from each user's next login.
+func SetMFAPolicy(c *gin.Context) {
+	role := c.Param("role")
+	if !auth.RoleExists(role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid role",
+		})
+		return
+	}
+	var req models.MFAPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	adminID, _, _, _, _ := middleware.GetUserFromContext(c)
+	policy := models.MFARolePolicy{Role: role, Required: *req.Required, UpdatedBy: adminID}
+	if err := database.GetDB().Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to save policy",
+		})
+		return
+	}
+
+	log.Printf("[AUTH] Two-factor authentication required for role %s: %t (admin %d)", role, policy.Required, adminID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Policy updated successfully",
+		"policy":  policy,
+	})
+}
+
+// startEnrollment answers with a new TOTP secret for a user and its
+// provisioning URI, which the client shows as a QR code
+func startEnrollment(c *gin.Context, user *models.User) {
+	secret, uri, err := auth.StartTOTPEnrollment(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to start enrollment",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":          true,
+		"secret":           secret,
+		"provisioning_uri": uri,
+	})
+}
+
+// loadMFALogin validates the MFA token of a login and loads its user
+func loadMFALogin(c *gin.Context, token string) (models.User, *auth.MFAClaims, bool) {
+	var user models.User
+
+	claims, err := auth.ValidateMFAToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		return user, nil, false
+	}
+	if err := database.GetDB().First(&user, claims.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not found",
+		})
+		return user, nil, false
+	}
+	return user, claims, true
+}
+
+// loadCurrentUser loads the authenticated user
+func loadCurrentUser(c *gin.Context) (models.User, bool) {
+	var user models.User
+
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return user, false
+	}
+	if err := database.GetDB().First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return user, false
+	}
+	return user, true
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/models"
+)
+
+// enableMFA turns on two-factor authentication for a test user with a new
+// secret, and undoes it and the login delays after the test
+func enableMFA(t *testing.T, username string) models.User {
+	t.Helper()
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	var user models.User
+	db := database.GetDB()
+	db.Where("username = ?", username).First(&user)
+	db.Model(&user).Updates(map[string]interface{}{"mfa_enabled": true, "totp_secret": secret})
+	t.Cleanup(func() {
+		auth.DisableMFA(user.ID)
+		auth.UnlockAccount(&user, 0, "")
+		// The test's IP address counts failures too
+		auth.InitLoginProtection()
+	})
+	return user
+}
+
+func TestMFACodesWithSessionAreThrottled(t *testing.T) {
+	user := enableMFA(t, "user3")
+	codes, err := auth.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+
+	r := userRouter(t, "user3")
+	r.POST("/mfa/disable", DisableMFA)
+	r.POST("/mfa/recovery-codes", RegenerateRecoveryCodes)
+
+	// Wrong codes count towards the same limit as logins, whichever
+	// endpoint they are tried at
+	for i, path := range []string{"/mfa/disable", "/mfa/recovery-codes", "/mfa/disable"} {
+		if code, response := post(t, r, path, `{"code":"000000"}`); code != http.StatusBadRequest {
+			t.Fatalf("wrong code %d = %d %v, want 400", i+1, code, response)
+		}
+	}
+	code, _ := post(t, r, "/mfa/disable", `{"code":"000000"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("fourth wrong code = %d, want 400 before the delay starts", code)
+	}
+
+	// Even a valid recovery code waits now
+	code, _ = post(t, r, "/mfa/disable", `{"code":"`+codes[0]+`"}`)
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("code after the failures = %d, want 429", code)
+	}
+	if left := auth.RecoveryCodesLeft(user.ID); left != int64(len(codes)) {
+		t.Errorf("a throttled request used a recovery code: %d left", left)
+	}
+	var reloaded models.User
+	database.GetDB().First(&reloaded, user.ID)
+	if !reloaded.MFAEnabled {
+		t.Error("two-factor authentication was disabled while throttled")
+	}
+}
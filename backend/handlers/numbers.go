@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// numberInUse reports whether a number phones can dial is already taken by
+// an extension, a conference room or a call queue
+func numberInUse(number string) (bool, error) {
+	db := database.GetDB()
+
+	for _, model := range []interface{}{&models.User{}, &models.ConferenceRoom{}, &models.CallQueue{}} {
+		column := "number"
+		if _, ok := model.(*models.User); ok {
+			column = "extension"
+		}
+
+		var count int64
+		if err := db.Model(model).Where(column+" = ?", number).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkNumberFree writes an error response if a number is already in use.
+// Phones dial these numbers, so they must not clash with each other.
+func checkNumberFree(c *gin.Context, number string) bool {
+	inUse, err := numberInUse(number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Database error",
+		})
+		return false
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Number " + number + " is already in use",
+		})
+		return false
+	}
+	return true
+}
+
+// nextFreeNumber returns the first number from first to last that is not in use
+func nextFreeNumber(first, last int) (string, error) {
+	for n := first; n <= last; n++ {
+		number := strconv.Itoa(n)
+		inUse, err := numberInUse(number)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return number, nil
+		}
+	}
+	return "", fmt.Errorf("no free numbers between %d and %d", first, last)
+}
+
+// validDialNumber reports whether a number is 3 to 10 digits
+func validDialNumber(number string) bool {
+	if len(number) < 3 || len(number) > 10 {
+		return false
+	}
+	_, err := strconv.ParseUint(number, 10, 64)
+	return err == nil
+}
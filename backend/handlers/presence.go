@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most presence transitions returned at once
+const maxPresenceHistory = 200
+
+// ListPresence returns the presence of every user with what it is made of
+func ListPresence(c *gin.Context) {
+	presence := services.GetPresenceService()
+	if presence == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Presence service not available",
+		})
+		return
+	}
+
+	users := presence.List()
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"presence": users,
+		"count":    len(users),
+	})
+}
+
+// GetPresence returns the presence of one extension's user and their latest
+// transitions (limit, default 50)
+func GetPresence(c *gin.Context) {
+	presence := services.GetPresenceService()
+	if presence == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Presence service not available",
+		})
+		return
+	}
+
+	state, found := presence.Get(c.Param("extension"))
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid limit",
+			})
+			return
+		}
+		limit = min(parsed, maxPresenceHistory)
+	}
+
+	var transitions []models.PresenceTransition
+	if err := database.GetDB().Where("user_id = ?", state.UserID).
+		Order("id DESC").Limit(limit).Find(&transitions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve presence history",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"presence":    state,
+		"transitions": transitions,
+	})
+}
@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ListCallQueues returns every call queue with its live state
+func ListCallQueues(c *gin.Context) {
+	var queues []models.CallQueue
+	if err := database.GetDB().Preload("Agents").Preload("Supervisors").Order("number").Find(&queues).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve call queues",
+		})
+		return
+	}
+
+	response := make([]callQueueView, 0, len(queues))
+	for _, queue := range queues {
+		response = append(response, callQueueResponse(queue))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"queues":  response,
+		"count":   len(response),
+	})
+}
+
+// GetCallQueue returns a call queue with its agents and waiting callers
+func GetCallQueue(c *gin.Context) {
+	queue, ok := loadCallQueue(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"queue":   callQueueResponse(queue),
+	})
+}
+
+// CreateCallQueue creates a call queue (admin only)
+func CreateCallQueue(c *gin.Context) {
+	var req models.CallQueueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	db := database.GetDB()
+
+	var existing int64
+	db.Model(&models.CallQueue{}).Where("name = ?", req.Name).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Queue " + req.Name + " already exists",
+		})
+		return
+	}
+
+	if req.Number == "" {
+		number, err := nextFreeNumber(7001, 7999)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to allocate a queue number",
+			})
+			return
+		}
+		req.Number = number
+	} else if !validDialNumber(req.Number) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Queue number must be 3 to 10 digits",
+		})
+		return
+	} else if !checkNumberFree(c, req.Number) {
+		return
+	}
+
+	agents, ok := loadQueueUsers(c, req.AgentExtensions, "agent")
+	if !ok {
+		return
+	}
+	supervisors, ok := loadQueueUsers(c, req.SupervisorExtensions, "supervisor")
+	if !ok {
+		return
+	}
+
+	queue := models.CallQueue{
+		Name:        req.Name,
+		Number:      req.Number,
+		Description: req.Description,
+		MaxWait:     req.MaxWait,
+		Agents:      agents,
+		Supervisors: supervisors,
+	}
+	if err := db.Create(&queue).Error; err != nil {
+		log.Printf("[QUEUE] Failed to create queue %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create call queue",
+		})
+		return
+	}
+
+	log.Printf("[QUEUE] Created queue %s on %s with %d agents", queue.Name, queue.Number, len(agents))
+
+	db.Preload("Agents").Preload("Supervisors").First(&queue, queue.ID)
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "Call queue created",
+		"queue":   callQueueResponse(queue),
+	})
+}
+
+// UpdateCallQueue changes a call queue (admin only). Agents removed from the
+// queue are logged out of it.
+func UpdateCallQueue(c *gin.Context) {
+	queue, ok := loadCallQueue(c)
+	if !ok {
+		return
+	}
+
+	var req models.CallQueueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	db := database.GetDB()
+	snapshot := services.GetQueueService().Snapshot(queue.Name)
+
+	if req.Name != queue.Name {
+		if len(snapshot.Members) > 0 || len(snapshot.Callers) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Cannot rename a queue while agents are logged in or callers are waiting",
+			})
+			return
+		}
+		var existing int64
+		db.Model(&models.CallQueue{}).Where("name = ?", req.Name).Count(&existing)
+		if existing > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "Queue " + req.Name + " already exists",
+			})
+			return
+		}
+	}
+
+	if req.Number == "" {
+		req.Number = queue.Number
+	} else if req.Number != queue.Number {
+		if !validDialNumber(req.Number) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Queue number must be 3 to 10 digits",
+			})
+			return
+		}
+		if !checkNumberFree(c, req.Number) {
+			return
+		}
+	}
+
+	agents, ok := loadQueueUsers(c, req.AgentExtensions, "agent")
+	if !ok {
+		return
+	}
+	supervisors, ok := loadQueueUsers(c, req.SupervisorExtensions, "supervisor")
+	if !ok {
+		return
+	}
+
+	// Work on a bare model so the preloaded associations are not written back
+	target := &models.CallQueue{ID: queue.ID}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(target).Updates(map[string]interface{}{
+			"name":        req.Name,
+			"number":      req.Number,
+			"description": req.Description,
+			"max_wait":    req.MaxWait,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(target).Association("Agents").Replace(agents); err != nil {
+			return err
+		}
+		return tx.Model(target).Association("Supervisors").Replace(supervisors)
+	})
+	if err != nil {
+		log.Printf("[QUEUE] Failed to update queue %s: %v", queue.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update call queue",
+		})
+		return
+	}
+
+	// Agents no longer assigned to the queue stop receiving its calls
+	remaining := make(map[string]bool, len(agents))
+	for _, agent := range agents {
+		remaining[agent.Extension] = true
+	}
+	for _, member := range snapshot.Members {
+		if !remaining[member.Extension] {
+			if err := asterisk.RemoveQueueMember(queue.Name, member.Extension); err != nil {
+				log.Printf("[QUEUE] Failed to log %s out of %s: %v", member.Extension, queue.Name, err)
+			}
+		}
+	}
+
+	var updated models.CallQueue
+	db.Preload("Agents").Preload("Supervisors").First(&updated, queue.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Call queue updated",
+		"queue":   callQueueResponse(updated),
+	})
+}
+
+// DeleteCallQueue deletes a call queue that has no waiting callers (admin
+// only), logging its agents out
+func DeleteCallQueue(c *gin.Context) {
+	queue, ok := loadCallQueue(c)
+	if !ok {
+		return
+	}
+
+	snapshot := services.GetQueueService().Snapshot(queue.Name)
+	if len(snapshot.Callers) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Callers are waiting in this queue",
+		})
+		return
+	}
+
+	for _, member := range snapshot.Members {
+		if err := asterisk.RemoveQueueMember(queue.Name, member.Extension); err != nil {
+			log.Printf("[QUEUE] Failed to log %s out of %s: %v", member.Extension, queue.Name, err)
+		}
+	}
+
+	if err := database.GetDB().Select("Agents", "Supervisors").Delete(&queue).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete call queue",
+		})
+		return
+	}
+
+	log.Printf("[QUEUE] Deleted queue %s", queue.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Call queue deleted",
+	})
+}
+
+// QueueAgentLogin logs an agent into a queue so it is offered calls
+func QueueAgentLogin(c *gin.Context) {
+	queue, agent, _, ok := loadQueueAgent(c)
+	if !ok {
+		return
+	}
+
+	if _, loggedIn := services.GetQueueService().Member(queue.Name, agent.Extension); loggedIn {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Extension " + agent.Extension + " is already logged into the queue",
+		})
+		return
+	}
+
+	if err := asterisk.AddQueueMember(queue.Name, agent.Extension, agent.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to log into queue: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[QUEUE] %s logged into %s", agent.Extension, queue.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"message":   "Logged into queue " + queue.Name,
+		"queue":     queue.Name,
+		"extension": agent.Extension,
+	})
+}
+
+// QueueAgentLogout logs an agent out of a queue
+func QueueAgentLogout(c *gin.Context) {
+	queue, agent, _, ok := loadQueueAgent(c)
+	if !ok {
+		return
+	}
+
+	if _, loggedIn := services.GetQueueService().Member(queue.Name, agent.Extension); !loggedIn {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Extension " + agent.Extension + " is not logged into the queue",
+		})
+		return
+	}
+
+	if err := asterisk.RemoveQueueMember(queue.Name, agent.Extension); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to log out of queue: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[QUEUE] %s logged out of %s", agent.Extension, queue.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"message":   "Logged out of queue " + queue.Name,
+		"queue":     queue.Name,
+		"extension": agent.Extension,
+	})
+}
+
+// QueueAgentPause stops offering queue calls to an agent, e.g. for a break
+func QueueAgentPause(c *gin.Context) {
+	setQueueAgentPause(c, true)
+}
+
+// QueueAgentUnpause offers queue calls to a paused agent again
+func QueueAgentUnpause(c *gin.Context) {
+	setQueueAgentPause(c, false)
+}
+
+// setQueueAgentPause handles pause (paused true) and unpause requests
+func setQueueAgentPause(c *gin.Context, paused bool) {
+	queue, agent, req, ok := loadQueueAgent(c)
+	if !ok {
+		return
+	}
+
+	if _, loggedIn := services.GetQueueService().Member(queue.Name, agent.Extension); !loggedIn {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Extension " + agent.Extension + " is not logged into the queue",
+		})
+		return
+	}
+
+	if err := asterisk.PauseQueueMember(queue.Name, agent.Extension, paused, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to change pause state: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[QUEUE] %s paused in %s: %t %s", agent.Extension, queue.Name, paused, req.Reason)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"queue":     queue.Name,
+		"extension": agent.Extension,
+		"paused":    paused,
+	})
+}
+
+// initiateQueueCall dials the caller into a queue, where they wait for the
+// next free agent
+func initiateQueueCall(c *gin.Context, userID uint, username, extension string, queue models.CallQueue) {
+	log.Printf("[CALL] User %s (ext: %s) calling queue %s (%s)", username, extension, queue.Name, queue.Number)
+
+	// The agent is not known until one answers, so the callee is filled in
+	// by the queue service
+	callID := asterisk.NewCallID()
+
+	callLog := models.CallLog{
+		CallerID:  userID,
+		StartTime: time.Now(),
+		Status:    "initiated",
+		Linkedid:  callID,
+		Direction: "outbound",
+	}
+	if err := database.GetDB().Create(&callLog).Error; err != nil {
+		c.Header("X-Warning", "Failed to create call log")
+	}
+
+	activeCall := models.ActiveCall{
+		CallerID:  userID,
+		Linkedid:  callID,
+		Status:    "ringing",
+		StartTime: time.Now(),
+	}
+	if err := database.GetDB().Create(&activeCall).Error; err != nil {
+		c.Header("X-Warning", "Failed to create active call record")
+	}
+
+	channel, err := asterisk.DialIntoQueue(extension, queue.Name, callID, queue.MaxWait)
+	if err != nil {
+		log.Printf("[CALL] ERROR: Failed to dial %s into queue %s: %v", extension, queue.Name, err)
+		database.GetDB().Model(&callLog).Updates(map[string]interface{}{
+			"status":   "failed",
+			"end_time": time.Now(),
+		})
+		database.GetDB().Where("linkedid = ?", callID).Delete(&models.ActiveCall{})
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to call queue: " + err.Error(),
+		})
+		return
+	}
+
+	database.GetDB().Model(&models.CallLog{}).Where("linkedid = ?", callID).Update("channel", channel)
+	database.GetDB().Model(&models.ActiveCall{}).Where("linkedid = ?", callID).Update("channel", channel)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Call queued for the next free agent",
+		"channel": channel,
+		"call_id": callID,
+		"caller":  username,
+		"queue":   queue.Name,
+		"waiting": len(services.GetQueueService().Snapshot(queue.Name).Callers),
+	})
+}
+
+// loadCallQueue loads the queue named by the :id parameter, writing an error
+// response if there is none
+func loadCallQueue(c *gin.Context) (models.CallQueue, bool) {
+	var queue models.CallQueue
+
+	queueID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid queue ID",
+		})
+		return queue, false
+	}
+
+	if err := database.GetDB().Preload("Agents").Preload("Supervisors").First(&queue, uint(queueID)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Call queue not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return queue, false
+	}
+	return queue, true
+}
+
+// loadQueueAgent loads the queue and the agent an agent request is about:
+// the user themselves, or the extension in the body for the queue's
+// supervisors and users allowed to supervise every queue. The agent must be
+// assigned to the queue. The body is optional.
+func loadQueueAgent(c *gin.Context) (models.CallQueue, models.User, models.QueueAgentRequest, bool) {
+	var agent models.User
+	var req models.QueueAgentRequest
+
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return models.CallQueue{}, agent, req, false
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return models.CallQueue{}, agent, req, false
+	}
+
+	queue, ok := loadCallQueue(c)
+	if !ok {
+		return queue, agent, req, false
+	}
+
+	if req.Extension != "" && req.Extension != extension {
+		if !queue.IsSupervisor(userID) && !middleware.HasPermission(c, models.PermQueuesSupervise) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Only supervisors can manage other agents",
+			})
+			return queue, agent, req, false
+		}
+		extension = req.Extension
+	}
+
+	for _, candidate := range queue.Agents {
+		if candidate.Extension == extension {
+			return queue, candidate, req, true
+		}
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": "Extension " + extension + " is not an agent of this queue",
+	})
+	return queue, agent, req, false
+}
+
+// loadQueueUsers loads the users with the given extensions, writing an
+// error response if any is unknown
+func loadQueueUsers(c *gin.Context, extensions []string, kind string) ([]models.User, bool) {
+	users := []models.User{}
+	if len(extensions) == 0 {
+		return users, true
+	}
+
+	if err := database.GetDB().Where("extension IN ?", extensions).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Database error",
+		})
+		return nil, false
+	}
+	if len(users) != len(uniqueStrings(extensions)) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown " + kind + " extension",
+		})
+		return nil, false
+	}
+	return users, true
+}
+
+// callQueueView is a call queue together with its live state
+type callQueueView struct {
+	models.CallQueue
+	services.QueueSnapshot
+}
+
+// callQueueResponse adds the live state of a queue to it
+func callQueueResponse(queue models.CallQueue) callQueueView {
+	return callQueueView{
+		CallQueue:     queue,
+		QueueSnapshot: services.GetQueueService().Snapshot(queue.Name),
+	}
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// roleView is a role with its permissions and how many users have it
+type roleView struct {
+	models.Role
+	Permissions []string `json:"permissions"`
+	Users       int64    `json:"users"`
+}
+
+// ListPermissions returns every permission a role can grant
+func ListPermissions(c *gin.Context) {
+	names := make([]string, 0, len(models.Permissions))
+	for name := range models.Permissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	permissions := make([]gin.H, 0, len(names)+1)
+	permissions = append(permissions, gin.H{"name": models.PermAll, "description": "Every permission"})
+	for _, name := range names {
+		permissions = append(permissions, gin.H{"name": name, "description": models.Permissions[name]})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"permissions": permissions,
+	})
+}
+
+// ListRoles returns the roles with their permissions
+func ListRoles(c *gin.Context) {
+	db := database.GetDB()
+
+	var roles []models.Role
+	if err := db.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve roles",
+		})
+		return
+	}
+
+	var counts []struct {
+		Role  string
+		Count int64
+	}
+	db.Model(&models.User{}).Select("role, COUNT(*) AS count").Group("role").Scan(&counts)
+	users := make(map[string]int64, len(counts))
+	for _, count := range counts {
+		users[count.Role] = count.Count
+	}
+
+	views := make([]roleView, len(roles))
+	for i, role := range roles {
+		views[i] = newRoleView(role, users[role.Name])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"roles":   views,
+	})
+}
+
+// CreateRole creates a role with permissions the current user holds
+func CreateRole(c *gin.Context) {
+	var req models.RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: name and permissions are required",
+		})
+		return
+	}
+	actorID, _, _, actorRole, _ := middleware.GetUserFromContext(c)
+	if !checkGrantable(c, actorRole, req.Permissions) {
+		return
+	}
+
+	db := database.GetDB()
+	var count int64
+	db.Model(&models.Role{}).Where("name = ?", req.Name).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Role " + req.Name + " already exists",
+		})
+		return
+	}
+
+	role := models.Role{Name: req.Name, Description: req.Description, Permissions: rolePermissions(req.Name, req.Permissions)}
+	if err := db.Create(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create role",
+		})
+		return
+	}
+	auth.InvalidateRoles()
+
+	log.Printf("[AUTH] Role %s created by user %d with permissions %v", role.Name, actorID, req.Permissions)
+	auth.Audit(models.AuditRoleCreated, nil, &actorID, c.ClientIP(), roleDetails(role.Name, req.Permissions))
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "Role created successfully",
+		"role":    newRoleView(role, 0),
+	})
+}
+
+// UpdateRole replaces a role's permissions, and its description if one is
+// given. The admin role always has every permission.
+func UpdateRole(c *gin.Context) {
+	var req models.RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: permissions are required",
+		})
+		return
+	}
+	role, ok := loadRole(c)
+	if !ok {
+		return
+	}
+	if role.Name == models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "The admin role cannot be changed",
+		})
+		return
+	}
+
+	// Both the permissions taken away and those given must be the user's
+	actorID, _, _, actorRole, _ := middleware.GetUserFromContext(c)
+	if !checkGrantable(c, actorRole, append(auth.RolePermissions(role.Name), req.Permissions...)) {
+		return
+	}
+
+	if req.Description != "" {
+		role.Description = req.Description
+	}
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&role).Update("description", role.Description).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role = ?", role.Name).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		role.Permissions = rolePermissions(role.Name, req.Permissions)
+		if len(role.Permissions) == 0 {
+			return nil
+		}
+		return tx.Create(&role.Permissions).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update role",
+		})
+		return
+	}
+	auth.InvalidateRoles()
+
+	var users int64
+	database.GetDB().Model(&models.User{}).Where("role = ?", role.Name).Count(&users)
+
+	log.Printf("[AUTH] Role %s updated by user %d with permissions %v", role.Name, actorID, req.Permissions)
+	auth.Audit(models.AuditRoleUpdated, nil, &actorID, c.ClientIP(), roleDetails(role.Name, req.Permissions))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Role updated successfully",
+		"role":    newRoleView(role, users),
+	})
+}
+
+// DeleteRole deletes a role no user has. Built-in roles cannot be deleted.
+func DeleteRole(c *gin.Context) {
+	role, ok := loadRole(c)
+	if !ok {
+		return
+	}
+	if role.BuiltIn {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Built-in roles cannot be deleted",
+		})
+		return
+	}
+	actorID, _, _, actorRole, _ := middleware.GetUserFromContext(c)
+	if !checkGrantable(c, actorRole, auth.RolePermissions(role.Name)) {
+		return
+	}
+
+	db := database.GetDB()
+	var users int64
+	db.Model(&models.User{}).Where("role = ?", role.Name).Count(&users)
+	if users > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("Role %s is assigned to %d users", role.Name, users),
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role = ?", role.Name).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role = ?", role.Name).Delete(&models.MFARolePolicy{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete role",
+		})
+		return
+	}
+	auth.InvalidateRoles()
+
+	log.Printf("[AUTH] Role %s deleted by user %d", role.Name, actorID)
+	auth.Audit(models.AuditRoleDeleted, nil, &actorID, c.ClientIP(), "role "+role.Name)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Role deleted successfully",
+	})
+}
+
+// checkGrantable refuses unknown permissions and permissions the user's
+// role does not hold
+func checkGrantable(c *gin.Context, actorRole string, permissions []string) bool {
+	for _, permission := range permissions {
+		if _, known := models.Permissions[permission]; !known && permission != models.PermAll {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Unknown permission: " + permission,
+			})
+			return false
+		}
+	}
+	if !auth.CanGrant(actorRole, permissions) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You can only grant or revoke permissions you have",
+		})
+		return false
+	}
+	return true
+}
+
+// loadRole loads the role named by the :name parameter
+func loadRole(c *gin.Context) (models.Role, bool) {
+	var role models.Role
+	if err := database.GetDB().Preload("Permissions").Where("name = ?", c.Param("name")).First(&role).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Role not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return role, false
+	}
+	return role, true
+}
+
+// rolePermissions returns the rows granting permissions to a role, without
+// duplicates
+func rolePermissions(role string, permissions []string) []models.RolePermission {
+	seen := make(map[string]bool)
+	rows := make([]models.RolePermission, 0, len(permissions))
+	for _, permission := range permissions {
+		if !seen[permission] {
+			seen[permission] = true
+			rows = append(rows, models.RolePermission{Role: role, Permission: permission})
+		}
+	}
+	return rows
+}
+
+// newRoleView returns a role with its permissions listed
+func newRoleView(role models.Role, users int64) roleView {
+	permissions := make([]string, len(role.Permissions))
+	for i, permission := range role.Permissions {
+		permissions[i] = permission.Permission
+	}
+	sort.Strings(permissions)
+	return roleView{Role: role, Permissions: permissions, Users: users}
+}
+
+// roleDetails describes a role's permissions for the audit trail
+func roleDetails(role string, permissions []string) string {
+	return fmt.Sprintf("role %s: %s", role, strings.Join(permissions, ", "))
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/websocket"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// sessionView is an active session as its user or an admin sees it
+type sessionView struct {
+	models.Session
+	Current          bool     `json:"current"`           // the session of the request
+	WebSocketClients []string `json:"websocket_clients"` // IDs of its connected clients on this node
+}
+
+// ListSessions returns the sessions the current user is logged in with
+func ListSessions(c *gin.Context) {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	listSessions(c, userID, extension, c.GetUint("session_id"))
+}
+
+// RevokeSession ends one of the current user's sessions, which may be the
+// current one
+func RevokeSession(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	revokeSession(c, userID, c.Param("id"), auth.RevokedByUser)
+}
+
+// RevokeSessions ends every session of the current user, or every other
+// one with keep_current=true
+func RevokeSessions(c *gin.Context) {
+	userID, _, _, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var exceptID uint
+	if c.Query("keep_current") == "true" {
+		exceptID = c.GetUint("session_id")
+	}
+	revokeSessions(c, userID, exceptID, auth.RevokedByUser)
+}
+
+// ListUserSessions returns the sessions of any user (admin only)
+func ListUserSessions(c *gin.Context) {
+	user, ok := loadUserParam(c)
+	if !ok {
+		return
+	}
+
+	listSessions(c, user.ID, user.Extension, c.GetUint("session_id"))
+}
+
+// RevokeUserSession ends one session of any user (admin only)
+func RevokeUserSession(c *gin.Context) {
+	user, ok := loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	revokeSession(c, user.ID, c.Param("session_id"), auth.RevokedByAdmin)
+}
+
+// RevokeUserSessions ends every session of any user (admin only)
+func RevokeUserSessions(c *gin.Context) {
+	user, ok := loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	revokeSessions(c, user.ID, 0, auth.RevokedByAdmin)
+}
+
+// listSessions answers with a user's active sessions, latest activity
+// first, with the WebSocket clients connected with each
+func listSessions(c *gin.Context, userID uint, extension string, currentID uint) {
+	var sessions []models.Session
+	if err := database.GetDB().
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to retrieve sessions",
+		})
+		return
+	}
+
+	clients := make(map[uint][]string)
+	if hub := websocket.GetHub(); hub != nil {
+		status := hub.GetExtensionStatus(extension)
+		if clientSessions, ok := status["client_sessions"].(map[string]uint); ok {
+			for clientID, sessionID := range clientSessions {
+				clients[sessionID] = append(clients[sessionID], clientID)
+			}
+		}
+	}
+
+	views := make([]sessionView, len(sessions))
+	for i, session := range sessions {
+		views[i] = sessionView{
+			Session:          session,
+			Current:          session.ID == currentID,
+			WebSocketClients: clients[session.ID],
+		}
+		if views[i].WebSocketClients == nil {
+			views[i].WebSocketClients = []string{}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"sessions": views,
+		"count":    len(views),
+	})
+}
+
+// revokeSession ends the active session of a user named by a parameter
+// and closes its WebSocket clients
+func revokeSession(c *gin.Context, userID uint, param, reason string) {
+	sessionID, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid session ID",
+		})
+		return
+	}
+
+	var session models.Session
+	if err := database.GetDB().
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", uint(sessionID), userID, time.Now()).
+		First(&session).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Session not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return
+	}
+
+	if err := auth.RevokeSession(session.ID, reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to revoke session",
+		})
+		return
+	}
+	if hub := websocket.GetHub(); hub != nil {
+		hub.DisconnectSession(userID, session.ID, websocket.CloseLoggedOut, "session revoked")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Session revoked successfully",
+	})
+}
+
+// revokeSessions ends every active session of a user but exceptID (0 for
+// none) and closes their WebSocket clients
+func revokeSessions(c *gin.Context, userID, exceptID uint, reason string) {
+	sessionIDs, err := auth.RevokeUserSessions(userID, exceptID, reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to revoke sessions",
+		})
+		return
+	}
+	if hub := websocket.GetHub(); hub != nil {
+		for _, sessionID := range sessionIDs {
+			hub.DisconnectSession(userID, sessionID, websocket.CloseLoggedOut, "session revoked")
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Sessions revoked successfully",
+		"revoked": len(sessionIDs),
+	})
+}
+
+// loadUserParam loads the user named by the :id parameter
+func loadUserParam(c *gin.Context) (models.User, bool) {
+	var user models.User
+
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid user ID format",
+		})
+		return user, false
+	}
+
+	if err := database.GetDB().First(&user, uint(userID)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "User not found",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Database error",
+			})
+		}
+		return user, false
+	}
+	return user, true
+}
+
+// loadManagedUser loads the user named by the :id parameter, if the current
+// user may manage them
+func loadManagedUser(c *gin.Context) (models.User, bool) {
+	user, ok := loadUserParam(c)
+	if !ok || !canManageUser(c, user) {
+		return user, false
+	}
+	return user, true
+}
+
+// canManageUser refuses users whose role grants permissions the current
+// user does not have
+func canManageUser(c *gin.Context, user models.User) bool {
+	_, _, _, actorRole, _ := middleware.GetUserFromContext(c)
+	if !auth.CanManageRole(actorRole, user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You cannot manage users with the " + user.Role + " role",
+		})
+		return false
+	}
+	return true
+}
+
+// checkAssignableRole refuses unknown roles and roles granting permissions
+// the current user does not have
+func checkAssignableRole(c *gin.Context, role string) bool {
+	if !auth.RoleExists(role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown role: " + role,
+		})
+		return false
+	}
+	return canManageUser(c, models.User{Role: role})
+}
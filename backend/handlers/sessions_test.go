@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startSession logs a test user in on a new device and returns the session
+// with its refresh token
+func startSession(t *testing.T, username string) (*models.Session, string) {
+	t.Helper()
+
+	var user models.User
+	if err := database.GetDB().Where("username = ?", username).First(&user).Error; err != nil {
+		t.Fatalf("Failed to load user %s: %v", username, err)
+	}
+	session, refreshToken, err := auth.CreateSession(user.ID, "test", "go-test", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	t.Cleanup(func() { auth.RevokeSession(session.ID, auth.RevokedLogout) })
+	return session, refreshToken
+}
+
+// sessionRouter serves the refresh endpoint and a protected route behind the
+// JWT middleware
+func sessionRouter() *gin.Engine {
+	r := gin.New()
+	r.POST("/refresh", RefreshToken)
+	r.GET("/protected/profile", middleware.AuthMiddleware(), GetProfile)
+	return r
+}
+
+// refresh exchanges a refresh token and returns the status with the new
+// access and refresh tokens
+func refresh(t *testing.T, r *gin.Engine, refreshToken string) (int, string, string) {
+	t.Helper()
+
+	code, response := post(t, r, "/refresh", `{"refresh_token":"`+refreshToken+`"}`)
+	token, _ := response["token"].(string)
+	newRefreshToken, _ := response["refresh_token"].(string)
+	return code, token, newRefreshToken
+}
+
+// getProfile requests a protected route with an access token
+func getProfile(r *gin.Engine, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/protected/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	session, refreshToken := startSession(t, "user1")
+	r := sessionRouter()
+
+	code, token, rotated := refresh(t, r, refreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh = %d, want 200", code)
+	}
+	if rotated == "" || rotated == refreshToken {
+		t.Fatalf("refresh token was not rotated: %q", rotated)
+	}
+	if code := getProfile(r, token); code != http.StatusOK {
+		t.Errorf("profile with the new access token = %d, want 200", code)
+	}
+
+	// The session keeps its ID and remembers the token it exchanged
+	var stored models.Session
+	database.GetDB().First(&stored, session.ID)
+	if stored.RefreshTokenHash == session.RefreshTokenHash || stored.RevokedAt != nil {
+		t.Errorf("session after refresh = %+v", stored)
+	}
+	var exchanged int64
+	database.GetDB().Model(&models.SessionToken{}).Where("session_id = ?", session.ID).Count(&exchanged)
+	if exchanged != 1 {
+		t.Errorf("%d exchanged tokens recorded, want 1", exchanged)
+	}
+
+	// The new refresh token can be exchanged in turn
+	if code, _, next := refresh(t, r, rotated); code != http.StatusOK || next == rotated {
+		t.Errorf("second refresh = %d, want 200 and a new token", code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	session, refreshToken := startSession(t, "user1")
+	r := sessionRouter()
+
+	_, token, rotated := refresh(t, r, refreshToken)
+	if rotated == "" {
+		t.Fatal("first refresh failed")
+	}
+
+	// Someone presents the token that was already exchanged
+	if code, _, _ := refresh(t, r, refreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token = %d, want 401", code)
+	}
+	var stored models.Session
+	database.GetDB().First(&stored, session.ID)
+	if stored.RevokedAt == nil || stored.RevokedReason != auth.RevokedTokenReused {
+		t.Fatalf("session after reuse: revoked at %v, reason %q", stored.RevokedAt, stored.RevokedReason)
+	}
+
+	// Neither the current refresh token nor the access tokens of the
+	// session work any more
+	if code, _, _ := refresh(t, r, rotated); code != http.StatusUnauthorized {
+		t.Errorf("current refresh token after reuse = %d, want 401", code)
+	}
+	if code := getProfile(r, token); code != http.StatusUnauthorized {
+		t.Errorf("access token after reuse = %d, want 401", code)
+	}
+
+	// A token that was never issued revokes nothing
+	if code, _, _ := refresh(t, r, "not-a-token"); code != http.StatusUnauthorized {
+		t.Errorf("unknown refresh token = %d, want 401", code)
+	}
+}
+
+func TestConcurrentRefreshesWithOneToken(t *testing.T) {
+	_, refreshToken := startSession(t, "user2")
+	r := sessionRouter()
+
+	// Requests racing with the same token: only one may get a new one
+	const requests = 8
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	succeeded := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusUnauthorized:
+		default:
+			t.Errorf("refresh = %d, want 200 or 401", code)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d refreshes succeeded, want 1", succeeded)
+	}
+}
+
+func TestCheckSessionRejectsRevokedSession(t *testing.T) {
+	session, refreshToken := startSession(t, "user2")
+	r := sessionRouter()
+
+	_, token, _ := refresh(t, r, refreshToken)
+	if code := getProfile(r, token); code != http.StatusOK {
+		t.Fatalf("profile = %d, want 200", code)
+	}
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+
+	if err := auth.RevokeSession(session.ID, auth.RevokedByUser); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if err := auth.CheckSession(claims); err != auth.ErrSessionRevoked {
+		t.Errorf("CheckSession after revocation = %v, want %v", err, auth.ErrSessionRevoked)
+	}
+	if code := getProfile(r, token); code != http.StatusUnauthorized {
+		t.Errorf("profile after revocation = %d, want 401", code)
+	}
+
+	// A token naming another user's session is refused too
+	claims.UserID++
+	if err := auth.CheckSession(claims); err != auth.ErrSessionRevoked {
+		t.Errorf("CheckSession for another user = %v, want %v", err, auth.ErrSessionRevoked)
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"voip-backend/asterisk"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListAllActiveCalls returns every active call, whoever is on it
+func ListAllActiveCalls(c *gin.Context) {
+	var activeCalls []models.ActiveCall
+	if err := database.GetDB().Preload("Caller").Preload("Callee").Order("start_time").Find(&activeCalls).Error; err != nil {
+		log.Printf("[SUPERVISOR] ERROR: Failed to fetch active calls: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch active calls",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"active_calls": activeCalls,
+		"count":        len(activeCalls),
+	})
+}
+
+// MonitorCall calls the supervisor's extension and connects it to an active
+// call to listen, whisper to one party or barge in
+func MonitorCall(c *gin.Context) {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.CallMonitorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = asterisk.MonitorListen
+	}
+
+	callID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid call ID",
+		})
+		return
+	}
+
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Preload("Caller").Preload("Callee").First(&activeCall, callID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Active call not found",
+		})
+		return
+	}
+	if activeCall.CallerID == userID || (activeCall.CalleeID != nil && *activeCall.CalleeID == userID) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "You cannot monitor your own call",
+		})
+		return
+	}
+
+	channel := activeCall.CallerChannel
+	if req.Party == "callee" {
+		channel = activeCall.CalleeChannel
+	} else if channel == "" {
+		channel = activeCall.Channel
+	}
+	if channel == "" || strings.HasPrefix(channel, "webrtc-call-") {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Only calls through Asterisk can be monitored",
+		})
+		return
+	}
+
+	supervisorChannel, err := asterisk.SpyOnCall(extension, channel, req.Mode)
+	if err != nil {
+		log.Printf("[SUPERVISOR] Failed to monitor call %d for %s: %v", activeCall.ID, extension, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to monitor call: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("[SUPERVISOR] %s monitoring call %d (%s) on %s", extension, activeCall.ID, req.Mode, channel)
+	auth.Audit(models.AuditCallMonitored, nil, &userID, c.ClientIP(),
+		fmt.Sprintf("%s call %d between %s and %s", req.Mode, activeCall.ID, activeCall.Caller.Extension, activeCall.Callee.Extension))
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Calling your extension to " + req.Mode,
+		"channel": supervisorChannel,
+		"mode":    req.Mode,
+	})
+}
@@ -133,6 +133,7 @@ func GetFastSystemHealth(c *gin.Context) {
 			Details: map[string]interface{}{
 				"active_clients":       hub.GetClientCount(),
 				"connected_extensions": len(hub.GetConnectedExtensions()),
+				"message_metrics":      hub.Metrics(),
 			},
 		}
 	} else {
@@ -443,6 +444,7 @@ func checkWebSocketHealth() ServiceInfo {
 		service.Status = "healthy"
 		service.Details["active_clients"] = hub.GetClientCount()
 		service.Details["connected_extensions"] = len(hub.GetConnectedExtensions())
+		service.Details["message_metrics"] = hub.Metrics()
 	}
 
 	service.ResponseTime = time.Since(startTime).Milliseconds()
@@ -0,0 +1,729 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/services"
+	"voip-backend/websocket"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// TransferCall handles blind and attended call transfers
+func TransferCall(c *gin.Context) {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "User not authenticated",
+		})
+		return
+	}
+
+	var req models.CallTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	req.Type = strings.ToLower(req.Type)
+	if req.Type == "" {
+		req.Type = "blind"
+	}
+	req.Action = strings.ToLower(req.Action)
+	if req.Action == "" {
+		req.Action = "start"
+	}
+
+	if req.Type != "blind" && req.Type != "attended" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid transfer type. Use 'blind' or 'attended'",
+		})
+		return
+	}
+	if req.Action != "start" && req.Action != "complete" && req.Action != "cancel" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid action. Use 'start', 'complete' or 'cancel'",
+		})
+		return
+	}
+	if req.Type == "blind" && req.Action != "start" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Only attended transfers can be completed or cancelled",
+		})
+		return
+	}
+	if req.Action == "start" && req.TargetExtension == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Target extension is required",
+		})
+		return
+	}
+
+	log.Printf("[TRANSFER] User %s requested %s transfer %s on channel %s (target: %s)",
+		extension, req.Type, req.Action, req.Channel, req.TargetExtension)
+
+	if strings.HasPrefix(req.Channel, "webrtc-call-") {
+		transferWebRTCCall(c, req, userID, extension)
+		return
+	}
+
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Preload("Caller").Preload("Callee").
+		Where("channel = ? AND (caller_id = ? OR callee_id = ?)", req.Channel, userID, userID).
+		First(&activeCall).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Active call not found",
+		})
+		return
+	}
+
+	switch req.Action {
+	case "start":
+		startTransfer(c, req, activeCall, userID)
+	case "complete":
+		completeTransfer(c, activeCall, userID, extension)
+	case "cancel":
+		cancelTransfer(c, activeCall, userID, extension)
+	}
+}
+
+// startTransfer performs a blind transfer or starts the consultation call of
+// an attended transfer
+func startTransfer(c *gin.Context, req models.CallTransferRequest, activeCall models.ActiveCall, userID uint) {
+	target, ok := findTransferTarget(c, req.TargetExtension, activeCall.CallerID, activeCall.CalleeID)
+	if !ok {
+		return
+	}
+
+	if activeCall.Status != "connected" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Only connected calls can be transferred (call is " + activeCall.Status + ")",
+		})
+		return
+	}
+
+	transferor, transferee, transferorChannel, transfereeChannel := transferParties(activeCall, userID)
+	if transferorChannel == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Call has no Asterisk channel to transfer yet",
+		})
+		return
+	}
+
+	tracker := services.GetCallTracker()
+	hub := websocket.GetHub()
+
+	transfer := protocol.CallTransfer{
+		Channel:      activeCall.Channel,
+		TransferType: req.Type,
+		Transferor:   transferor.Extension,
+		Transferee:   transferee.Extension,
+		Target:       target.Extension,
+	}
+
+	if req.Type == "blind" {
+		// Record the new parties first: Asterisk starts ringing the target
+		// as soon as it accepts the transfer
+		if tracker != nil {
+			tracker.Transfer(activeCall.Linkedid, transferee.Extension, target.Extension, transfereeChannel, "", true)
+		}
+		activeCallQuery(activeCall).Updates(map[string]interface{}{
+			"caller_id":      transferee.ID,
+			"callee_id":      target.ID,
+			"caller_channel": transfereeChannel,
+			"callee_channel": "",
+			"status":         "transferring",
+		})
+
+		if err := asterisk.BlindTransfer(transferorChannel, target.Extension); err != nil {
+			log.Printf("[TRANSFER] Blind transfer of %s to %s failed: %v", activeCall.Channel, target.Extension, err)
+			if tracker != nil {
+				tracker.Transfer(activeCall.Linkedid, activeCall.Caller.Extension, activeCall.Callee.Extension,
+					activeCall.CallerChannel, activeCall.CalleeChannel, false)
+			}
+			activeCallQuery(activeCall).Updates(map[string]interface{}{
+				"caller_id":      activeCall.CallerID,
+				"callee_id":      activeCall.CalleeID,
+				"caller_channel": activeCall.CallerChannel,
+				"callee_channel": activeCall.CalleeChannel,
+				"status":         "connected",
+			})
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to transfer call: " + err.Error(),
+			})
+			return
+		}
+
+		transfer.Status = "completed"
+		if hub != nil {
+			hub.NotifyCallTransfer(protocol.TypeCallTransfer, transfer)
+			hub.NotifyIncomingCall(transferee.Extension, target.Extension, activeCall.Channel, activeCall.Linkedid)
+		}
+
+		log.Printf("[TRANSFER] %s blind transferred %s to %s", transferor.Extension, transferee.Extension, target.Extension)
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":  true,
+			"message":  "Call transferred successfully",
+			"transfer": transfer,
+		})
+		return
+	}
+
+	activeCallQuery(activeCall).Updates(map[string]interface{}{
+		"status":          "transferring",
+		"transfer_by":     transferor.Extension,
+		"transfer_target": target.Extension,
+	})
+
+	if err := asterisk.AttendedTransfer(transferorChannel, target.Extension); err != nil {
+		log.Printf("[TRANSFER] Attended transfer of %s to %s failed: %v", activeCall.Channel, target.Extension, err)
+		clearTransfer(activeCall)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to start transfer: " + err.Error(),
+		})
+		return
+	}
+
+	transfer.Status = "consulting"
+	if hub != nil {
+		hub.NotifyCallTransfer(protocol.TypeCallTransfer, transfer)
+		hub.NotifyIncomingCall(transferor.Extension, target.Extension, activeCall.Channel, activeCall.Linkedid)
+	}
+
+	log.Printf("[TRANSFER] %s consulting %s before transferring %s", transferor.Extension, target.Extension, transferee.Extension)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"message":  "Consultation call started",
+		"transfer": transfer,
+	})
+}
+
+// completeTransfer connects the transferee with the consulted target by
+// hanging up the transferor
+func completeTransfer(c *gin.Context, activeCall models.ActiveCall, userID uint, extension string) {
+	if !checkTransferOwner(c, activeCall.TransferTarget, activeCall.TransferBy, extension) {
+		return
+	}
+
+	consult, err := findConsultChannel(activeCall)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to look up consultation call: " + err.Error(),
+		})
+		return
+	}
+	if consult == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Transfer target is not on the line",
+		})
+		return
+	}
+	if consult.ChannelStateDesc != "Up" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Transfer target has not answered yet",
+		})
+		return
+	}
+
+	var target models.User
+	if err := database.GetDB().Where("extension = ?", activeCall.TransferTarget).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Target extension not found",
+		})
+		return
+	}
+
+	transferor, transferee, transferorChannel, transfereeChannel := transferParties(activeCall, userID)
+
+	tracker := services.GetCallTracker()
+	if tracker != nil {
+		tracker.Transfer(activeCall.Linkedid, transferee.Extension, target.Extension, transfereeChannel, consult.Channel, false)
+	}
+	activeCallQuery(activeCall).Updates(map[string]interface{}{
+		"caller_id":       transferee.ID,
+		"callee_id":       target.ID,
+		"caller_channel":  transfereeChannel,
+		"callee_channel":  consult.Channel,
+		"status":          "connected",
+		"transfer_by":     "",
+		"transfer_target": "",
+	})
+
+	// Asterisk completes an attended transfer when the transferor hangs up
+	if err := asterisk.HangupCall(transferorChannel); err != nil {
+		log.Printf("[TRANSFER] Failed to complete transfer of %s: %v", activeCall.Channel, err)
+		if tracker != nil {
+			tracker.Transfer(activeCall.Linkedid, activeCall.Caller.Extension, activeCall.Callee.Extension,
+				activeCall.CallerChannel, activeCall.CalleeChannel, false)
+		}
+		activeCallQuery(activeCall).Updates(map[string]interface{}{
+			"caller_id":       activeCall.CallerID,
+			"callee_id":       activeCall.CalleeID,
+			"caller_channel":  activeCall.CallerChannel,
+			"callee_channel":  activeCall.CalleeChannel,
+			"status":          "transferring",
+			"transfer_by":     activeCall.TransferBy,
+			"transfer_target": activeCall.TransferTarget,
+		})
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to complete transfer: " + err.Error(),
+		})
+		return
+	}
+
+	transfer := protocol.CallTransfer{
+		Channel:      activeCall.Channel,
+		TransferType: "attended",
+		Status:       "completed",
+		Transferor:   transferor.Extension,
+		Transferee:   transferee.Extension,
+		Target:       target.Extension,
+	}
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyCallTransfer(protocol.TypeCallTransfer, transfer)
+		hub.NotifyCallStatus(transferee.Extension, target.Extension, "connected", activeCall.Channel, activeCall.Linkedid)
+	}
+
+	log.Printf("[TRANSFER] %s transferred %s to %s", transferor.Extension, transferee.Extension, target.Extension)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"message":  "Call transferred successfully",
+		"transfer": transfer,
+	})
+}
+
+// cancelTransfer hangs up the consultation call and returns the transferor
+// to the transferee
+func cancelTransfer(c *gin.Context, activeCall models.ActiveCall, userID uint, extension string) {
+	if !checkTransferOwner(c, activeCall.TransferTarget, activeCall.TransferBy, extension) {
+		return
+	}
+
+	consult, err := findConsultChannel(activeCall)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to look up consultation call: " + err.Error(),
+		})
+		return
+	}
+	if consult != nil {
+		if err := asterisk.HangupCall(consult.Channel); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to cancel transfer: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	clearTransfer(activeCall)
+
+	transferor, transferee, _, _ := transferParties(activeCall, userID)
+	transfer := protocol.CallTransfer{
+		Channel:      activeCall.Channel,
+		TransferType: "attended",
+		Status:       "cancelled",
+		Transferor:   transferor.Extension,
+		Transferee:   transferee.Extension,
+		Target:       activeCall.TransferTarget,
+	}
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyCallTransfer(protocol.TypeCallTransfer, transfer)
+	}
+
+	log.Printf("[TRANSFER] %s cancelled the transfer of %s to %s", transferor.Extension, transferee.Extension, activeCall.TransferTarget)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"message":  "Transfer cancelled",
+		"transfer": transfer,
+	})
+}
+
+// transferWebRTCCall transfers a WebRTC-direct call. There is no media server
+// in the path, so the transfer is carried out by telling the browsers which
+// calls to set up and tear down.
+func transferWebRTCCall(c *gin.Context, req models.CallTransferRequest, userID uint, extension string) {
+	hub := websocket.GetHub()
+	if hub == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "WebSocket hub not available",
+		})
+		return
+	}
+
+	var callLog models.CallLog
+	if err := database.GetDB().Preload("Caller").Preload("Callee").
+		Where("channel = ? AND end_time IS NULL AND (caller_id = ? OR callee_id = ?)", req.Channel, userID, userID).
+		Order("id DESC").First(&callLog).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Call not found",
+		})
+		return
+	}
+
+	transferor, transferee := callLog.Caller, callLog.Callee
+	if callLog.IsCallee(userID) {
+		transferor, transferee = callLog.Callee, callLog.Caller
+	}
+
+	transfer := protocol.CallTransfer{
+		Channel:      req.Channel,
+		TransferType: req.Type,
+		Transferor:   transferor.Extension,
+		Transferee:   transferee.Extension,
+	}
+
+	var pending *models.WebRTCTransfer
+	var stored models.WebRTCTransfer
+	if err := database.GetDB().Where("channel = ?", req.Channel).First(&stored).Error; err == nil {
+		pending = &stored
+	}
+
+	switch req.Action {
+	case "start":
+		if pending != nil {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "A transfer is already in progress",
+			})
+			return
+		}
+
+		target, ok := findTransferTarget(c, req.TargetExtension, callLog.CallerID, callLog.CalleeID)
+		if !ok {
+			return
+		}
+		transfer.Target = target.Extension
+
+		if req.Type == "blind" {
+			// The transferee calls the target; the transferor drops out
+			newCallID, err := createWebRTCCallLog(transferee, target, nil)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "Failed to create call log",
+				})
+				return
+			}
+			finishWebRTCCallLog(req.Channel)
+
+			transfer.Status = "completed"
+			transfer.NewChannel = newCallID
+			sendWebRTCInvitation(hub, newCallID, transferee, target, protocol.CallInvitation{
+				TransferredBy: transferor.Extension,
+			})
+			hub.NotifyCallTransfer(protocol.TypeWebRTCTransfer, transfer)
+			break
+		}
+
+		// The transferor calls the target while the transferee waits
+		consultCallID, err := createWebRTCCallLog(transferor, target, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to create call log",
+			})
+			return
+		}
+		// Of two transfers of the call started at once, only one is stored
+		if err := database.GetDB().Create(&models.WebRTCTransfer{
+			Channel:        req.Channel,
+			Transferor:     transferor.Extension,
+			Transferee:     transferee.Extension,
+			Target:         target.Extension,
+			ConsultChannel: consultCallID,
+		}).Error; err != nil {
+			finishWebRTCCallLog(consultCallID)
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "A transfer is already in progress",
+			})
+			return
+		}
+
+		transfer.Status = "consulting"
+		transfer.ConsultChannel = consultCallID
+		sendWebRTCInvitation(hub, consultCallID, transferor, target, protocol.CallInvitation{
+			ConsultFor: req.Channel,
+		})
+		hub.NotifyCallTransfer(protocol.TypeWebRTCTransfer, transfer)
+
+	case "complete":
+		if !checkTransferOwner(c, pendingTarget(pending), pendingTransferor(pending), extension) ||
+			!claimWebRTCTransfer(c, pending) {
+			return
+		}
+
+		var target models.User
+		if err := database.GetDB().Where("extension = ?", pending.Target).First(&target).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Target extension not found",
+			})
+			return
+		}
+
+		// Both parties are already talking to the transferor, so the new
+		// call between them counts as answered straight away
+		now := time.Now()
+		newCallID, err := createWebRTCCallLog(transferee, target, &now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to create call log",
+			})
+			return
+		}
+		finishWebRTCCallLog(req.Channel)
+		finishWebRTCCallLog(pending.ConsultChannel)
+		hub.StartCallSession(newCallID, transferee.Extension, target.Extension)
+
+		transfer.Status = "completed"
+		transfer.Target = pending.Target
+		transfer.ConsultChannel = pending.ConsultChannel
+		transfer.NewChannel = newCallID
+		hub.NotifyCallTransfer(protocol.TypeWebRTCTransfer, transfer)
+
+	case "cancel":
+		if !checkTransferOwner(c, pendingTarget(pending), pendingTransferor(pending), extension) ||
+			!claimWebRTCTransfer(c, pending) {
+			return
+		}
+
+		finishWebRTCCallLog(pending.ConsultChannel)
+
+		transfer.Status = "cancelled"
+		transfer.Target = pending.Target
+		transfer.ConsultChannel = pending.ConsultChannel
+		hub.NotifyCallTransfer(protocol.TypeWebRTCTransfer, transfer)
+	}
+
+	log.Printf("[TRANSFER] WebRTC call %s: %s transfer %s (%s -> %s)",
+		req.Channel, transfer.TransferType, transfer.Status, transfer.Transferee, transfer.Target)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"message":  "Transfer " + transfer.Status,
+		"transfer": transfer,
+	})
+}
+
+// claimWebRTCTransfer removes an attended transfer of a WebRTC-direct call
+// to complete or cancel it. Of two requests racing for the transfer, only
+// the one that removed it goes on.
+func claimWebRTCTransfer(c *gin.Context, pending *models.WebRTCTransfer) bool {
+	result := database.GetDB().Where("id = ?", pending.ID).Delete(&models.WebRTCTransfer{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "No attended transfer in progress",
+		})
+		return false
+	}
+	return true
+}
+
+// EndWebRTCTransfers cancels the attended transfers a WebRTC-direct call
+// took part in once it ended, as the call being transferred or as the
+// consultation call, and tells their parties
+func EndWebRTCTransfers(callID string) {
+	var transfers []models.WebRTCTransfer
+	database.GetDB().Where("channel = ? OR consult_channel = ?", callID, callID).Find(&transfers)
+
+	for _, pending := range transfers {
+		result := database.GetDB().Where("id = ?", pending.ID).Delete(&models.WebRTCTransfer{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		log.Printf("[TRANSFER] WebRTC call %s ended: attended transfer of %s to %s cancelled",
+			callID, pending.Channel, pending.Target)
+
+		if hub := websocket.GetHub(); hub != nil {
+			hub.NotifyCallTransfer(protocol.TypeWebRTCTransfer, protocol.CallTransfer{
+				Channel:        pending.Channel,
+				TransferType:   "attended",
+				Status:         "cancelled",
+				Transferor:     pending.Transferor,
+				Transferee:     pending.Transferee,
+				Target:         pending.Target,
+				ConsultChannel: pending.ConsultChannel,
+			})
+		}
+	}
+}
+
+// findTransferTarget looks up the user a call is being transferred to and
+// writes an error response if the transfer cannot go there
+func findTransferTarget(c *gin.Context, extension string, callerID uint, calleeID *uint) (models.User, bool) {
+	var target models.User
+	if err := database.GetDB().Where("extension = ?", extension).First(&target).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Target extension not found",
+		})
+		return target, false
+	}
+
+	if target.ID == callerID || (calleeID != nil && target.ID == *calleeID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Cannot transfer a call to one of its parties",
+		})
+		return target, false
+	}
+
+	return target, true
+}
+
+// checkTransferOwner makes sure an attended transfer is in progress and was
+// started by the user, writing an error response otherwise
+func checkTransferOwner(c *gin.Context, target, transferBy, extension string) bool {
+	if target == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "No attended transfer in progress",
+		})
+		return false
+	}
+	if transferBy != extension {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only the party that started the transfer can complete or cancel it",
+		})
+		return false
+	}
+	return true
+}
+
+// transferParties returns the user transferring the call, the party being
+// transferred and their Asterisk channels
+func transferParties(activeCall models.ActiveCall, userID uint) (models.User, models.User, string, string) {
+	if activeCall.CallerID == userID {
+		return activeCall.Caller, activeCall.Callee, activeCall.CallerChannel, activeCall.CalleeChannel
+	}
+	return activeCall.Callee, activeCall.Caller, activeCall.CalleeChannel, activeCall.CallerChannel
+}
+
+// findConsultChannel returns the channel of the consultation call of an
+// attended transfer, or nil if the target is no longer on the line
+func findConsultChannel(activeCall models.ActiveCall) (*asterisk.Channel, error) {
+	channels, err := asterisk.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, channel := range channels {
+		if asterisk.ExtensionFromChannel(channel.Channel) != activeCall.TransferTarget {
+			continue
+		}
+		if channel.Channel == activeCall.CallerChannel || channel.Channel == activeCall.CalleeChannel {
+			continue
+		}
+		if activeCall.Linkedid != "" && channel.Linkedid != activeCall.Linkedid {
+			continue
+		}
+		return &channels[i], nil
+	}
+	return nil, nil
+}
+
+// clearTransfer returns a call to connected after an attended transfer ends
+// without transferring it
+func clearTransfer(activeCall models.ActiveCall) {
+	activeCallQuery(activeCall).Updates(map[string]interface{}{
+		"status":          "connected",
+		"transfer_by":     "",
+		"transfer_target": "",
+	})
+}
+
+// activeCallQuery scopes an update to a single active call. Updating through
+// the preloaded model would write the caller and callee back from their
+// associations, undoing the change of parties.
+func activeCallQuery(activeCall models.ActiveCall) *gorm.DB {
+	return database.GetDB().Model(&models.ActiveCall{}).Where("id = ?", activeCall.ID)
+}
+
+// createWebRTCCallLog logs a WebRTC-direct call created by a transfer and
+// returns its call ID
+func createWebRTCCallLog(caller, callee models.User, answerTime *time.Time) (string, error) {
+	callID := fmt.Sprintf("webrtc-call-%d", time.Now().UnixNano())
+
+	status := "initiated"
+	if answerTime != nil {
+		status = "answered"
+	}
+
+	callLog := models.CallLog{
+		CallerID:   caller.ID,
+		CalleeID:   &callee.ID,
+		StartTime:  time.Now(),
+		AnswerTime: answerTime,
+		Status:     status,
+		Channel:    callID,
+		Direction:  "outbound",
+	}
+	if err := database.GetDB().Create(&callLog).Error; err != nil {
+		log.Printf("[TRANSFER] ERROR: Failed to create call log: %v", err)
+		return "", err
+	}
+	return callID, nil
+}
+
+// finishWebRTCCallLog ends the log of a WebRTC-direct call left by a transfer
+func finishWebRTCCallLog(callID string) {
+	if hub := websocket.GetHub(); hub != nil {
+		hub.EndWebRTCCallHold(callID)
+		hub.EndCallSession(callID)
+	}
+
+	var callLog models.CallLog
+	if err := database.GetDB().Where("channel = ? AND end_time IS NULL", callID).First(&callLog).Error; err != nil {
+		return
+	}
+
+	endTime := time.Now()
+	billsec := 0
+	if callLog.AnswerTime != nil {
+		billsec = int(endTime.Sub(*callLog.AnswerTime).Seconds())
+	}
+	database.GetDB().Model(&callLog).Updates(map[string]interface{}{
+		"status":   "ended",
+		"end_time": &endTime,
+		"duration": int(endTime.Sub(callLog.StartTime).Seconds()),
+		"billsec":  billsec,
+	})
+}
+
+// sendWebRTCInvitation invites the callee to a WebRTC-direct call created by
+// a transfer, in the same format as InitiateWebRTCCall. invitation carries
+// the transfer fields; the rest are filled in.
+func sendWebRTCInvitation(hub *websocket.Hub, callID string, caller, callee models.User, invitation protocol.CallInvitation) {
+	invitation.CallID = callID
+	invitation.CallerID = caller.ID
+	invitation.CallerUsername = caller.Username
+	invitation.CallerExtension = caller.Extension
+	invitation.TargetExtension = callee.Extension
+
+	hub.StartCallSession(callID, caller.Extension, callee.Extension)
+	if err := hub.SendToExtension(callee.Extension, protocol.New(protocol.TypeWebRTCCallInvitation, invitation)); err != nil {
+		log.Printf("[TRANSFER] Failed to send call invitation to %s: %v", callee.Extension, err)
+	}
+}
+
+func pendingTarget(pending *models.WebRTCTransfer) string {
+	if pending == nil {
+		return ""
+	}
+	return pending.Target
+}
+
+func pendingTransferor(pending *models.WebRTCTransfer) string {
+	if pending == nil {
+		return ""
+	}
+	return pending.Transferor
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/websocket"
+)
+
+// webrtcCall logs a WebRTC-direct call between two test users and starts
+// its call session
+func webrtcCall(t *testing.T, caller, callee string, ended bool) string {
+	t.Helper()
+
+	var from, to models.User
+	db := database.GetDB()
+	db.Where("username = ?", caller).First(&from)
+	db.Where("username = ?", callee).First(&to)
+
+	now := time.Now()
+	callID := fmt.Sprintf("webrtc-call-%d", now.UnixNano())
+	callLog := models.CallLog{
+		CallerID:   from.ID,
+		CalleeID:   &to.ID,
+		StartTime:  now,
+		AnswerTime: &now,
+		Status:     "answered",
+		Channel:    callID,
+		Direction:  "outbound",
+	}
+	if ended {
+		callLog.Status = "ended"
+		callLog.EndTime = &now
+	} else {
+		websocket.GetHub().StartCallSession(callID, from.Extension, to.Extension)
+	}
+	if err := db.Create(&callLog).Error; err != nil {
+		t.Fatalf("Failed to log the call: %v", err)
+	}
+	return callID
+}
+
+func TestTransferOfEndedWebRTCCallRefused(t *testing.T) {
+	callID := webrtcCall(t, "user1", "user2", true)
+	r := userRouter(t, "user1")
+	r.POST("/call/transfer", TransferCall)
+
+	var before, after int64
+	database.GetDB().Model(&models.CallLog{}).Count(&before)
+	code, response := post(t, r, "/call/transfer", `{"channel":"`+callID+`","target_extension":"1003"}`)
+	if code != http.StatusNotFound {
+		t.Fatalf("transfer = %d %v, want 404", code, response)
+	}
+	database.GetDB().Model(&models.CallLog{}).Count(&after)
+	if after != before {
+		t.Error("the transfer of an ended call created a new call")
+	}
+}
+
+func TestWebRTCTransferEndsWithItsCalls(t *testing.T) {
+	r := userRouter(t, "user1")
+	r.POST("/call/transfer", TransferCall)
+	r.POST("/call/hangup", HangupCall)
+	start := func(callID string) (int, map[string]interface{}) {
+		return post(t, r, "/call/transfer", `{"channel":"`+callID+`","target_extension":"1003","type":"attended"}`)
+	}
+
+	// The consultation call hangs up: the transfer is over, and another
+	// one may start
+	callID := webrtcCall(t, "user1", "user2", false)
+	code, response := start(callID)
+	if code != http.StatusOK {
+		t.Fatalf("start = %d %v, want 200", code, response)
+	}
+	transfer, _ := response["transfer"].(map[string]interface{})
+	consult, _ := transfer["consult_channel"].(string)
+	if consult == "" {
+		t.Fatalf("no consultation call in %v", response)
+	}
+	if code, response := start(callID); code != http.StatusConflict {
+		t.Fatalf("second start = %d %v, want 409", code, response)
+	}
+
+	if code, response := post(t, r, "/call/hangup", `{"channel":"`+consult+`"}`); code != http.StatusOK {
+		t.Fatalf("hangup = %d %v, want 200", code, response)
+	}
+	if code, response := start(callID); code != http.StatusOK {
+		t.Fatalf("start after the consultation ended = %d %v, want 200", code, response)
+	}
+
+	// The call being transferred ends: its transfer goes with it
+	websocket.GetHub().EndCallSession(callID)
+	var count int64
+	database.GetDB().Model(&models.WebRTCTransfer{}).Where("channel = ?", callID).Count(&count)
+	if count != 0 {
+		t.Error("the transfer outlived the call being transferred")
+	}
+}
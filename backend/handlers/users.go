@@ -6,9 +6,12 @@ import (
 	"net/http"
 	"strconv"
 	"time"
+	"voip-backend/auth"
 	"voip-backend/database"
 	"voip-backend/middleware"
 	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/services"
 	"voip-backend/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -54,7 +57,7 @@ func GetOnlineUsers(c *gin.Context) {
 
 	var users []models.User
 	// Get all users except the current user
-	if err := database.GetDB().Where("status = ? AND id != ?", "online", userID).Find(&users).Error; err != nil {
+	if err := database.GetDB().Where("is_online = ? AND id != ?", true, userID).Find(&users).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to fetch online users",
 		})
@@ -157,9 +160,10 @@ func GetConnectionStatus(c *gin.Context) {
 			"extension":    user.Extension,
 			"username":     user.Username,
 			"status":       user.Status,
+			"presence":     user.Presence,
 			"ws_connected": isConnected,
 			"client_count": clientCount,
-			"status_match": (user.Status == "online") == isConnected,
+			"status_match": user.IsOnline == isConnected,
 		})
 	}
 
@@ -177,11 +181,9 @@ func GetSystemStats(c *gin.Context) {
 	var totalUsers int64
 	database.GetDB().Model(&models.User{}).Count(&totalUsers)
 
-	// Count online users (users who are marked as online AND have recent activity)
+	// Count online users (the presence service keeps is_online up to date)
 	var onlineUsers int64
-	// Consider users online if they have status = "online" AND is_online = true AND last_seen within last 5 minutes
-	fiveMinutesAgo := time.Now().Add(-5 * time.Minute)
-	database.GetDB().Model(&models.User{}).Where("status = ? AND is_online = ? AND last_seen > ?", "online", true, fiveMinutesAgo).Count(&onlineUsers)
+	database.GetDB().Model(&models.User{}).Where("is_online = ?", true).Count(&onlineUsers)
 
 	// Count active calls
 	var activeCalls int64
@@ -249,13 +251,16 @@ func DeleteUser(c *gin.Context) {
 	}
 
 	// Don't allow deleting admin users
-	if user.Role == "admin" {
+	if user.Role == models.RoleAdmin {
 		c.JSON(http.StatusForbidden, gin.H{
 			"success": false,
 			"error":   "Cannot delete admin users",
 		})
 		return
 	}
+	if !canManageUser(c, user) {
+		return
+	}
 
 	// Get current admin user info for logging
 	adminUserID, _, _, _, exists := middleware.GetUserFromContext(c)
@@ -287,6 +292,45 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
+	// Remove the user from their conversations; their messages stay
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.ConversationMember{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to remove user from conversations",
+		})
+		return
+	}
+
+	// End the user's sessions
+	sessions := tx.Model(&models.Session{}).Select("id").Where("user_id = ?", user.ID)
+	if err := tx.Where("session_id IN (?)", sessions).Delete(&models.SessionToken{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to delete user's sessions",
+		})
+		return
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.Session{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to delete user's sessions",
+		})
+		return
+	}
+
+	// Delete the user's recovery codes
+	if err := tx.Where("user_id = ?", user.ID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "Failed to delete user's recovery codes",
+		})
+		return
+	}
+
 	// Delete the user
 	if err := tx.Delete(&user).Error; err != nil {
 		tx.Rollback()
@@ -306,15 +350,18 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
-	// Notify other users about user deletion via WebSocket
+	// Drop the deleted user's sockets and notify other users via WebSocket
 	hub := websocket.GetHub()
 	if hub != nil {
-		hub.BroadcastMessage(gin.H{
-			"type":       "user_deleted",
-			"user_id":    user.ID,
-			"username":   user.Username,
-			"deleted_by": adminUserID,
-		})
+		hub.DisconnectUser(user.ID, websocket.CloseUserChanged, "user deleted")
+		if presence := services.GetPresenceService(); presence != nil {
+			presence.Forget(user.Extension)
+		}
+		hub.BroadcastMessage(protocol.New(protocol.TypeUserDeleted, protocol.UserDeleted{
+			UserID:    user.ID,
+			Username:  user.Username,
+			DeletedBy: adminUserID,
+		}))
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -324,10 +371,34 @@ func DeleteUser(c *gin.Context) {
 	})
 }
 
-// UpdateUserStatus updates a user's online status
+// UnlockUser lifts the lockout of a user's account and the delays on
+// their logins
+func UnlockUser(c *gin.Context) {
+	user, ok := loadManagedUser(c)
+	if !ok {
+		return
+	}
+
+	actorID, _, _, _, _ := middleware.GetUserFromContext(c)
+	if err := auth.UnlockAccount(&user, actorID, c.ClientIP()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to unlock user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "User unlocked successfully",
+	})
+}
+
+// UpdateUserStatus records the status a user chose: available, away, dnd,
+// or offline to appear offline (online and busy are accepted for available
+// and dnd). Their presence follows unless they are on a call or unreachable.
 func UpdateUserStatus(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "User not authenticated",
 		})
@@ -345,37 +416,16 @@ func UpdateUserStatus(c *gin.Context) {
 		return
 	}
 
-	// Validate status
-	validStatuses := map[string]bool{
-		"online":  true,
-		"offline": true,
-		"busy":    true,
-		"away":    true,
-	}
-
-	if !validStatuses[req.Status] {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid status. Must be one of: online, offline, busy, away",
+	presence := services.GetPresenceService()
+	if presence == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Presence service not available",
 		})
 		return
 	}
-
-	// Update user status
-	now := time.Now()
-	updates := map[string]interface{}{
-		"status":    req.Status,
-		"last_seen": now,
-	}
-
-	if req.Status == "online" {
-		updates["is_online"] = true
-	} else if req.Status == "offline" {
-		updates["is_online"] = false
-	}
-
-	if err := database.GetDB().Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update status",
+	if err := presence.SetManualStatus(extension, req.Status); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid status. Must be one of: available, away, dnd, offline",
 		})
 		return
 	}
@@ -389,33 +439,6 @@ func UpdateUserStatus(c *gin.Context) {
 		return
 	}
 
-	// Broadcast status change to other users
-	hub := websocket.GetHub()
-	if hub != nil {
-		// Broadcast comprehensive status update
-		statusUpdate := gin.H{
-			"type":      "user_status_changed",
-			"user_id":   user.ID,
-			"username":  user.Username,
-			"extension": user.Extension,
-			"status":    user.Status,
-			"is_online": user.IsOnline,
-			"last_seen": user.LastSeen,
-			"timestamp": time.Now().Unix(),
-		}
-
-		// Add WebSocket connection info
-		if extensionStatus := hub.GetExtensionStatus(user.Extension); extensionStatus != nil {
-			statusUpdate["ws_connected"] = extensionStatus["ws_connected"]
-			statusUpdate["client_count"] = extensionStatus["client_count"]
-		}
-
-		hub.BroadcastMessage(statusUpdate)
-
-		// Also notify the specific user's extension
-		hub.NotifyUserStatus(user.Extension, user.Status)
-	}
-
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Status updated successfully",
@@ -423,115 +446,68 @@ func UpdateUserStatus(c *gin.Context) {
 	})
 }
 
-// HeartbeatUser updates user's last_seen timestamp to indicate they're still active
+// HeartbeatUser records that the user's browser is still open, which keeps
+// them online without a WebSocket connection
 func HeartbeatUser(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID, _, extension, _, ok := middleware.GetUserFromContext(c)
+	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "User not authenticated",
 		})
 		return
 	}
 
-	// Get user extension for WebSocket status check
-	userIDUint, ok := userID.(uint)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Invalid user ID",
-		})
-		return
-	}
-
-	// Get user info
-	var user models.User
-	if err := database.GetDB().First(&user, userIDUint).Error; err != nil {
+	now := time.Now()
+	if err := database.GetDB().Model(&models.User{}).Where("id = ?", userID).Update("last_seen", now).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to fetch user",
+			"error": "Failed to update heartbeat",
 		})
 		return
 	}
 
-	// Update last_seen timestamp and ensure user is marked as online if they have WebSocket connection
-	now := time.Now()
-	updates := map[string]interface{}{
-		"last_seen": now,
-	}
-
-	// Check if user has active WebSocket connection
-	hub := websocket.GetHub()
-	if hub != nil && hub.IsExtensionConnected(user.Extension) {
-		// User has active WebSocket connection, ensure they're marked as online
-		if user.Status == "offline" {
-			updates["status"] = "online"
-			updates["is_online"] = true
-		}
-	}
-
-	if err := database.GetDB().Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update heartbeat",
+	presence := services.GetPresenceService()
+	if presence == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Presence service not available",
 		})
 		return
 	}
+	presence.Heartbeat(extension)
 
+	state, _ := presence.Get(extension)
 	c.JSON(http.StatusOK, gin.H{
 		"success":   true,
 		"timestamp": now,
-		"status":    user.Status,
-		"is_online": user.IsOnline,
+		"presence":  state.State,
+		"status":    services.LegacyStatus(state.State),
+		"is_online": state.State != services.PresenceOffline,
 	})
 }
 
-// SetUserOfflineByExtension sets a user offline by their extension (called from WebSocket disconnect)
-func SetUserOfflineByExtension(extension string) error {
-	if extension == "" {
-		return fmt.Errorf("extension cannot be empty")
-	}
-
-	// Find user by extension
+// CheckWebSocketUser makes sure the user a WebSocket token was issued to
+// still exists with the extension and role in the token
+func CheckWebSocketUser(userID uint, extension, role string) error {
 	var user models.User
-	if err := database.GetDB().Where("extension = ?", extension).First(&user).Error; err != nil {
+	if err := database.GetDB().First(&user, userID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			log.Printf("User with extension %s not found", extension)
-			return nil // Not an error if user doesn't exist
+			return fmt.Errorf("user no longer exists")
 		}
 		return fmt.Errorf("failed to find user: %v", err)
 	}
 
-	// Update user status to offline
-	now := time.Now()
-	updates := map[string]interface{}{
-		"status":    "offline",
-		"is_online": false,
-		"last_seen": now,
+	if user.Extension != extension || user.Role != role {
+		return fmt.Errorf("user has changed since the token was issued")
 	}
+	return nil
+}
 
-	if err := database.GetDB().Model(&user).Updates(updates).Error; err != nil {
-		return fmt.Errorf("failed to update user status: %v", err)
-	}
-
-	log.Printf("Set user %s (extension: %s) offline due to WebSocket disconnection", user.Username, extension)
-
-	// Broadcast status change to other users
-	hub := websocket.GetHub()
-	if hub != nil {
-		statusUpdate := gin.H{
-			"type":         "user_status_changed",
-			"user_id":      user.ID,
-			"username":     user.Username,
-			"extension":    user.Extension,
-			"status":       "offline",
-			"is_online":    false,
-			"last_seen":    now,
-			"timestamp":    time.Now().Unix(),
-			"ws_connected": false,
-			"client_count": 0,
-		}
-
-		hub.BroadcastMessage(statusUpdate)
+// LookupUserRole returns a user's current role
+func LookupUserRole(userID uint) (string, error) {
+	var user models.User
+	if err := database.GetDB().Select("id", "role").First(&user, userID).Error; err != nil {
+		return "", err
 	}
-
-	return nil
+	return user.Role, nil
 }
 
 // CreateUser creates a new user (admin only)
@@ -553,12 +529,9 @@ func CreateUser(c *gin.Context) {
 
 	// Validate role
 	if req.Role == "" {
-		req.Role = "user"
+		req.Role = models.RoleUser
 	}
-	if req.Role != "user" && req.Role != "admin" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Role must be 'user' or 'admin'",
-		})
+	if !checkAssignableRole(c, req.Role) {
 		return
 	}
 
@@ -663,6 +636,9 @@ func UpdateUser(c *gin.Context) {
 		}
 		return
 	}
+	if !canManageUser(c, user) {
+		return
+	}
 
 	// Prepare updates
 	updates := make(map[string]interface{})
@@ -704,35 +680,27 @@ func UpdateUser(c *gin.Context) {
 	}
 
 	if req.Role != "" && req.Role != user.Role {
-		if req.Role != "user" && req.Role != "admin" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Role must be 'user' or 'admin'",
-			})
+		if !checkAssignableRole(c, req.Role) {
 			return
 		}
 		updates["role"] = req.Role
 	}
 
-	if req.Status != "" && req.Status != user.Status {
-		validStatuses := map[string]bool{
-			"online":  true,
-			"offline": true,
-			"busy":    true,
-			"away":    true,
-		}
-		if !validStatuses[req.Status] {
+	// The status is chosen through the presence service, which sets the
+	// user's presence from it
+	manualStatus := ""
+	if req.Status != "" {
+		status, err := services.NormalizeStatus(req.Status)
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid status. Must be one of: online, offline, busy, away",
+				"error": "Invalid status. Must be one of: available, away, dnd, offline",
 			})
 			return
 		}
-		updates["status"] = req.Status
-		if req.Status == "online" {
-			updates["is_online"] = true
-		} else if req.Status == "offline" {
-			updates["is_online"] = false
-		}
+		manualStatus = status
 	}
+	previousExtension := user.Extension
+	previousRole := user.Role
 
 	// Apply updates if any
 	if len(updates) > 0 {
@@ -752,61 +720,34 @@ func UpdateUser(c *gin.Context) {
 		}
 
 		log.Printf("Admin updated user: %s (ID: %d)", user.Username, user.ID)
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "User updated successfully",
-		"user":    user.ToResponse(),
-	})
-}
-
-// CleanupStaleUsers sets users offline if they haven't been seen recently and have no WebSocket connection
-func CleanupStaleUsers() {
-	log.Println("Running status cleanup...")
-
-	// Define stale threshold (5 minutes without activity)
-	staleThreshold := time.Now().Add(-5 * time.Minute)
 
-	// Get all users who are marked as online but haven't been seen recently
-	var staleUsers []models.User
-	if err := database.GetDB().Where(
-		"(status = ? OR is_online = ?) AND (last_seen IS NULL OR last_seen < ?)",
-		"online", true, staleThreshold,
-	).Find(&staleUsers).Error; err != nil {
-		log.Printf("Error fetching stale users: %v", err)
-		return
-	}
-
-	hub := websocket.GetHub()
-	if hub == nil {
-		log.Println("WebSocket hub not available for status cleanup")
-		return
+		// Sockets are bound to the extension and role in the user's token
+		_, extensionChanged := updates["extension"]
+		_, roleChanged := updates["role"]
+		if hub := websocket.GetHub(); hub != nil && (extensionChanged || roleChanged) {
+			hub.DisconnectUser(user.ID, websocket.CloseUserChanged, "extension or role changed")
+		}
+		if roleChanged {
+			actorID, _, _, _, _ := middleware.GetUserFromContext(c)
+			auth.Audit(models.AuditRoleAssigned, &user, &actorID, c.ClientIP(), previousRole+" -> "+user.Role)
+		}
 	}
 
-	cleanedCount := 0
-	for _, user := range staleUsers {
-		// Check if user has active WebSocket connection
-		if hub.IsExtensionConnected(user.Extension) {
-			// User has active connection, update their last_seen
-			now := time.Now()
-			if err := database.GetDB().Model(&user).Update("last_seen", now).Error; err != nil {
-				log.Printf("Error updating last_seen for user %s: %v", user.Username, err)
-			}
-			continue
+	if presence := services.GetPresenceService(); presence != nil {
+		if user.Extension != previousExtension {
+			presence.Forget(previousExtension)
 		}
-
-		// User has no active connection and is stale, set them offline
-		if err := SetUserOfflineByExtension(user.Extension); err != nil {
-			log.Printf("Error setting user %s offline during cleanup: %v", user.Username, err)
-			continue
+		if manualStatus != "" {
+			if err := presence.SetManualStatus(user.Extension, manualStatus); err != nil {
+				log.Printf("Failed to set status of %s: %v", user.Username, err)
+			}
+			database.GetDB().First(&user, uint(userID))
 		}
-
-		cleanedCount++
-		log.Printf("Set stale user %s (extension: %s) offline", user.Username, user.Extension)
 	}
 
-	if cleanedCount > 0 {
-		log.Printf("Status cleanup completed: %d users set offline", cleanedCount)
-	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "User updated successfully",
+		"user":    user.ToResponse(),
+	})
 }
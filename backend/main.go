@@ -4,10 +4,14 @@ import (
 	"log"
 	"time"
 	"voip-backend/asterisk"
+	"voip-backend/auth"
+	"voip-backend/broker"
 	"voip-backend/config"
 	"voip-backend/database"
 	"voip-backend/handlers"
 	"voip-backend/middleware"
+	"voip-backend/models"
+	"voip-backend/services"
 	"voip-backend/websocket"
 
 	"github.com/gin-contrib/cors"
@@ -22,24 +26,70 @@ func main() {
 	database.InitDatabase()
 	defer database.CloseDB()
 
+	// Throttle login and registration attempts
+	auth.InitLoginProtection()
+
 	// Initialize WebSocket hub
 	websocket.InitHub()
 
-	// Set up the user disconnect callback
+	// Set up the WebRTC hold, token user, role, call party and chat callbacks;
+	// the presence callbacks are set once the presence service starts
 	hub := websocket.GetHub()
 	if hub != nil {
-		hub.OnUserDisconnect = handlers.SetUserOfflineByExtension
+		hub.OnCallHoldEnded = handlers.RecordWebRTCHold
+		hub.CheckUser = handlers.CheckWebSocketUser
+		hub.LookupRole = handlers.LookupUserRole
+		hub.LookupCallParties = handlers.LookupCallParties
+		hub.LookupChatMembers = handlers.LookupChatMembers
+		hub.OnChatRead = handlers.RecordChatRead
+		hub.ResumeGrace = time.Duration(config.AppConfig.WSResumeGraceSeconds) * time.Second
+		hub.ReplayBufferSize = config.AppConfig.WSReplayBufferSize
 	}
 
-	// Start background status cleanup
-	go func() {
-		ticker := time.NewTicker(2 * time.Minute) // Run every 2 minutes
-		defer ticker.Stop()
+	// Connect the hub to the other backend nodes (a single node uses the
+	// in-memory broker)
+	if err := broker.InitBroker(); err != nil {
+		log.Fatalf("Failed to initialize broker: %v", err)
+	}
+	defer broker.StopBroker()
+	if hub != nil {
+		if err := hub.SetBroker(broker.GetBroker()); err != nil {
+			log.Fatalf("Failed to start broker: %v", err)
+		}
+	}
+
+	// Track call state from AMI events; subscriptions survive AMI reconnects
+	// so this can start before the AMI connection is up
+	services.InitCallTracker()
+
+	// Reconcile call logs with Asterisk's CDR and CEL records
+	services.InitCDRIngest()
 
-		for range ticker.C {
-			handlers.CleanupStaleUsers()
+	// Follow ConfBridge conferences and push their participant lists
+	services.InitConferenceService()
+
+	// Initialize queue service (follows ACD queues and their agents)
+	services.InitQueueService()
+
+	// Compute presence from WebSocket connections, heartbeats, PJSIP
+	// registrations and calls
+	services.InitPresenceService()
+	if hub != nil {
+		presence := services.GetPresenceService()
+		hub.OnUserDisconnect = presence.ClientDisconnected
+		hub.OnUserStatus = presence.SetManualStatus
+		hub.LookupPresence = presence.Statuses
+		hub.OnCallSession = func(callID string, parties []string, state string) {
+			presence.CallSessionChanged(callID, parties, state)
+			if state == "ended" {
+				handlers.EndWebRTCTransfers(callID)
+			}
 		}
-	}()
+		hub.OnClientConnected = func(userID uint, extension string) {
+			presence.ClientConnected(extension)
+			handlers.DeliverPendingChat(userID, extension)
+		}
+	}
 
 	// Initialize Asterisk AMI connection asynchronously with timeout
 	go func() {
@@ -79,13 +129,9 @@ func main() {
 	// Create Gin router
 	r := gin.Default()
 
-	// Configure trusted proxies for security
-	// Only trust specific proxy IPs in production
-	trustedProxies := []string{
-		"127.0.0.1",      // localhost
-		"172.20.10.0/24", // local network range
-	}
-	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+	// Configure trusted proxies for security: only these may set the
+	// client IP that login protection and sessions record
+	if err := r.SetTrustedProxies(config.AppConfig.TrustedProxies); err != nil {
 		log.Printf("Warning: Failed to set trusted proxies: %v", err)
 	}
 
@@ -160,28 +206,47 @@ func main() {
 	// WebSocket endpoint
 	r.GET("/ws", websocket.HandleWebSocket)
 
+	// Fallbacks for networks that block WebSocket upgrades
+	r.GET("/events", websocket.HandleSSE)
+	r.GET("/events/poll", websocket.HandleLongPoll)
+	r.POST("/events/send", websocket.HandleSendMessage)
+
 	// Public routes (no authentication required)
 	public := r.Group("/api")
 	{
 		public.POST("/login", handlers.Login)
+		public.POST("/login/mfa", handlers.LoginMFA)
+		public.POST("/login/mfa/enroll", handlers.LoginMFAEnroll)
 		public.POST("/register", handlers.Register)
 		public.POST("/refresh", handlers.RefreshToken)
 		public.POST("/test-asterisk", handlers.TestAsteriskConnectionsPublic)
 	}
 
-	// Protected routes (authentication required)
+	// Protected routes (authentication required); perm additionally
+	// requires permissions of the user's role
+	perm := middleware.RequirePermission
 	protected := r.Group("/protected")
 	protected.Use(middleware.AuthMiddleware())
 	{
 		// User routes
 		protected.GET("/profile", handlers.GetProfile)
 		protected.POST("/logout", handlers.Logout)
+		protected.GET("/sessions", handlers.ListSessions)
+		protected.DELETE("/sessions", handlers.RevokeSessions)
+		protected.DELETE("/sessions/:id", handlers.RevokeSession)
+		protected.GET("/mfa", handlers.GetMFAStatus)
+		protected.POST("/mfa/setup", handlers.SetupMFA)
+		protected.POST("/mfa/verify", handlers.VerifyMFA)
+		protected.POST("/mfa/disable", handlers.DisableMFA)
+		protected.POST("/mfa/recovery-codes", handlers.RegenerateRecoveryCodes)
 		protected.PUT("/status", handlers.UpdateUserStatus)
 		protected.POST("/heartbeat", handlers.HeartbeatUser)
 		protected.GET("/users/online", handlers.GetOnlineUsers)
 		protected.GET("/users/:extension", handlers.GetUserByExtension)
 		protected.GET("/extensions/connected", handlers.GetConnectedExtensions)
 		protected.GET("/extensions/status", handlers.GetConnectionStatus)
+		protected.GET("/presence", handlers.ListPresence)
+		protected.GET("/presence/:extension", handlers.GetPresence)
 
 		// Call routes
 		callRoutes := protected.Group("/call")
@@ -189,10 +254,53 @@ func main() {
 			callRoutes.POST("/initiate", handlers.InitiateCall)
 			callRoutes.POST("/answer", handlers.AnswerCall)
 			callRoutes.POST("/hangup", handlers.HangupCall)
+			callRoutes.POST("/transfer", handlers.TransferCall)
+			callRoutes.POST("/hold", handlers.HoldCall)
+			callRoutes.POST("/resume", handlers.ResumeCall)
 			callRoutes.GET("/active", handlers.GetActiveCalls)
 			callRoutes.GET("/logs", handlers.GetCallLogs)
 		}
 
+		// Conference routes
+		conferenceRoutes := protected.Group("/conference")
+		{
+			conferenceRoutes.GET("/rooms", handlers.ListConferenceRooms)
+			conferenceRoutes.POST("/rooms", handlers.CreateConferenceRoom)
+			conferenceRoutes.GET("/rooms/:id", handlers.GetConferenceRoom)
+			conferenceRoutes.DELETE("/rooms/:id", handlers.DeleteConferenceRoom)
+			conferenceRoutes.POST("/rooms/:id/join", handlers.JoinConferenceRoom)
+			conferenceRoutes.POST("/rooms/:id/dial", handlers.DialConferenceParticipant)
+			conferenceRoutes.POST("/rooms/:id/mute", handlers.MuteConferenceParticipant)
+			conferenceRoutes.POST("/rooms/:id/unmute", handlers.UnmuteConferenceParticipant)
+			conferenceRoutes.POST("/rooms/:id/kick", handlers.KickConferenceParticipant)
+			conferenceRoutes.POST("/rooms/:id/lock", handlers.LockConferenceRoom)
+			conferenceRoutes.POST("/rooms/:id/unlock", handlers.UnlockConferenceRoom)
+		}
+
+		// Call queue routes
+		queueRoutes := protected.Group("/queues")
+		{
+			queueRoutes.GET("", handlers.ListCallQueues)
+			queueRoutes.GET("/:id", handlers.GetCallQueue)
+			queueRoutes.POST("/:id/login", handlers.QueueAgentLogin)
+			queueRoutes.POST("/:id/logout", handlers.QueueAgentLogout)
+			queueRoutes.POST("/:id/pause", handlers.QueueAgentPause)
+			queueRoutes.POST("/:id/unpause", handlers.QueueAgentUnpause)
+		}
+
+		// Chat routes
+		chatRoutes := protected.Group("/chat")
+		{
+			chatRoutes.GET("/conversations", handlers.ListConversations)
+			chatRoutes.POST("/conversations", handlers.CreateConversation)
+			chatRoutes.GET("/conversations/:id", handlers.GetConversation)
+			chatRoutes.POST("/conversations/:id/members", handlers.AddConversationMembers)
+			chatRoutes.POST("/conversations/:id/leave", handlers.LeaveConversation)
+			chatRoutes.GET("/conversations/:id/messages", handlers.GetChatMessages)
+			chatRoutes.POST("/conversations/:id/messages", handlers.SendChatMessage)
+			chatRoutes.POST("/conversations/:id/read", handlers.MarkConversationRead)
+		}
+
 		// Diagnostic routes
 		protected.GET("/diagnostics", handlers.GetSystemDiagnostics)
 		protected.GET("/test-asterisk", handlers.TestAsteriskConnections)
@@ -206,7 +314,7 @@ func main() {
 			userID, exists1 := c.Get("user_id")
 			username, exists2 := c.Get("username")
 			extension, exists3 := c.Get("extension")
-			role, exists4 := c.Get("role")
+			role, exists4 := middleware.CurrentRole(c)
 
 			c.JSON(200, gin.H{
 				"success": true,
@@ -219,38 +327,64 @@ func main() {
 					"username":         username,
 					"extension":        extension,
 					"role":             role,
-					"is_admin":         role == "admin",
+					"permissions":      auth.RolePermissions(role),
 				},
 			})
 		})
 
-		// Admin routes
+		// Supervisor routes
+		supervisor := protected.Group("/supervisor")
+		{
+			supervisor.GET("/calls", perm(models.PermCallsViewAll), handlers.ListAllActiveCalls)
+			supervisor.POST("/calls/:id/monitor", perm(models.PermCallsMonitor), handlers.MonitorCall)
+		}
+
+		// Admin routes, each open to the roles with its permission
 		admin := protected.Group("/admin")
-		admin.Use(middleware.AdminMiddleware())
 		{
-			admin.GET("/users", handlers.GetUsers)
-			admin.POST("/users", handlers.CreateUser)
-			admin.PUT("/users/:id", handlers.UpdateUser)
-			admin.DELETE("/users/:id", handlers.DeleteUser)
-			admin.GET("/stats", handlers.GetSystemStats)
-			admin.DELETE("/call-logs/:id", handlers.DeleteCallLog)
-			admin.DELETE("/call-logs/bulk-delete", handlers.BulkDeleteCallLogs)
-			admin.DELETE("/call-logs/clear-all", handlers.ClearAllCallLogs)
-			admin.DELETE("/call-logs/bulk-delete-filter", handlers.BulkDeleteCallLogsByFilter)
-			admin.GET("/export/call-logs", handlers.ExportCallLogs)
-			admin.GET("/metrics/realtime", handlers.GetRealTimeMetrics)
+			admin.GET("/users", perm(models.PermUsersView), handlers.GetUsers)
+			admin.POST("/users", perm(models.PermUsersManage), handlers.CreateUser)
+			admin.PUT("/users/:id", perm(models.PermUsersManage), handlers.UpdateUser)
+			admin.DELETE("/users/:id", perm(models.PermUsersManage), handlers.DeleteUser)
+			admin.GET("/users/:id/sessions", perm(models.PermUsersView), handlers.ListUserSessions)
+			admin.DELETE("/users/:id/sessions", perm(models.PermUsersManage), handlers.RevokeUserSessions)
+			admin.DELETE("/users/:id/sessions/:session_id", perm(models.PermUsersManage), handlers.RevokeUserSession)
+			admin.DELETE("/users/:id/mfa", perm(models.PermUsersManage), handlers.ResetUserMFA)
+			admin.POST("/users/:id/unlock", perm(models.PermUsersManage), handlers.UnlockUser)
+			admin.GET("/audit", perm(models.PermAuditView), handlers.ListAuditEvents)
+			admin.GET("/mfa/policies", perm(models.PermRolesManage), handlers.ListMFAPolicies)
+			admin.PUT("/mfa/policies/:role", perm(models.PermRolesManage), handlers.SetMFAPolicy)
+			admin.GET("/stats", perm(models.PermSystemView), handlers.GetSystemStats)
+			admin.DELETE("/call-logs/:id", perm(models.PermCallLogsDelete), handlers.DeleteCallLog)
+			admin.DELETE("/call-logs/bulk-delete", perm(models.PermCallLogsDelete), handlers.BulkDeleteCallLogs)
+			admin.DELETE("/call-logs/clear-all", perm(models.PermCallLogsDelete), handlers.ClearAllCallLogs)
+			admin.DELETE("/call-logs/bulk-delete-filter", perm(models.PermCallLogsDelete), handlers.BulkDeleteCallLogsByFilter)
+			admin.GET("/export/call-logs", perm(models.PermCallLogsExport), handlers.ExportCallLogs)
+			admin.GET("/metrics/realtime", perm(models.PermSystemView), handlers.GetRealTimeMetrics)
+
+			// Roles and permissions
+			admin.GET("/permissions", perm(models.PermUsersView), handlers.ListPermissions)
+			admin.GET("/roles", perm(models.PermUsersView), handlers.ListRoles)
+			admin.POST("/roles", perm(models.PermRolesManage), handlers.CreateRole)
+			admin.PUT("/roles/:name", perm(models.PermRolesManage), handlers.UpdateRole)
+			admin.DELETE("/roles/:name", perm(models.PermRolesManage), handlers.DeleteRole)
+
+			// Call queue definitions
+			admin.POST("/queues", perm(models.PermQueuesManage), handlers.CreateCallQueue)
+			admin.PUT("/queues/:id", perm(models.PermQueuesManage), handlers.UpdateCallQueue)
+			admin.DELETE("/queues/:id", perm(models.PermQueuesManage), handlers.DeleteCallQueue)
 
 			// System Health endpoints
-			admin.GET("/health", handlers.GetSystemHealth)
-			admin.GET("/health/fast", handlers.GetFastSystemHealth)
+			admin.GET("/health", perm(models.PermSystemView), handlers.GetSystemHealth)
+			admin.GET("/health/fast", perm(models.PermSystemView), handlers.GetFastSystemHealth)
 
 			// Backup endpoints
-			admin.POST("/backup", handlers.CreateBackup)
-			admin.GET("/backup/status/:id", handlers.GetBackupStatus)
-			admin.GET("/backups", handlers.ListBackups)
-			admin.GET("/backup/download/:id", handlers.DownloadBackup)
-			admin.DELETE("/backup/:id", handlers.DeleteBackup)
-			admin.POST("/backup/restore/:id", handlers.RestoreBackup)
+			admin.POST("/backup", perm(models.PermBackupsManage), handlers.CreateBackup)
+			admin.GET("/backup/status/:id", perm(models.PermBackupsManage), handlers.GetBackupStatus)
+			admin.GET("/backups", perm(models.PermBackupsManage), handlers.ListBackups)
+			admin.GET("/backup/download/:id", perm(models.PermBackupsManage), handlers.DownloadBackup)
+			admin.DELETE("/backup/:id", perm(models.PermBackupsManage), handlers.DeleteBackup)
+			admin.POST("/backup/restore/:id", perm(models.PermBackupsManage), handlers.RestoreBackup)
 		}
 	}
 
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"strings"
 	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -39,8 +41,11 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Validate the token
+		// Validate the token and the session it was issued to
 		claims, err := auth.ValidateToken(tokenString)
+		if err == nil {
+			err = auth.CheckSession(claims)
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "Invalid token: " + err.Error(),
@@ -54,35 +59,82 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Set("username", claims.Username)
 		c.Set("extension", claims.Extension)
 		c.Set("role", claims.Role)
+		c.Set("session_id", claims.SessionID)
 
 		c.Next()
 	}
 }
 
-// AdminMiddleware ensures the user has admin role
-func AdminMiddleware() gin.HandlerFunc {
+// RequirePermission ensures the user's role grants every one of some
+// permissions. The role is read from the user, so a role changed since
+// the token was issued applies at once.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		role, exists := c.Get("role")
+		userID, exists := c.Get("user_id")
 		if !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "User role not found",
+				"error": "User not authenticated",
 			})
 			c.Abort()
 			return
 		}
 
-		if role != "admin" {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "Admin access required",
+		role, err := loadRole(userID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "User not found",
 			})
 			c.Abort()
 			return
 		}
+		c.Set("role", role)
+
+		for _, permission := range permissions {
+			if !auth.HasPermission(role, permission) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":      "Permission required: " + permission,
+					"permission": permission,
+				})
+				c.Abort()
+				return
+			}
+		}
 
 		c.Next()
 	}
 }
 
+// CurrentRole returns the user's role as stored in the database rather
+// than in the token, so that a role change applies at once
+func CurrentRole(c *gin.Context) (string, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		return "", false
+	}
+	role, err := loadRole(userID)
+	if err != nil {
+		return "", false
+	}
+	c.Set("role", role)
+	return role, true
+}
+
+// HasPermission reports whether the user's current role grants a
+// permission, for checks that depend on the resource as well
+func HasPermission(c *gin.Context, permission string) bool {
+	role, ok := CurrentRole(c)
+	return ok && auth.HasPermission(role, permission)
+}
+
+// loadRole reads a user's role
+func loadRole(userID interface{}) (string, error) {
+	var user models.User
+	if err := database.GetDB().Select("id", "role").First(&user, userID).Error; err != nil {
+		return "", err
+	}
+	return user.Role, nil
+}
+
 // GetUserFromContext extracts user information from gin context
 func GetUserFromContext(c *gin.Context) (uint, string, string, string, bool) {
 	userID, exists1 := c.Get("user_id")
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Security events recorded in the audit trail
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditIPThrottled     = "ip_throttled"
+	AuditRoleCreated     = "role_created"
+	AuditRoleUpdated     = "role_updated"
+	AuditRoleDeleted     = "role_deleted"
+	AuditRoleAssigned    = "role_assigned"
+	AuditCallMonitored   = "call_monitored"
+)
+
+// AuditEvent is an entry of the security audit trail
+type AuditEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Event     string    `json:"event" gorm:"index;not null"`
+	UserID    *uint     `json:"user_id" gorm:"index"` // The user concerned, if any
+	Username  string    `json:"username"`
+	ActorID   *uint     `json:"actor_id"` // The admin who acted, if any
+	IPAddress string    `json:"ip_address"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
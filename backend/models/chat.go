@@ -0,0 +1,79 @@
+package models
+
+import "time"
+
+// Conversation is a 1:1 or group chat between users
+type Conversation struct {
+	ID            uint                 `json:"id" gorm:"primaryKey"`
+	Type          string               `json:"type" gorm:"not null"` // direct, group
+	Name          string               `json:"name"`                 // Group name, empty for direct conversations
+	DirectKey     *string              `json:"-" gorm:"unique"`      // "<lower user ID>:<higher user ID>" for direct conversations
+	CreatedByID   uint                 `json:"created_by_id"`
+	Members       []ConversationMember `json:"members"`
+	LastMessageAt *time.Time           `json:"last_message_at"`
+	CreatedAt     time.Time            `json:"created_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
+}
+
+// Conversation types
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// Member returns a user's membership, or nil if they are not a member
+func (c *Conversation) Member(userID uint) *ConversationMember {
+	for i := range c.Members {
+		if c.Members[i].UserID == userID {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
+
+// ConversationMember is a user's membership of a conversation. The message
+// IDs are watermarks: every message up to them was delivered to or read by
+// the user.
+type ConversationMember struct {
+	ConversationID         uint      `json:"conversation_id" gorm:"primaryKey"`
+	UserID                 uint      `json:"user_id" gorm:"primaryKey;index"`
+	User                   User      `json:"user" gorm:"foreignKey:UserID"`
+	LastDeliveredMessageID uint      `json:"last_delivered_message_id"`
+	LastReadMessageID      uint      `json:"last_read_message_id"`
+	JoinedAt               time.Time `json:"joined_at"`
+}
+
+// ChatMessage is a text message in a conversation
+type ChatMessage struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	ConversationID uint      `json:"conversation_id" gorm:"index;not null"`
+	SenderID       uint      `json:"sender_id" gorm:"index:idx_chat_messages_client,priority:1;not null"`
+	Sender         User      `json:"sender" gorm:"foreignKey:SenderID"`
+	Body           string    `json:"body" gorm:"type:text;not null"`
+	ClientID       string    `json:"client_id,omitempty" gorm:"index:idx_chat_messages_client,priority:2"` // Chosen by the sender so a retried send is not stored twice
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ConversationRequest represents a conversation creation request. A request
+// without a name for one other member opens the direct conversation with
+// them; anything else creates a group.
+type ConversationRequest struct {
+	Name             string   `json:"name" binding:"max=100"`
+	MemberExtensions []string `json:"member_extensions" binding:"required,min=1,max=50"`
+}
+
+// ConversationMembersRequest represents adding members to a group
+type ConversationMembersRequest struct {
+	Extensions []string `json:"extensions" binding:"required,min=1,max=50"`
+}
+
+// ChatMessageRequest represents sending a message
+type ChatMessageRequest struct {
+	Body     string `json:"body" binding:"required,max=4000"`
+	ClientID string `json:"client_id" binding:"max=64"`
+}
+
+// ChatReadRequest marks a conversation read up to a message
+type ChatReadRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
+}
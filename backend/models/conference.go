@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// ConferenceRoom is a ConfBridge conference users can join or be dialled into
+type ConferenceRoom struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	Name            string    `json:"name" gorm:"not null"`
+	Number          string    `json:"number" gorm:"unique;not null"` // Conference name in ConfBridge, also dialled from phones
+	PIN             string    `json:"-"`                             // Required to join unless the user is a moderator
+	HasPIN          bool      `json:"has_pin" gorm:"-"`
+	MaxParticipants int       `json:"max_participants"` // 0 for no limit
+	OwnerID         uint      `json:"owner_id"`
+	Owner           User      `json:"owner" gorm:"foreignKey:OwnerID"`
+	Moderators      []User    `json:"moderators" gorm:"many2many:conference_room_moderators"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// IsModerator reports whether a user may moderate the room
+func (r *ConferenceRoom) IsModerator(userID uint) bool {
+	if r.OwnerID == userID {
+		return true
+	}
+	for _, moderator := range r.Moderators {
+		if moderator.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ConferenceRoomRequest represents a conference room creation request
+type ConferenceRoomRequest struct {
+	Name                string   `json:"name" binding:"required,max=100"`
+	Number              string   `json:"number"`
+	PIN                 string   `json:"pin" binding:"omitempty,numeric,min=4,max=10"`
+	MaxParticipants     int      `json:"max_participants" binding:"min=0,max=100"`
+	ModeratorExtensions []string `json:"moderator_extensions"`
+}
+
+// ConferenceJoinRequest represents a request to be dialled into a conference
+type ConferenceJoinRequest struct {
+	PIN string `json:"pin"`
+}
+
+// ConferenceDialRequest represents a moderator dialling an extension into a conference
+type ConferenceDialRequest struct {
+	Extension string `json:"extension" binding:"required"`
+}
+
+// ConferenceParticipantRequest represents a moderator action on a participant
+type ConferenceParticipantRequest struct {
+	Channel string `json:"channel" binding:"required"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// MFARecoveryCode is a single-use code that stands in for a TOTP code when
+// the user has lost their authenticator
+type MFARecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	CodeHash  string     `json:"-" gorm:"not null"` // SHA-256 of the code
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MFARolePolicy makes two-factor authentication mandatory for a role: its
+// users enroll at their next login before they get a session
+type MFARolePolicy struct {
+	Role      string    `json:"role" gorm:"primaryKey"`
+	Required  bool      `json:"required"`
+	UpdatedBy uint      `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// MFALoginRequest completes a login with the second factor: a TOTP code or
+// a recovery code
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFAEnrollRequest starts enrollment during a login that requires it
+type MFAEnrollRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+// MFACodeRequest confirms an operation with a current TOTP code
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFAPolicyRequest sets whether a role requires two-factor authentication
+type MFAPolicyRequest struct {
+	Required *bool `json:"required" binding:"required"`
+}
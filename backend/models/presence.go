@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// PresenceTransition records a change of a user's presence state
+type PresenceTransition struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"index;not null"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"` // What caused it, e.g. ws_disconnected, sip_registered, call_ringing
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
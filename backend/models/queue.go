@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// CallQueue is an Asterisk queue callers wait in until an agent is free.
+// The queue itself must be defined in queues.conf under Name.
+type CallQueue struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"unique;not null"`   // Queue name in Asterisk
+	Number      string    `json:"number" gorm:"unique;not null"` // Dialled to reach the queue
+	Description string    `json:"description"`
+	MaxWait     int       `json:"max_wait"` // seconds before a caller gives up waiting, 0 for the queue default
+	Agents      []User    `json:"agents" gorm:"many2many:call_queue_agents"`
+	Supervisors []User    `json:"supervisors" gorm:"many2many:call_queue_supervisors"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// IsAgent reports whether a user may log into the queue
+func (q *CallQueue) IsAgent(userID uint) bool {
+	for _, agent := range q.Agents {
+		if agent.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSupervisor reports whether a user supervises the queue
+func (q *CallQueue) IsSupervisor(userID uint) bool {
+	for _, supervisor := range q.Supervisors {
+		if supervisor.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CallQueueRequest represents a queue creation or update request
+type CallQueueRequest struct {
+	Name                 string   `json:"name" binding:"required,max=64,alphanum"`
+	Number               string   `json:"number"`
+	Description          string   `json:"description" binding:"max=255"`
+	MaxWait              int      `json:"max_wait" binding:"min=0,max=3600"`
+	AgentExtensions      []string `json:"agent_extensions"`
+	SupervisorExtensions []string `json:"supervisor_extensions"`
+}
+
+// QueueAgentRequest represents an agent login, logout or pause request.
+// Supervisors may name another agent's extension.
+type QueueAgentRequest struct {
+	Extension string `json:"extension"`
+	Reason    string `json:"reason" binding:"max=100"`
+}
@@ -0,0 +1,97 @@
+package models
+
+import "time"
+
+// Permissions a role can grant. PermAll grants every permission, including
+// ones added later.
+const (
+	PermAll                 = "*"
+	PermUsersView           = "users.view"
+	PermUsersManage         = "users.manage"
+	PermRolesManage         = "roles.manage"
+	PermAuditView           = "audit.view"
+	PermCallsViewAll        = "calls.view_all"
+	PermCallsMonitor        = "calls.monitor"
+	PermCallLogsExport      = "call_logs.export"
+	PermCallLogsDelete      = "call_logs.delete"
+	PermQueuesStats         = "queues.stats"
+	PermQueuesSupervise     = "queues.supervise"
+	PermQueuesManage        = "queues.manage"
+	PermConferencesModerate = "conferences.moderate"
+	PermPresenceViewAll     = "presence.view_all"
+	PermSystemView          = "system.view"
+	PermBackupsManage       = "backups.manage"
+)
+
+// Permissions describes every permission
+var Permissions = map[string]string{
+	PermUsersView:           "List users and their sessions",
+	PermUsersManage:         "Create, update and delete users, revoke their sessions, reset their 2FA and unlock them",
+	PermRolesManage:         "Manage roles, their permissions and 2FA policies",
+	PermAuditView:           "Read the security audit trail",
+	PermCallsViewAll:        "See every active call",
+	PermCallsMonitor:        "Listen to, whisper into and barge into active calls",
+	PermCallLogsExport:      "Export every user's call logs",
+	PermCallLogsDelete:      "Delete call logs",
+	PermQueuesStats:         "Receive live statistics of every queue",
+	PermQueuesSupervise:     "Log in, log out and pause the agents of any queue",
+	PermQueuesManage:        "Create, update and delete queues",
+	PermConferencesModerate: "Moderate any conference room",
+	PermPresenceViewAll:     "Follow the presence of every extension",
+	PermSystemView:          "See system statistics, metrics and health",
+	PermBackupsManage:       "Create, download, restore and delete backups",
+}
+
+// Built-in roles
+const (
+	RoleAdmin      = "admin"
+	RoleUser       = "user"
+	RoleSupervisor = "supervisor"
+	RoleOperator   = "operator"
+	RoleAuditor    = "auditor"
+)
+
+// DefaultRoles are created when missing, with these permissions. Except
+// for admin's, their permissions can be changed afterwards.
+var DefaultRoles = []struct {
+	Name        string
+	Description string
+	Permissions []string
+}{
+	{RoleAdmin, "Full access", []string{PermAll}},
+	{RoleUser, "Calls, chat and conferences", nil},
+	{RoleSupervisor, "Watches and assists calls and queues", []string{
+		PermUsersView, PermCallsViewAll, PermCallsMonitor, PermQueuesStats,
+		PermQueuesSupervise, PermConferencesModerate, PermPresenceViewAll,
+	}},
+	{RoleOperator, "Manages users", []string{
+		PermUsersView, PermUsersManage, PermQueuesManage, PermSystemView,
+	}},
+	{RoleAuditor, "Read-only access to users, calls, logs and the audit trail", []string{
+		PermUsersView, PermAuditView, PermCallsViewAll, PermCallLogsExport,
+		PermQueuesStats, PermSystemView,
+	}},
+}
+
+// Role is a named set of permissions assigned to users
+type Role struct {
+	Name        string           `json:"name" gorm:"primaryKey"`
+	Description string           `json:"description"`
+	BuiltIn     bool             `json:"built_in"` // Created by default; cannot be deleted
+	Permissions []RolePermission `json:"-" gorm:"foreignKey:Role;references:Name"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// RolePermission grants a permission to a role
+type RolePermission struct {
+	Role       string `gorm:"primaryKey"`
+	Permission string `gorm:"primaryKey"`
+}
+
+// RoleRequest creates or updates a role. The name is ignored on update.
+type RoleRequest struct {
+	Name        string   `json:"name" binding:"omitempty,min=2,max=32,alphanum,lowercase"`
+	Description string   `json:"description" binding:"max=200"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Session is a login on one device. Its refresh token is replaced every time
+// it is used; the tokens it replaced are kept as SessionTokens, so that one
+// presented again, which means it was stolen, revokes the session with every
+// token descended from the login.
+type Session struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	UserID           uint       `json:"user_id" gorm:"index;not null"`
+	RefreshTokenHash string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the current refresh token
+	DeviceName       string     `json:"device_name"`
+	UserAgent        string     `json:"user_agent"`
+	IPAddress        string     `json:"ip_address"`
+	LastUsedAt       time.Time  `json:"last_used_at"` // Last request or refresh, to the minute
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason    string     `json:"revoked_reason,omitempty"` // logout, refresh_token_reused, user_deleted...
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// SessionToken is a refresh token a session has already exchanged
+type SessionToken struct {
+	Hash      string    `gorm:"primaryKey"` // SHA-256 of the token
+	SessionID uint      `gorm:"index;not null"`
+	RotatedAt time.Time `gorm:"not null"`
+}
+
+// RefreshRequest represents a refresh token exchange
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
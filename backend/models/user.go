@@ -7,65 +7,124 @@ import (
 )
 
 type User struct {
-	ID        uint       `json:"id" gorm:"primaryKey"`
-	Username  string     `json:"username" gorm:"unique;not null"`
-	Email     string     `json:"email" gorm:"unique;not null"`
-	Password  string     `json:"-" gorm:"not null"` // Don't include in JSON responses
-	Extension string     `json:"extension" gorm:"unique;not null"`
-	Status    string     `json:"status" gorm:"default:offline"` // online, offline, busy, away
-	Role      string     `json:"role" gorm:"default:user"`      // user, admin
-	IsOnline  bool       `json:"is_online" gorm:"default:false"`
-	LastLogin *time.Time `json:"last_login"`
-	LastSeen  *time.Time `json:"last_seen"`
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Username     string     `json:"username" gorm:"unique;not null"`
+	Email        string     `json:"email" gorm:"unique;not null"`
+	Password     string     `json:"-" gorm:"not null"` // Don't include in JSON responses
+	Extension    string     `json:"extension" gorm:"unique;not null"`
+	Status       string     `json:"status" gorm:"default:offline"` // online, offline, busy, away; follows Presence
+	Role         string     `json:"role" gorm:"default:user"`      // user, admin
+	IsOnline     bool       `json:"is_online" gorm:"default:false"`
+	Presence     string     `json:"presence" gorm:"default:offline"`        // available, on_call, ringing, away, dnd, offline
+	ManualStatus string     `json:"manual_status" gorm:"default:available"` // chosen by the user: available, away, dnd, offline
+	MFAEnabled   bool       `json:"mfa_enabled" gorm:"default:false"`       // Login asks for a TOTP code
+	TOTPSecret   string     `json:"-"`
+	TOTPPending  string     `json:"-"`                              // Secret being enrolled, until its first code is verified
+	TOTPLastStep int64      `json:"-"`                              // Time step of the last code accepted, so it cannot be replayed
+	FailedLogins int        `json:"failed_logins" gorm:"default:0"` // Consecutive failed logins; reset by a login or a lockout
+	LockedUntil  *time.Time `json:"locked_until"`                   // Logins are refused until then
+	LastLogin    *time.Time `json:"last_login"`
+	LastSeen     *time.Time `json:"last_seen"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
 type CallLog struct {
-	ID        uint       `json:"id" gorm:"primaryKey"`
-	CallerID  uint       `json:"caller_id"`
-	CalleeID  uint       `json:"callee_id"`
-	Caller    User       `json:"caller" gorm:"foreignKey:CallerID"`
-	Callee    User       `json:"callee" gorm:"foreignKey:CalleeID"`
-	StartTime time.Time  `json:"start_time"`
-	EndTime   *time.Time `json:"end_time"`
-	Duration  int        `json:"duration"` // in seconds
-	Status    string     `json:"status"`   // initiated, ringing, answered, ended, failed
-	Channel   string     `json:"channel"`
-	Direction string     `json:"direction"` // inbound, outbound
-	CreatedAt time.Time  `json:"created_at"`
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CallerID   uint       `json:"caller_id"`
+	CalleeID   *uint      `json:"callee_id"` // nil while a queue call waits for an agent
+	Caller     User       `json:"caller" gorm:"foreignKey:CallerID"`
+	Callee     User       `json:"callee" gorm:"foreignKey:CalleeID"`
+	StartTime  time.Time  `json:"start_time"`
+	AnswerTime *time.Time `json:"answer_time"`
+	EndTime    *time.Time `json:"end_time"`
+	Duration   int        `json:"duration"` // in seconds, from start to end including ring time
+	Billsec    int        `json:"billsec"`  // in seconds, from answer to end
+	Status     string     `json:"status"`   // initiated, ringing, answered, ended, failed
+	Channel    string     `json:"channel"`
+	Linkedid   string     `json:"linkedid" gorm:"index"` // Asterisk Linkedid shared by every leg of the call
+	Uniqueid   string     `json:"uniqueid" gorm:"index"` // Asterisk Uniqueid of the originating channel
+	Direction  string     `json:"direction"`             // inbound, outbound
+
+	HoldDuration int `json:"hold_duration"` // in seconds, total time spent on hold
+
+	// Outcome as reported by Asterisk. Disposition is ANSWERED, NO ANSWER,
+	// BUSY or FAILED; HangupCause is the Q.850 cause code.
+	Disposition     string `json:"disposition"`
+	HangupCause     int    `json:"hangup_cause"`
+	HangupCauseText string `json:"hangup_cause_text"`
+	CDRImported     bool   `json:"cdr_imported"` // Timings come from an Asterisk CDR rather than our own estimate
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IsCallee reports whether a user is the called party
+func (l *CallLog) IsCallee(userID uint) bool {
+	return l.CalleeID != nil && *l.CalleeID == userID
 }
 
 type ActiveCall struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	CallerID  uint      `json:"caller_id"`
-	CalleeID  uint      `json:"callee_id"`
-	Caller    User      `json:"caller" gorm:"foreignKey:CallerID"`
-	Callee    User      `json:"callee" gorm:"foreignKey:CalleeID"`
-	Channel   string    `json:"channel"`
-	Status    string    `json:"status"` // ringing, connected, on_hold
-	StartTime time.Time `json:"start_time"`
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	CallerID      uint       `json:"caller_id"`
+	CalleeID      *uint      `json:"callee_id"` // nil while a queue call waits for an agent
+	Caller        User       `json:"caller" gorm:"foreignKey:CallerID"`
+	Callee        User       `json:"callee" gorm:"foreignKey:CalleeID"`
+	Channel       string     `json:"channel"`
+	Linkedid      string     `json:"linkedid" gorm:"index"`
+	CallerChannel string     `json:"caller_channel"` // Asterisk channel of each leg, e.g. PJSIP/1001-00000012
+	CalleeChannel string     `json:"callee_channel"`
+	Status        string     `json:"status"` // ringing, connected, on_hold, transferring
+	StartTime     time.Time  `json:"start_time"`
+	AnswerTime    *time.Time `json:"answer_time"`
+
+	// Attended transfer in progress: who started it and the extension being consulted
+	TransferBy     string `json:"transfer_by,omitempty"`
+	TransferTarget string `json:"transfer_target,omitempty"`
+
+	// Hold state: the extension that put the call on hold and since when,
+	// plus the seconds spent on hold before the current hold
+	HeldBy        string     `json:"held_by,omitempty"`
+	HoldStartTime *time.Time `json:"hold_start_time,omitempty"`
+	HoldDuration  int        `json:"hold_duration"`
+
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// WebRTCTransfer is an attended transfer of a WebRTC-direct call in
+// progress. It is stored rather than kept in memory so that every backend
+// node sees it.
+type WebRTCTransfer struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	Channel        string    `json:"channel" gorm:"uniqueIndex"` // call being transferred
+	Transferor     string    `json:"transferor"`
+	Transferee     string    `json:"transferee"`
+	Target         string    `json:"target"`
+	ConsultChannel string    `json:"consult_channel" gorm:"index"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 // UserResponse represents the user data sent to clients (without sensitive info)
 type UserResponse struct {
-	ID        uint       `json:"id"`
-	Username  string     `json:"username"`
-	Email     string     `json:"email"`
-	Extension string     `json:"extension"`
-	Status    string     `json:"status"`
-	Role      string     `json:"role"`
-	IsOnline  bool       `json:"is_online"`
-	LastLogin *time.Time `json:"last_login"`
-	LastSeen  *time.Time `json:"last_seen"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID          uint       `json:"id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Extension   string     `json:"extension"`
+	Status      string     `json:"status"`
+	Role        string     `json:"role"`
+	IsOnline    bool       `json:"is_online"`
+	Presence    string     `json:"presence"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	LastLogin   *time.Time `json:"last_login"`
+	LastSeen    *time.Time `json:"last_seen"`
+	CreatedAt   time.Time  `json:"created_at"`
 }
 
 // LoginRequest represents login request payload
 type LoginRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username   string `json:"username" binding:"required"`
+	Password   string `json:"password" binding:"required"`
+	DeviceName string `json:"device_name" binding:"max=100"` // Names the session, e.g. "Office desktop"
 }
 
 // RegisterRequest represents registration request payload
@@ -91,19 +150,45 @@ type CallHangupRequest struct {
 	Channel string `json:"channel" binding:"required"`
 }
 
+// CallHoldRequest represents a call hold or resume request
+type CallHoldRequest struct {
+	Channel string `json:"channel" binding:"required"`
+}
+
+// CallTransferRequest represents a call transfer request. Type is blind
+// (default) or attended; attended transfers go through the start (default),
+// complete and cancel actions.
+type CallTransferRequest struct {
+	Channel         string `json:"channel" binding:"required"`
+	TargetExtension string `json:"target_extension"`
+	Type            string `json:"type"`
+	Action          string `json:"action"`
+}
+
+// CallMonitorRequest represents a supervisor's request to monitor a call.
+// Mode is listen (default), whisper or barge; Party is the leg spied on and
+// whispered to, caller (default) or callee.
+type CallMonitorRequest struct {
+	Mode  string `json:"mode" binding:"omitempty,oneof=listen whisper barge"`
+	Party string `json:"party" binding:"omitempty,oneof=caller callee"`
+}
+
 // ToResponse converts User to UserResponse
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:        u.ID,
-		Username:  u.Username,
-		Email:     u.Email,
-		Extension: u.Extension,
-		Status:    u.Status,
-		Role:      u.Role,
-		IsOnline:  u.IsOnline,
-		LastLogin: u.LastLogin,
-		LastSeen:  u.LastSeen,
-		CreatedAt: u.CreatedAt,
+		ID:          u.ID,
+		Username:    u.Username,
+		Email:       u.Email,
+		Extension:   u.Extension,
+		Status:      u.Status,
+		Role:        u.Role,
+		IsOnline:    u.IsOnline,
+		Presence:    u.Presence,
+		MFAEnabled:  u.MFAEnabled,
+		LockedUntil: u.LockedUntil,
+		LastLogin:   u.LastLogin,
+		LastSeen:    u.LastSeen,
+		CreatedAt:   u.CreatedAt,
 	}
 }
 
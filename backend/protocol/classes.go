@@ -0,0 +1,64 @@
+package protocol
+
+// Classes of message, which decide how the hub rate limits a message from a
+// client and what it does with a message for a client that is not keeping up
+const (
+	// Call setup and WebRTC negotiation; never dropped
+	ClassSignaling = "signaling"
+
+	// User status and typing indicators; only the latest update about a user
+	// matters, so queued updates are replaced by newer ones and dropped when
+	// the queue is full
+	ClassPresence = "presence"
+
+	// Connection housekeeping: auth, ping and the replies to messages
+	ClassControl = "control"
+
+	// Everything else
+	ClassDefault = "default"
+)
+
+var messageClasses = map[string]string{
+	TypeWelcome:       ClassControl,
+	TypeAuth:          ClassControl,
+	TypeAuthenticated: ClassControl,
+	TypeAuthError:     ClassControl,
+	TypePing:          ClassControl,
+	TypePong:          ClassControl,
+	TypeAck:           ClassControl,
+	TypeError:         ClassControl,
+
+	TypeUserStatus:        ClassPresence,
+	TypeUserOnline:        ClassPresence,
+	TypeUserOffline:       ClassPresence,
+	TypeUserStatusChanged: ClassPresence,
+	TypeChatTyping:        ClassPresence,
+
+	TypeIncomingCall: ClassSignaling,
+	TypeCallStatus:   ClassSignaling,
+	TypeHangup:       ClassSignaling,
+	TypeAnswerCall:   ClassSignaling,
+	TypeCallEnded:    ClassSignaling,
+	TypeCallAnswered: ClassSignaling,
+	TypeCallTransfer: ClassSignaling,
+
+	TypeWebRTCCallInvitation: ClassSignaling,
+	TypeWebRTCCallInitiated:  ClassSignaling,
+	TypeWebRTCCallAccepted:   ClassSignaling,
+	TypeWebRTCCallRejected:   ClassSignaling,
+	TypeWebRTCCallEnded:      ClassSignaling,
+	TypeWebRTCOffer:          ClassSignaling,
+	TypeWebRTCAnswer:         ClassSignaling,
+	TypeWebRTCICECandidate:   ClassSignaling,
+	TypeWebRTCHold:           ClassSignaling,
+	TypeWebRTCResume:         ClassSignaling,
+	TypeWebRTCTransfer:       ClassSignaling,
+}
+
+// Class returns the class of a message type
+func Class(messageType string) string {
+	if class, ok := messageClasses[messageType]; ok {
+		return class
+	}
+	return ClassDefault
+}
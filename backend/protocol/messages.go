@@ -0,0 +1,408 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Message types
+const (
+	// Connection
+	TypeWelcome       = "welcome"
+	TypeAuth          = "auth"
+	TypeAuthenticated = "authenticated"
+	TypeAuthError     = "auth_error"
+	TypePing          = "ping"
+	TypePong          = "pong"
+	TypeAck           = "ack"
+	TypeError         = "error"
+
+	// Users
+	TypeUserStatus        = "user_status"
+	TypeUserOnline        = "user_online"
+	TypeUserOffline       = "user_offline"
+	TypeUserStatusChanged = "user_status_changed"
+	TypeUserDeleted       = "user_deleted"
+
+	// Presence subscriptions
+	TypePresenceSubscribe   = "presence_subscribe"
+	TypePresenceUnsubscribe = "presence_unsubscribe"
+	TypePresenceSnapshot    = "presence_snapshot"
+
+	// Calls
+	TypeIncomingCall = "incoming_call"
+	TypeCallStatus   = "call_status"
+	TypeHangup       = "hangup"
+	TypeAnswerCall   = "answer_call"
+	TypeCallEnded    = "call_ended"
+	TypeCallAnswered = "call_answered"
+	TypeCallTransfer = "call_transfer"
+
+	// WebRTC-direct calls
+	TypeWebRTCCallInvitation = "webrtc_call_invitation"
+	TypeWebRTCCallInitiated  = "webrtc_call_initiated"
+	TypeWebRTCCallAccepted   = "webrtc_call_accepted"
+	TypeWebRTCCallRejected   = "webrtc_call_rejected"
+	TypeWebRTCCallEnded      = "webrtc_call_ended"
+	TypeWebRTCOffer          = "webrtc_offer"
+	TypeWebRTCAnswer         = "webrtc_answer"
+	TypeWebRTCICECandidate   = "webrtc_ice_candidate"
+	TypeWebRTCHold           = "webrtc_hold"
+	TypeWebRTCResume         = "webrtc_resume"
+	TypeWebRTCTransfer       = "webrtc_transfer"
+
+	// Conferences and queues
+	TypeConferenceParticipants = "conference_participants"
+	TypeQueueStatus            = "queue_status"
+
+	// Chat
+	TypeChatMessage = "chat_message"
+	TypeChatTyping  = "chat_typing"
+	TypeChatRead    = "chat_read"
+)
+
+// Empty is the payload of messages that carry no fields
+type Empty struct{}
+
+// Welcome is sent when a connection has been authenticated
+type Welcome struct {
+	Status    string `json:"status"` // connected
+	Version   int    `json:"version"`
+	Extension string `json:"extension,omitempty"`
+
+	// Reconnect with ?resume=<resume_token>&last_seq=<seq of the last event
+	// received> to be sent the events missed while disconnected
+	ResumeToken string `json:"resume_token,omitempty"`
+	Seq         uint64 `json:"seq"` // Sequence number of the last event so far
+
+	// Set when the connection resumed a previous one. Missed events follow
+	// the welcome; if some were no longer buffered, ReplayTruncated is set
+	// and the client should reload its state.
+	Resumed         bool `json:"resumed,omitempty"`
+	Replayed        int  `json:"replayed,omitempty"`
+	ReplayTruncated bool `json:"replay_truncated,omitempty"`
+}
+
+// Auth authenticates a connection in its first message, or renews the
+// token of an open connection
+type Auth struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// AuthError tells the client why a token renewal was refused
+type AuthError struct {
+	Error string `json:"error"`
+}
+
+// Ack confirms that a message with an ID was handled
+type Ack struct {
+	RefType string `json:"ref_type"`
+}
+
+// Error tells the client why one of its messages was rejected
+type Error struct {
+	Code    string `json:"code"`
+	Error   string `json:"error"`
+	RefType string `json:"ref_type,omitempty"` // Type of the rejected message
+	Channel string `json:"channel,omitempty"`
+}
+
+// UserStatus is the status a user chooses: available, away, dnd, or
+// offline to appear offline (online and busy are accepted for available and
+// dnd)
+type UserStatus struct {
+	Status string `json:"status" binding:"required,oneof=available online away dnd busy offline"`
+}
+
+// UserStatusChanged is sent to a user's subscribers, and to the user,
+// whenever their presence changes
+type UserStatusChanged struct {
+	UserID        uint       `json:"user_id,omitempty"`
+	Username      string     `json:"username,omitempty"`
+	Extension     string     `json:"extension"`
+	Presence      string     `json:"presence"` // available, on_call, ringing, away, dnd, offline
+	Status        string     `json:"status"`   // online, busy, away or offline, for older clients
+	IsOnline      bool       `json:"is_online"`
+	SIPRegistered bool       `json:"sip_registered"`
+	LastSeen      *time.Time `json:"last_seen,omitempty"`
+	WSConnected   bool       `json:"ws_connected"`
+	ClientCount   int        `json:"client_count"`
+	Reason        string     `json:"reason,omitempty"` // What changed it, e.g. ws_disconnected, sip_registered, call_ringing
+}
+
+// PresenceSubscription names extensions whose presence to follow, or stop
+// following. All (admins only) follows every extension.
+type PresenceSubscription struct {
+	Extensions []string `json:"extensions" binding:"max=1000"`
+	All        bool     `json:"all,omitempty"`
+}
+
+// PresenceSnapshot is the current presence of the extensions a subscription
+// added. Extensions without a user are left out.
+type PresenceSnapshot struct {
+	Users []UserStatusChanged `json:"users"`
+	All   bool                `json:"all,omitempty"`
+}
+
+// UserDeleted is broadcast when an admin deletes a user
+type UserDeleted struct {
+	UserID    uint   `json:"user_id"`
+	Username  string `json:"username"`
+	DeletedBy uint   `json:"deleted_by"`
+}
+
+// Signal addresses a message about a call to its parties. The server
+// overwrites From with the sender's extension when it relays a message.
+type Signal struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"` // One party, or every other party if empty
+	Channel string `json:"channel" binding:"required"`
+	CallID  string `json:"call_id,omitempty"`
+}
+
+// GetSignal returns the addressing of a call message
+func (s *Signal) GetSignal() *Signal {
+	return s
+}
+
+// Call returns the ID the call is known by: its call_id, or the channel for
+// WebRTC calls, whose channel is their call ID
+func (s *Signal) Call() string {
+	if s.CallID != "" {
+		return s.CallID
+	}
+	return s.Channel
+}
+
+// Signaler is a call message addressed with a Signal
+type Signaler interface {
+	GetSignal() *Signal
+}
+
+// CallEvent reports something that happened to a call
+type CallEvent struct {
+	Signal
+	Status string `json:"status,omitempty"`
+}
+
+// CallStatus is the state of a call. The server sends it to both parties;
+// clients may also send it to the other party of a call.
+type CallStatus struct {
+	Signal
+	Caller    string `json:"caller,omitempty"`
+	Callee    string `json:"callee,omitempty"`
+	Status    string `json:"status"`
+	Priority  string `json:"priority,omitempty"`
+	Transport string `json:"transport,omitempty"`
+
+	// Hold updates only: who put the call on hold and its total time on hold
+	HeldBy       string `json:"held_by,omitempty"`
+	HoldDuration int    `json:"hold_duration,omitempty"`
+}
+
+// AnswerCall tells the other party of a call that the client answered it
+type AnswerCall struct {
+	Channel   string `json:"channel" binding:"required"`
+	CallID    string `json:"call_id,omitempty"`
+	Extension string `json:"extension,omitempty"`
+	Transport string `json:"transport,omitempty"`
+}
+
+// CallInvitation invites the callee to a WebRTC-direct call
+type CallInvitation struct {
+	CallID          string `json:"call_id"`
+	CallerID        uint   `json:"caller_id"`
+	CallerUsername  string `json:"caller_username"`
+	CallerExtension string `json:"caller_extension"`
+	TargetExtension string `json:"target_extension"`
+
+	// Calls created by a transfer only
+	TransferredBy string `json:"transferred_by,omitempty"`
+	ConsultFor    string `json:"consult_for,omitempty"`
+}
+
+// CallInitiated confirms to the caller that a WebRTC-direct call is ringing
+type CallInitiated struct {
+	CallID string `json:"call_id"`
+	Status string `json:"status"`
+	Target string `json:"target"`
+}
+
+// WebRTCOffer carries the caller's SDP offer
+type WebRTCOffer struct {
+	Signal
+	Offer json.RawMessage `json:"offer" binding:"required"`
+}
+
+// WebRTCAnswer carries the callee's SDP answer
+type WebRTCAnswer struct {
+	Signal
+	Answer json.RawMessage `json:"answer" binding:"required"`
+}
+
+// WebRTCICECandidate carries an ICE candidate to the peer
+type WebRTCICECandidate struct {
+	Signal
+	Candidate json.RawMessage `json:"candidate" binding:"required"`
+}
+
+// CallTransfer tells the three parties of a call transfer how it is going
+type CallTransfer struct {
+	Channel      string `json:"channel"`
+	TransferType string `json:"transfer_type"` // blind, attended
+	Status       string `json:"status"`        // consulting, completed, cancelled
+	Transferor   string `json:"transferor"`
+	Transferee   string `json:"transferee"`
+	Target       string `json:"target"`
+
+	// WebRTC-direct calls only: the consultation call between transferor
+	// and target, and the call the transferee and target continue on
+	ConsultChannel string `json:"consult_channel,omitempty"`
+	NewChannel     string `json:"new_channel,omitempty"`
+}
+
+// ConferenceParticipants carries the live participant list of a conference room
+type ConferenceParticipants struct {
+	RoomID       uint        `json:"room_id,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	Conference   string      `json:"conference"`
+	Event        string      `json:"event"` // joined, left, muted, unmuted, locked, unlocked, ended, synced
+	Locked       bool        `json:"locked"`
+	Participant  interface{} `json:"participant,omitempty"` // The participant the event is about
+	Participants interface{} `json:"participants"`
+}
+
+// QueueStatus carries the live state of a call queue to its supervisors
+type QueueStatus struct {
+	QueueID uint        `json:"queue_id,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Queue   string      `json:"queue"`
+	Event   string      `json:"event"` // caller_joined, caller_left, caller_abandoned, agent_*, synced
+	Stats   interface{} `json:"stats"`
+	Members interface{} `json:"members"`
+	Callers interface{} `json:"callers"`
+}
+
+// ChatMessage is a chat message, sent to every member of its conversation
+// including the sender's other connections. A message may arrive twice
+// when it is delivered again after a reconnect; clients drop duplicates by
+// id.
+type ChatMessage struct {
+	ID             uint      `json:"id"`
+	ConversationID uint      `json:"conversation_id"`
+	SenderID       uint      `json:"sender_id"`
+	SenderUsername string    `json:"sender_username"`
+	From           string    `json:"from"` // Sender's extension
+	Body           string    `json:"body"`
+	ClientID       string    `json:"client_id,omitempty"` // Chosen by the sender when it sent the message
+	SentAt         time.Time `json:"sent_at"`
+}
+
+// ChatTyping says whether a member is typing in a conversation
+type ChatTyping struct {
+	ConversationID uint   `json:"conversation_id" binding:"required"`
+	Typing         bool   `json:"typing"`
+	UserID         uint   `json:"user_id,omitempty"`   // Set by the server
+	Extension      string `json:"extension,omitempty"` // Set by the server
+}
+
+// ChatRead says a member read a conversation up to a message
+type ChatRead struct {
+	ConversationID uint   `json:"conversation_id" binding:"required"`
+	MessageID      uint   `json:"message_id" binding:"required"`
+	UserID         uint   `json:"user_id,omitempty"`   // Set by the server
+	Extension      string `json:"extension,omitempty"` // Set by the server
+}
+
+// Direction says who sends a message type
+type Direction string
+
+const (
+	FromClient Direction = "client"
+	FromServer Direction = "server"
+	FromBoth   Direction = "both"
+)
+
+// Spec describes a message type
+type Spec struct {
+	Type        string
+	Direction   Direction
+	Description string
+	payload     reflect.Type
+}
+
+func (s Spec) newPayload() interface{} {
+	return reflect.New(s.payload).Interface()
+}
+
+func spec(messageType string, direction Direction, payload interface{}, description string) Spec {
+	return Spec{
+		Type:        messageType,
+		Direction:   direction,
+		Description: description,
+		payload:     reflect.TypeOf(payload),
+	}
+}
+
+// specs lists every message type of the protocol
+var specs = []Spec{
+	spec(TypeWelcome, FromServer, Welcome{}, "Sent once the connection is authenticated"),
+	spec(TypeAuth, FromClient, Auth{}, "Authenticate in the first message, or renew the token of an open connection"),
+	spec(TypeAuthenticated, FromServer, Empty{}, "The token was renewed"),
+	spec(TypeAuthError, FromServer, AuthError{}, "The token renewal was refused"),
+	spec(TypePing, FromClient, Empty{}, "Heartbeat"),
+	spec(TypePong, FromServer, Empty{}, "Heartbeat response"),
+	spec(TypeAck, FromServer, Ack{}, "A message with an id was handled; correlation_id is its id"),
+	spec(TypeError, FromServer, Error{}, "A message was rejected; correlation_id is its id if it had one"),
+
+	spec(TypeUserStatus, FromClient, UserStatus{}, "Choose your status"),
+	spec(TypeUserOnline, FromClient, Empty{}, "Choose the available status"),
+	spec(TypeUserOffline, FromClient, Empty{}, "Appear offline"),
+	spec(TypeUserStatusChanged, FromServer, UserStatusChanged{}, "A user's presence changed"),
+	spec(TypeUserDeleted, FromServer, UserDeleted{}, "An admin deleted a user"),
+
+	spec(TypePresenceSubscribe, FromClient, PresenceSubscription{}, "Follow the presence of extensions, or of everyone (admins)"),
+	spec(TypePresenceUnsubscribe, FromClient, PresenceSubscription{}, "Stop following the presence of extensions, or of everyone"),
+	spec(TypePresenceSnapshot, FromServer, PresenceSnapshot{}, "Current presence of the extensions just subscribed to; correlation_id is the subscription's id"),
+
+	spec(TypeIncomingCall, FromServer, CallStatus{}, "A call is ringing your extension"),
+	spec(TypeCallStatus, FromBoth, CallStatus{}, "The state of a call changed"),
+	spec(TypeHangup, FromClient, CallEvent{}, "You hung up a call"),
+	spec(TypeAnswerCall, FromClient, AnswerCall{}, "You answered a call"),
+	spec(TypeCallEnded, FromServer, CallEvent{}, "The other party hung up"),
+	spec(TypeCallAnswered, FromServer, CallEvent{}, "The other party answered"),
+	spec(TypeCallTransfer, FromServer, CallTransfer{}, "Progress of a call transfer"),
+
+	spec(TypeWebRTCCallInvitation, FromServer, CallInvitation{}, "A WebRTC-direct call is ringing your extension"),
+	spec(TypeWebRTCCallInitiated, FromServer, CallInitiated{}, "Your WebRTC-direct call is ringing the callee"),
+	spec(TypeWebRTCCallAccepted, FromBoth, CallEvent{}, "The callee accepted a WebRTC-direct call"),
+	spec(TypeWebRTCCallRejected, FromBoth, CallEvent{}, "The callee rejected a WebRTC-direct call"),
+	spec(TypeWebRTCCallEnded, FromBoth, CallEvent{}, "A party ended a WebRTC-direct call"),
+	spec(TypeWebRTCOffer, FromBoth, WebRTCOffer{}, "SDP offer"),
+	spec(TypeWebRTCAnswer, FromBoth, WebRTCAnswer{}, "SDP answer"),
+	spec(TypeWebRTCICECandidate, FromBoth, WebRTCICECandidate{}, "ICE candidate"),
+	spec(TypeWebRTCHold, FromBoth, CallEvent{}, "Put a WebRTC-direct call on hold"),
+	spec(TypeWebRTCResume, FromBoth, CallEvent{}, "Resume a WebRTC-direct call"),
+	spec(TypeWebRTCTransfer, FromServer, CallTransfer{}, "Progress of a WebRTC-direct call transfer"),
+
+	spec(TypeConferenceParticipants, FromServer, ConferenceParticipants{}, "Participant list of a conference room after a change"),
+	spec(TypeQueueStatus, FromServer, QueueStatus{}, "Members, callers and stats of a call queue after a change"),
+
+	spec(TypeChatMessage, FromServer, ChatMessage{}, "A chat message in one of your conversations"),
+	spec(TypeChatTyping, FromBoth, ChatTyping{}, "Whether a member is typing in a conversation"),
+	spec(TypeChatRead, FromBoth, ChatRead{}, "Mark a conversation read up to a message, or a member's read receipt"),
+}
+
+var specsByType = make(map[string]Spec)
+
+func init() {
+	for _, s := range specs {
+		specsByType[s.Type] = s
+	}
+}
+
+// Specs returns every message type of the protocol
+func Specs() []Spec {
+	return append([]Spec(nil), specs...)
+}
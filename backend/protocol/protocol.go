@@ -0,0 +1,186 @@
+// Package protocol defines the messages exchanged over the WebSocket
+// connection between the backend and its clients.
+//
+// Version 1 wraps every message in an Envelope with the message fields in
+// its payload. Clients that connect without asking for a version speak
+// version 0, where the payload fields sit next to "type" in a flat object.
+// Both versions use the same payload structs.
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Version is the current protocol version
+const Version = 1
+
+// Envelope wraps every message of protocol version 1
+type Envelope struct {
+	Version       int             `json:"v"`
+	Type          string          `json:"type"`
+	ID            string          `json:"id,omitempty"`             // Chosen by the sender
+	CorrelationID string          `json:"correlation_id,omitempty"` // ID of the message this one answers
+	Seq           uint64          `json:"seq,omitempty"`            // Position in the recipient's event stream
+	Timestamp     int64           `json:"timestamp,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+// Message is a message from the server before it is encoded for a client
+type Message struct {
+	Type          string
+	ID            string
+	CorrelationID string
+	Seq           uint64 // Set by the hub for events sent to an extension
+	Payload       interface{}
+}
+
+// New returns a message of the given type
+func New(messageType string, payload interface{}) Message {
+	return Message{Type: messageType, Payload: payload}
+}
+
+// Inbound is a decoded and validated message from a client
+type Inbound struct {
+	Version int
+	Type    string
+	ID      string
+	Payload interface{} // Pointer to the payload struct registered for Type
+}
+
+// Error codes carried by error frames
+const (
+	CodeInvalidMessage     = "invalid_message"
+	CodeUnknownType        = "unknown_type"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeUnauthorized       = "unauthorized"
+	CodeRejected           = "rejected" // the message was understood but could not be carried out
+	CodeRateLimited        = "rate_limited"
+)
+
+// ProtocolError is an error that is reported to the client with a code
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// NewError returns an error reported to the client with a code
+func NewError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// ErrorCode returns the code of a ProtocolError, or fallback for other errors
+func ErrorCode(err error, fallback string) string {
+	if protocolErr, ok := err.(*ProtocolError); ok {
+		return protocolErr.Code
+	}
+	return fallback
+}
+
+// Decode parses and validates a message from a client
+func Decode(data []byte) (*Inbound, error) {
+	var head struct {
+		Version int             `json:"v"`
+		Type    string          `json:"type"`
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, NewError(CodeInvalidMessage, "message is not a valid JSON object")
+	}
+
+	inbound := &Inbound{Version: head.Version, Type: head.Type}
+	payload := []byte(head.Payload)
+	switch head.Version {
+	case 0:
+		payload = data
+	case Version:
+		inbound.ID = head.ID
+	default:
+		return inbound, NewError(CodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported", head.Version))
+	}
+
+	if head.Type == "" {
+		return inbound, NewError(CodeInvalidMessage, "message has no type")
+	}
+	spec, exists := specsByType[head.Type]
+	if !exists || spec.Direction == FromServer {
+		return inbound, NewError(CodeUnknownType, "unknown message type "+head.Type)
+	}
+
+	value := spec.newPayload()
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, value); err != nil {
+			return inbound, NewError(CodeInvalidMessage, "invalid payload: "+err.Error())
+		}
+	}
+	if err := binding.Validator.ValidateStruct(value); err != nil {
+		return inbound, NewError(CodeInvalidMessage, "invalid payload: "+err.Error())
+	}
+	inbound.Payload = value
+	return inbound, nil
+}
+
+// Encode renders a message for a client speaking the given protocol version
+func Encode(msg Message, version int) ([]byte, error) {
+	var payload json.RawMessage
+	if msg.Payload != nil {
+		data, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	}
+	now := time.Now().Unix()
+
+	if version == 0 {
+		fields := make(map[string]json.RawMessage)
+		if payload != nil {
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				return nil, fmt.Errorf("payload of %s is not an object: %v", msg.Type, err)
+			}
+		}
+		fields["type"], _ = json.Marshal(msg.Type)
+		if msg.Seq != 0 {
+			fields["seq"], _ = json.Marshal(msg.Seq)
+		}
+		if _, exists := fields["timestamp"]; !exists {
+			fields["timestamp"], _ = json.Marshal(now)
+		}
+		return json.Marshal(fields)
+	}
+
+	id := msg.ID
+	if id == "" {
+		id = NewID()
+	}
+	return json.Marshal(Envelope{
+		Version:       Version,
+		Type:          msg.Type,
+		ID:            id,
+		CorrelationID: msg.CorrelationID,
+		Seq:           msg.Seq,
+		Timestamp:     now,
+		Payload:       payload,
+	})
+}
+
+// NewID returns a random message ID
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantCode string // empty when the message is valid
+		wantType string
+		wantID   string
+		check    func(t *testing.T, payload interface{})
+	}{
+		{
+			name:     "v0 flat message",
+			data:     `{"type":"webrtc_offer","id":"m1","channel":"webrtc-call-1","offer":{"sdp":"v=0"}}`,
+			wantType: TypeWebRTCOffer,
+			check: func(t *testing.T, payload interface{}) {
+				offer := payload.(*WebRTCOffer)
+				if offer.Channel != "webrtc-call-1" || string(offer.Offer) != `{"sdp":"v=0"}` {
+					t.Errorf("payload = %+v", offer)
+				}
+			},
+		},
+		{
+			name:     "v1 envelope",
+			data:     `{"v":1,"type":"webrtc_offer","id":"m1","payload":{"channel":"webrtc-call-1","call_id":"1700000000.1","offer":{}}}`,
+			wantType: TypeWebRTCOffer,
+			wantID:   "m1",
+			check: func(t *testing.T, payload interface{}) {
+				offer := payload.(*WebRTCOffer)
+				if offer.Call() != "1700000000.1" {
+					t.Errorf("call = %q, want the call_id", offer.Call())
+				}
+			},
+		},
+		{
+			name:     "v0 without payload fields",
+			data:     `{"type":"ping"}`,
+			wantType: TypePing,
+		},
+		{
+			name:     "v1 without payload",
+			data:     `{"v":1,"type":"ping","id":"p1"}`,
+			wantType: TypePing,
+			wantID:   "p1",
+		},
+		{
+			name:     "message both sides send",
+			data:     `{"v":1,"type":"call_status","payload":{"channel":"PJSIP/1001","status":"ringing"}}`,
+			wantType: TypeCallStatus,
+		},
+		{name: "not JSON", data: `{"type":`, wantCode: CodeInvalidMessage},
+		{name: "not an object", data: `["ping"]`, wantCode: CodeInvalidMessage},
+		{name: "unsupported version", data: `{"v":2,"type":"ping"}`, wantCode: CodeUnsupportedVersion},
+		{name: "no type", data: `{"v":1,"payload":{}}`, wantCode: CodeInvalidMessage},
+		{name: "unknown type", data: `{"type":"dial_everyone"}`, wantCode: CodeUnknownType},
+		{name: "server-only type", data: `{"type":"welcome","status":"connected"}`, wantCode: CodeUnknownType},
+		{name: "server-only type in an envelope", data: `{"v":1,"type":"incoming_call","payload":{"channel":"PJSIP/1001"}}`, wantCode: CodeUnknownType},
+		{name: "missing required field", data: `{"type":"webrtc_offer","offer":{}}`, wantCode: CodeInvalidMessage},
+		{name: "value outside oneof", data: `{"v":1,"type":"user_status","payload":{"status":"asleep"}}`, wantCode: CodeInvalidMessage},
+		{name: "wrong field type", data: `{"v":1,"type":"chat_typing","payload":{"conversation_id":"seven"}}`, wantCode: CodeInvalidMessage},
+		{name: "payload not an object", data: `{"v":1,"type":"hangup","payload":"PJSIP/1001"}`, wantCode: CodeInvalidMessage},
+		{
+			name:     "too many extensions",
+			data:     `{"type":"presence_subscribe","extensions":[` + strings.Repeat(`"1001",`, 1000) + `"1002"]}`,
+			wantCode: CodeInvalidMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inbound, err := Decode([]byte(tt.data))
+			if tt.wantCode != "" {
+				if code := ErrorCode(err, ""); code != tt.wantCode {
+					t.Fatalf("Decode error = %v (code %q), want code %q", err, code, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode = %v", err)
+			}
+			if inbound.Type != tt.wantType || inbound.ID != tt.wantID {
+				t.Errorf("type %q, id %q, want %q, %q", inbound.Type, inbound.ID, tt.wantType, tt.wantID)
+			}
+			if tt.check != nil {
+				tt.check(t, inbound.Payload)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	status := CallStatus{
+		Signal: Signal{Channel: "PJSIP/1001", CallID: "1700000000.1"},
+		Caller: "1001",
+		Callee: "1002",
+		Status: "ringing",
+	}
+
+	tests := []struct {
+		name    string
+		msg     Message
+		version int
+		want    map[string]interface{} // fields the frame must have
+		absent  []string               // fields it must not have
+	}{
+		{
+			name:    "v0 puts the payload next to the type",
+			msg:     Message{Type: TypeCallStatus, ID: "m1", Seq: 7, Payload: status},
+			version: 0,
+			want:    map[string]interface{}{"type": TypeCallStatus, "channel": "PJSIP/1001", "call_id": "1700000000.1", "status": "ringing", "seq": 7.0},
+			absent:  []string{"v", "payload", "id"},
+		},
+		{
+			name:    "v0 without payload or seq",
+			msg:     New(TypePong, nil),
+			version: 0,
+			want:    map[string]interface{}{"type": TypePong},
+			absent:  []string{"seq"},
+		},
+		{
+			name:    "v0 keeps the payload's own timestamp",
+			msg:     New(TypeChatMessage, map[string]interface{}{"timestamp": 42}),
+			version: 0,
+			want:    map[string]interface{}{"timestamp": 42.0},
+		},
+		{
+			name:    "v1 wraps the payload",
+			msg:     Message{Type: TypeCallStatus, ID: "m1", CorrelationID: "c1", Seq: 7, Payload: status},
+			version: 1,
+			want:    map[string]interface{}{"v": 1.0, "type": TypeCallStatus, "id": "m1", "correlation_id": "c1", "seq": 7.0},
+			absent:  []string{"channel", "status"},
+		},
+		{
+			name:    "v1 without payload",
+			msg:     New(TypePong, nil),
+			version: 1,
+			want:    map[string]interface{}{"v": 1.0, "type": TypePong},
+			absent:  []string{"payload", "correlation_id", "seq"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Encode(tt.msg, tt.version)
+			if err != nil {
+				t.Fatalf("Encode = %v", err)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("frame %s is not an object: %v", data, err)
+			}
+			for key, want := range tt.want {
+				if fields[key] != want {
+					t.Errorf("%s = %v, want %v in %s", key, fields[key], want, data)
+				}
+			}
+			for _, key := range tt.absent {
+				if _, exists := fields[key]; exists {
+					t.Errorf("unexpected %s in %s", key, data)
+				}
+			}
+			if _, exists := fields["timestamp"]; !exists {
+				t.Errorf("no timestamp in %s", data)
+			}
+			if tt.version == 1 && fields["id"] == nil {
+				t.Errorf("no id in %s", data)
+			}
+		})
+	}
+
+	// v0 frames are flat objects, so the payload must be one
+	if _, err := Encode(New(TypeError, "boom"), 0); err == nil {
+		t.Error("Encode of a non-object payload for v0 succeeded")
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	offer := WebRTCOffer{
+		Signal: Signal{From: "1001", Channel: "webrtc-call-1"},
+		Offer:  json.RawMessage(`{"type":"offer","sdp":"v=0"}`),
+	}
+	for _, version := range []int{0, 1} {
+		data, err := Encode(Message{Type: TypeWebRTCOffer, ID: "m1", Payload: offer}, version)
+		if err != nil {
+			t.Fatalf("Encode v%d = %v", version, err)
+		}
+		inbound, err := Decode(data)
+		if err != nil {
+			t.Fatalf("Decode v%d = %v", version, err)
+		}
+		got := inbound.Payload.(*WebRTCOffer)
+		if got.From != offer.From || got.Channel != offer.Channel || string(got.Offer) != string(offer.Offer) {
+			t.Errorf("v%d round trip = %+v, want %+v", version, got, offer)
+		}
+		if inbound.Version != version {
+			t.Errorf("v%d decoded as version %d", version, inbound.Version)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema()
+
+	variants := schema["oneOf"].([]interface{})
+	titles := make(map[string]bool)
+	for _, variant := range variants {
+		titles[variant.(map[string]interface{})["title"].(string)] = true
+	}
+	for _, s := range Specs() {
+		if !titles[s.Type] {
+			t.Errorf("no schema for %s", s.Type)
+		}
+	}
+	if len(variants) != len(Specs()) {
+		t.Errorf("%d variants for %d message types", len(variants), len(Specs()))
+	}
+
+	defs := schema["$defs"].(map[string]interface{})
+	tests := []struct {
+		def, field string
+		want       map[string]interface{}
+		required   bool
+	}{
+		// Embedded Signal fields are flattened into the payload
+		{def: "WebRTCOffer", field: "channel", want: map[string]interface{}{"type": "string"}, required: true},
+		{def: "WebRTCOffer", field: "call_id", want: map[string]interface{}{"type": "string"}},
+		{def: "WebRTCOffer", field: "offer", want: map[string]interface{}{}, required: true},
+		{def: "UserStatus", field: "status", want: map[string]interface{}{"type": "string"}, required: true},
+		{def: "PresenceSubscription", field: "extensions", want: map[string]interface{}{"type": "array", "maxItems": 1000}},
+		{def: "ChatTyping", field: "conversation_id", want: map[string]interface{}{"type": "integer"}, required: true},
+	}
+	for _, tt := range tests {
+		def, ok := defs[tt.def].(map[string]interface{})
+		if !ok {
+			t.Errorf("no $defs entry for %s", tt.def)
+			continue
+		}
+		field, ok := def["properties"].(map[string]interface{})[tt.field].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s has no %s", tt.def, tt.field)
+			continue
+		}
+		for key, want := range tt.want {
+			if field[key] != want {
+				t.Errorf("%s.%s %s = %v, want %v", tt.def, tt.field, key, field[key], want)
+			}
+		}
+		required := false
+		if list, ok := def["required"].([]string); ok {
+			for _, name := range list {
+				required = required || name == tt.field
+			}
+		}
+		if required != tt.required {
+			t.Errorf("%s.%s required = %t, want %t", tt.def, tt.field, required, tt.required)
+		}
+	}
+	enum, _ := defs["UserStatus"].(map[string]interface{})["properties"].(map[string]interface{})["status"].(map[string]interface{})["enum"].([]string)
+	if strings.Join(enum, " ") != "available online away dnd busy offline" {
+		t.Errorf("UserStatus.status enum = %v", enum)
+	}
+}
+
+func TestSchemaFileIsCurrent(t *testing.T) {
+	committed, err := os.ReadFile("../../src/protocol/websocket.schema.json")
+	if err != nil {
+		t.Skipf("schema file not found: %v", err)
+	}
+
+	var generated bytes.Buffer
+	encoder := json.NewEncoder(&generated)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(Schema()); err != nil {
+		t.Fatalf("Failed to encode schema: %v", err)
+	}
+	if !bytes.Equal(committed, generated.Bytes()) {
+		t.Error("src/protocol/websocket.schema.json is out of date; run go run ./cmd/wsschema -o ../src/protocol/websocket.schema.json")
+	}
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// Schema returns a JSON Schema (draft 2020-12) that describes every message
+// of the protocol as a version 1 envelope. Each payload struct is a $defs
+// entry named after the Go type; "x-direction" says who sends a message.
+func Schema() map[string]interface{} {
+	defs := make(map[string]interface{})
+	variants := make([]interface{}, 0, len(specs))
+
+	for _, s := range specs {
+		name := s.payload.Name()
+		if _, exists := defs[name]; !exists {
+			defs[name] = schemaFor(s.payload)
+		}
+
+		variants = append(variants, map[string]interface{}{
+			"title":       s.Type,
+			"description": s.Description,
+			"x-direction": string(s.Direction),
+			"type":        "object",
+			"properties": map[string]interface{}{
+				"v":              map[string]interface{}{"const": Version},
+				"type":           map[string]interface{}{"const": s.Type},
+				"id":             map[string]interface{}{"type": "string"},
+				"correlation_id": map[string]interface{}{"type": "string"},
+				"seq":            map[string]interface{}{"type": "integer", "minimum": 1},
+				"timestamp":      map[string]interface{}{"type": "integer"},
+				"payload":        map[string]interface{}{"$ref": "#/$defs/" + name},
+			},
+			"required": []string{"v", "type"},
+		})
+	}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         "https://voip-backend/schemas/websocket-v" + strconv.Itoa(Version) + ".json",
+		"title":       "VoIP WebSocket protocol",
+		"description": "Messages exchanged over /ws. Version 0 clients send and receive the payload fields next to \"type\" instead of in an envelope.",
+		"x-version":   Version,
+		"oneOf":       variants,
+		"$defs":       defs,
+	}
+}
+
+// schemaFor describes a Go type
+func schemaFor(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{} // any JSON value
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		addFields(t, properties, &required)
+
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{} // interface{}: any JSON value
+}
+
+// addFields adds the JSON fields of a struct to properties, flattening
+// embedded structs the way encoding/json does
+func addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties, required)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if parts := strings.Split(tag, ","); parts[0] != "" {
+				name = parts[0]
+			}
+		}
+
+		schema := schemaFor(field.Type)
+		for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+			key, value, _ := strings.Cut(rule, "=")
+			switch key {
+			case "required":
+				*required = append(*required, name)
+			case "oneof":
+				schema["enum"] = strings.Fields(value)
+			case "min", "max":
+				addBound(schema, key, value)
+			}
+		}
+		properties[name] = schema
+	}
+}
+
+// addBound turns a min or max binding rule into the matching JSON Schema
+// keyword for the field's type
+func addBound(schema map[string]interface{}, rule, value string) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+
+	keyword := map[string]string{"min": "minimum", "max": "maximum"}[rule]
+	switch schema["type"] {
+	case "string":
+		keyword = map[string]string{"min": "minLength", "max": "maxLength"}[rule]
+	case "array":
+		keyword = map[string]string{"min": "minItems", "max": "maxItems"}[rule]
+	}
+	schema[keyword] = n
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"time"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"gorm.io/gorm"
+)
+
+// PutOnHold records that an active call was put on hold by one of its
+// parties. It returns false if the call was already on hold.
+func PutOnHold(activeCall models.ActiveCall, extension string) (bool, error) {
+	now := time.Now()
+	result := database.GetDB().Model(&models.ActiveCall{}).
+		Where("id = ? AND hold_start_time IS NULL", activeCall.ID).
+		Updates(map[string]interface{}{
+			"status":          "on_hold",
+			"held_by":         extension,
+			"hold_start_time": &now,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// TakeOffHold ends the hold of an active call, adding the time it spent on
+// hold to the call and its call log. It returns the seconds of this hold and
+// false if the call was not on hold.
+func TakeOffHold(activeCall models.ActiveCall) (int, bool, error) {
+	db := database.GetDB()
+
+	// Re-read the hold start: the caller's copy may predate the hold
+	var current models.ActiveCall
+	if err := db.Select("id", "status", "hold_start_time").First(&current, activeCall.ID).Error; err != nil {
+		return 0, false, err
+	}
+	if current.HoldStartTime == nil {
+		return 0, false, nil
+	}
+
+	seconds := int(time.Since(*current.HoldStartTime).Seconds())
+	updates := map[string]interface{}{
+		"held_by":         "",
+		"hold_start_time": nil,
+		"hold_duration":   gorm.Expr("hold_duration + ?", seconds),
+	}
+	if current.Status == "on_hold" {
+		updates["status"] = "connected"
+	}
+
+	result := db.Model(&models.ActiveCall{}).
+		Where("id = ? AND hold_start_time IS NOT NULL", activeCall.ID).
+		Updates(updates)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0, false, result.Error
+	}
+
+	callLogs := db.Model(&models.CallLog{})
+	if activeCall.Linkedid != "" {
+		callLogs = callLogs.Where("linkedid = ?", activeCall.Linkedid)
+	} else {
+		callLogs = callLogs.Where("channel = ? AND end_time IS NULL", activeCall.Channel)
+	}
+	err := callLogs.Update("hold_duration", gorm.Expr("hold_duration + ?", seconds)).Error
+
+	return seconds, true, err
+}
+
+// HoldSeconds returns the total time an active call has spent on hold,
+// including the current hold
+func HoldSeconds(activeCall models.ActiveCall) int {
+	seconds := activeCall.HoldDuration
+	if activeCall.HoldStartTime != nil {
+		seconds += int(time.Since(*activeCall.HoldStartTime).Seconds())
+	}
+	return seconds
+}
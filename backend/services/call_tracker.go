@@ -0,0 +1,598 @@
+package services
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/websocket"
+
+	"gorm.io/gorm"
+)
+
+// TrackedCall is the state of a call as observed from AMI events
+type TrackedCall struct {
+	Linkedid        string            `json:"linkedid"`
+	CallerExtension string            `json:"caller_extension"`
+	CalleeExtension string            `json:"callee_extension"`
+	CallerChannel   string            `json:"caller_channel"`
+	CalleeChannel   string            `json:"callee_channel"`
+	State           string            `json:"state"` // ringing, answered, ended, failed
+	Reason          string            `json:"reason,omitempty"`
+	Disposition     string            `json:"disposition,omitempty"`  // ANSWERED, NO ANSWER, BUSY, FAILED
+	HangupCause     int               `json:"hangup_cause,omitempty"` // Q.850 cause of the first leg to hang up
+	StartTime       time.Time         `json:"start_time"`
+	AnswerTime      *time.Time        `json:"answer_time,omitempty"`
+	EndTime         *time.Time        `json:"end_time,omitempty"`
+	Legs            map[string]string `json:"legs"` // Uniqueid -> channel
+}
+
+// CallTrackerService keeps ActiveCall and CallLog rows in sync with what
+// Asterisk reports, so calls hung up on a desk phone or dropped by Asterisk
+// are finished even when no browser calls the REST API
+type CallTrackerService struct {
+	subscription *asterisk.Subscription
+	calls        map[string]*TrackedCall
+	mutex        sync.RWMutex
+	stopChan     chan bool
+	running      bool
+}
+
+// callTrackerEvents are the AMI events the tracker consumes
+var callTrackerEvents = []string{
+	asterisk.EventNewchannel,
+	asterisk.EventNewstate,
+	asterisk.EventDialBegin,
+	asterisk.EventDialEnd,
+	asterisk.EventBridgeEnter,
+	asterisk.EventHangup,
+	asterisk.EventHold,
+	asterisk.EventUnhold,
+	asterisk.EventAMIConnected,
+}
+
+// NewCallTrackerService creates a new call tracker
+func NewCallTrackerService() *CallTrackerService {
+	return &CallTrackerService{
+		calls:    make(map[string]*TrackedCall),
+		stopChan: make(chan bool),
+	}
+}
+
+// Start subscribes to AMI events and begins tracking calls
+func (s *CallTrackerService) Start() {
+	if s.running {
+		log.Println("Call tracker is already running")
+		return
+	}
+
+	s.subscription = asterisk.Subscribe(asterisk.EventFilter{Types: callTrackerEvents}, 1024)
+	s.running = true
+
+	log.Println("Starting call tracker")
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-s.subscription.Events():
+				if !ok {
+					return
+				}
+				s.handleEvent(event)
+			case <-s.stopChan:
+				s.subscription.Unsubscribe()
+				s.running = false
+				log.Println("Call tracker stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the call tracker
+func (s *CallTrackerService) Stop() {
+	if !s.running {
+		return
+	}
+	s.stopChan <- true
+}
+
+// Calls returns a snapshot of the calls currently tracked
+func (s *CallTrackerService) Calls() []TrackedCall {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	calls := make([]TrackedCall, 0, len(s.calls))
+	for _, call := range s.calls {
+		calls = append(calls, call.snapshot())
+	}
+	return calls
+}
+
+// GetCall returns the tracked state of a call by Linkedid
+func (s *CallTrackerService) GetCall(linkedid string) (TrackedCall, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	call, ok := s.calls[linkedid]
+	if !ok {
+		return TrackedCall{}, false
+	}
+	return call.snapshot(), true
+}
+
+// snapshot copies a call so it can be read once s.mutex is released. The
+// caller must hold s.mutex.
+func (call *TrackedCall) snapshot() TrackedCall {
+	copied := *call
+	copied.Legs = make(map[string]string, len(call.Legs))
+	for uniqueid, channel := range call.Legs {
+		copied.Legs[uniqueid] = channel
+	}
+	return copied
+}
+
+// handleEvent updates call state from a single AMI event
+func (s *CallTrackerService) handleEvent(event asterisk.AMIEvent) {
+	f := event.Fields
+
+	switch event.Type {
+	case asterisk.EventAMIConnected:
+		// Calls may have ended while we were disconnected
+		s.reconcile()
+		return
+
+	case asterisk.EventNewchannel:
+		s.onNewchannel(f)
+
+	case asterisk.EventNewstate:
+		call := s.lookup(f["Linkedid"])
+		if call == nil {
+			return
+		}
+		if f["ChannelStateDesc"] == "Ringing" {
+			s.transitionIf(call, "ringing", "", notStarted)
+		}
+
+	case asterisk.EventDialBegin:
+		call := s.lookup(f["Linkedid"])
+		if call == nil {
+			return
+		}
+		s.mutex.Lock()
+		// Once answered, further dials are consultation calls of an
+		// attended transfer, unless a blind transfer is ringing its target
+		if call.AnswerTime == nil || call.State == "transferring" {
+			call.CalleeChannel = f["DestChannel"]
+			if ext := asterisk.ExtensionFromChannel(f["DestChannel"]); ext != "" {
+				call.CalleeExtension = ext
+			}
+		}
+		s.mutex.Unlock()
+		s.transitionIf(call, "ringing", "", notStarted)
+
+	case asterisk.EventDialEnd:
+		call := s.lookup(f["Linkedid"])
+		if call == nil {
+			return
+		}
+		status := f["DialStatus"]
+		if status != "" {
+			s.mutex.Lock()
+			call.Disposition = asterisk.DispositionFromDialStatus(status)
+			s.mutex.Unlock()
+		}
+		switch status {
+		case "ANSWER":
+			s.answer(call)
+		case "":
+		default:
+			// BUSY, NOANSWER, CHANUNAVAIL, CONGESTION, CANCEL... A failed
+			// transfer leg does not fail a call that was already answered.
+			s.transitionIf(call, "failed", strings.ToLower(status), notAnswered)
+		}
+
+	case asterisk.EventBridgeEnter:
+		call := s.lookup(f["Linkedid"])
+		if call != nil {
+			s.answer(call)
+		}
+
+	case asterisk.EventHangup:
+		s.onHangup(f)
+
+	case asterisk.EventHold, asterisk.EventUnhold:
+		s.onHold(f, event.Type == asterisk.EventHold)
+	}
+}
+
+// onHold records a phone putting a call on hold or taking it off hold
+func (s *CallTrackerService) onHold(f map[string]string, held bool) {
+	db := database.GetDB()
+
+	var activeCall models.ActiveCall
+	if err := db.Preload("Caller").Preload("Callee").Where("linkedid = ?", f["Linkedid"]).First(&activeCall).Error; err != nil {
+		return
+	}
+
+	var changed bool
+	var err error
+	if held {
+		changed, err = PutOnHold(activeCall, asterisk.ExtensionFromChannel(f["Channel"]))
+	} else {
+		_, changed, err = TakeOffHold(activeCall)
+	}
+	if err != nil {
+		log.Printf("[TRACKER] Failed to record hold state of call %s: %v", activeCall.Linkedid, err)
+		return
+	}
+	if !changed {
+		// Already recorded, e.g. through the REST API
+		return
+	}
+
+	var updated models.ActiveCall
+	db.First(&updated, activeCall.ID)
+	log.Printf("[TRACKER] Call %s is now %s (held by %s)", activeCall.Linkedid, updated.Status, updated.HeldBy)
+
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyCallHold(activeCall.Caller.Extension, activeCall.Callee.Extension,
+			updated.Status, activeCall.Channel, updated.HeldBy, HoldSeconds(updated))
+	}
+}
+
+// onNewchannel starts tracking a call or adds a leg to one
+func (s *CallTrackerService) onNewchannel(f map[string]string) {
+	linkedid := f["Linkedid"]
+	if linkedid == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	call, exists := s.calls[linkedid]
+	if !exists {
+		call = &TrackedCall{
+			Linkedid:        linkedid,
+			CallerExtension: asterisk.ExtensionFromChannel(f["Channel"]),
+			CalleeExtension: f["Exten"],
+			CallerChannel:   f["Channel"],
+			StartTime:       time.Now(),
+			Legs:            make(map[string]string),
+		}
+		if call.CallerExtension == "" {
+			call.CallerExtension = f["CallerIDNum"]
+		}
+		s.calls[linkedid] = call
+	} else if f["Uniqueid"] != linkedid && call.CalleeChannel == "" {
+		call.CalleeChannel = f["Channel"]
+		if ext := asterisk.ExtensionFromChannel(f["Channel"]); ext != "" {
+			call.CalleeExtension = ext
+		}
+	}
+	call.Legs[f["Uniqueid"]] = f["Channel"]
+	snapshot := call.snapshot()
+	s.mutex.Unlock()
+
+	if !exists {
+		s.bindActiveCall(snapshot)
+	}
+}
+
+// onHangup removes a leg and finishes the call once every leg is gone
+func (s *CallTrackerService) onHangup(f map[string]string) {
+	s.mutex.Lock()
+	call, ok := s.calls[f["Linkedid"]]
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	delete(call.Legs, f["Uniqueid"])
+	remaining := len(call.Legs)
+	if call.HangupCause == 0 {
+		call.HangupCause, _ = strconv.Atoi(f["Cause"])
+	}
+	s.mutex.Unlock()
+
+	s.transitionIf(call, "failed", strings.ToLower(f["Cause-txt"]), notAnswered)
+
+	if remaining == 0 {
+		s.finish(call)
+	}
+}
+
+// lookup returns the tracked call for a Linkedid
+func (s *CallTrackerService) lookup(linkedid string) *TrackedCall {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.calls[linkedid]
+}
+
+// answer marks a call as answered once, or again when the target of a
+// blind transfer picks up
+func (s *CallTrackerService) answer(call *TrackedCall) {
+	s.transitionIf(call, "answered", "", func(call *TrackedCall) bool {
+		if call.AnswerTime != nil && call.State != "transferring" {
+			return false
+		}
+		if call.AnswerTime == nil {
+			now := time.Now()
+			call.AnswerTime = &now
+		}
+		return true
+	})
+}
+
+// notStarted allows a transition of a call not yet ringing
+func notStarted(call *TrackedCall) bool {
+	return call.State == ""
+}
+
+// notAnswered allows a transition of a call never answered. A failed
+// transfer leg does not fail a call that was already answered.
+func notAnswered(call *TrackedCall) bool {
+	return call.AnswerTime == nil
+}
+
+// Transfer records that a call now connects different parties. After a
+// blind transfer the call rings the target again, so ringing is true and the
+// call is reported as answered once the target picks up.
+func (s *CallTrackerService) Transfer(linkedid, callerExtension, calleeExtension, callerChannel, calleeChannel string, ringing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	call, ok := s.calls[linkedid]
+	if !ok {
+		return
+	}
+	call.CallerExtension = callerExtension
+	call.CalleeExtension = calleeExtension
+	call.CallerChannel = callerChannel
+	call.CalleeChannel = calleeChannel
+	if ringing {
+		call.State = "transferring"
+	} else if call.AnswerTime != nil {
+		call.State = "answered"
+	}
+}
+
+// transitionIf records a new call state in the database and notifies both
+// parties, for calls allow accepts. allow runs under s.mutex, as Transfer
+// changes calls from request goroutines, and may update the call along with
+// its state.
+func (s *CallTrackerService) transitionIf(tracked *TrackedCall, state, reason string, allow func(*TrackedCall) bool) {
+	s.mutex.Lock()
+	if tracked.State == state || tracked.State == "ended" || (allow != nil && !allow(tracked)) {
+		s.mutex.Unlock()
+		return
+	}
+	tracked.State = state
+	tracked.Reason = reason
+	call := tracked.snapshot()
+	s.mutex.Unlock()
+
+	log.Printf("[TRACKER] Call %s (%s -> %s) is now %s %s",
+		call.Linkedid, call.CallerExtension, call.CalleeExtension, state, reason)
+
+	db := database.GetDB()
+	activeUpdates := map[string]interface{}{
+		"caller_channel": call.CallerChannel,
+		"callee_channel": call.CalleeChannel,
+	}
+	logUpdates := map[string]interface{}{}
+
+	switch state {
+	case "ringing":
+		activeUpdates["status"] = "ringing"
+		logUpdates["status"] = "ringing"
+	case "answered":
+		activeUpdates["status"] = "connected"
+		activeUpdates["answer_time"] = call.AnswerTime
+		logUpdates["status"] = "answered"
+		logUpdates["answer_time"] = call.AnswerTime
+	case "failed":
+		logUpdates["status"] = "failed"
+	}
+
+	db.Model(&models.ActiveCall{}).Where("linkedid = ?", call.Linkedid).Updates(activeUpdates)
+	if len(logUpdates) > 0 {
+		db.Model(&models.CallLog{}).Where("linkedid = ? AND cdr_imported = ?", call.Linkedid, false).Updates(logUpdates)
+	}
+
+	status := state
+	if state == "answered" {
+		// The frontend already understands "connected" from the answer flow
+		status = "connected"
+	}
+	s.notify(call, status)
+}
+
+// finish writes the final state of a call and stops tracking it
+func (s *CallTrackerService) finish(tracked *TrackedCall) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	tracked.EndTime = &now
+	finalState := "ended"
+	if tracked.AnswerTime == nil {
+		finalState = "failed"
+	}
+	tracked.State = finalState
+	delete(s.calls, tracked.Linkedid)
+	call := tracked.snapshot()
+	s.mutex.Unlock()
+
+	disposition := call.Disposition
+	if disposition == "" {
+		disposition = asterisk.DispositionNoAnswer
+		if call.AnswerTime != nil {
+			disposition = asterisk.DispositionAnswered
+		}
+	}
+
+	// These are estimates: the CDR, if Asterisk sends one, replaces them
+	updates := estimatedEndUpdates(call.StartTime, call.AnswerTime, now)
+	updates["disposition"] = disposition
+
+	db := database.GetDB()
+	db.Model(&models.CallLog{}).Where("linkedid = ? AND cdr_imported = ?", call.Linkedid, false).Updates(updates)
+	if call.HangupCause != 0 {
+		db.Model(&models.CallLog{}).Where("linkedid = ? AND hangup_cause = 0", call.Linkedid).Updates(map[string]interface{}{
+			"hangup_cause":      call.HangupCause,
+			"hangup_cause_text": asterisk.HangupCauseText(call.HangupCause),
+		})
+	}
+	// A hold still in progress counts towards the call's hold time, and the
+	// parties can no longer signal each other about the call
+	var activeCall models.ActiveCall
+	if err := db.Where("linkedid = ?", call.Linkedid).First(&activeCall).Error; err == nil {
+		TakeOffHold(activeCall)
+		if hub := websocket.GetHub(); hub != nil {
+			hub.EndCallSession(call.Linkedid)
+		}
+	}
+	db.Where("linkedid = ?", call.Linkedid).Delete(&models.ActiveCall{})
+
+	log.Printf("[TRACKER] Call %s finished: %s after %ds, billed %ds (reason: %s)",
+		call.Linkedid, finalState, updates["duration"], updates["billsec"], call.Reason)
+
+	s.notify(call, "ended")
+}
+
+// bindActiveCall attaches a new AMI call to the ActiveCall created by the
+// REST API, or creates ActiveCall and CallLog rows for calls placed directly
+// from a phone
+func (s *CallTrackerService) bindActiveCall(call TrackedCall) {
+	db := database.GetDB()
+
+	var activeCall models.ActiveCall
+	err := db.Where("linkedid = ?", call.Linkedid).First(&activeCall).Error
+	if err == nil {
+		return
+	}
+	if err != gorm.ErrRecordNotFound {
+		log.Printf("[TRACKER] Failed to look up active call %s: %v", call.Linkedid, err)
+		return
+	}
+
+	var caller, callee models.User
+	if db.Where("extension = ?", call.CallerExtension).First(&caller).Error != nil ||
+		db.Where("extension = ?", call.CalleeExtension).First(&callee).Error != nil {
+		// Not a call between two known users (e.g. a queue or conference)
+		return
+	}
+
+	activeCall = models.ActiveCall{
+		CallerID:      caller.ID,
+		CalleeID:      &callee.ID,
+		Channel:       call.CallerChannel,
+		Linkedid:      call.Linkedid,
+		CallerChannel: call.CallerChannel,
+		Status:        "ringing",
+		StartTime:     call.StartTime,
+	}
+	if err := db.Create(&activeCall).Error; err != nil {
+		log.Printf("[TRACKER] Failed to create active call for %s: %v", call.Linkedid, err)
+	}
+
+	callLog := models.CallLog{
+		CallerID:  caller.ID,
+		CalleeID:  &callee.ID,
+		StartTime: call.StartTime,
+		Status:    "initiated",
+		Channel:   call.CallerChannel,
+		Linkedid:  call.Linkedid,
+		Direction: "outbound",
+	}
+	if err := db.Create(&callLog).Error; err != nil {
+		log.Printf("[TRACKER] Failed to create call log for %s: %v", call.Linkedid, err)
+	}
+}
+
+// notify pushes a call_status message to both parties and updates their
+// presence
+func (s *CallTrackerService) notify(call TrackedCall, status string) {
+	if presence := GetPresenceService(); presence != nil {
+		presence.CallChanged(call.Linkedid, call.CallerExtension, call.CalleeExtension, status, false)
+	}
+
+	hub := websocket.GetHub()
+	if hub == nil || call.CallerExtension == "" || call.CalleeExtension == "" {
+		return
+	}
+
+	// Use the channel the clients were given by the REST API if there is one
+	channel := call.CallerChannel
+	var activeCall models.ActiveCall
+	if err := database.GetDB().Where("linkedid = ?", call.Linkedid).First(&activeCall).Error; err == nil && activeCall.Channel != "" {
+		channel = activeCall.Channel
+	} else {
+		var callLog models.CallLog
+		if err := database.GetDB().Where("linkedid = ?", call.Linkedid).First(&callLog).Error; err == nil && callLog.Channel != "" {
+			channel = callLog.Channel
+		}
+	}
+
+	hub.NotifyCallStatus(call.CallerExtension, call.CalleeExtension, status, channel, call.Linkedid)
+}
+
+// reconcile finishes tracked calls whose channels no longer exist in
+// Asterisk, which happens when hangups occur while AMI is disconnected
+func (s *CallTrackerService) reconcile() {
+	channels, err := asterisk.ListChannels()
+	if err != nil {
+		log.Printf("[TRACKER] Failed to reconcile calls: %v", err)
+		return
+	}
+
+	live := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		live[channel.Uniqueid] = true
+	}
+
+	s.mutex.Lock()
+	var finished []*TrackedCall
+	for _, call := range s.calls {
+		for uniqueid := range call.Legs {
+			if !live[uniqueid] {
+				delete(call.Legs, uniqueid)
+			}
+		}
+		if len(call.Legs) == 0 {
+			finished = append(finished, call)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, call := range finished {
+		s.finish(call)
+	}
+
+	if len(finished) > 0 {
+		log.Printf("[TRACKER] Reconciled %d calls that ended while AMI was disconnected", len(finished))
+	}
+}
+
+// Global instance
+var globalCallTracker *CallTrackerService
+
+// InitCallTracker initializes and starts the global call tracker
+func InitCallTracker() {
+	globalCallTracker = NewCallTrackerService()
+	globalCallTracker.Start()
+}
+
+// GetCallTracker returns the global call tracker instance
+func GetCallTracker() *CallTrackerService {
+	return globalCallTracker
+}
+
+// StopCallTracker stops the global call tracker
+func StopCallTracker() {
+	if globalCallTracker != nil {
+		globalCallTracker.Stop()
+	}
+}
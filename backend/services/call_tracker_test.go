@@ -0,0 +1,85 @@
+package services
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"voip-backend/asterisk"
+	"voip-backend/config"
+	"voip-backend/database"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "services-test")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	config.AppConfig = &config.Config{DBPath: filepath.Join(dir, "test.db")}
+	database.InitDatabase()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// event builds an AMI event of a call
+func event(eventType, linkedid string, fields map[string]string) asterisk.AMIEvent {
+	fields["Linkedid"] = linkedid
+	return asterisk.AMIEvent{Type: eventType, Fields: fields}
+}
+
+func TestTransferDuringEvents(t *testing.T) {
+	tracker := NewCallTrackerService()
+	tracker.handleEvent(event(asterisk.EventNewchannel, "1700000000.1", map[string]string{
+		"Channel": "PJSIP/1001-00000001", "Uniqueid": "1700000000.1", "Exten": "1002",
+	}))
+	tracker.handleEvent(event(asterisk.EventDialBegin, "1700000000.1", map[string]string{
+		"DestChannel": "PJSIP/1002-00000002",
+	}))
+	tracker.handleEvent(event(asterisk.EventDialEnd, "1700000000.1", map[string]string{
+		"DialStatus": "ANSWER",
+	}))
+
+	// Transfers come from request goroutines while AMI events keep arriving
+	started, done := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			tracker.Transfer("1700000000.1", "1001", "1003", "PJSIP/1001-00000001", "PJSIP/1003-00000003", i%2 == 0)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 200; i++ {
+		tracker.handleEvent(event(asterisk.EventNewstate, "1700000000.1", map[string]string{"ChannelStateDesc": "Ringing"}))
+		tracker.handleEvent(event(asterisk.EventDialEnd, "1700000000.1", map[string]string{"DialStatus": "BUSY"}))
+		tracker.handleEvent(event(asterisk.EventBridgeEnter, "1700000000.1", map[string]string{}))
+	}
+	close(done)
+	wg.Wait()
+
+	// An answered call never fails on a failed transfer leg
+	call, ok := tracker.GetCall("1700000000.1")
+	if !ok {
+		t.Fatal("the call is no longer tracked")
+	}
+	if call.State == "failed" {
+		t.Errorf("state = %s after a failed transfer leg", call.State)
+	}
+
+	tracker.handleEvent(event(asterisk.EventHangup, "1700000000.1", map[string]string{"Uniqueid": "1700000000.1", "Cause": "16"}))
+	if _, ok := tracker.GetCall("1700000000.1"); ok {
+		t.Error("the call is still tracked after its last leg hung up")
+	}
+}
@@ -0,0 +1,385 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/models"
+
+	"gorm.io/gorm"
+)
+
+// Outcomes of applying a CDR to the call logs
+const (
+	CDRUpdated   = "updated"
+	CDRCreated   = "created"
+	CDRDuplicate = "duplicate"
+	CDRSkipped   = "skipped"
+)
+
+// CDRImportResult summarises a batch of applied CDRs
+type CDRImportResult struct {
+	Processed  int      `json:"processed"`
+	Updated    int      `json:"updated"`
+	Created    int      `json:"created"`
+	Duplicates int      `json:"duplicates"`
+	Skipped    int      `json:"skipped"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// add records the outcome of a single CDR
+func (r *CDRImportResult) add(outcome string, err error) {
+	r.Processed++
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return
+	}
+	switch outcome {
+	case CDRUpdated:
+		r.Updated++
+	case CDRCreated:
+		r.Created++
+	case CDRDuplicate:
+		r.Duplicates++
+	default:
+		r.Skipped++
+	}
+}
+
+// CDRIngestService applies Cdr and CEL events from AMI to the call logs, so
+// durations, dispositions and hangup causes come from Asterisk rather than
+// from when the REST API happened to be called
+type CDRIngestService struct {
+	subscription *asterisk.Subscription
+	stopChan     chan bool
+	running      bool
+	result       CDRImportResult
+	celEvents    int
+	mutex        sync.Mutex
+}
+
+// NewCDRIngestService creates a new CDR ingest service
+func NewCDRIngestService() *CDRIngestService {
+	return &CDRIngestService{
+		stopChan: make(chan bool),
+	}
+}
+
+// Start subscribes to Cdr and CEL events
+func (s *CDRIngestService) Start() {
+	if s.running {
+		log.Println("CDR ingest is already running")
+		return
+	}
+
+	s.subscription = asterisk.Subscribe(asterisk.EventFilter{
+		Types: []string{asterisk.EventCdr, asterisk.EventCEL},
+	}, 1024)
+	s.running = true
+
+	log.Println("Starting CDR ingest")
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-s.subscription.Events():
+				if !ok {
+					return
+				}
+				s.handleEvent(event)
+			case <-s.stopChan:
+				s.subscription.Unsubscribe()
+				s.running = false
+				log.Println("CDR ingest stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the CDR ingest service
+func (s *CDRIngestService) Stop() {
+	if !s.running {
+		return
+	}
+	s.stopChan <- true
+}
+
+// Stats returns counters for diagnostics
+func (s *CDRIngestService) Stats() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return map[string]interface{}{
+		"cdrs":       s.result,
+		"cel_events": s.celEvents,
+	}
+}
+
+// handleEvent applies a single Cdr or CEL event
+func (s *CDRIngestService) handleEvent(event asterisk.AMIEvent) {
+	switch event.Type {
+	case asterisk.EventCdr:
+		record, err := asterisk.ParseCDREvent(event)
+		if err != nil {
+			log.Printf("[CDR] Ignoring malformed Cdr event: %v", err)
+			return
+		}
+		outcome, err := ApplyCDR(record)
+		if err != nil {
+			log.Printf("[CDR] Failed to apply CDR %s: %v", record.Uniqueid, err)
+		} else {
+			log.Printf("[CDR] CDR %s (%s -> %s, %s, billsec %d): %s",
+				record.Uniqueid, record.Source, record.Destination, record.Disposition, record.Billsec, outcome)
+		}
+
+		s.mutex.Lock()
+		s.result.add(outcome, err)
+		s.mutex.Unlock()
+
+	case asterisk.EventCEL:
+		record, err := asterisk.ParseCELEvent(event)
+		if err != nil {
+			log.Printf("[CDR] Ignoring malformed CEL event: %v", err)
+			return
+		}
+		if err := ApplyCEL(record); err != nil {
+			log.Printf("[CDR] Failed to apply CEL %s for %s: %v", record.EventName, record.Linkedid, err)
+		}
+
+		s.mutex.Lock()
+		s.celEvents++
+		s.mutex.Unlock()
+	}
+}
+
+// ApplyCDR reconciles a CDR with the call logs. The call log of the call is
+// found by Uniqueid or Linkedid and its timings are replaced with the CDR's;
+// calls we have no log for are created when both parties are known users.
+// Applying the same CDR twice is a no-op, so CSV files can be replayed.
+func ApplyCDR(record asterisk.CDR) (string, error) {
+	if record.Uniqueid == "" {
+		return CDRSkipped, fmt.Errorf("CDR from %s to %s has no uniqueid", record.Source, record.Destination)
+	}
+
+	db := database.GetDB()
+
+	var callLog models.CallLog
+	err := db.Where("uniqueid = ?", record.Uniqueid).
+		Or("linkedid IN ?", []string{record.CallID(), record.Uniqueid}).
+		Order("id").First(&callLog).Error
+	if err == gorm.ErrRecordNotFound {
+		return createCallLogFromCDR(record)
+	}
+	if err != nil {
+		return CDRSkipped, err
+	}
+
+	if callLog.CDRImported {
+		if callLog.Uniqueid == record.Uniqueid {
+			return CDRDuplicate, nil
+		}
+		return extendCallLogWithCDR(callLog, record)
+	}
+
+	updates := cdrUpdates(record)
+	if callLog.Linkedid == "" {
+		updates["linkedid"] = record.CallID()
+	}
+	if callLog.Channel != "" {
+		// Keep the channel the clients were given by the REST API
+		delete(updates, "channel")
+	}
+	if err := db.Model(&callLog).Updates(updates).Error; err != nil {
+		return CDRSkipped, err
+	}
+	return CDRUpdated, nil
+}
+
+// ApplyCEL records what a CEL event adds to the CDR: the hangup cause, and
+// the end of calls whose CDR has not arrived
+func ApplyCEL(record asterisk.CEL) error {
+	if record.Linkedid == "" {
+		return nil
+	}
+
+	db := database.GetDB()
+
+	switch record.EventName {
+	case "HANGUP":
+		if record.HangupCause == 0 {
+			return nil
+		}
+		// The first leg to hang up determines why the call ended
+		return db.Model(&models.CallLog{}).
+			Where("linkedid = ? AND hangup_cause = 0", record.Linkedid).
+			Updates(map[string]interface{}{
+				"hangup_cause":      record.HangupCause,
+				"hangup_cause_text": asterisk.HangupCauseText(record.HangupCause),
+			}).Error
+
+	case "LINKEDID_END":
+		var callLog models.CallLog
+		err := db.Where("linkedid = ? AND cdr_imported = ? AND end_time IS NULL", record.Linkedid, false).First(&callLog).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return db.Model(&callLog).Updates(estimatedEndUpdates(callLog.StartTime, callLog.AnswerTime, record.EventTime)).Error
+	}
+
+	return nil
+}
+
+// ImportCDRs applies a batch of CDRs, e.g. read from a Master.csv file
+func ImportCDRs(records []asterisk.CDR) CDRImportResult {
+	var result CDRImportResult
+	for _, record := range records {
+		outcome, err := ApplyCDR(record)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", record.Uniqueid, err)
+		}
+		result.add(outcome, err)
+	}
+	return result
+}
+
+// cdrUpdates returns the call log columns taken from a CDR
+func cdrUpdates(record asterisk.CDR) map[string]interface{} {
+	updates := map[string]interface{}{
+		"start_time":   record.StartTime,
+		"answer_time":  record.AnswerTime,
+		"end_time":     record.EndTime,
+		"duration":     record.Duration,
+		"billsec":      record.Billsec,
+		"disposition":  record.Disposition,
+		"uniqueid":     record.Uniqueid,
+		"status":       statusForDisposition(record.Disposition),
+		"cdr_imported": true,
+	}
+	if record.Channel != "" {
+		updates["channel"] = record.Channel
+	}
+	return updates
+}
+
+// extendCallLogWithCDR folds a further CDR of the same call into its log.
+// Asterisk writes one CDR per party pairing, so a transferred call has
+// several; the call lasts until the last of them ends.
+func extendCallLogWithCDR(callLog models.CallLog, record asterisk.CDR) (string, error) {
+	if callLog.EndTime != nil && !record.EndTime.After(*callLog.EndTime) {
+		// Already covered, e.g. when a CSV file is replayed
+		return CDRDuplicate, nil
+	}
+
+	updates := map[string]interface{}{
+		"end_time": record.EndTime,
+		"duration": int(record.EndTime.Sub(callLog.StartTime).Seconds()),
+		"billsec":  callLog.Billsec + record.Billsec,
+		"status":   statusForDisposition(callLog.Disposition),
+	}
+	if record.Disposition == asterisk.DispositionAnswered && callLog.Disposition != asterisk.DispositionAnswered {
+		updates["disposition"] = asterisk.DispositionAnswered
+		updates["status"] = statusForDisposition(asterisk.DispositionAnswered)
+		updates["answer_time"] = record.AnswerTime
+	}
+
+	if err := database.GetDB().Model(&callLog).Updates(updates).Error; err != nil {
+		return CDRSkipped, err
+	}
+	return CDRUpdated, nil
+}
+
+// createCallLogFromCDR creates the log of a call we did not see, such as one
+// made while the backend was down
+func createCallLogFromCDR(record asterisk.CDR) (string, error) {
+	db := database.GetDB()
+
+	callerExtension := asterisk.ExtensionFromChannel(record.Channel)
+	if callerExtension == "" {
+		callerExtension = record.Source
+	}
+	calleeExtension := asterisk.ExtensionFromChannel(record.DestinationChannel)
+	if calleeExtension == "" {
+		calleeExtension = record.Destination
+	}
+
+	var caller, callee models.User
+	if db.Where("extension = ?", callerExtension).First(&caller).Error != nil ||
+		db.Where("extension = ?", calleeExtension).First(&callee).Error != nil {
+		// Not a call between two known users (e.g. voicemail or a queue)
+		return CDRSkipped, nil
+	}
+
+	endTime := record.EndTime
+	callLog := models.CallLog{
+		CallerID:    caller.ID,
+		CalleeID:    &callee.ID,
+		StartTime:   record.StartTime,
+		AnswerTime:  record.AnswerTime,
+		EndTime:     &endTime,
+		Duration:    record.Duration,
+		Billsec:     record.Billsec,
+		Status:      statusForDisposition(record.Disposition),
+		Channel:     record.Channel,
+		Linkedid:    record.CallID(),
+		Uniqueid:    record.Uniqueid,
+		Direction:   "outbound",
+		Disposition: record.Disposition,
+		CDRImported: true,
+	}
+	if err := db.Create(&callLog).Error; err != nil {
+		return CDRSkipped, err
+	}
+	return CDRCreated, nil
+}
+
+// estimatedEndUpdates returns the end of call columns we can work out
+// ourselves until Asterisk's CDR arrives
+func estimatedEndUpdates(startTime time.Time, answerTime *time.Time, endTime time.Time) map[string]interface{} {
+	updates := map[string]interface{}{
+		"end_time": endTime,
+		"duration": int(endTime.Sub(startTime).Seconds()),
+		"billsec":  0,
+		"status":   "failed",
+	}
+	if answerTime != nil {
+		updates["billsec"] = int(endTime.Sub(*answerTime).Seconds())
+		updates["status"] = "ended"
+	}
+	return updates
+}
+
+// statusForDisposition maps a CDR disposition onto a call log status
+func statusForDisposition(disposition string) string {
+	if disposition == asterisk.DispositionAnswered {
+		return "ended"
+	}
+	return "failed"
+}
+
+// Global instance
+var globalCDRIngest *CDRIngestService
+
+// InitCDRIngest initializes and starts the CDR ingest service
+func InitCDRIngest() {
+	globalCDRIngest = NewCDRIngestService()
+	globalCDRIngest.Start()
+}
+
+// GetCDRIngest returns the global CDR ingest service instance
+func GetCDRIngest() *CDRIngestService {
+	return globalCDRIngest
+}
+
+// StopCDRIngest stops the global CDR ingest service
+func StopCDRIngest() {
+	if globalCDRIngest != nil {
+		globalCDRIngest.Stop()
+	}
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/websocket"
+)
+
+// conferenceState is the live state of a ConfBridge conference
+type conferenceState struct {
+	locked       bool
+	participants map[string]*asterisk.ConferenceParticipant // by channel
+}
+
+// ConferenceService follows ConfBridge conferences from AMI events and
+// pushes their participant lists to the people in or moderating each room
+type ConferenceService struct {
+	subscription *asterisk.Subscription
+	conferences  map[string]*conferenceState
+	mutex        sync.RWMutex
+	stopChan     chan bool
+	running      bool
+}
+
+// conferenceEvents are the AMI events the conference service consumes
+var conferenceEvents = []string{
+	asterisk.EventConfbridgeJoin,
+	asterisk.EventConfbridgeLeave,
+	asterisk.EventConfbridgeMute,
+	asterisk.EventConfbridgeUnmute,
+	asterisk.EventConfbridgeLock,
+	asterisk.EventConfbridgeUnlock,
+	asterisk.EventConfbridgeEnd,
+	asterisk.EventAMIConnected,
+}
+
+// NewConferenceService creates a new conference service
+func NewConferenceService() *ConferenceService {
+	return &ConferenceService{
+		conferences: make(map[string]*conferenceState),
+		stopChan:    make(chan bool),
+	}
+}
+
+// Start subscribes to ConfBridge events
+func (s *ConferenceService) Start() {
+	if s.running {
+		log.Println("Conference service is already running")
+		return
+	}
+
+	s.subscription = asterisk.Subscribe(asterisk.EventFilter{Types: conferenceEvents}, 256)
+	s.running = true
+
+	log.Println("Starting conference service")
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-s.subscription.Events():
+				if !ok {
+					return
+				}
+				s.handleEvent(event)
+			case <-s.stopChan:
+				s.subscription.Unsubscribe()
+				s.running = false
+				log.Println("Conference service stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the conference service
+func (s *ConferenceService) Stop() {
+	if !s.running {
+		return
+	}
+	s.stopChan <- true
+}
+
+// Participants returns the channels in a conference, in the order they joined
+func (s *ConferenceService) Participants(conference string) []asterisk.ConferenceParticipant {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	state, ok := s.conferences[conference]
+	if !ok {
+		return []asterisk.ConferenceParticipant{}
+	}
+
+	participants := make([]asterisk.ConferenceParticipant, 0, len(state.participants))
+	for _, participant := range state.participants {
+		participants = append(participants, *participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].JoinedAt.Before(participants[j].JoinedAt)
+	})
+	return participants
+}
+
+// Participant returns a channel in a conference
+func (s *ConferenceService) Participant(conference, channel string) (asterisk.ConferenceParticipant, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if state, ok := s.conferences[conference]; ok {
+		if participant, ok := state.participants[channel]; ok {
+			return *participant, true
+		}
+	}
+	return asterisk.ConferenceParticipant{}, false
+}
+
+// IsLocked reports whether a conference is locked
+func (s *ConferenceService) IsLocked(conference string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	state, ok := s.conferences[conference]
+	return ok && state.locked
+}
+
+// SetLocked records the lock state after a successful ConfbridgeLock or
+// ConfbridgeUnlock, for Asterisk versions that do not raise events for them
+func (s *ConferenceService) SetLocked(conference string, locked bool) {
+	s.update(conference, func(state *conferenceState) bool {
+		changed := state.locked != locked
+		state.locked = locked
+		return changed
+	}, lockEvent(locked), nil)
+}
+
+// SetMuted records the mute state of a participant after a successful
+// ConfbridgeMute or ConfbridgeUnmute
+func (s *ConferenceService) SetMuted(conference, channel string, muted bool) {
+	s.setMuted(conference, channel, muted)
+}
+
+// handleEvent updates conference state from a single AMI event
+func (s *ConferenceService) handleEvent(event asterisk.AMIEvent) {
+	f := event.Fields
+	conference := f["Conference"]
+
+	switch event.Type {
+	case asterisk.EventAMIConnected:
+		// Conferences may have changed while we were disconnected
+		s.resync()
+
+	case asterisk.EventConfbridgeJoin:
+		participant := asterisk.ParseConferenceParticipant(event)
+		s.update(conference, func(state *conferenceState) bool {
+			state.participants[participant.Channel] = &participant
+			return true
+		}, "joined", &participant)
+
+	case asterisk.EventConfbridgeLeave:
+		participant := asterisk.ParseConferenceParticipant(event)
+		s.update(conference, func(state *conferenceState) bool {
+			if _, ok := state.participants[participant.Channel]; !ok {
+				return false
+			}
+			delete(state.participants, participant.Channel)
+			return true
+		}, "left", &participant)
+
+	case asterisk.EventConfbridgeMute, asterisk.EventConfbridgeUnmute:
+		s.setMuted(conference, f["Channel"], event.Type == asterisk.EventConfbridgeMute)
+
+	case asterisk.EventConfbridgeLock, asterisk.EventConfbridgeUnlock:
+		s.SetLocked(conference, event.Type == asterisk.EventConfbridgeLock)
+
+	case asterisk.EventConfbridgeEnd:
+		s.mutex.Lock()
+		_, ok := s.conferences[conference]
+		delete(s.conferences, conference)
+		s.mutex.Unlock()
+		if ok {
+			s.notify(conference, "ended", nil)
+		}
+	}
+}
+
+// setMuted updates the mute state of a participant
+func (s *ConferenceService) setMuted(conference, channel string, muted bool) {
+	var changedParticipant asterisk.ConferenceParticipant
+	event := "unmuted"
+	if muted {
+		event = "muted"
+	}
+	s.update(conference, func(state *conferenceState) bool {
+		participant, ok := state.participants[channel]
+		if !ok || participant.Muted == muted {
+			return false
+		}
+		participant.Muted = muted
+		changedParticipant = *participant
+		return true
+	}, event, &changedParticipant)
+}
+
+// update applies a change to a conference and notifies the room if it
+// changed anything. Conferences are dropped once their last participant leaves.
+func (s *ConferenceService) update(conference string, change func(state *conferenceState) bool, event string, participant *asterisk.ConferenceParticipant) {
+	if conference == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	state, ok := s.conferences[conference]
+	if !ok {
+		state = &conferenceState{participants: make(map[string]*asterisk.ConferenceParticipant)}
+		s.conferences[conference] = state
+	}
+	changed := change(state)
+	if len(state.participants) == 0 {
+		delete(s.conferences, conference)
+	}
+	s.mutex.Unlock()
+
+	if changed {
+		s.notify(conference, event, participant)
+	}
+}
+
+// notify pushes the participant list of a conference to its participants,
+// owner and moderators
+func (s *ConferenceService) notify(conference, event string, participant *asterisk.ConferenceParticipant) {
+	hub := websocket.GetHub()
+	if hub == nil {
+		return
+	}
+
+	participants := s.Participants(conference)
+	recipients := make(map[string]bool)
+	for _, p := range participants {
+		recipients[p.Extension] = true
+	}
+	if participant != nil && participant.Extension != "" {
+		recipients[participant.Extension] = true
+	}
+
+	msg := protocol.ConferenceParticipants{
+		Conference:   conference,
+		Event:        event,
+		Locked:       s.IsLocked(conference),
+		Participants: participants,
+	}
+	if participant != nil {
+		msg.Participant = participant
+	}
+
+	var room models.ConferenceRoom
+	if err := database.GetDB().Preload("Owner").Preload("Moderators").
+		Where("number = ?", conference).First(&room).Error; err == nil {
+		msg.RoomID = room.ID
+		msg.Name = room.Name
+		recipients[room.Owner.Extension] = true
+		for _, moderator := range room.Moderators {
+			recipients[moderator.Extension] = true
+		}
+	}
+
+	log.Printf("[CONFERENCE] %s: %s (%d participants)", conference, event, len(participants))
+
+	extensions := make([]string, 0, len(recipients))
+	for extension := range recipients {
+		if extension != "" {
+			extensions = append(extensions, extension)
+		}
+	}
+	hub.NotifyConference(extensions, msg)
+}
+
+// resync rebuilds the state of every conference from ConfbridgeListRooms
+// and ConfbridgeList after (re)connecting to AMI
+func (s *ConferenceService) resync() {
+	rooms, err := asterisk.ListConferenceRooms()
+	if err != nil {
+		log.Printf("[CONFERENCE] Failed to list conferences: %v", err)
+		return
+	}
+
+	conferences := make(map[string]*conferenceState, len(rooms))
+	for _, room := range rooms {
+		participants, err := asterisk.ListConferenceParticipants(room.Conference)
+		if err != nil {
+			log.Printf("[CONFERENCE] Failed to list participants of %s: %v", room.Conference, err)
+			continue
+		}
+		state := &conferenceState{
+			locked:       room.Locked,
+			participants: make(map[string]*asterisk.ConferenceParticipant, len(participants)),
+		}
+		for i := range participants {
+			state.participants[participants[i].Channel] = &participants[i]
+		}
+		conferences[room.Conference] = state
+	}
+
+	s.mutex.Lock()
+	var ended []string
+	for conference := range s.conferences {
+		if _, ok := conferences[conference]; !ok {
+			ended = append(ended, conference)
+		}
+	}
+	s.conferences = conferences
+	s.mutex.Unlock()
+
+	for _, conference := range ended {
+		s.notify(conference, "ended", nil)
+	}
+	for conference := range conferences {
+		s.notify(conference, "synced", nil)
+	}
+}
+
+// lockEvent names the notification for a lock change
+func lockEvent(locked bool) string {
+	if locked {
+		return "locked"
+	}
+	return "unlocked"
+}
+
+// Global instance
+var globalConferenceService *ConferenceService
+
+// InitConferenceService initializes and starts the conference service
+func InitConferenceService() {
+	globalConferenceService = NewConferenceService()
+	globalConferenceService.Start()
+}
+
+// GetConferenceService returns the global conference service instance
+func GetConferenceService() *ConferenceService {
+	return globalConferenceService
+}
+
+// StopConferenceService stops the global conference service
+func StopConferenceService() {
+	if globalConferenceService != nil {
+		globalConferenceService.Stop()
+	}
+}
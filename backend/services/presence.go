@@ -0,0 +1,605 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/websocket"
+)
+
+// Presence states
+const (
+	PresenceAvailable = "available"
+	PresenceOnCall    = "on_call"
+	PresenceRinging   = "ringing"
+	PresenceAway      = "away"
+	PresenceDND       = "dnd"
+	PresenceOffline   = "offline"
+)
+
+const (
+	// A REST heartbeat keeps a user reachable this long; the frontend sends
+	// one every 30 seconds
+	presenceHeartbeatTimeout = 90 * time.Second
+
+	// How often heartbeats are expired and WebSocket state is checked
+	// against the hub
+	presenceSweepInterval = 30 * time.Second
+)
+
+// UserPresence is everything the presence service knows about a user
+type UserPresence struct {
+	UserID        uint       `json:"user_id"`
+	Username      string     `json:"username"`
+	Extension     string     `json:"extension"`
+	State         string     `json:"state"`
+	Since         time.Time  `json:"since"`         // when State was entered
+	ManualStatus  string     `json:"manual_status"` // available, away, dnd or offline
+	WSConnected   bool       `json:"ws_connected"`
+	SIPRegistered bool       `json:"sip_registered"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	Calls         int        `json:"calls"`
+
+	contacts map[string]bool          // reachable PJSIP contact URIs
+	calls    map[string]*presenceCall // by call ID
+}
+
+// presenceCall is the user's side of a call
+type presenceCall struct {
+	ringing bool // the user is being called and has not answered
+	webrtc  bool // a WebRTC-direct call, which ends with the user's browser
+}
+
+// PresenceService computes each user's presence from their WebSocket
+// connections, REST heartbeats, PJSIP registrations and calls, stores it on
+// the user with every transition, and broadcasts user_status_changed. It is
+// the only place presence changes.
+type PresenceService struct {
+	subscription *asterisk.Subscription
+	users        map[string]*UserPresence // by extension
+	mutex        sync.Mutex
+	stopChan     chan bool
+	running      bool
+}
+
+// presenceEvents are the AMI events the presence service consumes
+var presenceEvents = []string{
+	asterisk.EventContactStatus,
+	asterisk.EventAMIConnected,
+}
+
+// NewPresenceService creates a new presence service
+func NewPresenceService() *PresenceService {
+	return &PresenceService{
+		users:    make(map[string]*UserPresence),
+		stopChan: make(chan bool),
+	}
+}
+
+// Start loads the users, settles their presence and follows AMI events
+func (s *PresenceService) Start() {
+	if s.running {
+		log.Println("Presence service is already running")
+		return
+	}
+
+	var users []models.User
+	if err := database.GetDB().Find(&users).Error; err != nil {
+		log.Printf("[PRESENCE] Failed to load users: %v", err)
+	}
+	s.mutex.Lock()
+	for i := range users {
+		s.users[users[i].Extension] = newUserPresence(&users[i])
+	}
+	s.mutex.Unlock()
+
+	// Nobody is connected to a server that just started
+	s.sweep()
+
+	s.subscription = asterisk.Subscribe(asterisk.EventFilter{Types: presenceEvents}, 256)
+	s.running = true
+
+	log.Printf("[PRESENCE] Starting presence service for %d users", len(users))
+
+	go func() {
+		ticker := time.NewTicker(presenceSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event, ok := <-s.subscription.Events():
+				if !ok {
+					return
+				}
+				s.handleEvent(event)
+			case <-ticker.C:
+				s.sweep()
+			case <-s.stopChan:
+				s.subscription.Unsubscribe()
+				s.running = false
+				log.Println("[PRESENCE] Presence service stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the presence service
+func (s *PresenceService) Stop() {
+	if !s.running {
+		return
+	}
+	s.stopChan <- true
+}
+
+// List returns the presence of every user, by extension
+func (s *PresenceService) List() []UserPresence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list := make([]UserPresence, 0, len(s.users))
+	for _, presence := range s.users {
+		list = append(list, presence.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Extension < list[j].Extension })
+	return list
+}
+
+// Get returns the presence of an extension's user
+func (s *PresenceService) Get(extension string) (UserPresence, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	presence := s.lookupLocked(extension)
+	if presence == nil {
+		return UserPresence{}, false
+	}
+	return presence.snapshot(), true
+}
+
+// Statuses returns the current presence of extensions as user_status_changed
+// payloads, or of every user when extensions is nil. Extensions without a
+// user are left out.
+func (s *PresenceService) Statuses(extensions []string) []protocol.UserStatusChanged {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var users []*UserPresence
+	if extensions == nil {
+		for _, presence := range s.users {
+			users = append(users, presence)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Extension < users[j].Extension })
+	} else {
+		for _, extension := range extensions {
+			if presence := s.lookupLocked(extension); presence != nil {
+				users = append(users, presence)
+			}
+		}
+	}
+
+	statuses := make([]protocol.UserStatusChanged, len(users))
+	for i, presence := range users {
+		statuses[i] = presence.status("")
+	}
+	return statuses
+}
+
+// ClientConnected records that a user has a WebSocket (or fallback)
+// connection
+func (s *PresenceService) ClientConnected(extension string) {
+	s.update(extension, "ws_connected", func(p *UserPresence) {
+		p.WSConnected = true
+	})
+}
+
+// ClientDisconnected records that a user's last connection closed and its
+// resume grace period passed. Their WebRTC-direct calls ended with it.
+func (s *PresenceService) ClientDisconnected(extension string) error {
+	s.update(extension, "ws_disconnected", func(p *UserPresence) {
+		p.WSConnected = false
+		for callID, call := range p.calls {
+			if call.webrtc {
+				delete(p.calls, callID)
+			}
+		}
+	})
+	return nil
+}
+
+// Heartbeat records a REST heartbeat from a user
+func (s *PresenceService) Heartbeat(extension string) {
+	s.update(extension, "heartbeat", func(p *UserPresence) {
+		now := time.Now()
+		p.LastHeartbeat = &now
+	})
+}
+
+// LoggedIn records a login, which counts as a heartbeat and ends appearing
+// offline
+func (s *PresenceService) LoggedIn(extension string) {
+	s.update(extension, "login", func(p *UserPresence) {
+		now := time.Now()
+		p.LastHeartbeat = &now
+		if p.ManualStatus == PresenceOffline {
+			p.ManualStatus = PresenceAvailable
+			s.saveManualStatus(p)
+		}
+	})
+}
+
+// LoggedOut records a logout; the user stays online while other
+// connections or a SIP phone keep them reachable
+func (s *PresenceService) LoggedOut(extension string) {
+	s.update(extension, "logout", func(p *UserPresence) {
+		p.LastHeartbeat = nil
+	})
+}
+
+// SetManualStatus records the status a user chose: available, away, dnd or
+// offline, or the older online and busy
+func (s *PresenceService) SetManualStatus(extension, status string) error {
+	status, err := NormalizeStatus(status)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	s.update(extension, "manual", func(p *UserPresence) {
+		found = true
+		if p.ManualStatus != status {
+			p.ManualStatus = status
+			s.saveManualStatus(p)
+		}
+	})
+	if !found {
+		return fmt.Errorf("unknown extension %s", extension)
+	}
+	return nil
+}
+
+// NormalizeStatus checks a status a user may choose, mapping the older
+// online and busy to available and dnd
+func NormalizeStatus(status string) (string, error) {
+	switch status {
+	case "online":
+		return PresenceAvailable, nil
+	case "busy":
+		return PresenceDND, nil
+	case PresenceAvailable, PresenceAway, PresenceDND, PresenceOffline:
+		return status, nil
+	}
+	return "", fmt.Errorf("invalid status %q", status)
+}
+
+// CallChanged records a call between two extensions ringing, being
+// answered or ending (ended, failed). Other states count as answered.
+// Extensions that were parties before, such as the transferor of a
+// transferred call, are no longer on it.
+func (s *PresenceService) CallChanged(callID, caller, callee, state string, webrtc bool) {
+	ended := state == "ended" || state == "failed"
+	reason := "call_" + state
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	parties := make(map[string]bool, 2)
+	if !ended {
+		for _, extension := range []string{caller, callee} {
+			presence := s.lookupLocked(extension)
+			if presence == nil {
+				continue
+			}
+			parties[extension] = true
+			ringing := state == "ringing" && extension == callee
+			presence.calls[callID] = &presenceCall{ringing: ringing, webrtc: webrtc}
+			s.settleLocked(presence, reason)
+		}
+	}
+
+	for extension, presence := range s.users {
+		if _, onCall := presence.calls[callID]; onCall && !parties[extension] {
+			delete(presence.calls, callID)
+			s.settleLocked(presence, reason)
+		}
+	}
+}
+
+// CallSessionChanged follows the WebRTC-direct calls of the hub; the first
+// party is the caller
+func (s *PresenceService) CallSessionChanged(callID string, parties []string, state string) {
+	if len(parties) != 2 {
+		return
+	}
+	s.CallChanged(callID, parties[0], parties[1], state, true)
+}
+
+// Forget drops an extension whose user was deleted or renumbered
+func (s *PresenceService) Forget(extension string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.users, extension)
+}
+
+// handleEvent updates SIP registrations from a single AMI event
+func (s *PresenceService) handleEvent(event asterisk.AMIEvent) {
+	f := event.Fields
+
+	switch event.Type {
+	case asterisk.EventAMIConnected:
+		// Registrations may have changed while we were disconnected
+		s.resyncContacts()
+
+	case asterisk.EventContactStatus:
+		extension := f["EndpointName"]
+		if extension == "" {
+			extension = f["AOR"]
+		}
+		contact := asterisk.Contact{Endpoint: extension, URI: f["URI"], Status: f["ContactStatus"]}
+
+		reachable := contact.IsReachable()
+		reason := "sip_unregistered"
+		if reachable {
+			reason = "sip_registered"
+		}
+		s.update(extension, reason, func(p *UserPresence) {
+			if reachable {
+				p.contacts[contact.URI] = true
+			} else {
+				delete(p.contacts, contact.URI)
+			}
+			p.SIPRegistered = len(p.contacts) > 0
+		})
+	}
+}
+
+// resyncContacts replaces the known registrations with Asterisk's list
+func (s *PresenceService) resyncContacts() {
+	contacts, err := asterisk.ListContacts()
+	if err != nil {
+		log.Printf("[PRESENCE] Failed to list PJSIP contacts: %v", err)
+		return
+	}
+
+	registered := make(map[string]map[string]bool)
+	for _, contact := range contacts {
+		if !contact.IsReachable() {
+			continue
+		}
+		if registered[contact.Endpoint] == nil {
+			registered[contact.Endpoint] = make(map[string]bool)
+		}
+		registered[contact.Endpoint][contact.URI] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for extension, presence := range s.users {
+		presence.contacts = registered[extension]
+		if presence.contacts == nil {
+			presence.contacts = make(map[string]bool)
+		}
+		presence.SIPRegistered = len(presence.contacts) > 0
+		s.settleLocked(presence, "sip_resync")
+	}
+	log.Printf("[PRESENCE] Synced %d PJSIP contacts", len(contacts))
+}
+
+// sweep expires heartbeats and corrects WebSocket state from the hub, which
+// also sees clients connected to other nodes
+func (s *PresenceService) sweep() {
+	hub := websocket.GetHub()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, presence := range s.users {
+		reason := "heartbeat_expired"
+		if hub != nil {
+			connected := hub.IsExtensionOnline(presence.Extension)
+			if connected != presence.WSConnected {
+				presence.WSConnected = connected
+				reason = "ws_disconnected"
+				if connected {
+					reason = "ws_connected"
+				}
+			}
+		}
+		s.settleLocked(presence, reason)
+	}
+}
+
+// update applies a change to an extension's presence and settles it
+func (s *PresenceService) update(extension, reason string, change func(p *UserPresence)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	presence := s.lookupLocked(extension)
+	if presence == nil {
+		return
+	}
+	change(presence)
+	s.settleLocked(presence, reason)
+}
+
+// lookupLocked returns an extension's presence, loading users created since
+// the service started. Returns nil for extensions without a user.
+func (s *PresenceService) lookupLocked(extension string) *UserPresence {
+	if extension == "" {
+		return nil
+	}
+	if presence, exists := s.users[extension]; exists {
+		return presence
+	}
+
+	var user models.User
+	if err := database.GetDB().Where("extension = ?", extension).First(&user).Error; err != nil {
+		return nil
+	}
+	presence := newUserPresence(&user)
+	s.users[extension] = presence
+	return presence
+}
+
+// settleLocked recomputes a user's state and, when it changed, stores the
+// transition and broadcasts it
+func (s *PresenceService) settleLocked(p *UserPresence, reason string) {
+	p.Calls = len(p.calls)
+	state := p.compute()
+	if state == p.State {
+		return
+	}
+
+	from := p.State
+	now := time.Now()
+	p.State = state
+	p.Since = now
+
+	db := database.GetDB()
+	if err := db.Model(&models.User{}).Where("id = ?", p.UserID).Updates(map[string]interface{}{
+		"presence":  state,
+		"status":    LegacyStatus(state),
+		"is_online": state != PresenceOffline,
+		"last_seen": now,
+	}).Error; err != nil {
+		log.Printf("[PRESENCE] Failed to store presence of %s: %v", p.Extension, err)
+	}
+	if err := db.Create(&models.PresenceTransition{
+		UserID: p.UserID,
+		From:   from,
+		To:     state,
+		Reason: reason,
+	}).Error; err != nil {
+		log.Printf("[PRESENCE] Failed to record transition of %s: %v", p.Extension, err)
+	}
+
+	log.Printf("[PRESENCE] %s (%s) is now %s, was %s (%s)", p.Username, p.Extension, state, from, reason)
+
+	if hub := websocket.GetHub(); hub != nil {
+		status := p.status(reason)
+		status.LastSeen = &now
+		hub.NotifyUserStatus(status)
+	}
+}
+
+// saveManualStatus stores the status a user chose
+func (s *PresenceService) saveManualStatus(p *UserPresence) {
+	if err := database.GetDB().Model(&models.User{}).Where("id = ?", p.UserID).
+		Update("manual_status", p.ManualStatus).Error; err != nil {
+		log.Printf("[PRESENCE] Failed to store status of %s: %v", p.Extension, err)
+	}
+}
+
+// compute derives the state. Calls come before the status the user chose,
+// except appearing offline; a user nothing keeps reachable is offline.
+func (p *UserPresence) compute() string {
+	if p.ManualStatus == PresenceOffline {
+		return PresenceOffline
+	}
+
+	ringing := false
+	for _, call := range p.calls {
+		if !call.ringing {
+			return PresenceOnCall
+		}
+		ringing = true
+	}
+	if ringing {
+		return PresenceRinging
+	}
+
+	heartbeat := p.LastHeartbeat != nil && time.Since(*p.LastHeartbeat) < presenceHeartbeatTimeout
+	if !p.WSConnected && !p.SIPRegistered && !heartbeat {
+		return PresenceOffline
+	}
+
+	switch p.ManualStatus {
+	case PresenceAway, PresenceDND:
+		return p.ManualStatus
+	}
+	return PresenceAvailable
+}
+
+// status describes the user's state in a user_status_changed payload
+func (p *UserPresence) status(reason string) protocol.UserStatusChanged {
+	return protocol.UserStatusChanged{
+		UserID:        p.UserID,
+		Username:      p.Username,
+		Extension:     p.Extension,
+		Presence:      p.State,
+		Status:        LegacyStatus(p.State),
+		IsOnline:      p.State != PresenceOffline,
+		SIPRegistered: p.SIPRegistered,
+		Reason:        reason,
+	}
+}
+
+// snapshot copies the exported fields
+func (p *UserPresence) snapshot() UserPresence {
+	snapshot := *p
+	snapshot.contacts = nil
+	snapshot.calls = nil
+	return snapshot
+}
+
+func newUserPresence(user *models.User) *UserPresence {
+	manual := user.ManualStatus
+	if manual == "" {
+		manual = PresenceAvailable
+	}
+	state := user.Presence
+	if state == "" {
+		state = PresenceOffline
+	}
+	return &UserPresence{
+		UserID:       user.ID,
+		Username:     user.Username,
+		Extension:    user.Extension,
+		State:        state,
+		Since:        user.UpdatedAt,
+		ManualStatus: manual,
+		contacts:     make(map[string]bool),
+		calls:        make(map[string]*presenceCall),
+	}
+}
+
+// LegacyStatus maps a presence state to the online, busy, away or offline
+// that User.Status has always held
+func LegacyStatus(state string) string {
+	switch state {
+	case PresenceAvailable:
+		return "online"
+	case PresenceOnCall, PresenceRinging, PresenceDND:
+		return "busy"
+	}
+	return state
+}
+
+// Global instance
+var globalPresenceService *PresenceService
+
+// InitPresenceService initializes and starts the global presence service
+func InitPresenceService() {
+	globalPresenceService = NewPresenceService()
+	globalPresenceService.Start()
+}
+
+// GetPresenceService returns the global presence service instance
+func GetPresenceService() *PresenceService {
+	return globalPresenceService
+}
+
+// StopPresenceService stops the global presence service
+func StopPresenceService() {
+	if globalPresenceService != nil {
+		globalPresenceService.Stop()
+	}
+}
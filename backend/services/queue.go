@@ -0,0 +1,461 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"voip-backend/asterisk"
+	"voip-backend/auth"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/protocol"
+	"voip-backend/websocket"
+)
+
+// QueueStats summarises a queue for supervisors
+type QueueStats struct {
+	Waiting         int `json:"waiting"`
+	LongestWait     int `json:"longest_wait"` // seconds the first caller in line has waited
+	AgentsLoggedIn  int `json:"agents_logged_in"`
+	AgentsAvailable int `json:"agents_available"`
+	AgentsPaused    int `json:"agents_paused"`
+	AgentsInCall    int `json:"agents_in_call"`
+	Completed       int `json:"completed"`
+	Abandoned       int `json:"abandoned"`
+}
+
+// QueueSnapshot is the live state of a queue
+type QueueSnapshot struct {
+	Queue   string                 `json:"queue"`
+	Stats   QueueStats             `json:"stats"`
+	Members []asterisk.QueueMember `json:"members"`
+	Callers []asterisk.QueueCaller `json:"callers"`
+}
+
+// queueState is the live state of an Asterisk queue
+type queueState struct {
+	members   map[string]*asterisk.QueueMember // by interface
+	callers   map[string]*asterisk.QueueCaller // by channel
+	completed int
+	abandoned int
+}
+
+// QueueService follows Asterisk queues from AMI events and pushes their
+// state to the queue's supervisors
+type QueueService struct {
+	subscription *asterisk.Subscription
+	queues       map[string]*queueState
+	mutex        sync.RWMutex
+	stopChan     chan bool
+	running      bool
+}
+
+// queueEvents are the AMI events the queue service consumes
+var queueEvents = []string{
+	asterisk.EventQueueCallerJoin,
+	asterisk.EventQueueCallerLeave,
+	asterisk.EventQueueCallerAbandon,
+	asterisk.EventQueueMemberAdded,
+	asterisk.EventQueueMemberRemoved,
+	asterisk.EventQueueMemberPause,
+	asterisk.EventQueueMemberStatus,
+	asterisk.EventAgentCalled,
+	asterisk.EventAgentConnect,
+	asterisk.EventAgentComplete,
+	asterisk.EventAMIConnected,
+}
+
+// NewQueueService creates a new queue service
+func NewQueueService() *QueueService {
+	return &QueueService{
+		queues:   make(map[string]*queueState),
+		stopChan: make(chan bool),
+	}
+}
+
+// Start subscribes to queue events
+func (s *QueueService) Start() {
+	if s.running {
+		log.Println("Queue service is already running")
+		return
+	}
+
+	s.subscription = asterisk.Subscribe(asterisk.EventFilter{Types: queueEvents}, 512)
+	s.running = true
+
+	log.Println("Starting queue service")
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-s.subscription.Events():
+				if !ok {
+					return
+				}
+				s.handleEvent(event)
+			case <-s.stopChan:
+				s.subscription.Unsubscribe()
+				s.running = false
+				log.Println("Queue service stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the queue service
+func (s *QueueService) Stop() {
+	if !s.running {
+		return
+	}
+	s.stopChan <- true
+}
+
+// Snapshot returns the live state of a queue. Callers are in the order they
+// joined and members in interface order.
+func (s *QueueService) Snapshot(queue string) QueueSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshot := QueueSnapshot{
+		Queue:   queue,
+		Members: []asterisk.QueueMember{},
+		Callers: []asterisk.QueueCaller{},
+	}
+	state, ok := s.queues[queue]
+	if !ok {
+		return snapshot
+	}
+
+	for _, member := range state.members {
+		snapshot.Members = append(snapshot.Members, *member)
+		snapshot.Stats.AgentsLoggedIn++
+		switch {
+		case member.Paused:
+			snapshot.Stats.AgentsPaused++
+		case member.InCall:
+			snapshot.Stats.AgentsInCall++
+		case member.IsAvailable():
+			snapshot.Stats.AgentsAvailable++
+		}
+	}
+	sort.Slice(snapshot.Members, func(i, j int) bool {
+		return snapshot.Members[i].Interface < snapshot.Members[j].Interface
+	})
+
+	for _, caller := range state.callers {
+		snapshot.Callers = append(snapshot.Callers, *caller)
+	}
+	sort.Slice(snapshot.Callers, func(i, j int) bool {
+		return snapshot.Callers[i].JoinedAt.Before(snapshot.Callers[j].JoinedAt)
+	})
+	for i := range snapshot.Callers {
+		snapshot.Callers[i].Position = i + 1
+	}
+
+	snapshot.Stats.Waiting = len(snapshot.Callers)
+	if len(snapshot.Callers) > 0 {
+		snapshot.Stats.LongestWait = int(time.Since(snapshot.Callers[0].JoinedAt).Seconds())
+	}
+	snapshot.Stats.Completed = state.completed
+	snapshot.Stats.Abandoned = state.abandoned
+	return snapshot
+}
+
+// Member returns the state of an extension logged into a queue
+func (s *QueueService) Member(queue, extension string) (asterisk.QueueMember, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if state, ok := s.queues[queue]; ok {
+		if member, ok := state.members[asterisk.QueueInterface(extension)]; ok {
+			return *member, true
+		}
+	}
+	return asterisk.QueueMember{}, false
+}
+
+// handleEvent updates queue state from a single AMI event
+func (s *QueueService) handleEvent(event asterisk.AMIEvent) {
+	f := event.Fields
+	queue := f["Queue"]
+
+	switch event.Type {
+	case asterisk.EventAMIConnected:
+		// Agents and callers may have changed while we were disconnected
+		s.resync()
+
+	case asterisk.EventQueueCallerJoin:
+		caller := asterisk.ParseQueueCaller(event)
+		s.update(queue, "caller_joined", func(state *queueState) bool {
+			state.callers[caller.Channel] = &caller
+			return true
+		})
+
+	case asterisk.EventQueueCallerLeave:
+		s.update(queue, "caller_left", func(state *queueState) bool {
+			if _, ok := state.callers[f["Channel"]]; !ok {
+				return false
+			}
+			delete(state.callers, f["Channel"])
+			return true
+		})
+
+	case asterisk.EventQueueCallerAbandon:
+		s.update(queue, "caller_abandoned", func(state *queueState) bool {
+			delete(state.callers, f["Channel"])
+			state.abandoned++
+			return true
+		})
+
+	case asterisk.EventQueueMemberAdded:
+		member := asterisk.ParseQueueMember(event)
+		s.update(queue, "agent_logged_in", func(state *queueState) bool {
+			state.members[member.Interface] = &member
+			return true
+		})
+
+	case asterisk.EventQueueMemberRemoved:
+		member := asterisk.ParseQueueMember(event)
+		s.update(queue, "agent_logged_out", func(state *queueState) bool {
+			if _, ok := state.members[member.Interface]; !ok {
+				return false
+			}
+			delete(state.members, member.Interface)
+			return true
+		})
+
+	case asterisk.EventQueueMemberPause:
+		member := asterisk.ParseQueueMember(event)
+		name := "agent_unpaused"
+		if member.Paused {
+			name = "agent_paused"
+		}
+		s.update(queue, name, func(state *queueState) bool {
+			state.members[member.Interface] = &member
+			return true
+		})
+
+	case asterisk.EventQueueMemberStatus:
+		member := asterisk.ParseQueueMember(event)
+		s.update(queue, "agent_status", func(state *queueState) bool {
+			existing, ok := state.members[member.Interface]
+			changed := !ok || existing.Status != member.Status || existing.InCall != member.InCall ||
+				existing.Paused != member.Paused || existing.CallsTaken != member.CallsTaken
+			state.members[member.Interface] = &member
+			return changed
+		})
+
+	case asterisk.EventAgentCalled:
+		s.offerCall(f)
+
+	case asterisk.EventAgentConnect:
+		s.connectCall(f)
+		s.update(queue, "agent_connected", func(state *queueState) bool {
+			delete(state.callers, f["Channel"])
+			return true
+		})
+
+	case asterisk.EventAgentComplete:
+		s.update(queue, "agent_completed", func(state *queueState) bool {
+			state.completed++
+			return true
+		})
+	}
+}
+
+// offerCall tells an agent that a queue call is ringing their phone and,
+// for calls placed through the API, names them as the callee until someone
+// answers
+func (s *QueueService) offerCall(f map[string]string) {
+	agent := asterisk.ExtensionFromChannel(f["DestChannel"])
+	if agent == "" {
+		agent = asterisk.ExtensionFromChannel(f["Interface"])
+	}
+
+	var user models.User
+	if agent == "" || database.GetDB().Where("extension = ?", agent).First(&user).Error != nil {
+		return
+	}
+
+	db := database.GetDB()
+	db.Model(&models.ActiveCall{}).Where("linkedid = ? AND callee_id IS NULL", f["Linkedid"]).Update("callee_id", user.ID)
+	db.Model(&models.CallLog{}).Where("linkedid = ? AND callee_id IS NULL", f["Linkedid"]).Update("callee_id", user.ID)
+
+	channel := f["Channel"]
+	var activeCall models.ActiveCall
+	if err := db.Where("linkedid = ?", f["Linkedid"]).First(&activeCall).Error; err == nil && activeCall.Channel != "" {
+		channel = activeCall.Channel
+	}
+
+	caller := asterisk.ExtensionFromChannel(f["Channel"])
+	if caller == "" {
+		caller = f["CallerIDNum"]
+	}
+
+	log.Printf("[QUEUE] %s: offering call from %s to agent %s", f["Queue"], caller, agent)
+	if hub := websocket.GetHub(); hub != nil {
+		hub.NotifyIncomingCall(caller, agent, channel, f["Linkedid"])
+	}
+}
+
+// connectCall records the agent who answered a queue call as its callee
+func (s *QueueService) connectCall(f map[string]string) {
+	agent := asterisk.ExtensionFromChannel(f["DestChannel"])
+	if agent == "" {
+		agent = asterisk.ExtensionFromChannel(f["Interface"])
+	}
+
+	var user models.User
+	if agent == "" || database.GetDB().Where("extension = ?", agent).First(&user).Error != nil {
+		return
+	}
+
+	db := database.GetDB()
+	db.Model(&models.ActiveCall{}).Where("linkedid = ?", f["Linkedid"]).Updates(map[string]interface{}{
+		"callee_id":      user.ID,
+		"callee_channel": f["DestChannel"],
+	})
+	db.Model(&models.CallLog{}).Where("linkedid = ?", f["Linkedid"]).Update("callee_id", user.ID)
+
+	log.Printf("[QUEUE] %s: agent %s answered %s after %ss", f["Queue"], agent, f["Channel"], f["HoldTime"])
+}
+
+// update applies a change to a queue and notifies its supervisors if it
+// changed anything
+func (s *QueueService) update(queue, event string, change func(state *queueState) bool) {
+	if queue == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	state, ok := s.queues[queue]
+	if !ok {
+		state = newQueueState()
+		s.queues[queue] = state
+	}
+	changed := change(state)
+	s.mutex.Unlock()
+
+	if changed {
+		s.notify(queue, event)
+	}
+}
+
+// notify pushes the state of a queue to its supervisors and to the users
+// whose role may see the statistics of every queue
+func (s *QueueService) notify(queue, event string) {
+	hub := websocket.GetHub()
+	if hub == nil {
+		return
+	}
+
+	snapshot := s.Snapshot(queue)
+	msg := protocol.QueueStatus{
+		Queue:   queue,
+		Event:   event,
+		Stats:   snapshot.Stats,
+		Members: snapshot.Members,
+		Callers: snapshot.Callers,
+	}
+
+	db := database.GetDB()
+	recipients := make(map[string]bool)
+
+	var callQueue models.CallQueue
+	if err := db.Preload("Supervisors").Where("name = ?", queue).First(&callQueue).Error; err == nil {
+		msg.QueueID = callQueue.ID
+		msg.Name = callQueue.Name
+		for _, supervisor := range callQueue.Supervisors {
+			recipients[supervisor.Extension] = true
+		}
+	}
+
+	var watchers []string
+	db.Model(&models.User{}).Where("role IN ?", auth.RolesWithPermission(models.PermQueuesStats)).Pluck("extension", &watchers)
+	for _, extension := range watchers {
+		recipients[extension] = true
+	}
+
+	log.Printf("[QUEUE] %s: %s (%d waiting, %d of %d agents available)", queue, event,
+		snapshot.Stats.Waiting, snapshot.Stats.AgentsAvailable, snapshot.Stats.AgentsLoggedIn)
+
+	extensions := make([]string, 0, len(recipients))
+	for extension := range recipients {
+		if extension != "" {
+			extensions = append(extensions, extension)
+		}
+	}
+	hub.NotifyQueue(extensions, msg)
+}
+
+// resync rebuilds the state of every queue from QueueStatus after
+// (re)connecting to AMI
+func (s *QueueService) resync() {
+	statuses, err := asterisk.GetQueueStatus("")
+	if err != nil {
+		log.Printf("[QUEUE] Failed to get queue status: %v", err)
+		return
+	}
+
+	queues := make(map[string]*queueState, len(statuses))
+	for _, status := range statuses {
+		state := newQueueState()
+		state.completed = status.Params.Completed
+		state.abandoned = status.Params.Abandoned
+		for i := range status.Members {
+			state.members[status.Members[i].Interface] = &status.Members[i]
+		}
+		for i := range status.Callers {
+			state.callers[status.Callers[i].Channel] = &status.Callers[i]
+		}
+		queues[status.Params.Queue] = state
+	}
+
+	// Queues configured here but unknown to Asterisk cannot take calls
+	var names []string
+	database.GetDB().Model(&models.CallQueue{}).Pluck("name", &names)
+	for _, name := range names {
+		if _, ok := queues[name]; !ok {
+			log.Printf("[QUEUE] WARNING: queue %s is not defined in Asterisk (queues.conf)", name)
+		}
+	}
+
+	s.mutex.Lock()
+	s.queues = queues
+	s.mutex.Unlock()
+
+	for queue := range queues {
+		s.notify(queue, "synced")
+	}
+}
+
+// newQueueState creates the state of a queue with no members or callers
+func newQueueState() *queueState {
+	return &queueState{
+		members: make(map[string]*asterisk.QueueMember),
+		callers: make(map[string]*asterisk.QueueCaller),
+	}
+}
+
+// Global instance
+var globalQueueService *QueueService
+
+// InitQueueService initializes and starts the queue service
+func InitQueueService() {
+	globalQueueService = NewQueueService()
+	globalQueueService.Start()
+}
+
+// GetQueueService returns the global queue service instance
+func GetQueueService() *QueueService {
+	return globalQueueService
+}
+
+// StopQueueService stops the global queue service
+func StopQueueService() {
+	if globalQueueService != nil {
+		globalQueueService.Stop()
+	}
+}
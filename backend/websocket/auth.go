@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"voip-backend/auth"
+	"voip-backend/config"
+	"voip-backend/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes the server uses when it ends a connection because of its
+// credentials. Clients should log in again rather than reconnect blindly.
+const (
+	CloseAuthFailed   = 4001 // No token, or the token is invalid
+	CloseTokenExpired = 4002 // The token expired and was not renewed
+	CloseUserChanged  = 4003 // The user was deleted or their extension or role changed
+	CloseLoggedOut    = 4006 // The session the token belongs to was revoked
+)
+
+// Close codes the server uses when a client misbehaves or falls behind. The
+// client may reconnect, and resume to get the events it missed.
+const (
+	CloseRateLimited   = 4004 // The client kept sending faster than its rate limit
+	CloseSendQueueFull = 4005 // The client did not read its messages fast enough
+)
+
+const (
+	// Time allowed for the first message when the token is not in the request
+	authWait = 10 * time.Second
+
+	// Subprotocol that carries the token in Sec-WebSocket-Protocol, sent by
+	// browsers as new WebSocket(url, ["bearer", token])
+	bearerProtocol = "bearer"
+)
+
+// tokenFromRequest returns the JWT from the token query parameter or the
+// Sec-WebSocket-Protocol header, or "" if the client will send it in its
+// first message
+func tokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if strings.EqualFold(protocol, bearerProtocol) && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// checkOrigin accepts browsers only from the configured CORS origins.
+// Clients that send no Origin header are not browsers and are let through.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if config.AppConfig != nil {
+		for _, allowed := range config.AppConfig.CORSOrigins {
+			allowed = strings.TrimSuffix(strings.TrimSpace(allowed), "/")
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+	}
+
+	log.Printf("WebSocket connection from origin %s rejected", origin)
+	return false
+}
+
+// authenticate validates a token and checks that its user still exists
+// with the extension the token was issued for
+func (h *Hub) authenticate(token string) (*auth.Claims, error) {
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Extension == "" {
+		return nil, errors.New("token has no extension")
+	}
+	if err := auth.CheckSession(claims); err != nil {
+		return nil, err
+	}
+
+	if h.CheckUser != nil {
+		if err := h.CheckUser(claims.UserID, claims.Extension, claims.Role); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// readAuthMessage authenticates a connection whose token was not in the
+// request from an auth first message, in either protocol version
+func (h *Hub) readAuthMessage(conn *websocket.Conn) (*auth.Claims, error) {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(authWait))
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("no auth message: %v", err)
+	}
+
+	in, err := protocol.Decode(data)
+	if err != nil || in.Type != protocol.TypeAuth {
+		return nil, errors.New("first message must be an auth message with a token")
+	}
+	return h.authenticate(in.Payload.(*protocol.Auth).Token)
+}
+
+// closeWith sends a close frame with a code and reason and closes the
+// connection, which makes readPump unregister the client
+func closeWith(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+// close ends a client's connection with a close code and reason, which makes
+// its transport unregister it
+func (c *Client) close(code int, reason string) {
+	if c.conn != nil {
+		closeWith(c.conn, code, reason)
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		close(c.done)
+	})
+}
+
+// setIdentity binds a new client to the user in its token
+func (c *Client) setIdentity(claims *auth.Claims) {
+	c.UserID = claims.UserID
+	c.Username = claims.Username
+	c.Extension = claims.Extension
+	c.Role = claims.Role
+	c.SessionID = claims.SessionID
+	c.setExpiry(claims)
+}
+
+// setExpiry arranges for the connection to be closed when the token expires
+func (c *Client) setExpiry(claims *auth.Claims) {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if claims.ExpiresAt != nil {
+		c.expiry = time.AfterFunc(time.Until(claims.ExpiresAt.Time), func() {
+			log.Printf("WebSocket token of %s (extension: %s) expired", c.ID, c.Extension)
+			c.close(CloseTokenExpired, "token expired")
+		})
+	}
+}
+
+// stopExpiry cancels the token expiry timer of a disconnected client
+func (c *Client) stopExpiry() {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
+
+// renewToken handles an auth message on an open connection, which lets
+// clients keep their socket across a token refresh. The reply carries the
+// auth message's id as its correlation id.
+func (c *Client) renewToken(in *protocol.Inbound, token string) {
+	claims, err := c.hub.authenticate(token)
+	if err == nil && (claims.UserID != c.UserID || claims.Extension != c.Extension) {
+		err = errors.New("token belongs to another user")
+	}
+	if err == nil && claims.SessionID != c.SessionID {
+		err = errors.New("token belongs to another session")
+	}
+
+	reply := protocol.New(protocol.TypeAuthenticated, protocol.Empty{})
+	if err != nil {
+		log.Printf("Rejected token renewal from %s (extension: %s): %v", c.ID, c.Extension, err)
+		reply = protocol.New(protocol.TypeAuthError, protocol.AuthError{Error: err.Error()})
+	} else {
+		c.setExpiry(claims)
+	}
+	reply.CorrelationID = in.ID
+	c.sendMessage(reply)
+}
+
+// DisconnectUser closes every connection of a user on every node, for
+// example after the user is deleted. The connections cannot be resumed.
+// Returns the number of connections closed on this node.
+func (h *Hub) DisconnectUser(userID uint, code int, reason string) int {
+	return h.disconnect(userID, 0, code, reason)
+}
+
+// DisconnectSession closes the connections of one of a user's sessions on
+// every node, after it is revoked. The connections cannot be resumed.
+// Returns the number of connections closed on this node.
+func (h *Hub) DisconnectSession(userID, sessionID uint, code int, reason string) int {
+	return h.disconnect(userID, sessionID, code, reason)
+}
+
+func (h *Hub) disconnect(userID, sessionID uint, code int, reason string) int {
+	if h.broker != nil {
+		if err := h.broker.DisconnectUser(userID, sessionID, code, reason); err != nil {
+			log.Printf("Failed to disconnect user %d on other nodes: %v", userID, err)
+		}
+	}
+	return h.disconnectLocal(userID, sessionID, code, reason)
+}
+
+// disconnectLocal closes the connections of a user on this node, or only
+// those of one session when sessionID is not zero
+func (h *Hub) disconnectLocal(userID, sessionID uint, code int, reason string) int {
+	h.mutex.Lock()
+	var clients []*Client
+	for client := range h.clients {
+		if client.UserID == userID && (sessionID == 0 || client.SessionID == sessionID) {
+			client.revoked = true
+			clients = append(clients, client)
+		}
+	}
+	h.mutex.Unlock()
+
+	for _, client := range clients {
+		client.close(code, reason)
+	}
+	if len(clients) > 0 {
+		log.Printf("Disconnected %d WebSocket clients of user %d: %s", len(clients), userID, reason)
+	}
+	return len(clients)
+}
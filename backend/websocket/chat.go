@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"log"
+	"voip-backend/protocol"
+)
+
+// NotifyChat sends a chat message, typing indicator or read receipt to the
+// given extensions. Extensions that are offline get chat messages when they
+// next connect, through OnClientConnected.
+func (h *Hub) NotifyChat(extensions []string, msg protocol.Message) {
+	for _, extension := range extensions {
+		if !h.IsExtensionOnline(extension) {
+			continue
+		}
+		if err := h.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send %s to %s: %v", msg.Type, extension, err)
+		}
+	}
+}
+
+// relayChatTyping passes a typing indicator on to the other members of the
+// conversation that are connected
+func (c *Client) relayChatTyping(typing *protocol.ChatTyping) error {
+	if c.hub.LookupChatMembers == nil {
+		return protocol.NewError(protocol.CodeRejected, "chat is not available")
+	}
+	members, err := c.hub.LookupChatMembers(typing.ConversationID, c.UserID)
+	if err != nil {
+		return err
+	}
+
+	typing.UserID = c.UserID
+	typing.Extension = c.Extension
+	msg := protocol.New(protocol.TypeChatTyping, *typing)
+	for _, extension := range members {
+		if extension == c.Extension || !c.hub.IsExtensionConnected(extension) {
+			continue
+		}
+		if err := c.hub.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send typing indicator to %s: %v", extension, err)
+		}
+	}
+	return nil
+}
+
+// markChatRead stores a read receipt from the client
+func (c *Client) markChatRead(read *protocol.ChatRead) error {
+	if c.hub.OnChatRead == nil {
+		return protocol.NewError(protocol.CodeRejected, "chat is not available")
+	}
+	read.UserID = c.UserID
+	read.Extension = c.Extension
+	return c.hub.OnChatRead(*read)
+}
@@ -1,10 +1,14 @@
 package websocket
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
+	"voip-backend/auth"
+	"voip-backend/protocol"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -20,40 +24,68 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, enough for SDP offers
+	maxMessageSize = 16384
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow connections from any origin in development
-		// In production, you should check the origin properly
-		return true
-	},
+	CheckOrigin:     checkOrigin,
+	Subprotocols:    []string{bearerProtocol},
 }
 
 // Client is a middleman between the websocket connection and the hub
 type Client struct {
 	hub *Hub
 
-	// The websocket connection
+	// The websocket connection; nil for clients of the HTTP fallback
+	// transports, which are closed through done instead
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages
-	send chan []byte
+	// Closed by close for fallback clients, with the code and reason
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+
+	// Queue of outbound frames
+	outbox *outbox
+
+	// Limits the messages the client sends
+	limiter *inboundLimiter
 
 	// Client identifier
 	ID string
 
 	// User extension
 	Extension string
+
+	// Protocol version the client speaks, 0 for flat legacy messages
+	Version int
+
+	// Connection the client resumes, from its welcome message
+	resumeToken string
+	lastSeq     uint64
+
+	// Closed by the server because of its credentials; cannot be resumed
+	revoked bool
+
+	// Identity from the client's JWT
+	UserID    uint
+	Username  string
+	Role      string
+	SessionID uint
+
+	// Closes the connection when the token expires, unless renewed
+	expiry    *time.Timer
+	authMutex sync.Mutex
 }
 
 // readPump pumps messages from the websocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
+		c.stopExpiry()
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -74,15 +106,24 @@ func (c *Client) readPump() {
 			break
 		}
 
-		// Parse the message
-		var msg Message
-		if err := json.Unmarshal(messageBytes, &msg); err != nil {
-			log.Printf("Failed to parse message: %v", err)
+		// Parse and validate the message; invalid ones count towards the
+		// rate limit too
+		in, err := protocol.Decode(messageBytes)
+		if in == nil {
+			in = &protocol.Inbound{}
+		}
+		if ok, kicked := c.admit(in); !ok {
+			if kicked {
+				c.hub.metrics.count(&c.hub.metrics.Disconnected, "rate_limited")
+				break
+			}
 			continue
 		}
-
-		// Handle different message types
-		c.handleMessage(msg)
+		if err != nil {
+			c.sendError(in, err)
+			continue
+		}
+		c.handleMessage(in)
 	}
 }
 
@@ -96,28 +137,32 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.outbox.ready:
+			frames, open := c.outbox.take()
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
 
-			// Add queued chat messages to the current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+			if len(frames) > 0 {
+				w, err := c.conn.NextWriter(websocket.TextMessage)
+				if err != nil {
+					return
+				}
+
+				// Queued messages share a websocket message, one per line
+				for i, frame := range frames {
+					if i > 0 {
+						w.Write([]byte{'\n'})
+					}
+					w.Write(frame)
+				}
+
+				if err := w.Close(); err != nil {
+					return
+				}
 			}
 
-			if err := w.Close(); err != nil {
+			if !open {
+				// The hub unregistered the client
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
@@ -130,142 +175,164 @@ func (c *Client) writePump() {
 	}
 }
 
-// handleMessage processes incoming messages from the client
-func (c *Client) handleMessage(msg Message) {
-	log.Printf("Received message from %s: %+v", c.Extension, msg)
+// handleMessage processes a decoded message from the client. Messages that
+// carry an id are acknowledged once handled, or answered with an error frame.
+func (c *Client) handleMessage(in *protocol.Inbound) {
+	log.Printf("Received %s from %s", in.Type, c.Extension)
 
-	switch msg.Type {
-	case "ping":
-		// Respond with pong
-		pongMsg := Message{
-			Type:      "pong",
-			Timestamp: time.Now().Unix(),
-		}
-		if data, err := json.Marshal(pongMsg); err == nil {
-			select {
-			case c.send <- data:
-			default:
-				log.Printf("Failed to send pong to %s", c.Extension)
-			}
-		}
+	var err error
+	switch payload := in.Payload.(type) {
+	case *protocol.Auth:
+		// Renew the token of an open connection; the reply is the ack
+		c.renewToken(in, payload.Token)
+		return
 
-	case "call_status":
-		// Forward call status to the target extension
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
+	case *protocol.CallStatus:
+		// Forward call status to the other party
+		err = c.relay(in.Type, payload)
+
+	case *protocol.CallEvent:
+		err = c.handleCallEvent(in.Type, payload)
+
+	case *protocol.AnswerCall:
+		// Tell the other parties the call was answered
+		signal := protocol.Signal{From: c.Extension, Channel: payload.Channel, CallID: payload.CallID}
+		err = c.notifyParties(signal.Call(), protocol.New(protocol.TypeCallAnswered, protocol.CallEvent{
+			Signal: signal,
+			Status: "answered",
+		}))
+
+	case *protocol.UserStatus:
+		err = c.setUserStatus(payload.Status)
+
+	case *protocol.PresenceSubscription:
+		if in.Type == protocol.TypePresenceUnsubscribe {
+			err = c.unsubscribePresence(payload)
+		} else {
+			err = c.subscribePresence(in, payload)
 		}
 
-	case "hangup":
-		// Handle hangup message
-		if msg.Channel != "" {
-			// Notify other party about hangup
-			hangupMsg := Message{
-				Type:    "call_ended",
-				From:    c.Extension,
-				Channel: msg.Channel,
-				Status:  "ended",
-			}
-			c.hub.BroadcastMessage(hangupMsg)
-		}
+	case *protocol.ChatTyping:
+		err = c.relayChatTyping(payload)
 
-	case "answer_call":
-		// Handle call answer
-		if msg.Channel != "" {
-			answerMsg := Message{
-				Type:    "call_answered",
-				From:    c.Extension,
-				Channel: msg.Channel,
-				Status:  "answered",
-			}
-			c.hub.BroadcastMessage(answerMsg)
-		}
+	case *protocol.ChatRead:
+		err = c.markChatRead(payload)
 
-	case "user_status":
-		// Handle user status updates
-		statusMsg := Message{
-			Type:      "user_status",
-			From:      c.Extension,
-			Status:    msg.Status,
-			Timestamp: time.Now().Unix(),
-		}
-		c.hub.BroadcastMessage(statusMsg)
-
-	case "user_online":
-		// Handle user coming online
-		onlineMsg := Message{
-			Type:      "user_status_changed",
-			From:      c.Extension,
-			Status:    "online",
-			Timestamp: time.Now().Unix(),
+	// WebRTC signaling is only relayed between the parties of the call
+	case protocol.Signaler:
+		err = c.relay(in.Type, payload)
+
+	case *protocol.Empty:
+		if in.Type == protocol.TypePing {
+			pong := protocol.New(protocol.TypePong, protocol.Empty{})
+			pong.CorrelationID = in.ID
+			c.sendMessage(pong)
+			return
 		}
-		c.hub.BroadcastMessage(onlineMsg)
-
-	case "user_offline":
-		// Handle user going offline
-		offlineMsg := Message{
-			Type:      "user_status_changed",
-			From:      c.Extension,
-			Status:    "offline",
-			Timestamp: time.Now().Unix(),
+		// user_online and user_offline carry no payload
+		status := "available"
+		if in.Type == protocol.TypeUserOffline {
+			status = "offline"
 		}
-		c.hub.BroadcastMessage(offlineMsg)
+		err = c.setUserStatus(status)
 
-	// WebRTC message types
-	case "webrtc_call_accepted":
-		// Forward call acceptance to caller
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
-		}
+	default:
+		err = protocol.NewError(protocol.CodeUnknownType, "unhandled message type "+in.Type)
+	}
 
-	case "webrtc_call_rejected":
-		// Forward call rejection to caller
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
-		}
+	if err != nil {
+		c.sendError(in, err)
+		return
+	}
+	if in.ID != "" {
+		c.sendAck(in)
+	}
+}
 
-	case "webrtc_offer":
-		// Forward WebRTC offer to target
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
-		}
+// setUserStatus passes the status the user chose to the presence service,
+// which broadcasts the change
+func (c *Client) setUserStatus(status string) error {
+	if c.hub.OnUserStatus == nil {
+		return protocol.NewError(protocol.CodeRejected, "presence is not available")
+	}
+	if err := c.hub.OnUserStatus(c.Extension, status); err != nil {
+		return protocol.NewError(protocol.CodeRejected, err.Error())
+	}
+	return nil
+}
 
-	case "webrtc_answer":
-		// Forward WebRTC answer to caller
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
+// handleCallEvent handles the call messages that carry only a status
+func (c *Client) handleCallEvent(messageType string, event *protocol.CallEvent) error {
+	callID := event.Call()
+
+	switch messageType {
+	case protocol.TypeHangup:
+		// Tell the other parties the call ended
+		c.hub.EndWebRTCCallHold(callID)
+		err := c.notifyParties(callID, protocol.New(protocol.TypeCallEnded, protocol.CallEvent{
+			Signal: protocol.Signal{From: c.Extension, Channel: event.Channel, CallID: event.CallID},
+			Status: "ended",
+		}))
+		if err != nil {
+			return err
 		}
+		c.hub.EndCallSession(callID)
 
-	case "webrtc_ice_candidate":
-		// Forward ICE candidate to peer
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
+	case protocol.TypeWebRTCCallRejected, protocol.TypeWebRTCCallEnded:
+		if err := c.relay(messageType, event); err != nil {
+			return err
 		}
+		c.hub.EndWebRTCCallHold(callID)
+		c.hub.EndCallSession(callID)
 
-	case "webrtc_call_ended":
-		// Forward call end notification to peer
-		if msg.To != "" {
-			c.hub.SendToExtension(msg.To, msg)
+	case protocol.TypeWebRTCHold, protocol.TypeWebRTCResume:
+		// Relay hold/resume to the peer and track the hold state
+		session, err := c.partySession(callID)
+		if err != nil {
+			return err
 		}
+		if event.To == c.Extension || !session.HasParty(event.To) {
+			return protocol.NewError(protocol.CodeForbidden,
+				fmt.Sprintf("not a party to call %s with %s", callID, event.To))
+		}
+		_, err = c.hub.HoldWebRTCCall(callID, c.Extension, event.To, messageType == protocol.TypeWebRTCHold)
+		return err
 
 	default:
-		log.Printf("Unknown message type: %s", msg.Type)
+		// webrtc_call_accepted
+		if err := c.relay(messageType, event); err != nil {
+			return err
+		}
+		c.hub.AnswerCallSession(callID)
 	}
+	return nil
 }
 
-// HandleWebSocket handles websocket requests from the peer
+// HandleWebSocket handles websocket requests from the peer. The client must
+// present a JWT in the token query parameter, in Sec-WebSocket-Protocol
+// after "bearer", or in an auth message sent first; its extension comes from
+// the token.
 func HandleWebSocket(c *gin.Context) {
+	hub := GetHub()
 	extension := c.Query("extension")
-	if extension == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Extension parameter required"})
+
+	version, resumeToken, lastSeq, ok := streamParams(c)
+	if !ok {
 		return
 	}
 
-	// Optional: Validate token for authenticated connections
-	token := c.Query("token")
-	if token != "" {
-		// TODO: Add token validation here if needed
-		// For now, we'll allow connections with extension parameter
-		log.Printf("WebSocket connection with token for extension: %s", extension)
+	var claims *auth.Claims
+	if token := tokenFromRequest(c.Request); token != "" {
+		var err error
+		claims, err = hub.authenticate(token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+			return
+		}
+		if extension != "" && extension != claims.Extension {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token does not belong to extension " + extension})
+			return
+		}
 	}
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -274,13 +341,29 @@ func HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	if claims == nil {
+		claims, err = hub.readAuthMessage(conn)
+		if err == nil && extension != "" && extension != claims.Extension {
+			err = fmt.Errorf("token does not belong to extension %s", extension)
+		}
+		if err != nil {
+			log.Printf("WebSocket authentication failed: %v", err)
+			closeWith(conn, CloseAuthFailed, err.Error())
+			return
+		}
+	}
+
 	client := &Client{
-		hub:       GetHub(),
-		conn:      conn,
-		send:      make(chan []byte, 256),
-		ID:        generateClientID(),
-		Extension: extension,
+		hub:         hub,
+		conn:        conn,
+		outbox:      newOutbox(sendBufferSize(hub)),
+		limiter:     newInboundLimiter(hub.RateLimits),
+		ID:          generateClientID(),
+		Version:     version,
+		resumeToken: resumeToken,
+		lastSeq:     lastSeq,
 	}
+	client.setIdentity(claims)
 
 	client.hub.register <- client
 
@@ -288,7 +371,43 @@ func HandleWebSocket(c *gin.Context) {
 	go client.writePump()
 	go client.readPump()
 
-	log.Printf("WebSocket client connected: %s (extension: %s)", client.ID, extension)
+	log.Printf("WebSocket client connected: %s (user: %s, extension: %s)", client.ID, client.Username, client.Extension)
+}
+
+// streamParams reads the query parameters shared by the WebSocket and the
+// fallback transports, answering 400 when they are invalid
+func streamParams(c *gin.Context) (version int, resumeToken string, lastSeq uint64, ok bool) {
+	// Clients opt in to the enveloped protocol with ?v=1
+	if v := c.Query("v"); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil || version < 0 || version > protocol.Version {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported protocol version %s, the latest is %d", v, protocol.Version)})
+			return 0, "", 0, false
+		}
+	}
+
+	// Reconnecting clients pass the resume token of their welcome message and
+	// the seq of the last event they received
+	resumeToken = c.Query("resume")
+	if s := c.Query("last_seq"); s != "" {
+		var err error
+		lastSeq, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last_seq"})
+			return 0, "", 0, false
+		}
+	}
+	return version, resumeToken, lastSeq, true
+}
+
+// sendBufferSize returns the size of a client's outbound queue, which must
+// hold the welcome message and a full replay
+func sendBufferSize(hub *Hub) int {
+	if hub.ReplayBufferSize+1 > 256 {
+		return hub.ReplayBufferSize + 1
+	}
+	return 256
 }
 
 // generateClientID generates a unique client ID
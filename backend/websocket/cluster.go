@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"log"
+	"voip-backend/broker"
+	"voip-backend/protocol"
+)
+
+// SetBroker connects the hub to the hubs of the other backend nodes. From
+// then on messages for extensions connected elsewhere are passed on, and
+// connection queries cover the whole cluster. Call it before serving.
+func (h *Hub) SetBroker(b broker.Broker) error {
+	h.broker = b
+	if err := b.Start(h); err != nil {
+		return err
+	}
+	log.Printf("WebSocket hub joined the cluster as node %s", b.NodeID())
+	return nil
+}
+
+// DeliverToExtension delivers a message another node sent for an extension
+// to this node's clients of it
+func (h *Hub) DeliverToExtension(extension string, message protocol.Message) {
+	if sent, err := h.deliver(extension, message); err == nil {
+		log.Printf("Message from another node sent to %d clients for extension %s", sent, extension)
+	}
+}
+
+// DeliverBroadcast delivers a message another node broadcast to this node's
+// clients
+func (h *Hub) DeliverBroadcast(message protocol.Message) {
+	if err := h.deliverBroadcast(message); err != nil {
+		log.Printf("Failed to deliver broadcast from another node: %v", err)
+	}
+}
+
+// DeliverDisconnectUser closes this node's connections of a user, or of
+// one of their sessions, that another node disconnected
+func (h *Hub) DeliverDisconnectUser(userID, sessionID uint, code int, reason string) {
+	h.disconnectLocal(userID, sessionID, code, reason)
+}
+
+// remotePresence returns the number of clients other nodes have for an
+// extension, and whether the extension is present on any of them (possibly
+// with no clients while it may resume there)
+func (h *Hub) remotePresence(extension string) (int, bool) {
+	if h.broker == nil {
+		return 0, false
+	}
+	clients, present := h.broker.RemotePresence()[extension]
+	return clients, present
+}
+
+// remoteExtensions returns the extensions present on other nodes
+func (h *Hub) remoteExtensions() map[string]int {
+	if h.broker == nil {
+		return nil
+	}
+	return h.broker.RemotePresence()
+}
+
+// reportPresenceLocked tells the other nodes how many clients this node has
+// for an extension; present false means it is gone. The caller holds
+// h.mutex.
+func (h *Hub) reportPresenceLocked(extension string, clients int, present bool) {
+	if h.broker == nil {
+		return
+	}
+	if present {
+		h.broker.SetPresence(extension, clients)
+	} else {
+		h.broker.ClearPresence(extension)
+	}
+}
@@ -0,0 +1,227 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"voip-backend/auth"
+	"voip-backend/broker"
+	"voip-backend/broker/redistest"
+	"voip-backend/protocol"
+)
+
+// clusterSetups start two brokers connected to each other
+var clusterSetups = []struct {
+	name  string
+	start func(t *testing.T) (broker.Broker, broker.Broker)
+}{
+	{"memory", func(t *testing.T) (broker.Broker, broker.Broker) {
+		bus := broker.NewMemoryBus()
+		return broker.NewMemoryBroker(bus, "node-a"), broker.NewMemoryBroker(bus, "node-b")
+	}},
+	{"redis", func(t *testing.T) (broker.Broker, broker.Broker) {
+		server := redistest.NewServer(redistest.Config{})
+		if err := server.Start(""); err != nil {
+			t.Fatalf("Failed to start fake Redis: %v", err)
+		}
+		t.Cleanup(server.Close)
+
+		newBroker := func(node string) broker.Broker {
+			return broker.NewRedisBroker(broker.RedisConfig{
+				Address:          server.Addr(),
+				Channel:          "voip:test",
+				Node:             node,
+				PresenceInterval: 50 * time.Millisecond,
+			})
+		}
+		return newBroker("node-a"), newBroker("node-b")
+	}},
+}
+
+// startCluster runs two hubs joined through the brokers of a setup
+func startCluster(t *testing.T, start func(t *testing.T) (broker.Broker, broker.Broker)) (*Hub, *Hub) {
+	t.Helper()
+
+	brokerA, brokerB := start(t)
+	hubs := make([]*Hub, 2)
+	for i, b := range []broker.Broker{brokerA, brokerB} {
+		hubs[i] = NewHub()
+		if err := hubs[i].SetBroker(b); err != nil {
+			t.Fatalf("Failed to start broker %s: %v", b.NodeID(), err)
+		}
+		t.Cleanup(func() { b.Close() })
+	}
+	return hubs[0], hubs[1]
+}
+
+// connectClient registers a client of an extension with a hub, as the
+// HTTP fallback transports do
+func connectClient(h *Hub, userID uint, extension string) *Client {
+	client := h.newFallbackClient(&auth.Claims{UserID: userID, Extension: extension, Role: "user"}, 1, "", 0)
+	h.addClient(client)
+	return client
+}
+
+// waitFor polls until condition holds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForMessage waits for a client to be sent a message of a type and
+// returns its payload
+func waitForMessage(t *testing.T, client *Client, messageType string) json.RawMessage {
+	t.Helper()
+
+	var payload json.RawMessage
+	waitFor(t, messageType+" for "+client.Extension, func() bool {
+		frames, _ := client.outbox.take()
+		for _, frame := range frames {
+			var envelope struct {
+				Type    string          `json:"type"`
+				Payload json.RawMessage `json:"payload"`
+			}
+			if err := json.Unmarshal(frame, &envelope); err != nil {
+				t.Fatalf("Invalid frame %s: %v", frame, err)
+			}
+			if envelope.Type == messageType {
+				payload = envelope.Payload
+				return true
+			}
+		}
+		return false
+	})
+	return payload
+}
+
+// joinCluster connects a client to each hub and waits until each hub sees
+// the other's client, which also means both brokers are receiving
+func joinCluster(t *testing.T, hubA, hubB *Hub) (*Client, *Client) {
+	t.Helper()
+
+	clientA := connectClient(hubA, 1, "1001")
+	clientB := connectClient(hubB, 2, "1002")
+	waitFor(t, "1002 on node a", func() bool { return hubA.IsExtensionConnected("1002") })
+	waitFor(t, "1001 on node b", func() bool { return hubB.IsExtensionConnected("1001") })
+
+	// Drop the welcome messages
+	clientA.outbox.take()
+	clientB.outbox.take()
+	return clientA, clientB
+}
+
+func TestClusterSendToExtension(t *testing.T) {
+	for _, setup := range clusterSetups {
+		t.Run(setup.name, func(t *testing.T) {
+			hubA, hubB := startCluster(t, setup.start)
+			clientA, clientB := joinCluster(t, hubA, hubB)
+
+			err := hubA.SendToExtension("1002", protocol.New(protocol.TypeCallStatus, protocol.CallStatus{
+				Signal: protocol.Signal{Channel: "PJSIP/1001", CallID: "1700000000.1"},
+				Caller: "1001",
+				Callee: "1002",
+				Status: "ringing",
+			}))
+			if err != nil {
+				t.Fatalf("SendToExtension = %v", err)
+			}
+
+			var status protocol.CallStatus
+			json.Unmarshal(waitForMessage(t, clientB, protocol.TypeCallStatus), &status)
+			if status.CallID != "1700000000.1" || status.Status != "ringing" {
+				t.Errorf("call_status on node b = %+v", status)
+			}
+			if frames, _ := clientA.outbox.take(); len(frames) != 0 {
+				t.Errorf("1001 was sent %d frames meant for 1002", len(frames))
+			}
+		})
+	}
+}
+
+func TestClusterBroadcastMessage(t *testing.T) {
+	for _, setup := range clusterSetups {
+		t.Run(setup.name, func(t *testing.T) {
+			hubA, hubB := startCluster(t, setup.start)
+			clientA, clientB := joinCluster(t, hubA, hubB)
+
+			err := hubB.BroadcastMessage(protocol.New(protocol.TypeQueueStatus, protocol.QueueStatus{Queue: "support"}))
+			if err != nil {
+				t.Fatalf("BroadcastMessage = %v", err)
+			}
+			for _, client := range []*Client{clientA, clientB} {
+				var status protocol.QueueStatus
+				json.Unmarshal(waitForMessage(t, client, protocol.TypeQueueStatus), &status)
+				if status.Queue != "support" {
+					t.Errorf("queue_status for %s = %+v", client.Extension, status)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterPresence(t *testing.T) {
+	for _, setup := range clusterSetups {
+		t.Run(setup.name, func(t *testing.T) {
+			hubA, hubB := startCluster(t, setup.start)
+			_, clientB := joinCluster(t, hubA, hubB)
+
+			// Each node counts the other's clients
+			if count := hubA.GetClientCount(); count != 2 {
+				t.Errorf("clients on node a = %d, want 2", count)
+			}
+			if extensions := hubB.GetConnectedExtensions(); len(extensions) != 2 {
+				t.Errorf("extensions on node b = %v, want 1001 and 1002", extensions)
+			}
+
+			// A status change reaches the user on the other node
+			if err := hubA.NotifyUserStatus(protocol.UserStatusChanged{Extension: "1002", Status: "dnd"}); err != nil {
+				t.Fatalf("NotifyUserStatus = %v", err)
+			}
+			var status protocol.UserStatusChanged
+			json.Unmarshal(waitForMessage(t, clientB, protocol.TypeUserStatusChanged), &status)
+			if status.Status != "dnd" || status.ClientCount != 1 {
+				t.Errorf("user_status_changed on node b = %+v", status)
+			}
+
+			// An extension that left one node is gone from the other
+			hubB.ResumeGrace = 0
+			hubB.mutex.Lock()
+			hubB.removeClientLocked(clientB)
+			hubB.mutex.Unlock()
+			waitFor(t, "1002 to leave node a", func() bool { return !hubA.IsExtensionConnected("1002") })
+		})
+	}
+}
+
+func TestClusterDisconnectUser(t *testing.T) {
+	for _, setup := range clusterSetups {
+		t.Run(setup.name, func(t *testing.T) {
+			hubA, hubB := startCluster(t, setup.start)
+			clientA, clientB := joinCluster(t, hubA, hubB)
+
+			if closed := hubA.DisconnectUser(2, CloseLoggedOut, "session revoked"); closed != 0 {
+				t.Errorf("node a closed %d connections of a user connected to node b", closed)
+			}
+			select {
+			case <-clientB.done:
+				if clientB.closeCode != CloseLoggedOut {
+					t.Errorf("close code = %d, want %d", clientB.closeCode, CloseLoggedOut)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("the user's connection on node b was not closed")
+			}
+			select {
+			case <-clientA.done:
+				t.Error("another user's connection was closed")
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"voip-backend/auth"
+	"voip-backend/protocol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fallback transports for networks that block WebSocket upgrades. An SSE
+// stream or a long-poll session is a hub client like a socket: it is sent
+// the welcome message, gets the extension's events with their seq numbers
+// and can resume. Messages to the server go through HandleSendMessage.
+
+const (
+	// Comment sent on idle SSE streams so proxies keep them open
+	sseKeepAlive = 25 * time.Second
+
+	// Default and longest wait of a long poll with no events
+	defaultPollWait = 25 * time.Second
+	maxPollWait     = 55 * time.Second
+
+	// Time after a poll returns within which the next one must arrive, or
+	// the session is closed
+	pollIdleTimeout = 30 * time.Second
+)
+
+// pollSession is a long-poll client kept registered between polls
+type pollSession struct {
+	client *Client
+
+	mutex   sync.Mutex
+	polling bool
+	idle    *time.Timer
+	closed  chan struct{}
+}
+
+// httpToken returns the JWT from the Authorization header or the token
+// query parameter, which EventSource clients must use
+func httpToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticateRequest authenticates a fallback request, answering 401 when
+// it carries no valid token
+func (h *Hub) authenticateRequest(c *gin.Context) (*auth.Claims, bool) {
+	token := httpToken(c.Request)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header or token parameter required"})
+		return nil, false
+	}
+	claims, err := h.authenticate(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+		return nil, false
+	}
+	return claims, true
+}
+
+// newFallbackClient creates a client without a socket
+func (h *Hub) newFallbackClient(claims *auth.Claims, version int, resumeToken string, lastSeq uint64) *Client {
+	client := &Client{
+		hub:         h,
+		outbox:      newOutbox(sendBufferSize(h)),
+		done:        make(chan struct{}),
+		ID:          generateClientID(),
+		Version:     version,
+		resumeToken: resumeToken,
+		lastSeq:     lastSeq,
+	}
+	client.setIdentity(claims)
+	return client
+}
+
+// frameSeq returns the seq number of an encoded frame, 0 if it has none
+func frameSeq(frame []byte) uint64 {
+	var header struct {
+		Seq uint64 `json:"seq"`
+	}
+	json.Unmarshal(frame, &header)
+	return header.Seq
+}
+
+// HandleSSE streams an extension's events as Server-Sent Events. Each event
+// is the frame a socket would receive, with its seq as the event id. It takes
+// the same v, resume and last_seq parameters as /ws, and the Last-Event-ID
+// header an EventSource sends when it reconnects stands in for last_seq.
+// When the server ends the stream it sends a close event with the code a
+// socket would be closed with.
+func HandleSSE(c *gin.Context) {
+	hub := GetHub()
+
+	version, resumeToken, lastSeq, ok := streamParams(c)
+	if !ok {
+		return
+	}
+	if id := c.GetHeader("Last-Event-ID"); id != "" && c.Query("last_seq") == "" {
+		if seq, err := strconv.ParseUint(id, 10, 64); err == nil {
+			lastSeq = seq
+		}
+	}
+
+	claims, ok := hub.authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	flusher, canFlush := c.Writer.(http.Flusher)
+	if !canFlush {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	client := hub.newFallbackClient(claims, version, resumeToken, lastSeq)
+	defer client.stopExpiry()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // disable nginx buffering
+	c.Status(http.StatusOK)
+	flusher.Flush()
+
+	hub.register <- client
+	log.Printf("SSE client connected: %s (user: %s, extension: %s)", client.ID, client.Username, client.Extension)
+	defer func() {
+		hub.unregister <- client
+		log.Printf("SSE client disconnected: %s (extension: %s)", client.ID, client.Extension)
+	}()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-client.outbox.ready:
+			frames, open := client.outbox.take()
+			for _, frame := range frames {
+				if seq := frameSeq(frame); seq > 0 {
+					fmt.Fprintf(c.Writer, "id: %d\n", seq)
+				}
+				fmt.Fprintf(c.Writer, "data: %s\n\n", frame)
+			}
+			flusher.Flush()
+			if !open {
+				// The hub dropped the client; it can resume
+				return
+			}
+
+		case <-keepAlive.C:
+			io.WriteString(c.Writer, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-client.done:
+			data, _ := json.Marshal(gin.H{"code": client.closeCode, "reason": client.closeReason})
+			fmt.Fprintf(c.Writer, "event: close\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// HandleLongPoll returns an extension's events in batches. A poll without a
+// session parameter opens a session and returns at once with the welcome
+// message and the session to pass to the following polls, which wait up to
+// timeout seconds for events. A session that is not polled for 30 seconds is
+// closed; the client then opens a new one with resume and last_seq to get
+// the events it missed.
+func HandleLongPoll(c *gin.Context) {
+	hub := GetHub()
+
+	claims, ok := hub.authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	wait := defaultPollWait
+	if t := c.Query("timeout"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+	}
+
+	var session *pollSession
+	if id := c.Query("session"); id != "" {
+		hub.pollsMutex.Lock()
+		session = hub.polls[id]
+		hub.pollsMutex.Unlock()
+		if session == nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Poll session closed, open a new one and resume"})
+			return
+		}
+		if session.client.UserID != claims.UserID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Poll session belongs to another user"})
+			return
+		}
+		// A newer token keeps the session open past the old one's expiry
+		session.client.setExpiry(claims)
+	} else {
+		version, resumeToken, lastSeq, ok := streamParams(c)
+		if !ok {
+			return
+		}
+		session = hub.openPollSession(claims, version, resumeToken, lastSeq)
+	}
+
+	session.mutex.Lock()
+	if session.polling {
+		session.mutex.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "A poll of this session is already waiting"})
+		return
+	}
+	session.polling = true
+	session.idle.Stop()
+	session.mutex.Unlock()
+
+	frames, open := session.collect(wait, c.Request.Context().Done())
+
+	session.mutex.Lock()
+	session.polling = false
+	if open {
+		session.idle.Reset(pollIdleTimeout)
+	}
+	session.mutex.Unlock()
+
+	if !open {
+		hub.closePollSession(session)
+	}
+	if len(frames) == 0 && !open {
+		response := gin.H{"error": "Poll session closed, open a new one and resume"}
+		if code := session.client.closeCode; code != 0 {
+			response["code"] = code
+			response["reason"] = session.client.closeReason
+		}
+		c.JSON(http.StatusGone, response)
+		return
+	}
+
+	messages := make([]json.RawMessage, len(frames))
+	for i, frame := range frames {
+		messages[i] = frame
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"session":  session.client.ID,
+		"messages": messages,
+	})
+}
+
+// openPollSession registers a long-poll client
+func (h *Hub) openPollSession(claims *auth.Claims, version int, resumeToken string, lastSeq uint64) *pollSession {
+	session := &pollSession{
+		client: h.newFallbackClient(claims, version, resumeToken, lastSeq),
+		closed: make(chan struct{}),
+	}
+	session.idle = time.AfterFunc(pollIdleTimeout, func() {
+		log.Printf("Long-poll session %s (extension: %s) was not polled in time", session.client.ID, session.client.Extension)
+		h.closePollSession(session)
+	})
+
+	// Close the session as soon as the server closes the client, even
+	// between polls
+	go func() {
+		select {
+		case <-session.client.done:
+			h.closePollSession(session)
+		case <-session.closed:
+		}
+	}()
+
+	h.pollsMutex.Lock()
+	h.polls[session.client.ID] = session
+	h.pollsMutex.Unlock()
+
+	h.register <- session.client
+	log.Printf("Long-poll client connected: %s (user: %s, extension: %s)",
+		session.client.ID, session.client.Username, session.client.Extension)
+	return session
+}
+
+// closePollSession unregisters a long-poll client once
+func (h *Hub) closePollSession(session *pollSession) {
+	h.pollsMutex.Lock()
+	_, open := h.polls[session.client.ID]
+	delete(h.polls, session.client.ID)
+	h.pollsMutex.Unlock()
+	if !open {
+		return
+	}
+
+	close(session.closed)
+	session.idle.Stop()
+	session.client.stopExpiry()
+	h.unregister <- session.client
+	log.Printf("Long-poll client disconnected: %s (extension: %s)", session.client.ID, session.client.Extension)
+}
+
+// collect waits up to wait for the first frame and returns it with any
+// others already queued. open is false once the session was closed.
+func (s *pollSession) collect(wait time.Duration, cancel <-chan struct{}) (frames [][]byte, open bool) {
+	client := s.client
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		if frames, open := client.outbox.take(); len(frames) > 0 || !open {
+			return frames, open
+		}
+
+		select {
+		case <-client.outbox.ready:
+		case <-client.done:
+			return nil, false
+		case <-timer.C:
+			return nil, true
+		case <-cancel:
+			return nil, true
+		}
+	}
+}
+
+// HandleSendMessage handles a message a fallback client sends to the server:
+// the same JSON it would send over a socket, such as a WebRTC answer, an ICE
+// candidate or a hangup. The replies a socket would get (ack, error, pong)
+// are returned in messages; events for other users go through the hub.
+func HandleSendMessage(c *gin.Context) {
+	hub := GetHub()
+
+	claims, ok := hub.authenticateRequest(c)
+	if !ok {
+		return
+	}
+	version, _, _, ok := streamParams(c)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxMessageSize))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Message too large"})
+		return
+	}
+
+	// A client that is never registered, so it only receives its replies.
+	// The user's rate limit carries over from one request to the next.
+	client := hub.newFallbackClient(claims, version, "", 0)
+	client.limiter = hub.sendLimiter(claims.UserID)
+	defer client.stopExpiry()
+
+	in, err := protocol.Decode(data)
+	if in == nil {
+		in = &protocol.Inbound{}
+	}
+	// A rate limited message is answered with a rate_limited error
+	admitted, kicked := client.admit(in)
+	switch {
+	case kicked:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many messages", "code": CloseRateLimited})
+		return
+	case admitted && err != nil:
+		client.sendError(in, err)
+	case admitted:
+		client.handleMessage(in)
+	}
+
+	frames, _ := client.outbox.take()
+	messages := make([]json.RawMessage, len(frames))
+	for i, frame := range frames {
+		messages[i] = frame
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
@@ -1,10 +1,13 @@
 package websocket
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
+	"voip-backend/broker"
+	"voip-backend/protocol"
 )
 
 // Hub maintains the set of active clients and broadcasts messages to the clients
@@ -12,9 +15,6 @@ type Hub struct {
 	// Registered clients
 	clients map[*Client]bool
 
-	// Inbound messages from the clients
-	broadcast chan []byte
-
 	// Register requests from the clients
 	register chan *Client
 
@@ -25,30 +25,114 @@ type Hub struct {
 	extensionClients map[string][]*Client
 	mutex            sync.RWMutex
 
-	// Callback for when user disconnects (to update database)
+	// Presence subscriptions: the extensions each extension follows, and
+	// the extensions following each extension (allExtensions for those
+	// following everyone). They last as long as the subscriber's event
+	// stream.
+	presenceSubscriptions map[string]map[string]bool
+	presenceWatchers      map[string]map[string]bool
+
+	// Event streams of the connected extensions, and of extensions whose
+	// last client disconnected less than ResumeGrace ago
+	streams map[string]*eventStream
+
+	// How long an extension stays online after its last client disconnects,
+	// so that it can resume and be sent the events it missed
+	ResumeGrace time.Duration
+
+	// Number of events kept per extension for replay
+	ReplayBufferSize int
+
+	// Limits on the messages each client sends, by protocol class
+	RateLimits map[string]RateLimit
+
+	// Limiters of the messages users send over the HTTP fallback, by user
+	sendLimiters  map[uint]*inboundLimiter
+	limitersMutex sync.Mutex
+
+	// Counters of refused and undelivered messages
+	metrics hubMetrics
+
+	// Passes traffic to the hubs of the other backend nodes; nil when the
+	// hub runs alone
+	broker broker.Broker
+
+	// Long-poll clients, by session ID
+	polls      map[string]*pollSession
+	pollsMutex sync.Mutex
+
+	// Callback for when user disconnects (to update their presence)
 	OnUserDisconnect func(extension string) error
+
+	// Callback for when a user chooses a status (online, away, dnd...)
+	OnUserStatus func(extension, status string) error
+
+	// Callback to find the current presence of extensions, or of every
+	// user when extensions is nil
+	LookupPresence func(extensions []string) []protocol.UserStatusChanged
+
+	// Callback to check that the user a token was issued to still exists
+	// with the same extension and role
+	CheckUser func(userID uint, extension, role string) error
+
+	// Callback to find a user's current role, which may have changed since
+	// their token was issued
+	LookupRole func(userID uint) (string, error)
+
+	// Hold state of WebRTC-direct calls, by call ID
+	callHolds  map[string]*CallHold
+	holdsMutex sync.Mutex
+
+	// Callback for when a WebRTC-direct call comes off hold (to add the
+	// seconds on hold to its call log)
+	OnCallHoldEnded func(channel string, seconds int) error
+
+	// Calls whose parties may signal each other, by call ID
+	sessions      map[string]*CallSession
+	sessionsMutex sync.Mutex
+
+	// How long a call session lasts without signaling
+	CallSessionTTL time.Duration
+
+	// Callback to find the parties of a live call that has no session, such
+	// as calls placed through Asterisk
+	LookupCallParties func(callID string) ([]string, error)
+
+	// Callback for when a call session starts ringing, is answered or ends
+	// (to update the presence of its parties)
+	OnCallSession func(callID string, parties []string, state string)
+
+	// Callback for when a client is registered (to deliver the chat
+	// messages stored while the user was offline)
+	OnClientConnected func(userID uint, extension string)
+
+	// Callback to find the extensions of a conversation's members; fails
+	// when the user is not a member
+	LookupChatMembers func(conversationID, userID uint) ([]string, error)
+
+	// Callback for when a member marks a conversation read (to store the
+	// read receipt and pass it on)
+	OnChatRead func(read protocol.ChatRead) error
 }
 
-// Message represents a WebSocket message
-type Message struct {
-	Type      string      `json:"type"`
-	From      string      `json:"from,omitempty"`
-	To        string      `json:"to,omitempty"`
-	Channel   string      `json:"channel,omitempty"`
-	Status    string      `json:"status,omitempty"`
-	Data      interface{} `json:"data,omitempty"`
-	Timestamp int64       `json:"timestamp"`
+// CallHold is the hold state of a WebRTC-direct call. There is no media
+// server in the path, so the hub relays hold and resume between the browsers
+// and keeps the state the REST API keeps on ActiveCall for other calls.
+type CallHold struct {
+	Channel   string     `json:"channel"`
+	HeldBy    string     `json:"held_by,omitempty"`
+	Peer      string     `json:"peer,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	Completed int        `json:"completed"` // seconds spent on earlier holds
 }
 
-// CallMessage represents call-related messages
-type CallMessage struct {
-	Type      string `json:"type"`
-	Caller    string `json:"caller"`
-	Callee    string `json:"callee"`
-	Channel   string `json:"channel"`
-	Status    string `json:"status"`
-	Priority  string `json:"priority,omitempty"`
-	Transport string `json:"transport,omitempty"`
+// Seconds returns the total time the call has spent on hold
+func (h CallHold) Seconds() int {
+	seconds := h.Completed
+	if h.Since != nil {
+		seconds += int(time.Since(*h.Since).Seconds())
+	}
+	return seconds
 }
 
 var globalHub *Hub
@@ -56,231 +140,260 @@ var globalHub *Hub
 // NewHub creates a new Hub
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:        make(chan []byte),
-		register:         make(chan *Client),
-		unregister:       make(chan *Client),
-		clients:          make(map[*Client]bool),
-		extensionClients: make(map[string][]*Client),
+		register:              make(chan *Client),
+		unregister:            make(chan *Client),
+		clients:               make(map[*Client]bool),
+		extensionClients:      make(map[string][]*Client),
+		presenceSubscriptions: make(map[string]map[string]bool),
+		presenceWatchers:      make(map[string]map[string]bool),
+		callHolds:             make(map[string]*CallHold),
+		sessions:              make(map[string]*CallSession),
+		streams:               make(map[string]*eventStream),
+		polls:                 make(map[string]*pollSession),
+		ResumeGrace:           defaultResumeGrace,
+		CallSessionTTL:        defaultCallSessionTTL,
+		ReplayBufferSize:      defaultReplayBufferSize,
+		RateLimits:            defaultRateLimits,
+		sendLimiters:          make(map[uint]*inboundLimiter),
 	}
 }
 
 // Run starts the hub
 func (h *Hub) Run() {
+	sweep := time.NewTicker(callSessionSweepInterval)
+	defer sweep.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
-			h.mutex.Lock()
-			h.clients[client] = true
-			if client.Extension != "" {
-				// Add client to extension's client list
-				h.extensionClients[client.Extension] = append(h.extensionClients[client.Extension], client)
-				log.Printf("Client registered: %s (extension: %s) - Total clients for extension: %d",
-					client.ID, client.Extension, len(h.extensionClients[client.Extension]))
-			}
-			h.mutex.Unlock()
-
-			// Send welcome message
-			welcomeMsg := Message{
-				Type:   "welcome",
-				Status: "connected",
-			}
-			if data, err := json.Marshal(welcomeMsg); err == nil {
-				select {
-				case client.send <- data:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+			h.addClient(client)
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				if client.Extension != "" {
-					// Remove client from extension's client list
-					clients := h.extensionClients[client.Extension]
-					for i, c := range clients {
-						if c == client {
-							// Remove client from slice
-							h.extensionClients[client.Extension] = append(clients[:i], clients[i+1:]...)
-							break
-						}
-					}
-					// If no more clients for this extension, remove the entry and set user offline
-					if len(h.extensionClients[client.Extension]) == 0 {
-						delete(h.extensionClients, client.Extension)
-						// Set user offline in database and broadcast status change
-						go h.SetUserOfflineOnDisconnect(client.Extension)
-					}
-					log.Printf("Client unregistered: %s (extension: %s) - Remaining clients for extension: %d",
-						client.ID, client.Extension, len(h.extensionClients[client.Extension]))
-				}
-				close(client.send)
-			}
+			h.removeClientLocked(client)
 			h.mutex.Unlock()
 
-		case message := <-h.broadcast:
-			h.mutex.RLock()
-			var failedClients []*Client
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					failedClients = append(failedClients, client)
-				}
-			}
-			h.mutex.RUnlock()
-
-			// Clean up failed clients
-			if len(failedClients) > 0 {
-				h.mutex.Lock()
-				for _, client := range failedClients {
-					close(client.send)
-					delete(h.clients, client)
-					if client.Extension != "" {
-						// Remove from extension clients list
-						clients := h.extensionClients[client.Extension]
-						for i, c := range clients {
-							if c == client {
-								h.extensionClients[client.Extension] = append(clients[:i], clients[i+1:]...)
-								break
-							}
-						}
-						// If no more clients for this extension, remove the entry
-						if len(h.extensionClients[client.Extension]) == 0 {
-							delete(h.extensionClients, client.Extension)
-						}
-					}
-				}
-				h.mutex.Unlock()
-			}
+		case <-sweep.C:
+			h.sweepCallSessions()
 		}
 	}
 }
 
-// SendToExtension sends a message to all clients of a specific extension
-func (h *Hub) SendToExtension(extension string, message interface{}) error {
-	h.mutex.RLock()
-	clients, exists := h.extensionClients[extension]
-	h.mutex.RUnlock()
+// encodings renders a message once per protocol version
+type encodings struct {
+	message  protocol.Message
+	versions map[int][]byte
+}
 
-	if !exists || len(clients) == 0 {
-		log.Printf("No client found for extension: %s", extension)
-		return fmt.Errorf("no client found for extension: %s", extension)
+func newEncodings(message protocol.Message) *encodings {
+	if message.ID == "" {
+		message.ID = protocol.NewID()
 	}
+	return &encodings{message: message, versions: make(map[int][]byte)}
+}
 
-	data, err := json.Marshal(message)
+func (e *encodings) forVersion(version int) ([]byte, error) {
+	if data, exists := e.versions[version]; exists {
+		return data, nil
+	}
+	data, err := protocol.Encode(e.message, version)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	e.versions[version] = data
+	return data, nil
+}
 
-	// Send to all clients for this extension
-	var failedClients []*Client
-	successCount := 0
+// SendToExtension sends a message to all clients of a specific extension,
+// on this node and any other. While the extension is within its resume
+// grace period the message is only buffered, to be replayed when it
+// reconnects.
+func (h *Hub) SendToExtension(extension string, message protocol.Message) error {
+	if message.ID == "" {
+		message.ID = protocol.NewID()
+	}
 
-	h.mutex.RLock()
-	for _, client := range clients {
-		select {
-		case client.send <- data:
-			successCount++
-		default:
-			// Client's send channel is full, mark for removal
-			failedClients = append(failedClients, client)
+	sent, localErr := h.deliver(extension, message)
+	if localErr == nil {
+		if sent == 0 {
+			log.Printf("Message buffered for extension %s until it reconnects", extension)
+		} else {
+			log.Printf("Message sent to %d clients for extension %s", sent, extension)
 		}
 	}
-	h.mutex.RUnlock()
 
-	// Remove failed clients
-	if len(failedClients) > 0 {
-		h.mutex.Lock()
-		for _, failedClient := range failedClients {
-			delete(h.clients, failedClient)
-			close(failedClient.send)
-
-			// Remove from extension clients list
-			updatedClients := make([]*Client, 0)
-			for _, client := range h.extensionClients[extension] {
-				if client != failedClient {
-					updatedClients = append(updatedClients, client)
-				}
+	// Other nodes deliver to their own clients of the extension
+	if remoteClients, remote := h.remotePresence(extension); remote {
+		if err := h.broker.SendToExtension(extension, message); err != nil {
+			log.Printf("Failed to pass %s for extension %s to other nodes: %v", message.Type, extension, err)
+			if localErr != nil {
+				return err
 			}
-			h.extensionClients[extension] = updatedClients
+			return nil
+		}
+		log.Printf("Message passed to other nodes for extension %s (%d clients)", extension, remoteClients)
+		return nil
+	}
 
-			// If no more clients for this extension, remove the entry
-			if len(h.extensionClients[extension]) == 0 {
-				delete(h.extensionClients, extension)
-			}
+	if localErr != nil {
+		log.Printf("Failed to send %s to extension %s: %v", message.Type, extension, localErr)
+	}
+	return localErr
+}
+
+// deliver records a message in an extension's event stream and queues it
+// for the extension's clients. Returns the number of clients it was queued
+// for. Clients that cannot take it are closed with CloseSendQueueFull.
+func (h *Hub) deliver(extension string, message protocol.Message) (int, error) {
+	h.mutex.RLock()
+	stream, exists := h.streams[extension]
+	h.mutex.RUnlock()
+	if !exists {
+		return 0, fmt.Errorf("no client found for extension: %s", extension)
+	}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	message = stream.record(message, h.ReplayBufferSize)
+	encoded := newEncodings(message)
+	class := protocol.Class(message.Type)
+	key := coalesceKey(message)
+
+	var slowClients []*Client
+	sent := 0
+
+	h.mutex.RLock()
+	for _, client := range h.extensionClients[extension] {
+		data, err := encoded.forVersion(client.Version)
+		if err != nil {
+			h.mutex.RUnlock()
+			return 0, err
+		}
+		switch client.outbox.push(data, class, key) {
+		case pushQueued:
+			sent++
+		case pushCoalesced:
+			sent++
+			h.metrics.count(&h.metrics.Coalesced, message.Type)
+		case pushDropped:
+			h.metrics.count(&h.metrics.Dropped, message.Type)
+		case pushOverflow:
+			slowClients = append(slowClients, client)
 		}
-		h.mutex.Unlock()
-		log.Printf("Removed %d failed clients for extension %s", len(failedClients), extension)
 	}
+	h.mutex.RUnlock()
 
-	if successCount == 0 {
-		return fmt.Errorf("failed to send message to any client for extension %s", extension)
+	// Close clients that fell behind; they can resume from the events they
+	// missed
+	for _, client := range slowClients {
+		h.closeSlowClient(client)
 	}
+	if len(slowClients) > 0 {
+		log.Printf("Closed %d slow clients for extension %s", len(slowClients), extension)
+	}
+	return sent, nil
+}
 
-	log.Printf("Message sent to %d clients for extension %s", successCount, extension)
-	return nil
+// closeSlowClient closes a client whose send queue overflowed
+func (h *Hub) closeSlowClient(client *Client) {
+	h.metrics.count(&h.metrics.Disconnected, "send_queue_full")
+	go client.close(CloseSendQueueFull, "send queue full")
 }
 
-// BroadcastMessage broadcasts a message to all connected clients
-func (h *Hub) BroadcastMessage(message interface{}) error {
-	data, err := json.Marshal(message)
-	if err != nil {
-		return err
+// BroadcastMessage broadcasts a message to all connected clients, on this
+// node and any other
+func (h *Hub) BroadcastMessage(message protocol.Message) error {
+	if message.ID == "" {
+		message.ID = protocol.NewID()
 	}
+	if h.broker != nil {
+		if err := h.broker.Broadcast(message); err != nil {
+			log.Printf("Failed to pass broadcast %s to other nodes: %v", message.Type, err)
+		}
+	}
+	return h.deliverBroadcast(message)
+}
 
-	select {
-	case h.broadcast <- data:
+// deliverBroadcast delivers a message to this node's clients; every
+// extension gets it in its own event stream. Presence updates only go to
+// the user's subscribers. An extension that cannot take the message does
+// not keep it from the others; the first failure is returned.
+func (h *Hub) deliverBroadcast(message protocol.Message) error {
+	if message.Type == protocol.TypeUserStatusChanged {
+		h.deliverUserStatus(message)
 		return nil
-	default:
-		log.Printf("Failed to broadcast message: channel full")
-		return fmt.Errorf("failed to broadcast message: channel full")
 	}
+
+	h.mutex.RLock()
+	extensions := make([]string, 0, len(h.streams))
+	for extension := range h.streams {
+		extensions = append(extensions, extension)
+	}
+	h.mutex.RUnlock()
+
+	var firstErr error
+	for _, extension := range extensions {
+		if _, err := h.deliver(extension, message); err != nil {
+			log.Printf("Failed to broadcast %s to %s: %v", message.Type, extension, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
 }
 
-// GetConnectedExtensions returns a list of connected extensions
+// GetConnectedExtensions returns a list of the extensions connected to any
+// node
 func (h *Hub) GetConnectedExtensions() []string {
+	remote := h.remoteExtensions()
+
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	extensions := make([]string, 0, len(h.extensionClients))
 	for extension, clients := range h.extensionClients {
-		if len(clients) > 0 {
+		if len(clients) > 0 || remote[extension] > 0 {
 			extensions = append(extensions, extension)
 		}
 	}
+	for extension, clients := range remote {
+		if _, local := h.extensionClients[extension]; !local && clients > 0 {
+			extensions = append(extensions, extension)
+		}
+	}
+	sort.Strings(extensions)
 	return extensions
 }
 
-// IsExtensionConnected checks if an extension is connected
+// IsExtensionConnected checks if an extension is connected to any node
 func (h *Hub) IsExtensionConnected(extension string) bool {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	clients, exists := h.extensionClients[extension]
-	return exists && len(clients) > 0
+	return h.GetExtensionClientCount(extension) > 0
 }
 
-// GetExtensionClientCount returns the number of connected clients for an extension
+// GetExtensionClientCount returns the number of clients connected for an
+// extension across the cluster
 func (h *Hub) GetExtensionClientCount(extension string) int {
+	remoteClients, _ := h.remotePresence(extension)
+
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	clients, exists := h.extensionClients[extension]
-	if !exists {
-		return 0
-	}
-	return len(clients)
+	return len(h.extensionClients[extension]) + remoteClients
 }
 
-// GetClientCount returns the number of connected clients
+// GetClientCount returns the number of clients connected across the cluster
 func (h *Hub) GetClientCount() int {
+	count := 0
+	for _, clients := range h.remoteExtensions() {
+		count += clients
+	}
+
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	return len(h.clients)
+	return len(h.clients) + count
 }
 
 // InitHub initializes the global hub
@@ -296,29 +409,25 @@ func GetHub() *Hub {
 }
 
 // NotifyIncomingCall sends an incoming call notification to the target extension
-func (h *Hub) NotifyIncomingCall(caller, callee, channel string) error {
-	callMsg := CallMessage{
-		Type:      "incoming_call",
+func (h *Hub) NotifyIncomingCall(caller, callee, channel, callID string) error {
+	return h.SendToExtension(callee, protocol.New(protocol.TypeIncomingCall, protocol.CallStatus{
+		Signal:    protocol.Signal{Channel: channel, CallID: callID},
 		Caller:    caller,
 		Callee:    callee,
-		Channel:   channel,
 		Status:    "ringing",
 		Priority:  "normal",
 		Transport: "transport-ws",
-	}
-
-	return h.SendToExtension(callee, callMsg)
+	}))
 }
 
 // NotifyCallStatus sends call status updates to relevant extensions
-func (h *Hub) NotifyCallStatus(caller, callee, status, channel string) error {
-	statusMsg := CallMessage{
-		Type:    "call_status",
-		Caller:  caller,
-		Callee:  callee,
-		Channel: channel,
-		Status:  status,
-	}
+func (h *Hub) NotifyCallStatus(caller, callee, status, channel, callID string) error {
+	statusMsg := protocol.New(protocol.TypeCallStatus, protocol.CallStatus{
+		Signal: protocol.Signal{Channel: channel, CallID: callID},
+		Caller: caller,
+		Callee: callee,
+		Status: status,
+	})
 
 	// Send to both caller and callee
 	if err := h.SendToExtension(caller, statusMsg); err != nil {
@@ -332,15 +441,157 @@ func (h *Hub) NotifyCallStatus(caller, callee, status, channel string) error {
 	return nil
 }
 
-// NotifyUserStatus broadcasts user status changes
-func (h *Hub) NotifyUserStatus(extension, status string) error {
-	statusMsg := Message{
-		Type:   "user_status",
-		From:   extension,
+// NotifyCallHold sends a call_status update with the hold state to both parties
+func (h *Hub) NotifyCallHold(caller, callee, status, channel, heldBy string, holdSeconds int) error {
+	statusMsg := protocol.New(protocol.TypeCallStatus, protocol.CallStatus{
+		Signal:       protocol.Signal{Channel: channel},
+		Caller:       caller,
+		Callee:       callee,
+		Status:       status,
+		HeldBy:       heldBy,
+		HoldDuration: holdSeconds,
+	})
+
+	for _, extension := range []string{caller, callee} {
+		if err := h.SendToExtension(extension, statusMsg); err != nil {
+			log.Printf("Failed to send hold status to %s: %v", extension, err)
+		}
+	}
+	return nil
+}
+
+// HoldWebRTCCall puts a WebRTC-direct call on hold (held true) or resumes it
+// on behalf of extension, relays webrtc_hold/webrtc_resume to the peer so its
+// browser can pause or restart media, and notifies both parties
+func (h *Hub) HoldWebRTCCall(channel, extension, peer string, held bool) (CallHold, error) {
+	h.holdsMutex.Lock()
+	hold, exists := h.callHolds[channel]
+	if !exists {
+		hold = &CallHold{Channel: channel}
+	}
+
+	endedSeconds := 0
+	if held {
+		if hold.Since != nil {
+			h.holdsMutex.Unlock()
+			return *hold, fmt.Errorf("call is already on hold")
+		}
+		now := time.Now()
+		hold.HeldBy = extension
+		hold.Peer = peer
+		hold.Since = &now
+		h.callHolds[channel] = hold
+	} else {
+		if hold.Since == nil {
+			h.holdsMutex.Unlock()
+			return *hold, fmt.Errorf("call is not on hold")
+		}
+		if hold.HeldBy != extension {
+			h.holdsMutex.Unlock()
+			return *hold, fmt.Errorf("call was put on hold by %s", hold.HeldBy)
+		}
+		endedSeconds = int(time.Since(*hold.Since).Seconds())
+		hold.Completed += endedSeconds
+		hold.HeldBy = ""
+		hold.Since = nil
+	}
+	snapshot := *hold
+	h.holdsMutex.Unlock()
+
+	msgType, status := protocol.TypeWebRTCResume, "connected"
+	if held {
+		msgType, status = protocol.TypeWebRTCHold, "on_hold"
+	}
+	log.Printf("[HOLD] WebRTC call %s is now %s (by %s, %ds on hold in total)", channel, status, extension, snapshot.Seconds())
+
+	if err := h.SendToExtension(peer, protocol.New(msgType, protocol.CallEvent{
+		Signal: protocol.Signal{From: extension, To: peer, Channel: channel},
 		Status: status,
+	})); err != nil {
+		log.Printf("Failed to relay %s to %s: %v", msgType, peer, err)
 	}
+	h.NotifyCallHold(extension, peer, status, channel, snapshot.HeldBy, snapshot.Seconds())
 
-	return h.BroadcastMessage(statusMsg)
+	if !held {
+		h.recordHoldEnded(channel, endedSeconds)
+	}
+	return snapshot, nil
+}
+
+// EndWebRTCCallHold stops tracking the hold state of a WebRTC-direct call
+// that ended, recording a hold still in progress
+func (h *Hub) EndWebRTCCallHold(channel string) {
+	h.holdsMutex.Lock()
+	hold, exists := h.callHolds[channel]
+	delete(h.callHolds, channel)
+	h.holdsMutex.Unlock()
+
+	if exists && hold.Since != nil {
+		h.recordHoldEnded(channel, int(time.Since(*hold.Since).Seconds()))
+	}
+}
+
+// GetWebRTCCallHold returns the hold state of a WebRTC-direct call
+func (h *Hub) GetWebRTCCallHold(channel string) (CallHold, bool) {
+	h.holdsMutex.Lock()
+	defer h.holdsMutex.Unlock()
+
+	hold, exists := h.callHolds[channel]
+	if !exists {
+		return CallHold{Channel: channel}, false
+	}
+	return *hold, true
+}
+
+// recordHoldEnded passes the seconds of a finished hold to the callback
+func (h *Hub) recordHoldEnded(channel string, seconds int) {
+	if h.OnCallHoldEnded == nil {
+		return
+	}
+	if err := h.OnCallHoldEnded(channel, seconds); err != nil {
+		log.Printf("Error recording hold time of call %s: %v", channel, err)
+	}
+}
+
+// NotifyCallTransfer sends a transfer update to the transferor, transferee
+// and target. messageType is call_transfer, or webrtc_transfer for
+// WebRTC-direct calls.
+func (h *Hub) NotifyCallTransfer(messageType string, transfer protocol.CallTransfer) error {
+	msg := protocol.New(messageType, transfer)
+	for _, extension := range []string{transfer.Transferor, transfer.Transferee, transfer.Target} {
+		if err := h.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send transfer update to %s: %v", extension, err)
+		}
+	}
+	return nil
+}
+
+// NotifyConference sends a conference update to the given extensions
+func (h *Hub) NotifyConference(extensions []string, participants protocol.ConferenceParticipants) error {
+	msg := protocol.New(protocol.TypeConferenceParticipants, participants)
+	for _, extension := range extensions {
+		if !h.IsExtensionOnline(extension) {
+			continue
+		}
+		if err := h.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send conference update to %s: %v", extension, err)
+		}
+	}
+	return nil
+}
+
+// NotifyQueue sends a queue update to the given extensions
+func (h *Hub) NotifyQueue(extensions []string, status protocol.QueueStatus) error {
+	msg := protocol.New(protocol.TypeQueueStatus, status)
+	for _, extension := range extensions {
+		if !h.IsExtensionOnline(extension) {
+			continue
+		}
+		if err := h.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send queue update to %s: %v", extension, err)
+		}
+	}
+	return nil
 }
 
 // SetUserOfflineOnDisconnect sets a user offline when they disconnect
@@ -349,39 +600,52 @@ func (h *Hub) SetUserOfflineOnDisconnect(extension string) {
 		return
 	}
 
+	// The node the user is still connected to sets them offline in turn
+	if _, remote := h.remotePresence(extension); remote {
+		log.Printf("User %s disconnected from this node but is still present on another", extension)
+		return
+	}
+
 	log.Printf("Setting user %s offline due to WebSocket disconnection", extension)
 
-	// Call the callback function to update database if available
 	if h.OnUserDisconnect != nil {
 		if err := h.OnUserDisconnect(extension); err != nil {
 			log.Printf("Error setting user %s offline: %v", extension, err)
 		}
-	} else {
-		// Fallback: just broadcast the status change
-		h.NotifyUserStatus(extension, "offline")
 	}
 }
 
 // GetExtensionStatus returns detailed status for an extension
 func (h *Hub) GetExtensionStatus(extension string) map[string]interface{} {
+	remoteClients, _ := h.remotePresence(extension)
+
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
 	clients, exists := h.extensionClients[extension]
 	status := map[string]interface{}{
-		"extension":    extension,
-		"ws_connected": exists && len(clients) > 0,
-		"client_count": 0,
-		"clients":      []string{},
+		"extension":           extension,
+		"ws_connected":        len(clients)+remoteClients > 0,
+		"client_count":        len(clients) + remoteClients,
+		"remote_client_count": remoteClients, // connected to other nodes
+		"clients":             []string{},    // IDs of this node's clients
+
+		// Extensions it follows the presence of on this node
+		"presence_subscriptions": len(h.presenceSubscriptions[extension]),
+
+		// Login session of each of this node's clients, by client ID
+		"client_sessions": map[string]uint{},
 	}
 
 	if exists {
-		status["client_count"] = len(clients)
 		clientIDs := make([]string, len(clients))
+		clientSessions := make(map[string]uint, len(clients))
 		for i, client := range clients {
 			clientIDs[i] = client.ID
+			clientSessions[client.ID] = client.SessionID
 		}
 		status["clients"] = clientIDs
+		status["client_sessions"] = clientSessions
 	}
 
 	return status
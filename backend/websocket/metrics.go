@@ -0,0 +1,48 @@
+package websocket
+
+import "sync"
+
+// HubMetrics counts the messages the hub refused or did not deliver as
+// sent, since the server started
+type HubMetrics struct {
+	RateLimited  map[string]uint64 `json:"rate_limited"` // messages from clients rejected, by type
+	Coalesced    map[string]uint64 `json:"coalesced"`    // queued messages replaced by newer ones, by type
+	Dropped      map[string]uint64 `json:"dropped"`      // messages to slow clients dropped, by type
+	Disconnected map[string]uint64 `json:"disconnected"` // clients closed, by reason
+}
+
+type hubMetrics struct {
+	mutex sync.Mutex
+	HubMetrics
+}
+
+// count increments a counter of one of the maps
+func (m *hubMetrics) count(counter *map[string]uint64, key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if *counter == nil {
+		*counter = make(map[string]uint64)
+	}
+	(*counter)[key]++
+}
+
+// Metrics returns a copy of the hub's counters
+func (h *Hub) Metrics() HubMetrics {
+	h.metrics.mutex.Lock()
+	defer h.metrics.mutex.Unlock()
+
+	copyOf := func(counter map[string]uint64) map[string]uint64 {
+		copied := make(map[string]uint64, len(counter))
+		for key, value := range counter {
+			copied[key] = value
+		}
+		return copied
+	}
+	return HubMetrics{
+		RateLimited:  copyOf(h.metrics.RateLimited),
+		Coalesced:    copyOf(h.metrics.Coalesced),
+		Dropped:      copyOf(h.metrics.Dropped),
+		Disconnected: copyOf(h.metrics.Disconnected),
+	}
+}
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"voip-backend/protocol"
+)
+
+// What became of a frame offered to an outbox
+type pushResult int
+
+const (
+	pushQueued    pushResult = iota
+	pushCoalesced            // replaced an older frame with the same key
+	pushDropped              // the queue is full and the frame can be lost
+	pushOverflow             // the queue is full and the client must be closed
+	pushClosed               // the client is gone or being closed
+)
+
+// outbox is the queue of frames waiting to be written to a client. When the
+// client does not keep up, presence updates replace the queued update about
+// the same user and are dropped once the queue is full, and replies to the
+// client are dropped. Call signaling may go past the limit up to twice it;
+// anything else that does not fit gets the client closed, so that it
+// reconnects and resumes from the events it missed.
+type outbox struct {
+	mutex      sync.Mutex
+	frames     []outFrame
+	limit      int
+	closed     bool
+	overflowed bool
+
+	// Receives a value whenever frames are queued or the outbox is closed
+	ready chan struct{}
+}
+
+type outFrame struct {
+	data []byte
+	key  string
+}
+
+func newOutbox(limit int) *outbox {
+	return &outbox{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+// push queues a frame of a message class. Frames with the same non-empty
+// key replace each other.
+func (o *outbox) push(data []byte, class, key string) pushResult {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed || o.overflowed {
+		return pushClosed
+	}
+
+	if key != "" {
+		for i := range o.frames {
+			if o.frames[i].key == key {
+				o.frames[i].data = data
+				return pushCoalesced
+			}
+		}
+	}
+
+	if len(o.frames) >= o.limit {
+		switch {
+		case class == protocol.ClassSignaling && len(o.frames) < 2*o.limit:
+		case class == protocol.ClassPresence || class == protocol.ClassControl:
+			return pushDropped
+		default:
+			o.overflowed = true
+			return pushOverflow
+		}
+	}
+
+	o.frames = append(o.frames, outFrame{data: data, key: key})
+	o.signal()
+	return pushQueued
+}
+
+// take removes and returns the queued frames, and whether the outbox is
+// still open
+func (o *outbox) take() ([][]byte, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	frames := make([][]byte, len(o.frames))
+	for i, frame := range o.frames {
+		frames[i] = frame.data
+	}
+	o.frames = nil
+	return frames, !o.closed
+}
+
+// close marks the end of the frames; the writer writes the queued ones and
+// stops
+func (o *outbox) close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.closed = true
+	o.signal()
+}
+
+// signal wakes the writer. The caller holds o.mutex.
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// coalesceKey returns the key under which a presence update replaces an
+// older one about the same extension (in the same conversation, for typing
+// indicators), or "" for other messages
+func coalesceKey(message protocol.Message) string {
+	if protocol.Class(message.Type) != protocol.ClassPresence {
+		return ""
+	}
+
+	// The payload may be a struct or, from another node, raw JSON
+	data, err := json.Marshal(message.Payload)
+	if err != nil {
+		return ""
+	}
+	var subject struct {
+		Extension      string `json:"extension"`
+		ConversationID uint   `json:"conversation_id"`
+	}
+	if json.Unmarshal(data, &subject) != nil || subject.Extension == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s:%d", message.Type, subject.Extension, subject.ConversationID)
+}
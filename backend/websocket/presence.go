@@ -0,0 +1,223 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"voip-backend/auth"
+	"voip-backend/models"
+	"voip-backend/protocol"
+)
+
+// Subscription key of the subscribers that follow every extension
+const allExtensions = "*"
+
+// NotifyUserStatus sends a user_status_changed message, with the user's
+// WebSocket connections filled in, to the user and to the extensions that
+// subscribed to them, on this node and any other
+func (h *Hub) NotifyUserStatus(status protocol.UserStatusChanged) error {
+	status.ClientCount = h.GetExtensionClientCount(status.Extension)
+	status.WSConnected = status.ClientCount > 0
+	return h.BroadcastMessage(protocol.New(protocol.TypeUserStatusChanged, status))
+}
+
+// deliverUserStatus delivers a user_status_changed message to this node's
+// subscribers of its user, and to the user
+func (h *Hub) deliverUserStatus(message protocol.Message) {
+	subject := statusSubject(message)
+	if subject == "" {
+		return
+	}
+
+	for _, extension := range h.presenceSubscribers(subject) {
+		if _, err := h.deliver(extension, message); err != nil {
+			log.Printf("Failed to send presence of %s to %s: %v", subject, extension, err)
+		}
+	}
+}
+
+// presenceSubscribers returns the extensions with an event stream on this
+// node that follow an extension, including the extension itself
+func (h *Hub) presenceSubscribers(extension string) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var subscribers []string
+	if _, exists := h.streams[extension]; exists {
+		subscribers = append(subscribers, extension)
+	}
+	for _, key := range []string{extension, allExtensions} {
+		for subscriber := range h.presenceWatchers[key] {
+			if subscriber != extension {
+				subscribers = append(subscribers, subscriber)
+			}
+		}
+	}
+	return subscribers
+}
+
+// subscribePresence adds extensions to those the client's extension follows
+// and sends it their current presence. Subscriptions belong to the
+// extension: every client of it receives the updates until its event stream
+// ends.
+func (c *Client) subscribePresence(in *protocol.Inbound, sub *protocol.PresenceSubscription) error {
+	if !sub.All && len(sub.Extensions) == 0 {
+		return protocol.NewError(protocol.CodeInvalidMessage, "extensions or all is required")
+	}
+	if sub.All && !c.hasPermission(models.PermPresenceViewAll) {
+		return protocol.NewError(protocol.CodeForbidden, "following every extension requires the presence.view_all permission")
+	}
+	if c.hub.LookupPresence == nil {
+		return protocol.NewError(protocol.CodeRejected, "presence is not available")
+	}
+
+	keys := []string{allExtensions}
+	if !sub.All {
+		keys = nil
+		for _, extension := range sub.Extensions {
+			if extension != allExtensions {
+				keys = append(keys, extension)
+			}
+		}
+	}
+	added, ok := c.hub.addPresenceSubscriptions(c.Extension, keys)
+	if !ok {
+		return protocol.NewError(protocol.CodeRejected, "subscribe from a connected client")
+	}
+
+	// Only the extensions just added; the others already had their snapshot
+	var extensions []string
+	if !sub.All {
+		extensions = added
+	}
+	snapshot := protocol.PresenceSnapshot{Users: []protocol.UserStatusChanged{}, All: sub.All}
+	if sub.All || len(added) > 0 {
+		for _, status := range c.hub.LookupPresence(extensions) {
+			status.ClientCount = c.hub.GetExtensionClientCount(status.Extension)
+			status.WSConnected = status.ClientCount > 0
+			snapshot.Users = append(snapshot.Users, status)
+		}
+	}
+
+	reply := protocol.New(protocol.TypePresenceSnapshot, snapshot)
+	reply.CorrelationID = in.ID
+	c.sendMessage(reply)
+	log.Printf("Extension %s follows the presence of %d more extensions (all: %t)", c.Extension, len(added), sub.All)
+	return nil
+}
+
+// hasPermission reports whether the user's current role grants a
+// permission. The role in the token is only used when the hub cannot look
+// roles up.
+func (c *Client) hasPermission(permission string) bool {
+	role := c.Role
+	if c.hub.LookupRole != nil {
+		current, err := c.hub.LookupRole(c.UserID)
+		if err != nil {
+			log.Printf("Failed to look up the role of user %d: %v", c.UserID, err)
+			return false
+		}
+		role = current
+	}
+	return auth.HasPermission(role, permission)
+}
+
+// unsubscribePresence removes extensions from those the client's extension
+// follows; all removes every subscription
+func (c *Client) unsubscribePresence(sub *protocol.PresenceSubscription) error {
+	if !sub.All && len(sub.Extensions) == 0 {
+		return protocol.NewError(protocol.CodeInvalidMessage, "extensions or all is required")
+	}
+
+	c.hub.mutex.Lock()
+	defer c.hub.mutex.Unlock()
+
+	if sub.All {
+		c.hub.dropPresenceSubscriptionsLocked(c.Extension)
+		return nil
+	}
+	for _, extension := range sub.Extensions {
+		c.hub.removePresenceSubscriptionLocked(c.Extension, extension)
+	}
+	return nil
+}
+
+// addPresenceSubscriptions records that subscriber follows extensions, and
+// returns the ones it did not follow yet. Fails when the subscriber has no
+// event stream to deliver to.
+func (h *Hub) addPresenceSubscriptions(subscriber string, extensions []string) ([]string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, exists := h.streams[subscriber]; !exists {
+		return nil, false
+	}
+
+	subscriptions, exists := h.presenceSubscriptions[subscriber]
+	if !exists {
+		subscriptions = make(map[string]bool)
+		h.presenceSubscriptions[subscriber] = subscriptions
+	}
+
+	var added []string
+	for _, extension := range extensions {
+		if extension == "" || extension == subscriber || subscriptions[extension] {
+			continue
+		}
+		subscriptions[extension] = true
+
+		watchers, exists := h.presenceWatchers[extension]
+		if !exists {
+			watchers = make(map[string]bool)
+			h.presenceWatchers[extension] = watchers
+		}
+		watchers[subscriber] = true
+		added = append(added, extension)
+	}
+	return added, true
+}
+
+// removePresenceSubscriptionLocked stops subscriber following an extension.
+// The caller holds h.mutex.
+func (h *Hub) removePresenceSubscriptionLocked(subscriber, extension string) {
+	if subscriptions, exists := h.presenceSubscriptions[subscriber]; exists {
+		delete(subscriptions, extension)
+		if len(subscriptions) == 0 {
+			delete(h.presenceSubscriptions, subscriber)
+		}
+	}
+	if watchers, exists := h.presenceWatchers[extension]; exists {
+		delete(watchers, subscriber)
+		if len(watchers) == 0 {
+			delete(h.presenceWatchers, extension)
+		}
+	}
+}
+
+// dropPresenceSubscriptionsLocked removes every subscription of an
+// extension, when its event stream ends. The caller holds h.mutex.
+func (h *Hub) dropPresenceSubscriptionsLocked(subscriber string) {
+	for extension := range h.presenceSubscriptions[subscriber] {
+		h.removePresenceSubscriptionLocked(subscriber, extension)
+	}
+}
+
+// statusSubject returns the extension a user_status_changed message is
+// about
+func statusSubject(message protocol.Message) string {
+	if status, ok := message.Payload.(protocol.UserStatusChanged); ok {
+		return status.Extension
+	}
+
+	// From another node the payload is raw JSON
+	data, err := json.Marshal(message.Payload)
+	if err != nil {
+		return ""
+	}
+	var subject struct {
+		Extension string `json:"extension"`
+	}
+	if json.Unmarshal(data, &subject) != nil {
+		return ""
+	}
+	return subject.Extension
+}
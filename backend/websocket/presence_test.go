@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"voip-backend/config"
+	"voip-backend/database"
+	"voip-backend/models"
+	"voip-backend/protocol"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "websocket-test")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	config.AppConfig = &config.Config{DBPath: filepath.Join(dir, "test.db")}
+	database.InitDatabase()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestSubscribeAllUsesCurrentRole(t *testing.T) {
+	hub := NewHub()
+	hub.LookupPresence = func(extensions []string) []protocol.UserStatusChanged { return nil }
+	roles := map[uint]string{1: models.RoleUser, 2: models.RoleAdmin}
+	hub.LookupRole = func(userID uint) (string, error) { return roles[userID], nil }
+
+	// The tokens still say admin and user, but the roles were swapped since
+	demoted := connectClient(hub, 1, "1001")
+	demoted.Role = models.RoleAdmin
+	promoted := connectClient(hub, 2, "1002")
+
+	in := &protocol.Inbound{Type: protocol.TypePresenceSubscribe}
+	err := demoted.subscribePresence(in, &protocol.PresenceSubscription{All: true})
+	if protocol.ErrorCode(err, "") != protocol.CodeForbidden {
+		t.Errorf("subscribe all with a demoted role = %v, want forbidden", err)
+	}
+	if err := promoted.subscribePresence(in, &protocol.PresenceSubscription{All: true}); err != nil {
+		t.Errorf("subscribe all with a promoted role = %v", err)
+	}
+}
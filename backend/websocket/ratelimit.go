@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"log"
+	"sync"
+	"time"
+	"voip-backend/protocol"
+)
+
+// RateLimit is a token bucket: PerSecond messages on average, in bursts of
+// up to Burst
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Default limits on the messages a client sends, by protocol class.
+// Trickled ICE candidates arrive in bursts when a call starts.
+var defaultRateLimits = map[string]RateLimit{
+	protocol.ClassSignaling: {PerSecond: 20, Burst: 100},
+	protocol.ClassPresence:  {PerSecond: 1, Burst: 5},
+	protocol.ClassControl:   {PerSecond: 2, Burst: 10},
+	protocol.ClassDefault:   {PerSecond: 5, Burst: 20},
+}
+
+// Rejected messages a client may send before it is disconnected. Every
+// rejection uses a strike; strikes come back at strikeRate per second.
+const (
+	maxStrikes = 50
+	strikeRate = 5
+)
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// take uses a token if one is available
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.PerSecond
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// inboundLimiter limits the messages of one client
+type inboundLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	strikes *tokenBucket
+}
+
+func newInboundLimiter(limits map[string]RateLimit) *inboundLimiter {
+	limiter := &inboundLimiter{
+		buckets: make(map[string]*tokenBucket, len(limits)),
+		strikes: newTokenBucket(RateLimit{PerSecond: strikeRate, Burst: maxStrikes}),
+	}
+	for class, limit := range limits {
+		limiter.buckets[class] = newTokenBucket(limit)
+	}
+	return limiter
+}
+
+// check reports whether a message of a class may be handled, and when it
+// may not, whether the client has been rejected so often that it should be
+// disconnected
+func (l *inboundLimiter) check(class string) (allowed, kick bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	bucket, limited := l.buckets[class]
+	if !limited || bucket.take(now) {
+		return true, false
+	}
+	return false, !l.strikes.take(now)
+}
+
+// sendLimiter returns the limiter of a user's messages over the HTTP
+// fallback, which has no connection to keep it on
+func (h *Hub) sendLimiter(userID uint) *inboundLimiter {
+	h.limitersMutex.Lock()
+	defer h.limitersMutex.Unlock()
+
+	limiter, exists := h.sendLimiters[userID]
+	if !exists {
+		limiter = newInboundLimiter(h.RateLimits)
+		h.sendLimiters[userID] = limiter
+	}
+	return limiter
+}
+
+// admit applies the client's rate limit to a message. A rejected message is
+// answered with a rate_limited error; a client that keeps sending regardless
+// is closed with CloseRateLimited, and kicked is set.
+func (c *Client) admit(in *protocol.Inbound) (ok, kicked bool) {
+	if c.limiter == nil {
+		return true, false
+	}
+	allowed, kick := c.limiter.check(protocol.Class(in.Type))
+	if allowed {
+		return true, false
+	}
+
+	c.hub.metrics.count(&c.hub.metrics.RateLimited, in.Type)
+	if kick {
+		log.Printf("Rejected %s from %s (extension: %s): too many messages", in.Type, c.ID, c.Extension)
+		c.close(CloseRateLimited, "too many messages")
+		return false, true
+	}
+	c.sendError(in, protocol.NewError(protocol.CodeRateLimited, "rate limit exceeded for "+in.Type))
+	return false, false
+}
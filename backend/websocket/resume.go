@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"log"
+	"sync"
+	"time"
+	"voip-backend/protocol"
+)
+
+const (
+	// Default time an extension stays online after its last client
+	// disconnects, waiting for it to resume
+	defaultResumeGrace = 15 * time.Second
+
+	// Default number of events kept per extension for replay
+	defaultReplayBufferSize = 200
+)
+
+// eventStream numbers the events sent to one extension and keeps the latest
+// of them, so that a client reconnecting after a short drop can be sent the
+// ones it missed
+type eventStream struct {
+	mutex  sync.Mutex
+	token  string // resume token handed out in the welcome message
+	seq    uint64 // sequence number of the last event
+	events []protocol.Message
+
+	// Set while the extension has no clients; guarded by the hub's mutex.
+	// graceRound tells a timer that fires after being replaced or stopped
+	// that it is stale.
+	graceTimer *time.Timer
+	graceRound int
+}
+
+// record numbers an event and adds it to the replay buffer. The caller
+// holds s.mutex.
+func (s *eventStream) record(message protocol.Message, limit int) protocol.Message {
+	s.seq++
+	message.Seq = s.seq
+	if message.ID == "" {
+		message.ID = protocol.NewID()
+	}
+
+	s.events = append(s.events, message)
+	if limit > 0 && len(s.events) > limit {
+		s.events = append([]protocol.Message(nil), s.events[len(s.events)-limit:]...)
+	}
+	return message
+}
+
+// since returns the buffered events after lastSeq, and whether the buffer
+// still held all of them. The caller holds s.mutex.
+func (s *eventStream) since(lastSeq uint64) ([]protocol.Message, bool) {
+	if lastSeq >= s.seq {
+		return nil, true
+	}
+
+	var missed []protocol.Message
+	for _, event := range s.events {
+		if event.Seq > lastSeq {
+			missed = append(missed, event)
+		}
+	}
+	complete := len(missed) > 0 && missed[0].Seq == lastSeq+1
+	return missed, complete
+}
+
+// streamFor returns the event stream of an extension, creating it for a
+// first connection and cancelling its grace period for a reconnection
+func (h *Hub) streamFor(extension string) *eventStream {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stream, exists := h.streams[extension]
+	if !exists {
+		stream = &eventStream{token: protocol.NewID() + protocol.NewID()}
+		h.streams[extension] = stream
+	}
+	if stream.graceTimer != nil {
+		stream.graceTimer.Stop()
+		stream.graceTimer = nil
+		log.Printf("Extension %s reconnected within the resume grace period", extension)
+	}
+	return stream
+}
+
+// addClient registers a client, sending it the welcome message and, when it
+// resumes an earlier connection, the events it missed before any new one
+func (h *Hub) addClient(client *Client) {
+	stream := h.streamFor(client.Extension)
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	welcome := protocol.Welcome{
+		Status:      "connected",
+		Version:     client.Version,
+		Extension:   client.Extension,
+		ResumeToken: stream.token,
+		Seq:         stream.seq,
+	}
+	var missed []protocol.Message
+	if client.resumeToken != "" {
+		if client.resumeToken == stream.token {
+			var complete bool
+			missed, complete = stream.since(client.lastSeq)
+			welcome.Resumed = true
+			welcome.Replayed = len(missed)
+			welcome.ReplayTruncated = !complete
+		} else {
+			log.Printf("Client %s (extension: %s) could not resume: unknown resume token", client.ID, client.Extension)
+		}
+	}
+
+	// Queue the welcome and replay before the client can receive live events
+	client.sendMessage(protocol.New(protocol.TypeWelcome, welcome))
+	for _, event := range missed {
+		client.sendMessage(event)
+	}
+
+	h.mutex.Lock()
+	h.clients[client] = true
+	h.extensionClients[client.Extension] = append(h.extensionClients[client.Extension], client)
+	h.reportPresenceLocked(client.Extension, len(h.extensionClients[client.Extension]), true)
+	log.Printf("Client registered: %s (extension: %s) - Total clients for extension: %d",
+		client.ID, client.Extension, len(h.extensionClients[client.Extension]))
+	h.mutex.Unlock()
+
+	if welcome.Resumed {
+		log.Printf("Client %s (extension: %s) resumed after seq %d, replayed %d events (truncated: %t)",
+			client.ID, client.Extension, client.lastSeq, welcome.Replayed, welcome.ReplayTruncated)
+	}
+
+	if h.OnClientConnected != nil {
+		go h.OnClientConnected(client.UserID, client.Extension)
+	}
+}
+
+// removeClientLocked unregisters a client. When it was the last client of
+// its extension, the extension stays online for the resume grace period
+// unless the server revoked the connection. The caller holds h.mutex.
+func (h *Hub) removeClientLocked(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	client.outbox.close()
+
+	extension := client.Extension
+	clients := h.extensionClients[extension]
+	for i, c := range clients {
+		if c == client {
+			h.extensionClients[extension] = append(clients[:i:i], clients[i+1:]...)
+			break
+		}
+	}
+	log.Printf("Client unregistered: %s (extension: %s) - Remaining clients for extension: %d",
+		client.ID, extension, len(h.extensionClients[extension]))
+	if len(h.extensionClients[extension]) > 0 {
+		h.reportPresenceLocked(extension, len(h.extensionClients[extension]), true)
+		return
+	}
+	delete(h.extensionClients, extension)
+
+	stream, exists := h.streams[extension]
+	if !exists || h.ResumeGrace <= 0 || client.revoked {
+		if exists && stream.graceTimer != nil {
+			stream.graceTimer.Stop()
+		}
+		delete(h.streams, extension)
+		h.dropPresenceSubscriptionsLocked(extension)
+		h.reportPresenceLocked(extension, 0, false)
+		go h.SetUserOfflineOnDisconnect(extension)
+		return
+	}
+	h.reportPresenceLocked(extension, 0, true)
+	if stream.graceTimer == nil {
+		stream.graceRound++
+		round := stream.graceRound
+		stream.graceTimer = time.AfterFunc(h.ResumeGrace, func() {
+			h.expireStream(extension, stream, round)
+		})
+	}
+}
+
+// expireStream sets an extension offline once its grace period passed
+// without a client reconnecting
+func (h *Hub) expireStream(extension string, stream *eventStream, round int) {
+	h.mutex.Lock()
+	if h.streams[extension] != stream || stream.graceTimer == nil || stream.graceRound != round {
+		h.mutex.Unlock()
+		return
+	}
+	delete(h.streams, extension)
+	h.dropPresenceSubscriptionsLocked(extension)
+	h.reportPresenceLocked(extension, 0, false)
+	h.mutex.Unlock()
+
+	log.Printf("Extension %s did not reconnect within %s", extension, h.ResumeGrace)
+	h.SetUserOfflineOnDisconnect(extension)
+}
+
+// IsExtensionOnline reports whether an extension is connected or may still
+// resume its connection, on any node
+func (h *Hub) IsExtensionOnline(extension string) bool {
+	if _, remote := h.remotePresence(extension); remote {
+		return true
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	_, exists := h.streams[extension]
+	return exists
+}
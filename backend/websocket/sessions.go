@@ -0,0 +1,249 @@
+package websocket
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"voip-backend/protocol"
+)
+
+const (
+	// Default time a call session lasts without signaling before it is
+	// forgotten, for calls whose end the hub never hears of
+	defaultCallSessionTTL = 4 * time.Hour
+
+	// How often expired call sessions are looked for
+	callSessionSweepInterval = time.Minute
+)
+
+// CallSession is a call whose parties may exchange signaling through the hub
+type CallSession struct {
+	ID        string    `json:"id"`
+	Parties   []string  `json:"parties"` // extensions
+	CreatedAt time.Time `json:"created_at"`
+
+	// Time of the last signaling for the call
+	activeAt time.Time
+}
+
+// HasParty reports whether an extension takes part in the call
+func (s *CallSession) HasParty(extension string) bool {
+	for _, party := range s.Parties {
+		if party == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// StartCallSession registers the parties of a call so that they can signal
+// each other through the hub
+func (h *Hub) StartCallSession(callID string, parties ...string) {
+	now := time.Now()
+	h.sessionsMutex.Lock()
+	h.sessions[callID] = &CallSession{
+		ID:        callID,
+		Parties:   parties,
+		CreatedAt: now,
+		activeAt:  now,
+	}
+	h.sessionsMutex.Unlock()
+
+	log.Printf("Call session %s started for %v", callID, parties)
+	h.reportCallSession(callID, parties, "ringing")
+}
+
+// AnswerCallSession records that the callee of a call session answered
+func (h *Hub) AnswerCallSession(callID string) {
+	h.sessionsMutex.Lock()
+	session, exists := h.sessions[callID]
+	h.sessionsMutex.Unlock()
+
+	if exists {
+		h.reportCallSession(callID, session.Parties, "answered")
+	}
+}
+
+// EndCallSession forgets a call that ended
+func (h *Hub) EndCallSession(callID string) {
+	h.sessionsMutex.Lock()
+	session, exists := h.sessions[callID]
+	delete(h.sessions, callID)
+	h.sessionsMutex.Unlock()
+
+	if exists {
+		log.Printf("Call session %s ended", callID)
+		h.reportCallSession(callID, session.Parties, "ended")
+	}
+}
+
+// sweepCallSessions forgets the call sessions with no signaling for
+// CallSessionTTL, such as calls both browsers left without hanging up
+func (h *Hub) sweepCallSessions() {
+	if h.CallSessionTTL <= 0 {
+		return
+	}
+
+	var expired []*CallSession
+	h.sessionsMutex.Lock()
+	for callID, session := range h.sessions {
+		if time.Since(session.activeAt) > h.CallSessionTTL {
+			delete(h.sessions, callID)
+			expired = append(expired, session)
+		}
+	}
+	h.sessionsMutex.Unlock()
+
+	for _, session := range expired {
+		log.Printf("Call session %s expired after %s without signaling", session.ID, h.CallSessionTTL)
+		h.EndWebRTCCallHold(session.ID)
+		h.reportCallSession(session.ID, session.Parties, "ended")
+	}
+}
+
+// reportCallSession passes a change of a call session to OnCallSession
+func (h *Hub) reportCallSession(callID string, parties []string, state string) {
+	if h.OnCallSession != nil {
+		h.OnCallSession(callID, parties, state)
+	}
+}
+
+// GetCallSession returns a call registered with StartCallSession or, for
+// calls the hub did not see start, the parties LookupCallParties finds
+func (h *Hub) GetCallSession(callID string) (*CallSession, error) {
+	if callID == "" {
+		return nil, protocol.NewError(protocol.CodeInvalidMessage, "message has no channel")
+	}
+
+	h.sessionsMutex.Lock()
+	session, exists := h.sessions[callID]
+	if exists {
+		session.activeAt = time.Now()
+	}
+	h.sessionsMutex.Unlock()
+	if exists {
+		return session, nil
+	}
+
+	if h.LookupCallParties != nil {
+		parties, err := h.LookupCallParties(callID)
+		if err == nil && len(parties) > 0 {
+			return &CallSession{ID: callID, Parties: parties}, nil
+		}
+	}
+	return nil, protocol.NewError(protocol.CodeNotFound, "unknown call "+callID)
+}
+
+// NotifyCallParties sends a message about a call to its parties other than
+// from
+func (h *Hub) NotifyCallParties(callID, from string, msg protocol.Message) error {
+	session, err := h.GetCallSession(callID)
+	if err != nil {
+		return err
+	}
+
+	for _, extension := range session.Parties {
+		if extension == from {
+			continue
+		}
+		if err := h.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to send %s for call %s to %s: %v", msg.Type, session.ID, extension, err)
+		}
+	}
+	return nil
+}
+
+// partySession returns the call a signaling message refers to after checking
+// that the client takes part in it
+func (c *Client) partySession(callID string) (*CallSession, error) {
+	session, err := c.hub.GetCallSession(callID)
+	if err != nil {
+		return nil, err
+	}
+	if !session.HasParty(c.Extension) {
+		return nil, protocol.NewError(protocol.CodeForbidden, "not a party to call "+session.ID)
+	}
+	return session, nil
+}
+
+// relay forwards a signaling message from a party of a call to the other
+// parties, or only to its To if set. From is replaced by the sender's
+// authenticated extension.
+func (c *Client) relay(messageType string, payload protocol.Signaler) error {
+	signal := payload.GetSignal()
+	session, err := c.partySession(signal.Call())
+	if err != nil {
+		return err
+	}
+
+	recipients := session.Parties
+	if signal.To != "" {
+		if signal.To == c.Extension || !session.HasParty(signal.To) {
+			return protocol.NewError(protocol.CodeForbidden,
+				fmt.Sprintf("%s is not another party to call %s", signal.To, session.ID))
+		}
+		recipients = []string{signal.To}
+	}
+	signal.From = c.Extension
+
+	msg := protocol.New(messageType, payload)
+	for _, extension := range recipients {
+		if extension == c.Extension {
+			continue
+		}
+		if err := c.hub.SendToExtension(extension, msg); err != nil {
+			log.Printf("Failed to relay %s for call %s to %s: %v", messageType, session.ID, extension, err)
+		}
+	}
+	return nil
+}
+
+// notifyParties sends a message about a call to its parties other than the
+// sender, after checking that the sender takes part in it
+func (c *Client) notifyParties(callID string, msg protocol.Message) error {
+	if _, err := c.partySession(callID); err != nil {
+		return err
+	}
+	return c.hub.NotifyCallParties(callID, c.Extension, msg)
+}
+
+// sendMessage encodes a message for the client's protocol version and
+// queues it
+func (c *Client) sendMessage(msg protocol.Message) {
+	data, err := protocol.Encode(msg, c.Version)
+	if err != nil {
+		log.Printf("Failed to encode %s for %s: %v", msg.Type, c.Extension, err)
+		return
+	}
+	switch c.outbox.push(data, protocol.Class(msg.Type), "") {
+	case pushDropped:
+		c.hub.metrics.count(&c.hub.metrics.Dropped, msg.Type)
+		log.Printf("Failed to send %s to %s: send queue full", msg.Type, c.Extension)
+	case pushOverflow:
+		c.hub.closeSlowClient(c)
+	}
+}
+
+// sendAck confirms that a message carrying an id was handled
+func (c *Client) sendAck(in *protocol.Inbound) {
+	msg := protocol.New(protocol.TypeAck, protocol.Ack{RefType: in.Type})
+	msg.CorrelationID = in.ID
+	c.sendMessage(msg)
+}
+
+// sendError tells the client that one of its messages was rejected
+func (c *Client) sendError(in *protocol.Inbound, err error) {
+	log.Printf("Rejected %s from %s: %v", in.Type, c.Extension, err)
+
+	frame := protocol.Error{
+		Code:    protocol.ErrorCode(err, protocol.CodeRejected),
+		Error:   err.Error(),
+		RefType: in.Type,
+	}
+	if signaler, ok := in.Payload.(protocol.Signaler); ok {
+		frame.Channel = signaler.GetSignal().Channel
+	}
+	msg := protocol.New(protocol.TypeError, frame)
+	msg.CorrelationID = in.ID
+	c.sendMessage(msg)
+}
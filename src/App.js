@@ -21,6 +21,7 @@ import BrowserCompatibilityAlert from './components/BrowserCompatibilityAlert';
 import MicrophoneFix from './components/MicrophoneFix';
 import MicrophoneTroubleshooter from './components/MicrophoneTroubleshooter';
 import sipManager from './services/sipManager';
+import { endSession } from './services/login';
 import ipConfigService from './services/ipConfigService';
 import { testMicrophoneAccess } from './utils/microphoneDiagnostics';
 import MicrophoneTestPage from './pages/MicrophoneTestPage';
@@ -197,6 +198,9 @@ const App = () => {
     // Clean up SIP connection
     sipManager.destroy();
 
+    // End the session on the server
+    endSession();
+
     // Clear localStorage
     localStorage.removeItem('token');
     localStorage.removeItem('extension');
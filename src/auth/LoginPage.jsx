@@ -12,7 +12,7 @@ import {
   FiSun as Sun,
   FiArrowRight as ArrowRight
 } from "react-icons/fi";
-import { login } from "../services/login";
+import { login, verifyMFA, startMFAEnrollment } from "../services/login";
 import { useTheme } from "../contexts/ThemeContext";
 import { cn } from "../utils/ui";
 import toast from "react-hot-toast";
@@ -23,6 +23,12 @@ const LoginPage = ({ onLogin, onSwitchToRegister }) => {
   const [showPassword, setShowPassword] = useState(false);
   const [loading, setLoading] = useState(false);
   const [rememberMe, setRememberMe] = useState(false);
+  // Second step of a two-factor login: { token, enrollment, secret, provisioningUri }
+  const [mfa, setMfa] = useState(null);
+  const [mfaCode, setMfaCode] = useState("");
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
+  // Login that just issued recovery codes, shown before continuing
+  const [enrolledLogin, setEnrolledLogin] = useState(null);
   const navigate = useNavigate();
   const location = useLocation();
   const { darkMode, toggleDarkMode } = useTheme();
@@ -66,6 +72,59 @@ const LoginPage = ({ onLogin, onSwitchToRegister }) => {
     return true;
   };
 
+  const finishLogin = (result) => {
+    // Handle remember me
+    if (rememberMe) {
+      localStorage.setItem('rememberedUsername', username);
+      localStorage.setItem('rememberMe', 'true');
+    } else {
+      localStorage.removeItem('rememberedUsername');
+      localStorage.removeItem('rememberMe');
+    }
+
+    toast.success(result.message || "Login successful!");
+
+    // Recovery codes are shown once, before entering the app
+    if (result.recoveryCodes) {
+      setEnrolledLogin(result);
+      return;
+    }
+    enterApp(result);
+  };
+
+  const enterApp = (result) => {
+    console.log('[LoginPage.jsx] Login successful, calling onLogin with result:', result);
+
+    // Call the parent's onLogin handler
+    if (typeof onLogin === 'function') {
+      onLogin(result);
+    } else {
+      console.error('[LoginPage.jsx] onLogin is not a function:', onLogin);
+    }
+  };
+
+  const handleVerify = async (e) => {
+    e.preventDefault();
+
+    if (!mfaCode.trim()) {
+      toast.error(useRecoveryCode ? "Recovery code is required" : "Authentication code is required");
+      return;
+    }
+
+    setLoading(true);
+    try {
+      const result = await verifyMFA(mfa.token, mfaCode, useRecoveryCode);
+      if (result.success) {
+        setMfa(null);
+        finishLogin(result);
+      } else {
+        toast.error(result.message || "Verification failed");
+      }
+    } finally {
+      setLoading(false);
+    }
+  };
+
   const handleLogin = async (e) => {
     e.preventDefault();
 
@@ -81,24 +140,20 @@ const LoginPage = ({ onLogin, onSwitchToRegister }) => {
       console.log('[LoginPage.jsx] Login result:', result);
 
       if (result.success) {
-        // Handle remember me
-        if (rememberMe) {
-          localStorage.setItem('rememberedUsername', username);
-          localStorage.setItem('rememberMe', 'true');
-        } else {
-          localStorage.removeItem('rememberedUsername');
-          localStorage.removeItem('rememberMe');
-        }
-
-        toast.success(result.message || "Login successful!");
-        console.log('[LoginPage.jsx] Login successful, calling onLogin with result:', result);
-
-        // Call the parent's onLogin handler
-        if (typeof onLogin === 'function') {
-          onLogin(result);
-        } else {
-          console.error('[LoginPage.jsx] onLogin is not a function:', onLogin);
+        finishLogin(result);
+      } else if (result.mfaRequired) {
+        let next = { token: result.mfaToken, enrollment: result.enrollmentRequired };
+        if (result.enrollmentRequired) {
+          const enrollment = await startMFAEnrollment(result.mfaToken);
+          if (!enrollment.success) {
+            toast.error(enrollment.message);
+            return;
+          }
+          next = { ...next, secret: enrollment.secret, provisioningUri: enrollment.provisioningUri };
         }
+        setMfa(next);
+        setMfaCode("");
+        setUseRecoveryCode(false);
       } else {
         console.error('[LoginPage.jsx] Login failed:', result.error);
         toast.error(result.error || "Login failed");
@@ -182,7 +237,99 @@ const LoginPage = ({ onLogin, onSwitchToRegister }) => {
             </motion.p>
           </div>
 
-          {/* Login Form */}
+          {/* Recovery codes issued by enrolling at login */}
+          {enrolledLogin ? (
+            <div className="space-y-6">
+              <p className={cn(
+                'text-sm',
+                darkMode ? 'text-secondary-300' : 'text-secondary-700'
+              )}>
+                Two-factor authentication is on. Save these recovery codes somewhere safe:
+                each one signs you in once if you lose your authenticator.
+              </p>
+              <div className="grid grid-cols-2 gap-2 font-mono text-sm text-center">
+                {enrolledLogin.recoveryCodes.map((code) => (
+                  <span key={code} className={cn('py-1 rounded', darkMode ? 'bg-secondary-800 text-white' : 'bg-secondary-100 text-secondary-900')}>
+                    {code}
+                  </span>
+                ))}
+              </div>
+              <button type="button" onClick={() => enterApp(enrolledLogin)} className={cn(
+                'w-full py-3 px-4 rounded-lg font-medium transition-all duration-200 text-white',
+                'focus:outline-none focus:ring-2 focus:ring-primary-500 focus:ring-offset-2',
+                loading ? 'bg-secondary-400 cursor-not-allowed' : 'bg-primary-600 hover:bg-primary-700'
+              )}>
+                Continue
+              </button>
+            </div>
+          ) : mfa ? (
+          /* Two-factor step */
+          <form onSubmit={handleVerify} className="space-y-6">
+            {mfa.enrollment && (
+              <div className={cn('space-y-2', darkMode ? 'text-secondary-300' : 'text-secondary-700')}>
+                <p className="text-sm">
+                  Your account requires two-factor authentication. Add this key to your
+                  authenticator app, then enter the code it shows.
+                </p>
+                <p className="font-mono text-sm break-all select-all">{mfa.secret}</p>
+                <a href={mfa.provisioningUri} className="text-xs text-primary-600 hover:text-primary-500">
+                  Open in authenticator app
+                </a>
+              </div>
+            )}
+            <div>
+              <label className={cn(
+                'block text-sm font-medium mb-2',
+                darkMode ? 'text-secondary-300' : 'text-secondary-700'
+              )}>
+                {useRecoveryCode ? 'Recovery code' : 'Authentication code'}
+              </label>
+              <input
+                type="text"
+                value={mfaCode}
+                onChange={(e) => setMfaCode(e.target.value)}
+                className={cn(
+                  'w-full px-4 py-3 rounded-lg border transition-all duration-200 tracking-widest text-center',
+                  'focus:ring-2 focus:ring-primary-500 focus:border-primary-500',
+                  darkMode
+                    ? 'bg-secondary-800 border-secondary-600 text-white placeholder-secondary-400'
+                    : 'bg-white border-secondary-300 text-secondary-900 placeholder-secondary-500'
+                )}
+                placeholder={useRecoveryCode ? 'xxxxx-xxxxx' : '123456'}
+                disabled={loading}
+                autoComplete="one-time-code"
+                inputMode={useRecoveryCode ? 'text' : 'numeric'}
+                autoFocus
+              />
+            </div>
+            <button type="submit" disabled={loading} className={cn(
+                'w-full py-3 px-4 rounded-lg font-medium transition-all duration-200 text-white',
+                'focus:outline-none focus:ring-2 focus:ring-primary-500 focus:ring-offset-2',
+                loading ? 'bg-secondary-400 cursor-not-allowed' : 'bg-primary-600 hover:bg-primary-700'
+              )}>
+              {loading ? 'Verifying...' : 'Verify'}
+            </button>
+            <div className="flex justify-between text-sm">
+              {!mfa.enrollment && (
+                <button
+                  type="button"
+                  onClick={() => { setUseRecoveryCode(!useRecoveryCode); setMfaCode(""); }}
+                  className="text-primary-600 hover:text-primary-500"
+                >
+                  {useRecoveryCode ? 'Use authenticator code' : 'Use a recovery code'}
+                </button>
+              )}
+              <button
+                type="button"
+                onClick={() => setMfa(null)}
+                className={darkMode ? 'text-secondary-400' : 'text-secondary-600'}
+              >
+                Back
+              </button>
+            </div>
+          </form>
+          ) : (
+          /* Login Form */
           <form onSubmit={handleLogin} className="space-y-6">
             {/* Username Field */}
             <motion.div
@@ -343,6 +490,7 @@ const LoginPage = ({ onLogin, onSwitchToRegister }) => {
               </p>
             </motion.div>
           </form>
+          )}
         </div>
 
         {/* Footer */}
@@ -343,6 +343,9 @@ const CreateUserModal = ({ isOpen, onClose, onCreateUser, darkMode }) => {
                     disabled={isSubmitting}
                   >
                     <option value="user">User</option>
+                    <option value="supervisor">Supervisor</option>
+                    <option value="operator">Operator</option>
+                    <option value="auditor">Auditor</option>
                     <option value="admin">Administrator</option>
                   </select>
                 </div>
@@ -39,7 +39,7 @@ const VoipPhone = ({
   const setupWebSocket = useCallback(() => {
     if (!extension || incomingStream) return; // Skip for incoming calls
     const wsUrl = `${CONFIG.WS_URL}?extension=${encodeURIComponent(extension)}`;
-    wsRef.current = new WebSocket(wsUrl);
+    wsRef.current = new WebSocket(wsUrl, ['bearer', localStorage.getItem('token')]);
 
     wsRef.current.onopen = () => {
       console.log('WebSocket connected for VoIP');
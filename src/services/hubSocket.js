@@ -0,0 +1,118 @@
+import { CONFIG } from './config';
+
+// Set once a WebSocket to the backend fails before opening, as happens on
+// networks that block upgrades; later connections then use Server-Sent Events
+let webSocketBlocked = false;
+
+// EventStreamSocket looks like a WebSocket to the code using it, but receives
+// through the backend's SSE endpoint and sends through POST /events/send
+class EventStreamSocket extends EventTarget {
+  constructor(params) {
+    super();
+    this.readyState = WebSocket.CONNECTING;
+    this.onopen = null;
+    this.onmessage = null;
+    this.onerror = null;
+    this.onclose = null;
+
+    const query = new URLSearchParams(params);
+    query.delete('extension');
+    this.version = query.get('v');
+    query.set('token', localStorage.getItem('token') || '');
+    this.url = `${CONFIG.API_URL}/events?${query}`;
+
+    this.source = new EventSource(this.url);
+    this.source.onopen = () => {
+      this.readyState = WebSocket.OPEN;
+      this.emit('open', new Event('open'));
+    };
+    this.source.onmessage = (event) => {
+      this.emit('message', new MessageEvent('message', { data: event.data }));
+    };
+    this.source.addEventListener('close', (event) => {
+      let detail = {};
+      try {
+        detail = JSON.parse(event.data);
+      } catch (error) {
+        // No close details
+      }
+      this.finish(detail.code || 1000, detail.reason || '');
+    });
+    this.source.onerror = () => {
+      this.emit('error', new Event('error'));
+      // The browser retries on its own, without the resume token; let the
+      // caller reconnect instead
+      this.finish(1006, 'Event stream lost');
+    };
+  }
+
+  emit(type, event) {
+    const handler = this[`on${type}`];
+    if (handler) {
+      handler.call(this, event);
+    }
+    this.dispatchEvent(event);
+  }
+
+  finish(code, reason) {
+    if (this.readyState === WebSocket.CLOSED) {
+      return;
+    }
+    this.source.close();
+    this.readyState = WebSocket.CLOSED;
+    const event = new Event('close');
+    event.code = code;
+    event.reason = reason;
+    event.wasClean = code === 1000;
+    this.emit('close', event);
+  }
+
+  async send(data) {
+    const query = this.version ? `?v=${this.version}` : '';
+    const response = await fetch(`${CONFIG.API_URL}/events/send${query}`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+      body: data,
+    });
+    const result = await response.json();
+    if (!response.ok) {
+      throw new Error(result.error || `Send failed with status ${response.status}`);
+    }
+    // Acks, errors and pongs a socket would have received
+    (result.messages || []).forEach((message) => {
+      this.emit('message', new MessageEvent('message', { data: JSON.stringify(message) }));
+    });
+  }
+
+  close() {
+    this.finish(1000, '');
+  }
+}
+
+// createHubSocket connects to the backend's real-time hub: over a WebSocket
+// when the network allows it, and over Server-Sent Events otherwise
+export const createHubSocket = (params = new URLSearchParams(), url = CONFIG.WS_URL) => {
+  if (webSocketBlocked) {
+    console.log('[hubSocket] WebSocket unavailable, using Server-Sent Events');
+    return new EventStreamSocket(params);
+  }
+
+  const query = params.toString();
+  const socket = new WebSocket(query ? `${url}?${query}` : url, ['bearer', localStorage.getItem('token')]);
+  let opened = false;
+  socket.addEventListener('open', () => {
+    opened = true;
+  });
+  socket.addEventListener('close', (event) => {
+    // 1006 before opening means the upgrade never went through; closes
+    // with the server's own codes (4001...) do not
+    if (!opened && event.code === 1006) {
+      console.warn('[hubSocket] WebSocket could not connect; falling back to Server-Sent Events');
+      webSocketBlocked = true;
+    }
+  });
+  return socket;
+};
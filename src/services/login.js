@@ -13,6 +13,48 @@ try {
   validatedApiUrl = CONFIG.API_URL;
 }
 
+// Access tokens are short-lived. A request refused with 401 renews the
+// token with the refresh token and is retried once. Requests failing
+// together share one refresh, since a refresh token only works once.
+let refreshing = null;
+
+export const refreshAccessToken = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refreshToken');
+    refreshing = (refreshToken
+      ? axios.post(`${validatedApiUrl}/api/refresh`, { refresh_token: refreshToken }, { timeout: 8000 })
+          .then((response) => {
+            localStorage.setItem('token', response.data.token);
+            localStorage.setItem('refreshToken', response.data.refresh_token);
+            return response.data.token;
+          })
+      : Promise.reject(new Error('No refresh token')))
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+};
+
+axios.interceptors.response.use(undefined, async (error) => {
+  const request = error.config;
+  const url = request?.url || '';
+  if (error.response?.status !== 401 || !request || request._retried ||
+      url.includes('/api/login') || url.includes('/api/refresh')) {
+    throw error;
+  }
+
+  request._retried = true;
+  try {
+    const token = await refreshAccessToken();
+    request.headers.Authorization = `Bearer ${token}`;
+    return axios(request);
+  } catch (refreshError) {
+    console.warn('[login.js] Token refresh failed:', refreshError.message);
+    throw error;
+  }
+});
+
 export const getToken = () => {
   const token = localStorage.getItem('token');
   if (!token) {
@@ -40,6 +82,45 @@ export const getUser = () => {
   return { username: extension, extension };
 };
 
+// completeLogin stores the tokens of a successful login and connects the
+// WebSocket
+const completeLogin = (data) => {
+if (data && data.token && data.user && data.user.extension) {
+    const { token, refresh_token: refreshToken, message, user } = data;
+    const extension = user.extension;
+
+    if (!/^\d{4,6}$/.test(extension)) {
+      console.error('[login.js] Invalid extension format:', extension);
+      return { success: false, message: 'Extension must be a 4-6 digit number' };
+    }
+
+    localStorage.setItem('token', token);
+    localStorage.setItem('refreshToken', refreshToken);
+    localStorage.setItem('extension', extension);
+    localStorage.setItem('userRole', user.role || 'user'); // Store user role
+    console.log('[login.js] Login successful, stored:', { token, extension, role: user.role });
+
+    // ✅ Connect to WebSocket after successful login
+    connectWebSocket();
+
+    return {
+      success: true,
+      token,
+      extension,
+      message: message || 'Login successful',
+      user: {
+        username: user.username,
+        extension,
+        role: user.role || 'user'
+      },
+      recoveryCodes: data.recovery_codes,
+    };
+  } else {
+    console.error('[login.js] Invalid response:', data);
+    return { success: false, message: 'Invalid login response: token or user data missing' };
+  }
+};
+
 export const login = async (username, password) => {
   if (!username || !password) {
     console.error('[login.js] Username or password missing');
@@ -58,45 +139,27 @@ export const login = async (username, password) => {
       },
     });
 
-    if (response.data && response.data.token && response.data.user && response.data.user.extension) {
-      const { token, message, user } = response.data;
-      const extension = user.extension;
-
-      if (!/^\d{4,6}$/.test(extension)) {
-        console.error('[login.js] Invalid extension format:', extension);
-        return { success: false, message: 'Extension must be a 4-6 digit number' };
-      }
-
-      localStorage.setItem('token', token);
-      localStorage.setItem('extension', extension);
-      localStorage.setItem('userRole', user.role || 'user'); // Store user role
-      console.log('[login.js] Login successful, stored:', { token, extension, role: user.role });
-
-      // ✅ Connect to WebSocket after successful login
-      connectWebSocket();
-
+    // Accounts with two-factor authentication finish with verifyMFA
+    if (response.data && response.data.mfa_required) {
       return {
-        success: true,
-        token,
-        extension,
-        message: message || 'Login successful',
-        user: {
-          username: user.username,
-          extension,
-          role: user.role || 'user'
-        },
+        success: false,
+        mfaRequired: true,
+        mfaToken: response.data.mfa_token,
+        enrollmentRequired: !!response.data.mfa_enrollment_required,
+        message: response.data.message,
       };
-    } else {
-      console.error('[login.js] Invalid response:', response.data);
-      return { success: false, message: 'Invalid login response: token or user data missing' };
     }
+
+    return completeLogin(response.data);
   } catch (error) {
     let message = 'Login failed. Please try again.';
     if (error.code === 'ERR_INVALID_URL') {
       message = 'Invalid API URL configuration. Contact support.';
       console.error('[login.js] URL error:', validatedApiUrl, error);
     } else if (error.response && error.response.data) {
-      message = error.response.data.message || 'Invalid credentials';
+      // 429 says how long to wait after too many failed attempts
+      message = error.response.data.message ||
+        (error.response.status === 429 ? error.response.data.error : 'Invalid credentials');
     } else if (error.request) {
       message = 'No response from server. Check your connection.';
     } else {
@@ -107,8 +170,60 @@ export const login = async (username, password) => {
   }
 };
 
+// verifyMFA completes a two-factor login with a code from the authenticator
+// app or, with isRecoveryCode, a recovery code
+export const verifyMFA = async (mfaToken, code, isRecoveryCode = false) => {
+  try {
+    const response = await axios.post(`${validatedApiUrl}/api/login/mfa`, {
+      mfa_token: mfaToken,
+      [isRecoveryCode ? 'recovery_code' : 'code']: code.trim(),
+    }, { timeout: 8000 });
+    return completeLogin(response.data);
+  } catch (error) {
+    const message = error.response?.data?.error || 'Verification failed';
+    console.error('[login.js] MFA error:', message);
+    return { success: false, message };
+  }
+};
+
+// startMFAEnrollment gets the TOTP secret of a user who must set up
+// two-factor authentication before logging in
+export const startMFAEnrollment = async (mfaToken) => {
+  try {
+    const response = await axios.post(`${validatedApiUrl}/api/login/mfa/enroll`, {
+      mfa_token: mfaToken,
+    }, { timeout: 8000 });
+    return {
+      success: true,
+      secret: response.data.secret,
+      provisioningUri: response.data.provisioning_uri,
+    };
+  } catch (error) {
+    const message = error.response?.data?.error || 'Failed to start enrollment';
+    console.error('[login.js] MFA enrollment error:', message);
+    return { success: false, message };
+  }
+};
+
+// endSession revokes the session on the server, so that its tokens stop
+// working
+export const endSession = () => {
+  const token = localStorage.getItem('token');
+  localStorage.removeItem('refreshToken');
+  if (!token) {
+    return Promise.resolve();
+  }
+  return axios.post(`${validatedApiUrl}/protected/logout`, {}, {
+    timeout: 5000,
+    headers: { Authorization: `Bearer ${token}` },
+  }).catch((error) => {
+    console.warn('[login.js] Logout request failed:', error.message);
+  });
+};
+
 export const logout = () => {
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
   localStorage.removeItem('extension');
   localStorage.removeItem('userRole');
   console.log('[login.js] Logged out');
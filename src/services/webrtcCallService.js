@@ -1,4 +1,5 @@
 import CONFIG from './config';
+import { createHubSocket } from './hubSocket';
 import { checkBrowserCompatibility, getMediaStreamWithFallback } from '../utils/browserCompat';
 import audioManager from './audioManager';
 import webrtcMonitor from '../utils/webrtcMonitor';
@@ -140,11 +141,12 @@ class WebRTCCallService {
       return;
     }
 
-    const wsUrl = `${CONFIG.WS_URL}?extension=${encodeURIComponent(this.extension)}`;
-    console.log('[WebRTCCallService] Connecting to WebSocket:', wsUrl);
+    const params = new URLSearchParams({ extension: this.extension });
+    console.log('[WebRTCCallService] Connecting to WebSocket:', `${CONFIG.WS_URL}?${params}`);
 
     try {
-      this.ws = new WebSocket(wsUrl);
+      // Falls back to Server-Sent Events where WebSockets are blocked
+      this.ws = createHubSocket(params);
     } catch (error) {
       console.error('[WebRTCCallService] Failed to create WebSocket:', error);
       this.onCallStatusChange && this.onCallStatusChange('WebSocket connection failed');
@@ -1,9 +1,14 @@
 import { CONFIG } from './config';
+import { createHubSocket } from './hubSocket';
+import { refreshAccessToken } from './login';
 
 let socket = null;
 let reconnectTimeout = null;
 let reconnectAttempts = 0;
 let currentExtension = null;
+// Lets a reconnect within the server's grace period receive missed events
+let resumeToken = null;
+let lastSeq = 0;
 const MAX_RECONNECT_ATTEMPTS = 5;
 const RECONNECT_INTERVAL = 5000;
 
@@ -23,11 +28,24 @@ export const connectWebSocket = (extension = null, url = CONFIG.WS_URL) => {
     socket = null;
   }
 
+  if (currentExtension !== targetExtension) {
+    resumeToken = null;
+    lastSeq = 0;
+  }
   currentExtension = targetExtension;
-  const wsUrl = targetExtension ? `${url}?extension=${encodeURIComponent(targetExtension)}` : url;
+  const params = new URLSearchParams();
+  if (targetExtension) {
+    params.set('extension', targetExtension);
+  }
+  if (resumeToken) {
+    params.set('resume', resumeToken);
+    params.set('last_seq', String(lastSeq));
+  }
+  const wsUrl = params.toString() ? `${url}?${params}` : url;
 
   console.log(`[websocketservice] Connecting WebSocket to ${wsUrl}`);
-  socket = new WebSocket(wsUrl);
+  // Falls back to Server-Sent Events where WebSockets are blocked
+  socket = createHubSocket(params, url);
 
   socket.onopen = () => {
     console.log(`[websocketservice] ✅ WebSocket connected for extension ${currentExtension || 'unknown'}`);
@@ -40,6 +58,28 @@ export const connectWebSocket = (extension = null, url = CONFIG.WS_URL) => {
     }
   };
 
+  socket.addEventListener('message', (event) => {
+    // Several messages may arrive in one frame, separated by newlines
+    event.data.split('\n').forEach((line) => {
+      try {
+        const message = JSON.parse(line);
+        if (message.type === 'welcome') {
+          if (message.resumed) {
+            console.log(`[websocketservice] Resumed connection, ${message.replayed || 0} missed events replayed`);
+          } else if (resumeToken) {
+            console.warn('[websocketservice] Could not resume connection; missed events are lost');
+          }
+          resumeToken = message.resume_token || null;
+          lastSeq = message.resumed ? lastSeq : message.seq || 0;
+        } else if (message.seq) {
+          lastSeq = message.seq;
+        }
+      } catch (error) {
+        // Not JSON; other listeners deal with it
+      }
+    });
+  });
+
   socket.onerror = (err) => {
     console.error('[websocketservice] WebSocket error:', err);
   };
@@ -49,7 +89,13 @@ export const connectWebSocket = (extension = null, url = CONFIG.WS_URL) => {
     if (reconnectAttempts < MAX_RECONNECT_ATTEMPTS) {
       reconnectAttempts += 1;
       console.log(`[websocketservice] Reconnecting (${reconnectAttempts}/${MAX_RECONNECT_ATTEMPTS}) in ${RECONNECT_INTERVAL}ms...`);
-      reconnectTimeout = setTimeout(() => {
+      reconnectTimeout = setTimeout(async () => {
+        // 4002: the access token expired; renew it before reconnecting
+        if (event.code === 4002) {
+          await refreshAccessToken().catch((error) => {
+            console.warn('[websocketservice] Token refresh failed:', error.message);
+          });
+        }
         connectWebSocket(currentExtension, url);
       }, RECONNECT_INTERVAL);
     } else {
@@ -131,5 +177,7 @@ export const closeWebSocket = () => {
     socket.close();
     socket = null;
     currentExtension = null;
+    resumeToken = null;
+    lastSeq = 0;
   }
 };